@@ -1,35 +1,339 @@
 package net
 
-// arp represents an instance of the ARP protocol.
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+const (
+	// how often the ARP daemon checks the timers of cache entries
+	arpTickInterval = 100 * time.Millisecond
+	// how long to wait for a reply to the first request for an address;
+	// the timeout doubles with each subsequent request
+	arpRetransmitTimeout = 500 * time.Millisecond
+	// number of requests sent before giving up on an address
+	arpMaxRequests = 3
+	// how long an entry is considered reachable after it was last
+	// confirmed by a reply
+	arpReachableTime = 30 * time.Second
+	// how long an unused stale entry is kept before being evicted
+	arpStaleTime = 60 * time.Second
+	// how long a failed entry is kept; while it is, writes to the
+	// address fail immediately rather than triggering new requests
+	arpFailedTime = 5 * time.Second
+	// maximum number of frames queued per entry while resolution
+	// is pending; when full, the oldest frame is dropped
+	arpMaxPending = 8
+)
+
+type arpState uint8
+
+const (
+	// a request has been sent, but no reply has been received
+	arpStateIncomplete arpState = iota
+	// the address was recently confirmed by a reply
+	arpStateReachable
+	// the address was learned from a request, or its reachable
+	// time has expired; it may still be used, but will be probed
+	// the next time it is
+	arpStateStale
+	// a stale entry is in use and being re-confirmed with unicast
+	// requests; the address continues to be used in the meantime
+	arpStateProbe
+	// resolution failed
+	arpStateFailed
+)
+
+type arpEntry struct {
+	state arpState
+	mac   MAC // unset if state is arpStateIncomplete or arpStateFailed
+	// for incomplete and probe entries, the time at which the last request
+	// was sent; for all others, the time of the last state change
+	updated  time.Time
+	requests int      // number of requests sent while incomplete or probing
+	pending  [][]byte // frames waiting for resolution
+}
+
+// arp represents an instance of the ARP protocol. It resolves IPv4 addresses
+// on the link attached to iface, and answers requests for its own addresses.
 type arp struct {
+	iface EthernetInterface
+	hw    MAC
+	addrs []IPv4DeviceAddr // never modified in place
+	cache map[IPv4]*arpEntry
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
 }
 
-// newARP creates a new ARP instance; hw and net must be non-zero
-func newARP(hw MAC, net IPv4) (*arp, error) {
-	if hw == (MAC{}) || net == (IPv4{}) {
+// newARP creates a new ARP instance which uses iface to write frames, and
+// spawns its daemon goroutine; call Stop to terminate it. hw must be non-zero,
+// and addrs must be non-empty.
+func newARP(iface EthernetInterface, hw MAC, addrs []IPv4DeviceAddr) *arp {
+	if hw == (MAC{}) || len(addrs) == 0 {
 		panic("new arp instance with zero addr")
 	}
-	panic("not implemented")
+	a := &arp{
+		iface: iface,
+		hw:    hw,
+		addrs: addrs,
+		cache: make(map[IPv4]*arpEntry),
+		stop:  make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.daemon()
+	return a
 }
 
+// HandlePacket handles an incoming ARP packet. Any neighbor which sent a
+// request for our address or a reply to us is added to the cache, and requests
+// for our address are answered.
 func (a *arp) HandlePacket(src, dst MAC, payload []byte) error {
-	panic("not implemented")
+	hdr, err := parseARPHeader(payload)
+	if err != nil {
+		return errors.Annotate(err, "handle ARP packet")
+	}
+	if hdr.HTYPE != arpHTYPEEthernet || hdr.PTYPE != uint16(EtherTypeIPv4) ||
+		hdr.HLEN != 6 || hdr.PLEN != 4 {
+		return errors.New("handle ARP packet: unsupported hardware or protocol type")
+	}
+	if hdr.SHA == a.hw {
+		return nil
+	}
+
+	// See the "Packet Reception" section of RFC 826
+	now := time.Now()
+	var frames []frame
+	a.mu.Lock()
+	us := hasIPv4Addr(a.addrs, hdr.TPA)
+	e, ok := a.cache[hdr.SPA]
+	// a zero SPA indicates an address probe (RFC 5227),
+	// which doesn't tell us anything about the sender
+	if hdr.SPA != (IPv4{}) && (ok || us) {
+		if !ok {
+			e = &arpEntry{}
+			a.cache[hdr.SPA] = e
+		}
+		frames = a.update(e, hdr.SHA, us && hdr.OPER == arpOperReply, now)
+	}
+	if us && hdr.OPER == arpOperRequest {
+		frames = append(frames, a.makeFrame(arpOperReply, hdr.SHA, hdr.TPA, hdr.SPA, hdr.SHA))
+	}
+	a.mu.Unlock()
+
+	a.send(frames)
+	return nil
 }
 
+// LookupIPv4 looks up the hardware address of ip in the cache. It does not
+// send any requests. If resolution of ip has recently failed, the returned
+// error will be a host unreachable error (see IsHostUnreachable).
 func (a *arp) LookupIPv4(ip IPv4) (MAC, error) {
-	panic("not implemented")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.cache[ip]
+	switch {
+	case !ok || e.state == arpStateIncomplete:
+		return MAC{}, errors.Errorf("lookup %v: address not resolved", ip)
+	case e.state == arpStateFailed:
+		return MAC{}, errors.Annotate(errors.NewHostUnreachable(ip.String()), "lookup")
+	default:
+		return e.mac, nil
+	}
 }
 
-func (a *arp) LookupIPv6(ip IPv6) (MAC, error) {
-	panic("not implemented")
+// WriteIPv4 writes the IPv4 packet in b to the neighbor with address ip. Like
+// EthernetInterface's WriteFrame, b must contain space for the Ethernet header
+// preceding the packet itself.
+//
+// If ip has not yet been resolved, a request is sent, and b is queued until a
+// reply arrives; in this case, WriteIPv4 returns len(b) and a nil error, and
+// b must not be modified by the caller. If resolution fails, any queued frames
+// are dropped, and subsequent calls to WriteIPv4 with ip will return a host
+// unreachable error (see IsHostUnreachable) for a short period.
+//
+// If ip is the limited broadcast address or the directed broadcast address of
+// one of our subnets, b is sent to the broadcast MAC without resolution, and
+// if it is a multicast address, to the multicast MAC to which it is mapped.
+func (a *arp) WriteIPv4(b []byte, ip IPv4) (n int, err error) {
+	if ip.IsMulticast() {
+		return a.iface.WriteFrame(b, ipv4MulticastMAC(ip), EtherTypeIPv4)
+	}
+
+	now := time.Now()
+	var frames []frame
+	a.mu.Lock()
+	if isIPv4Broadcast(a.addrs, ip) {
+		a.mu.Unlock()
+		return a.iface.WriteFrame(b, BroadcastMAC, EtherTypeIPv4)
+	}
+	e, ok := a.cache[ip]
+	if !ok {
+		e = &arpEntry{state: arpStateIncomplete, updated: now, requests: 1}
+		a.cache[ip] = e
+		frames = append(frames, a.makeFrame(arpOperRequest, BroadcastMAC, a.source(ip), ip, MAC{}))
+	}
+
+	switch e.state {
+	case arpStateIncomplete:
+		if len(e.pending) == arpMaxPending {
+			e.pending = e.pending[1:]
+		}
+		e.pending = append(e.pending, b)
+		a.mu.Unlock()
+		a.send(frames)
+		return len(b), nil
+	case arpStateFailed:
+		a.mu.Unlock()
+		return 0, errors.Annotate(errors.NewHostUnreachable(ip.String()), "resolve IPv4 address")
+	case arpStateStale:
+		e.state, e.updated, e.requests = arpStateProbe, now, 1
+		frames = append(frames, a.makeFrame(arpOperRequest, e.mac, a.source(ip), ip, e.mac))
+	}
+	mac := e.mac
+	a.mu.Unlock()
+
+	a.send(frames)
+	return a.iface.WriteFrame(b, mac, EtherTypeIPv4)
 }
 
+// Stop terminates a's daemon goroutine. Any frames pending resolution are
+// dropped.
 func (a *arp) Stop() {
+	close(a.stop)
+	a.wg.Wait()
+}
 
+// update records mac as the hardware address in e. If confirmed is true, e
+// is marked reachable; otherwise, e is marked stale unless it is already
+// reachable with the same address. Any frames which were pending resolution
+// are returned so that they may be sent once a.mu has been released.
+//
+// update assumes a.mu is held.
+func (a *arp) update(e *arpEntry, mac MAC, confirmed bool, now time.Time) []frame {
+	switch {
+	case confirmed:
+		e.state = arpStateReachable
+	case e.state == arpStateReachable && e.mac == mac:
+		return nil
+	default:
+		e.state = arpStateStale
+	}
+	e.mac, e.updated, e.requests = mac, now, 0
+
+	var frames []frame
+	for _, b := range e.pending {
+		frames = append(frames, frame{b: b, dst: mac, et: EtherTypeIPv4})
+	}
+	e.pending = nil
+	return frames
+}
+
+// tick advances the timers of all cache entries, returning any requests
+// which need to be sent. tick assumes a.mu is held.
+func (a *arp) tick(now time.Time) []frame {
+	var frames []frame
+	for ip, e := range a.cache {
+		elapsed := now.Sub(e.updated)
+		switch e.state {
+		case arpStateIncomplete, arpStateProbe:
+			if elapsed < arpRetransmitTimeout<<uint(e.requests-1) {
+				continue
+			}
+			if e.requests == arpMaxRequests {
+				e.state, e.mac, e.updated, e.pending = arpStateFailed, MAC{}, now, nil
+				continue
+			}
+			dst := BroadcastMAC
+			if e.state == arpStateProbe {
+				dst = e.mac
+			}
+			e.updated = now
+			e.requests++
+			frames = append(frames, a.makeFrame(arpOperRequest, dst, a.source(ip), ip, e.mac))
+		case arpStateReachable:
+			if elapsed >= arpReachableTime {
+				e.state, e.updated = arpStateStale, now
+			}
+		case arpStateStale:
+			if elapsed >= arpStaleTime {
+				delete(a.cache, ip)
+			}
+		case arpStateFailed:
+			if elapsed >= arpFailedTime {
+				delete(a.cache, ip)
+			}
+		}
+	}
+	return frames
+}
+
+func (a *arp) daemon() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(arpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			frames := a.tick(now)
+			a.mu.Unlock()
+			a.send(frames)
+		}
+	}
+}
+
+// SetAddrs replaces the addresses for which requests are answered.
+func (a *arp) SetAddrs(addrs []IPv4DeviceAddr) {
+	a.mu.Lock()
+	a.addrs = addrs
+	a.mu.Unlock()
+}
+
+// source returns our address to use in requests for ip.
+// It assumes a.mu is held.
+func (a *arp) source(ip IPv4) IPv4 {
+	src, _ := selectIPv4Source(a.addrs, ip)
+	return src
+}
+
+// makeFrame constructs an ARP packet from our address spa to the target
+// with the given operation, addressed to the link-layer destination dst.
+func (a *arp) makeFrame(oper uint16, dst MAC, spa, tpa IPv4, tha MAC) frame {
+	hdr := arpHeader{
+		HTYPE: arpHTYPEEthernet,
+		PTYPE: uint16(EtherTypeIPv4),
+		HLEN:  6,
+		PLEN:  4,
+		OPER:  oper,
+		SHA:   a.hw,
+		SPA:   spa,
+		THA:   tha,
+		TPA:   tpa,
+	}
+	b := make([]byte, ethernetHeaderLen+arpHeaderLen)
+	writeARPHeader(&hdr, b[ethernetHeaderLen:])
+	return frame{b: b, dst: dst, et: EtherTypeARP}
 }
 
+// send writes frames to a.iface. It must not be called while a.mu is held.
+func (a *arp) send(frames []frame) { writeFrames(a.iface, frames) }
+
 const arpHeaderLen = 28
 
+const (
+	arpHTYPEEthernet = 1
+
+	arpOperRequest = 1
+	arpOperReply   = 2
+)
+
 // https://en.wikipedia.org/wiki/Address_Resolution_Protocol#Packet_structure
 type arpHeader struct {
 	HTYPE, PTYPE uint16
@@ -40,3 +344,32 @@ type arpHeader struct {
 	THA          MAC
 	TPA          IPv4
 }
+
+func parseARPHeader(b []byte) (hdr arpHeader, err error) {
+	if len(b) < arpHeaderLen {
+		return hdr, errors.Errorf("invalid ARP packet length: %v", len(b))
+	}
+	hdr.HTYPE = parse.GetUint16(&b)
+	hdr.PTYPE = parse.GetUint16(&b)
+	hdr.HLEN = parse.GetByte(&b)
+	hdr.PLEN = parse.GetByte(&b)
+	hdr.OPER = parse.GetUint16(&b)
+	copy(hdr.SHA[:], parse.GetBytes(&b, 6))
+	copy(hdr.SPA[:], parse.GetBytes(&b, 4))
+	copy(hdr.THA[:], parse.GetBytes(&b, 6))
+	copy(hdr.TPA[:], parse.GetBytes(&b, 4))
+	return hdr, nil
+}
+
+// assumes that b is at least arpHeaderLen bytes long
+func writeARPHeader(hdr *arpHeader, b []byte) {
+	parse.PutUint16(&b, hdr.HTYPE)
+	parse.PutUint16(&b, hdr.PTYPE)
+	parse.PutByte(&b, hdr.HLEN)
+	parse.PutByte(&b, hdr.PLEN)
+	parse.PutUint16(&b, hdr.OPER)
+	copy(parse.GetBytes(&b, 6), hdr.SHA[:])
+	copy(parse.GetBytes(&b, 4), hdr.SPA[:])
+	copy(parse.GetBytes(&b, 6), hdr.THA[:])
+	copy(parse.GetBytes(&b, 4), hdr.TPA[:])
+}
@@ -0,0 +1,118 @@
+package net
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestARPHeader(t *testing.T) {
+	spa, _ := ParseIPv4("10.0.0.1")
+	tpa, _ := ParseIPv4("10.0.0.2")
+	hdr := arpHeader{
+		HTYPE: arpHTYPEEthernet,
+		PTYPE: uint16(EtherTypeIPv4),
+		HLEN:  6,
+		PLEN:  4,
+		OPER:  arpOperReply,
+		SHA:   MAC{1, 2, 3, 4, 5, 6},
+		SPA:   spa,
+		THA:   MAC{6, 5, 4, 3, 2, 1},
+		TPA:   tpa,
+	}
+
+	buf := make([]byte, arpHeaderLen)
+	writeARPHeader(&hdr, buf)
+	read, err := parseARPHeader(buf)
+	if err != nil {
+		t.Fatalf("unexpected error parsing ARP header: %v", err)
+	}
+	if read != hdr {
+		t.Error("Parsed ARP header isn't equivalent to input")
+	}
+	if _, err := parseARPHeader(buf[:arpHeaderLen-1]); err == nil {
+		t.Error("expected error parsing short ARP header")
+	}
+}
+
+// frameRecorder is an EthernetInterface which records written frames
+type frameRecorder struct {
+	frames []recordedFrame
+	mu     sync.Mutex
+	EthernetInterface
+}
+
+type recordedFrame struct {
+	b   []byte
+	dst MAC
+	et  EtherType
+}
+
+func (f *frameRecorder) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	f.mu.Lock()
+	f.frames = append(f.frames, recordedFrame{b: b, dst: dst, et: et})
+	f.mu.Unlock()
+	return len(b), nil
+}
+
+func (f *frameRecorder) take() []recordedFrame {
+	f.mu.Lock()
+	frames := f.frames
+	f.frames = nil
+	f.mu.Unlock()
+	return frames
+}
+
+func TestARPResolve(t *testing.T) {
+	var iface frameRecorder
+	ourMAC, theirMAC := MAC{2, 0, 0, 0, 0, 1}, MAC{2, 0, 0, 0, 0, 2}
+	ourIP, _ := ParseIPv4("10.0.0.1")
+	theirIP, _ := ParseIPv4("10.0.0.2")
+	a := newARP(&iface, ourMAC, []IPv4DeviceAddr{{Addr: ourIP}})
+	defer a.Stop()
+
+	pkt := make([]byte, ethernetHeaderLen+20)
+	n, err := a.WriteIPv4(pkt, theirIP)
+	if n != len(pkt) || err != nil {
+		t.Fatalf("unexpected result from WriteIPv4: (%v, %v)", n, err)
+	}
+	frames := iface.take()
+	if len(frames) != 1 || frames[0].dst != BroadcastMAC || frames[0].et != EtherTypeARP {
+		t.Fatalf("expected single broadcast ARP request; got %v", frames)
+	}
+	req, _ := parseARPHeader(frames[0].b[ethernetHeaderLen:])
+	if req.OPER != arpOperRequest || req.TPA != theirIP || req.SPA != ourIP || req.SHA != ourMAC {
+		t.Fatalf("unexpected ARP request: %+v", req)
+	}
+
+	// answer the request; the queued packet should be flushed
+	reply := arpHeader{
+		HTYPE: arpHTYPEEthernet, PTYPE: uint16(EtherTypeIPv4), HLEN: 6, PLEN: 4,
+		OPER: arpOperReply, SHA: theirMAC, SPA: theirIP, THA: ourMAC, TPA: ourIP,
+	}
+	buf := make([]byte, arpHeaderLen)
+	writeARPHeader(&reply, buf)
+	if err := a.HandlePacket(theirMAC, ourMAC, buf); err != nil {
+		t.Fatalf("unexpected error handling ARP reply: %v", err)
+	}
+	frames = iface.take()
+	if len(frames) != 1 || frames[0].dst != theirMAC || frames[0].et != EtherTypeIPv4 {
+		t.Fatalf("expected queued IPv4 packet to be flushed; got %v", frames)
+	}
+	if mac, err := a.LookupIPv4(theirIP); mac != theirMAC || err != nil {
+		t.Fatalf("unexpected result from LookupIPv4: (%v, %v)", mac, err)
+	}
+
+	// a request for our address should be answered
+	req = reply
+	req.OPER, req.THA = arpOperRequest, MAC{}
+	writeARPHeader(&req, buf)
+	a.HandlePacket(theirMAC, BroadcastMAC, buf)
+	frames = iface.take()
+	if len(frames) != 1 || frames[0].dst != theirMAC {
+		t.Fatalf("expected single unicast ARP reply; got %v", frames)
+	}
+	got, _ := parseARPHeader(frames[0].b[ethernetHeaderLen:])
+	if got.OPER != arpOperReply || got.SHA != ourMAC || got.SPA != ourIP || got.TPA != theirIP {
+		t.Fatalf("unexpected ARP reply: %+v", got)
+	}
+}
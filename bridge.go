@@ -0,0 +1,376 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+const (
+	// how long a learned MAC is remembered after the last
+	// frame from it (the IEEE 802.1D default)
+	bridgeAgingTime = 5 * time.Minute
+	// how often expired entries are removed from the
+	// forwarding database
+	bridgeAgingInterval = time.Second
+)
+
+// A Bridge is a learning Ethernet bridge which forwards frames between any
+// number of EthernetInterfaces, its ports. It learns which port each MAC is
+// reachable through from the source MACs of incoming frames, and forwards
+// frames destined for a learned MAC only to that MAC's port. Frames destined
+// for unknown MACs, the broadcast MAC, or multicast MACs are flooded to all
+// ports other than the one they arrived on. Learned MACs are forgotten if no
+// frames are received from them within the aging time (five minutes), or if
+// their port goes down.
+//
+// Ports which are down (see EthernetInterface's IsUp) neither receive nor
+// forward frames. Ports may be brought down and up individually while the
+// bridge is up.
+//
+// A Bridge can optionally have its own EthernetDevice (see NewDevice), which
+// behaves as if it were connected to an additional port.
+//
+// The zero Bridge is not a valid Bridge. Bridges are safe for concurrent
+// access.
+type Bridge struct {
+	ports []EthernetInterface
+	local *bridgeInterface // nil if no device has been created
+	fdb   map[MAC]bridgeEntry
+	up    bool
+
+	sync syncer
+}
+
+// an entry in a Bridge's forwarding database
+type bridgeEntry struct {
+	port    EthernetInterface
+	expires time.Time
+}
+
+// NewBridge creates a new Bridge with no ports. The returned bridge is down.
+func NewBridge() *Bridge {
+	return &Bridge{fdb: make(map[MAC]bridgeEntry)}
+}
+
+// AddPort adds iface to br's ports. Since each port must receive all frames,
+// iface must not have a MAC set. After a successful call to AddPort, br is
+// considered to own iface; the caller may bring iface up or down, but any
+// other modifications to iface may result in undefined behavior. AddPort can
+// only be called while br is down.
+func (br *Bridge) AddPort(iface EthernetInterface) error {
+	if ok, _ := iface.MAC(); ok {
+		return errors.New("add bridge port: interface has MAC set")
+	}
+	br.sync.Lock()
+	defer br.sync.Unlock()
+	if br.up {
+		return errors.New("add port to up bridge")
+	}
+	br.ports = append(br.ports, iface)
+	iface.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) {
+		br.forward(iface, b, src, dst, et)
+	})
+	return nil
+}
+
+// NewDevice creates a new EthernetDevice with the MAC address mac, attached
+// to br as if it were connected to an additional port. This allows the host
+// to have addresses on the bridged network. The returned device is down, and
+// has no associated IPv4 or IPv6 addresses; its MTU is the smallest MTU of
+// br's ports. NewDevice can only be called once, while br is down.
+func (br *Bridge) NewDevice(mac MAC) (*EthernetDevice, error) {
+	br.sync.Lock()
+	if br.up {
+		br.sync.Unlock()
+		return nil, errors.New("create bridge device on up bridge")
+	}
+	if br.local != nil {
+		br.sync.Unlock()
+		return nil, errors.New("create bridge device: bridge already has a device")
+	}
+	br.local = &bridgeInterface{br: br}
+	local := br.local
+	br.sync.Unlock()
+	dev, err := NewEthernetDevice(local, mac)
+	return dev, errors.Annotate(err, "create bridge device")
+}
+
+// BringUp brings br and all of its ports up. If br is already up,
+// BringUp is a no-op. If any port can't be brought up, the ports which
+// BringUp brought up are brought back down, and br remains down.
+func (br *Bridge) BringUp() error {
+	return br.sync.BringUp(func() error {
+		br.sync.RLock()
+		ports := br.ports
+		br.sync.RUnlock()
+		var brought []EthernetInterface // ports which were down
+		for _, p := range ports {
+			if p.IsUp() {
+				continue
+			}
+			err := p.BringUp()
+			if err != nil {
+				for _, p := range brought {
+					p.BringDown()
+					// TODO(joshlf): Log error
+				}
+				return errors.Annotate(err, "bring bridge up")
+			}
+			brought = append(brought, p)
+		}
+		br.sync.Lock()
+		br.up = true
+		br.sync.Unlock()
+		return nil
+	}, br.agingDaemon)
+}
+
+// BringDown brings br and all of its ports down, and clears its forwarding
+// database. If br is already down, BringDown is a no-op.
+func (br *Bridge) BringDown() error {
+	return br.sync.BringDown(func() error {
+		br.sync.Lock()
+		br.up = false
+		br.fdb = make(map[MAC]bridgeEntry)
+		ports := br.ports
+		br.sync.Unlock()
+		// NOTE(joshlf): Don't hold the lock while bringing ports down,
+		// since that waits for any in-progress calls to forward
+		for _, p := range ports {
+			err := p.BringDown()
+			if err != nil {
+				return errors.Annotate(err, "bring bridge down")
+			}
+		}
+		return nil
+	})
+}
+
+// IsUp returns true if br is up.
+func (br *Bridge) IsUp() bool {
+	br.sync.RLock()
+	up := br.up
+	br.sync.RUnlock()
+	return up
+}
+
+// forward learns src and forwards the frame with payload b, which arrived
+// on the port from, to the appropriate ports.
+func (br *Bridge) forward(from EthernetInterface, b []byte, src, dst MAC, et EtherType) {
+	if !from.IsUp() {
+		return
+	}
+	var out []EthernetInterface
+	br.sync.Lock()
+	if !br.up {
+		br.sync.Unlock()
+		return
+	}
+	if !src.IsMulticast() {
+		br.fdb[src] = bridgeEntry{port: from, expires: time.Now().Add(bridgeAgingTime)}
+	}
+	if e, ok := br.fdb[dst]; ok && !dst.IsMulticast() {
+		if e.port != from {
+			out = append(out, e.port)
+		}
+	} else {
+		for _, p := range br.ports {
+			if p != from {
+				out = append(out, p)
+			}
+		}
+		if br.local != nil && EthernetInterface(br.local) != from {
+			out = append(out, br.local)
+		}
+	}
+	br.sync.Unlock()
+
+	// NOTE(joshlf): Don't hold the lock while writing frames,
+	// since the local device may write frames in response
+	for _, p := range out {
+		if local, ok := p.(*bridgeInterface); ok {
+			local.deliver(b, src, dst, et)
+			continue
+		}
+		if !p.IsUp() {
+			continue
+		}
+		frame := make([]byte, ethernetHeaderLen+len(b))
+		copy(frame[ethernetHeaderLen:], b)
+		p.WriteFrameSrc(frame, src, dst, et)
+		// TODO(joshlf): Log error
+	}
+}
+
+// age removes expired entries, and entries whose
+// ports are down, from the forwarding database.
+func (br *Bridge) age(now time.Time) {
+	br.sync.Lock()
+	defer br.sync.Unlock()
+	for mac, e := range br.fdb {
+		if now.After(e.expires) || !e.port.IsUp() {
+			delete(br.fdb, mac)
+		}
+	}
+}
+
+func (br *Bridge) agingDaemon() {
+	ticker := time.NewTicker(bridgeAgingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-br.sync.StopChan():
+			return
+		case now := <-ticker.C:
+			br.age(now)
+		}
+	}
+}
+
+// minMTU returns the smallest non-zero MTU of br's ports,
+// or 0 if none of br's ports have an MTU set.
+func (br *Bridge) minMTU() int {
+	br.sync.RLock()
+	defer br.sync.RUnlock()
+	var min int
+	for _, p := range br.ports {
+		if mtu := p.MTU(); mtu != 0 && (min == 0 || mtu < min) {
+			min = mtu
+		}
+	}
+	return min
+}
+
+// bridgeInterface is the EthernetInterface through which
+// a Bridge's own device is attached to the bridge.
+type bridgeInterface struct {
+	br       *Bridge
+	up       bool
+	mtu      int                                        // 0 if unset
+	callback func(b []byte, src, dst MAC, et EtherType) // unset if nil
+	macFilter
+
+	mu sync.RWMutex
+}
+
+var _ EthernetInterface = &bridgeInterface{} // make sure *bridgeInterface implements EthernetInterface
+
+func (iface *bridgeInterface) BringUp() error {
+	iface.mu.Lock()
+	iface.up = true
+	iface.mu.Unlock()
+	return nil
+}
+
+func (iface *bridgeInterface) BringDown() error {
+	iface.mu.Lock()
+	iface.up = false
+	iface.mu.Unlock()
+	return nil
+}
+
+func (iface *bridgeInterface) IsUp() bool {
+	iface.mu.RLock()
+	up := iface.up
+	iface.mu.RUnlock()
+	return up
+}
+
+func (iface *bridgeInterface) MAC() (ok bool, mac MAC) {
+	iface.mu.RLock()
+	ok, mac = iface.macSet, iface.mac
+	iface.mu.RUnlock()
+	return ok, mac
+}
+
+func (iface *bridgeInterface) SetMAC(mac MAC) error {
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+	if iface.up {
+		return errors.New("set MAC on up interface")
+	}
+	return iface.setMAC(mac)
+}
+
+func (iface *bridgeInterface) MTU() int {
+	iface.mu.RLock()
+	mtu := iface.mtu
+	iface.mu.RUnlock()
+	if mtu == 0 {
+		return iface.br.minMTU()
+	}
+	return mtu
+}
+
+func (iface *bridgeInterface) SetMTU(mtu uint64) error {
+	if mtu == 0 {
+		return errors.New("set interface MTU: zero MTU")
+	}
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+	if iface.up {
+		return errors.New("set MTU on up interface")
+	}
+	iface.mtu = int(mtu)
+	return nil
+}
+
+func (iface *bridgeInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.mu.Lock()
+	iface.callback = f
+	iface.mu.Unlock()
+}
+
+func (iface *bridgeInterface) AddMulticastMAC(mac MAC) error {
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+	return iface.addMulticastMAC(mac)
+}
+
+func (iface *bridgeInterface) RemoveMulticastMAC(mac MAC) error {
+	iface.mu.Lock()
+	iface.removeMulticastMAC(mac)
+	iface.mu.Unlock()
+	return nil
+}
+
+func (iface *bridgeInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	iface.mu.RLock()
+	src, ok := iface.mac, iface.macSet
+	iface.mu.RUnlock()
+	if !ok {
+		return 0, errors.New("write frame: interface has no MAC")
+	}
+	return iface.WriteFrameSrc(b, src, dst, et)
+}
+
+func (iface *bridgeInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	if len(b) < ethernetHeaderLen {
+		return 0, errors.New("write frame: buffer too short for Ethernet header")
+	}
+	if !iface.IsUp() {
+		return 0, errors.New("write to down interface")
+	}
+	if mtu := iface.MTU(); mtu != 0 && len(b)-frameHeaderLen(et) > mtu {
+		return 0, errors.MTUf(mtu, "write frame: payload exceeds MTU")
+	}
+	if !iface.br.IsUp() {
+		return 0, errors.New("write to down bridge")
+	}
+	iface.br.forward(iface, b[ethernetHeaderLen:], src, dst, et)
+	return len(b), nil
+}
+
+// deliver delivers a frame forwarded by the bridge to iface's callback
+// if iface is up and accepts frames sent to dst.
+func (iface *bridgeInterface) deliver(b []byte, src, dst MAC, et EtherType) {
+	iface.mu.RLock()
+	accept := iface.up && iface.accepts(dst)
+	callback := iface.callback
+	iface.mu.RUnlock()
+	if accept && callback != nil {
+		callback(b, src, dst, et)
+	}
+}
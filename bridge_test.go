@@ -0,0 +1,128 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+func TestBridge(t *testing.T) {
+	// three segments joined by a bridge, with a device on each
+	// segment, and a device on the bridge itself
+	segs := make([]EthernetSegment, 3)
+	br := NewBridge()
+	var devs []*EthernetDevice
+	var chans []chan []byte
+	newDev := func(dev *EthernetDevice, err error) {
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(IPv4{10, 0, 0, byte(len(devs) + 1)}, IPv4{255, 0, 0, 0})
+		c := make(chan []byte, 4)
+		dev.RegisterIPv4Callback(func(b []byte) { c <- b })
+		devs, chans = append(devs, dev), append(chans, c)
+	}
+	for i := range segs {
+		if err := br.AddPort(segs[i].NewInterface()); err != nil {
+			t.Fatalf("unexpected error adding port: %v", err)
+		}
+		dev, err := NewEthernetDevice(segs[i].NewInterface(), MAC{2, 0, 0, 0, 0, byte(i + 1)})
+		newDev(dev, err)
+	}
+	dev, err := br.NewDevice(MAC{2, 0, 0, 0, 0, 4})
+	newDev(dev, err)
+	if err := br.BringUp(); err != nil {
+		t.Fatalf("unexpected error bringing bridge up: %v", err)
+	}
+	defer br.BringDown()
+	for _, dev := range devs {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		defer dev.BringDown()
+	}
+
+	// a promiscuous listener on the third segment
+	sniffer := segs[2].NewInterface()
+	sniffed := make(chan MAC, 16)
+	sniffer.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) { sniffed <- dst })
+	sniffer.BringUp()
+	defer sniffer.BringDown()
+
+	send := func(from, to int) {
+		pkt := []byte{byte(from), byte(to)}
+		if _, err := devs[from].WriteToIPv4(pkt, IPv4{10, 0, 0, byte(to + 1)}); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+		select {
+		case got := <-chans[to]:
+			if !bytes.Equal(got, pkt) {
+				t.Errorf("got packet %v; want %v", got, pkt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for packet from %v to %v", from, to)
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case <-sniffed:
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}
+
+	// the ARP request is flooded to the third segment
+	send(0, 1)
+	drain()
+	// both MACs have been learned, so unicast frames
+	// between them are not flooded
+	send(1, 0)
+	send(0, 1)
+	select {
+	case dst := <-sniffed:
+		t.Errorf("unexpected frame to %v flooded to third segment", dst)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// to and from the bridge's own device
+	send(3, 2)
+	send(0, 3)
+}
+
+// failingUpInterface is an EthernetInterface which can't be brought up.
+type failingUpInterface struct {
+	EthernetInterface
+}
+
+func (iface failingUpInterface) BringUp() error {
+	return errors.New("bring interface up: failed")
+}
+
+func TestBridgeBringUpError(t *testing.T) {
+	var seg EthernetSegment
+	br := NewBridge()
+	ports := []EthernetInterface{seg.NewInterface(), seg.NewInterface(), failingUpInterface{seg.NewInterface()}}
+	for _, p := range ports {
+		if err := br.AddPort(p); err != nil {
+			t.Fatalf("unexpected error adding port: %v", err)
+		}
+	}
+	// a port which was already up stays up
+	if err := ports[1].BringUp(); err != nil {
+		t.Fatalf("unexpected error bringing port up: %v", err)
+	}
+	defer ports[1].BringDown()
+	if err := br.BringUp(); err == nil {
+		t.Fatalf("expected error bringing bridge up")
+	}
+	if br.IsUp() {
+		t.Errorf("bridge is up after failing to bring a port up")
+	}
+	if ports[0].IsUp() || !ports[1].IsUp() {
+		t.Errorf("got ports up: %v, %v; want false, true", ports[0].IsUp(), ports[1].IsUp())
+	}
+}
@@ -0,0 +1,274 @@
+package net
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// A Direction is the direction in which a captured packet was travelling.
+type Direction uint8
+
+// The values of the Direction constants match those
+// of the direction bits of pcapng's epb_flags option.
+const (
+	DirectionInbound  Direction = 1
+	DirectionOutbound Direction = 2
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	}
+	return "unknown"
+}
+
+// A CapturedPacket is a packet which has been captured.
+type CapturedPacket struct {
+	Time      time.Time
+	Direction Direction
+	// If Ethernet is true, Data begins with an Ethernet header. Otherwise,
+	// it begins with an IPv4 or IPv6 header.
+	Ethernet bool
+	Data     []byte
+}
+
+// A CaptureFilter decides whether a captured packet should be written. It
+// must not modify the packet. See also ParseCaptureFilter.
+type CaptureFilter func(p *CapturedPacket) bool
+
+// capture writes captured packets to a file.
+type capture struct {
+	w        *pcapWriter
+	ethernet bool
+	filter   CaptureFilter // unset if nil
+	err      error         // once set, no more packets are written
+	mu       sync.Mutex
+}
+
+func newCapture(w io.Writer, format CaptureFormat, ethernet bool, filter CaptureFilter) (*capture, error) {
+	linkType := uint16(linkTypeRaw)
+	if ethernet {
+		linkType = linkTypeEthernet
+	}
+	pw, err := newPcapWriter(w, format, linkType)
+	if err != nil {
+		return nil, err
+	}
+	return &capture{w: pw, ethernet: ethernet, filter: filter}, nil
+}
+
+// capture captures the packet b, which is not retained.
+func (c *capture) capture(dir Direction, b []byte) {
+	p := CapturedPacket{Time: time.Now(), Direction: dir, Ethernet: c.ethernet, Data: b}
+	if c.filter != nil && !c.filter(&p) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = c.w.WritePacket(p.Time, p.Direction, p.Data)
+}
+
+// captureFrame captures the frame with the given header and payload.
+func (c *capture) captureFrame(dir Direction, b []byte, src, dst MAC, et EtherType) {
+	frame := make([]byte, ethernetHeaderLen+len(b))
+	writeEthernetHeader(ethernetHeader{src: src, dst: dst, et: et}, frame)
+	copy(frame[ethernetHeaderLen:], b)
+	c.capture(dir, frame)
+}
+
+// Err returns the first error encountered while writing captured packets,
+// if any. Once an error has been encountered, no more packets are written.
+func (c *capture) Err() error {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	return err
+}
+
+// A CaptureDevice is a Device which captures all IP packets sent and received
+// through another Device. See NewCaptureDevice.
+type CaptureDevice interface {
+	Device
+	// Err returns the first error encountered while writing captured
+	// packets, if any. Once an error has been encountered, no more
+	// packets are written.
+	Err() error
+}
+
+// NewCaptureDevice creates a new CaptureDevice which wraps dev, writing all
+// IP packets sent and received through dev to w in the given format, using
+// the raw IP link type. If filter is non-nil, only packets for which filter
+// returns true are written. The returned device implements IPv4Device if
+// dev does, and IPv6Device if dev does. After a successful call to
+// NewCaptureDevice, the returned device is considered to own dev;
+// modifications to dev by the caller may result in undefined behavior.
+//
+// Packets are captured when they are written successfully, or when they are
+// received, regardless of whether a callback is registered.
+func NewCaptureDevice(dev Device, w io.Writer, format CaptureFormat, filter CaptureFilter) (CaptureDevice, error) {
+	dev4, ok4 := dev.(IPv4Device)
+	dev6, ok6 := dev.(IPv6Device)
+	if !ok4 && !ok6 {
+		return nil, errors.New("create capture device: device is neither IPv4Device nor IPv6Device")
+	}
+	c, err := newCapture(w, format, false, filter)
+	if err != nil {
+		return nil, errors.Annotate(err, "create capture device")
+	}
+	var cdev CaptureDevice
+	switch {
+	case ok4 && ok6:
+		cdev = &captureDualDevice{captureIPv4Device{dev4, c}, captureIPv6Device{dev6, c}}
+	case ok4:
+		cdev = &captureIPv4Device{dev4, c}
+	default:
+		cdev = &captureIPv6Device{dev6, c}
+	}
+	// register callbacks so that incoming packets are
+	// captured even if the caller never registers any
+	if cdev, ok := cdev.(IPv4Device); ok {
+		cdev.RegisterIPv4Callback(nil)
+	}
+	if cdev, ok := cdev.(IPv6Device); ok {
+		cdev.RegisterIPv6Callback(nil)
+	}
+	return cdev, nil
+}
+
+type captureIPv4Device struct {
+	IPv4Device
+	*capture
+}
+
+var _ IPv4Device = &captureIPv4Device{} // make sure *captureIPv4Device implements IPv4Device
+
+func (dev *captureIPv4Device) RegisterIPv4Callback(f func(b []byte)) {
+	dev.IPv4Device.RegisterIPv4Callback(func(b []byte) {
+		dev.capture.capture(DirectionInbound, b)
+		if f != nil {
+			f(b)
+		}
+	})
+}
+
+func (dev *captureIPv4Device) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	n, err = dev.IPv4Device.WriteToIPv4(b, dst)
+	if err == nil {
+		dev.capture.capture(DirectionOutbound, b)
+	}
+	return n, err
+}
+
+type captureIPv6Device struct {
+	IPv6Device
+	*capture
+}
+
+var _ IPv6Device = &captureIPv6Device{} // make sure *captureIPv6Device implements IPv6Device
+
+func (dev *captureIPv6Device) RegisterIPv6Callback(f func(b []byte)) {
+	dev.IPv6Device.RegisterIPv6Callback(func(b []byte) {
+		dev.capture.capture(DirectionInbound, b)
+		if f != nil {
+			f(b)
+		}
+	})
+}
+
+func (dev *captureIPv6Device) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	n, err = dev.IPv6Device.WriteToIPv6(b, dst)
+	if err == nil {
+		dev.capture.capture(DirectionOutbound, b)
+	}
+	return n, err
+}
+
+// NOTE(joshlf): The methods common to IPv4Device and IPv6Device are
+// ambiguous, so captureDualDevice has to define them explicitly.
+
+type captureDualDevice struct {
+	captureIPv4Device
+	captureIPv6Device
+}
+
+var _ IPv4Device = &captureDualDevice{} // make sure *captureDualDevice implements IPv4Device
+var _ IPv6Device = &captureDualDevice{} // make sure *captureDualDevice implements IPv6Device
+
+func (dev *captureDualDevice) BringUp() error   { return dev.captureIPv4Device.BringUp() }
+func (dev *captureDualDevice) BringDown() error { return dev.captureIPv4Device.BringDown() }
+func (dev *captureDualDevice) IsUp() bool       { return dev.captureIPv4Device.IsUp() }
+func (dev *captureDualDevice) MTU() int         { return dev.captureIPv4Device.MTU() }
+func (dev *captureDualDevice) Err() error       { return dev.captureIPv4Device.Err() }
+
+// A CaptureInterface is an EthernetInterface which captures all frames sent
+// and received through another EthernetInterface. See NewCaptureInterface.
+type CaptureInterface interface {
+	EthernetInterface
+	// Err returns the first error encountered while writing captured
+	// frames, if any. Once an error has been encountered, no more
+	// frames are written.
+	Err() error
+}
+
+// NewCaptureInterface creates a new CaptureInterface which wraps iface,
+// writing all frames sent and received through iface to w in the given
+// format, using the Ethernet link type. If filter is non-nil, only frames
+// for which filter returns true are written. After a successful call to
+// NewCaptureInterface, the returned interface is considered to own iface;
+// modifications to iface by the caller may result in undefined behavior.
+//
+// Frames are captured when they are written successfully, or when they are
+// received, regardless of whether a callback is registered. Since iface
+// filters incoming frames by MAC, only frames which pass the filter are
+// captured.
+func NewCaptureInterface(iface EthernetInterface, w io.Writer, format CaptureFormat, filter CaptureFilter) (CaptureInterface, error) {
+	c, err := newCapture(w, format, true, filter)
+	if err != nil {
+		return nil, errors.Annotate(err, "create capture interface")
+	}
+	ciface := &captureInterface{iface, c}
+	// register a callback so that incoming frames are captured
+	// even if the caller never registers one
+	ciface.RegisterCallback(nil)
+	return ciface, nil
+}
+
+type captureInterface struct {
+	EthernetInterface
+	*capture
+}
+
+func (iface *captureInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.EthernetInterface.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) {
+		iface.captureFrame(DirectionInbound, b, src, dst, et)
+		if f != nil {
+			f(b, src, dst, et)
+		}
+	})
+}
+
+func (iface *captureInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	ok, src := iface.MAC()
+	n, err = iface.EthernetInterface.WriteFrame(b, dst, et)
+	if err == nil && ok {
+		iface.captureFrame(DirectionOutbound, b[ethernetHeaderLen:], src, dst, et)
+	}
+	return n, err
+}
+
+func (iface *captureInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	n, err = iface.EthernetInterface.WriteFrameSrc(b, src, dst, et)
+	if err == nil {
+		iface.captureFrame(DirectionOutbound, b[ethernetHeaderLen:], src, dst, et)
+	}
+	return n, err
+}
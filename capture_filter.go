@@ -0,0 +1,304 @@
+package net
+
+import (
+	gonet "net"
+	"strconv"
+	"strings"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// ParseCaptureFilter parses a filter expression in a subset of the syntax
+// used by tcpdump (see pcap-filter(7)), returning the equivalent
+// CaptureFilter. An expression is made up of the following primitives,
+// which may be combined using "and" (or "&&"), "or" (or "||"), "not" (or
+// "!"), and parentheses. As in tcpdump, "and" and "or" have the same
+// precedence, and associate to the left.
+//
+//	inbound, outbound           the packet's direction
+//	ip, ip6, arp                the packet's network protocol
+//	tcp, udp, icmp, icmp6       the packet's transport protocol
+//	vlan [vid]                  the frame has an IEEE 802.1Q tag (with the VID)
+//	[src|dst] host <addr>       the packet's source or destination IP address
+//	[src|dst] net <cidr>        the packet's source or destination IP subnet
+//	[src|dst] port <port>       the packet's source or destination TCP or UDP port
+//	ether [src|dst] host <mac>  the frame's source or destination MAC
+//
+// If neither src nor dst is given, either address matches. Primitives which
+// refer to Ethernet headers never match packets without them, and the "vlan"
+// primitive only considers the outermost tag.
+func ParseCaptureFilter(expr string) (CaptureFilter, error) {
+	p := filterParser{toks: tokenizeFilter(expr)}
+	if len(p.toks) == 0 {
+		return func(*CapturedPacket) bool { return true }, nil
+	}
+	f, err := p.parseOr()
+	if err == nil && len(p.toks) > 0 {
+		err = errors.Errorf("unexpected %q", p.toks[0])
+	}
+	if err != nil {
+		return nil, errors.Annotate(err, "parse capture filter")
+	}
+	return func(p *CapturedPacket) bool {
+		fields := decodeCapturedPacket(p)
+		return f(p, &fields)
+	}, nil
+}
+
+// capturedFields holds the fields of a captured
+// packet which filter expressions can refer to
+type capturedFields struct {
+	ethernet         bool // the remaining Ethernet fields are only valid if true
+	srcMAC, dstMAC   MAC
+	vlan             bool
+	vid              uint16
+	et               EtherType // the EtherType after any IEEE 802.1Q tag
+	ipVersion        int       // 0 if not IP; the remaining fields are only valid if not 0
+	srcIP, dstIP     IP
+	proto            IPProtocol
+	ports            bool // srcPort and dstPort are only valid if true
+	srcPort, dstPort uint16
+}
+
+func decodeCapturedPacket(p *CapturedPacket) (f capturedFields) {
+	b := p.Data
+	if p.Ethernet {
+		eh, err := parseEthernetHeader(b)
+		if err != nil {
+			return f
+		}
+		f.ethernet, f.srcMAC, f.dstMAC = true, eh.src, eh.dst
+		f.vlan, f.vid, f.et = eh.Has8021Q(), eh.VID(), eh.et
+		if f.et != EtherTypeIPv4 && f.et != EtherTypeIPv6 {
+			return f
+		}
+		b = b[eh.EncodedLen():]
+	}
+	if len(b) < 1 {
+		return f
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return f
+		}
+		var hdr ipv4Header
+		readIPv4Header(&hdr, b)
+		f.ipVersion, f.srcIP, f.dstIP, f.proto = 4, hdr.src, hdr.dst, hdr.proto
+		if !p.Ethernet {
+			f.et = EtherTypeIPv4
+		}
+		if hdr.fragOff != 0 || len(b) < int(hdr.IHL)*4 {
+			// only the first fragment has the transport header
+			return f
+		}
+		b = b[int(hdr.IHL)*4:]
+	case 6:
+		if len(b) < 40 {
+			return f
+		}
+		var hdr ipv6Header
+		readIPv6Header(&hdr, b)
+		f.ipVersion, f.srcIP, f.dstIP, f.proto = 6, hdr.src, hdr.dst, hdr.nextHdr
+		if !p.Ethernet {
+			f.et = EtherTypeIPv6
+		}
+		b = b[40:]
+	default:
+		return f
+	}
+	if (f.proto == IPProtocolTCP || f.proto == IPProtocolUDP) && len(b) >= 4 {
+		f.ports = true
+		f.srcPort = uint16(b[0])<<8 | uint16(b[1])
+		f.dstPort = uint16(b[2])<<8 | uint16(b[3])
+	}
+	return f
+}
+
+type filterFunc func(p *CapturedPacket, f *capturedFields) bool
+
+func tokenizeFilter(expr string) []string {
+	for _, s := range []string{"(", ")", "!"} {
+		expr = strings.Replace(expr, s, " "+s+" ", -1)
+	}
+	toks := strings.Fields(expr)
+	for i, tok := range toks {
+		switch tok {
+		case "&&":
+			toks[i] = "and"
+		case "||":
+			toks[i] = "or"
+		case "!":
+			toks[i] = "not"
+		}
+	}
+	return toks
+}
+
+type filterParser struct {
+	toks []string
+}
+
+// next consumes and returns the next token, or "" if there are none.
+func (p *filterParser) next() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	tok := p.toks[0]
+	p.toks = p.toks[1:]
+	return tok
+}
+
+func (p *filterParser) peek() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	return p.toks[0]
+}
+
+func (p *filterParser) parseOr() (filterFunc, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "or" {
+		op := p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "and" {
+			left = func(p *CapturedPacket, f *capturedFields) bool { return l(p, f) && right(p, f) }
+		} else {
+			left = func(p *CapturedPacket, f *capturedFields) bool { return l(p, f) || right(p, f) }
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterFunc, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *CapturedPacket, fs *capturedFields) bool { return !f(p, fs) }, nil
+	case "(":
+		p.next()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ')'")
+		}
+		return f, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (filterFunc, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "inbound", "outbound":
+		dir := DirectionInbound
+		if tok == "outbound" {
+			dir = DirectionOutbound
+		}
+		return func(p *CapturedPacket, f *capturedFields) bool { return p.Direction == dir }, nil
+	case "ip":
+		return func(p *CapturedPacket, f *capturedFields) bool { return f.ipVersion == 4 }, nil
+	case "ip6":
+		return func(p *CapturedPacket, f *capturedFields) bool { return f.ipVersion == 6 }, nil
+	case "arp":
+		return func(p *CapturedPacket, f *capturedFields) bool { return f.ethernet && f.et == EtherTypeARP }, nil
+	case "tcp", "udp", "icmp", "icmp6":
+		proto := map[string]IPProtocol{
+			"tcp":   IPProtocolTCP,
+			"udp":   IPProtocolUDP,
+			"icmp":  IPProtocolICMPv4,
+			"icmp6": IPProtocolICMPv6,
+		}[tok]
+		return func(p *CapturedPacket, f *capturedFields) bool { return f.ipVersion != 0 && f.proto == proto }, nil
+	case "vlan":
+		vid, err := strconv.ParseUint(p.peek(), 10, 12)
+		if err != nil {
+			return func(p *CapturedPacket, f *capturedFields) bool { return f.ethernet && f.vlan }, nil
+		}
+		p.next()
+		return func(p *CapturedPacket, f *capturedFields) bool {
+			return f.ethernet && f.vlan && f.vid == uint16(vid)
+		}, nil
+	case "ether":
+		src, dst := p.parseDir()
+		if p.peek() == "host" {
+			p.next()
+		}
+		arg := p.next()
+		hw, err := gonet.ParseMAC(arg)
+		if err != nil || len(hw) != 6 {
+			return nil, errors.Errorf("invalid MAC: %q", arg)
+		}
+		var mac MAC
+		copy(mac[:], hw)
+		return func(p *CapturedPacket, f *capturedFields) bool {
+			return f.ethernet && ((src && f.srcMAC == mac) || (dst && f.dstMAC == mac))
+		}, nil
+	}
+
+	p.toks = append([]string{tok}, p.toks...)
+	src, dst := p.parseDir()
+	switch tok := p.next(); tok {
+	case "host":
+		arg := p.next()
+		addr, err := ParseIP(arg)
+		if err != nil {
+			return nil, errors.Errorf("invalid IP address: %q", arg)
+		}
+		return func(p *CapturedPacket, f *capturedFields) bool {
+			return f.ipVersion != 0 && ((src && f.srcIP == addr) || (dst && f.dstIP == addr))
+		}, nil
+	case "net":
+		arg := p.next()
+		_, subnet, err := ParseCIDR(arg)
+		if err != nil {
+			return nil, errors.Errorf("invalid subnet: %q", arg)
+		}
+		return func(p *CapturedPacket, f *capturedFields) bool {
+			return f.ipVersion == subnet.IPVersion() &&
+				((src && SubnetHas(subnet, f.srcIP)) || (dst && SubnetHas(subnet, f.dstIP)))
+		}, nil
+	case "port":
+		arg := p.next()
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, errors.Errorf("invalid port: %q", arg)
+		}
+		return func(p *CapturedPacket, f *capturedFields) bool {
+			return f.ports && ((src && f.srcPort == uint16(port)) || (dst && f.dstPort == uint16(port)))
+		}, nil
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	default:
+		return nil, errors.Errorf("unexpected %q", tok)
+	}
+}
+
+// parseDir parses an optional "src" or "dst" qualifier, returning
+// which of the source and destination addresses should be matched.
+func (p *filterParser) parseDir() (src, dst bool) {
+	switch p.peek() {
+	case "src":
+		p.next()
+		return true, false
+	case "dst":
+		p.next()
+		return false, true
+	}
+	return true, true
+}
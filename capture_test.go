@@ -0,0 +1,136 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestCaptureFilter(t *testing.T) {
+	// a TCP segment from 10.0.0.1:1234 to 10.0.0.2:80
+	pkt := make([]byte, 40)
+	writeIPv4Header(&ipv4Header{version: 4, IHL: 5, len: 40, TTL: 1, proto: IPProtocolTCP,
+		src: IPv4{10, 0, 0, 1}, dst: IPv4{10, 0, 0, 2}}, pkt)
+	pkt[20], pkt[21], pkt[22], pkt[23] = 0x04, 0xD2, 0, 80
+	// the same segment in a tagged Ethernet frame
+	frame := make([]byte, ethernetHeaderLen8021+len(pkt))
+	writeEthernetHeader(ethernetHeader{src: MAC{2, 0, 0, 0, 0, 1}, dst: MAC{2, 0, 0, 0, 0, 2},
+		ieee8021Q: 7, et: EtherTypeIPv4}, frame)
+	copy(frame[ethernetHeaderLen8021:], pkt)
+
+	ip := &CapturedPacket{Direction: DirectionInbound, Data: pkt}
+	eth := &CapturedPacket{Direction: DirectionOutbound, Ethernet: true, Data: frame}
+	for _, c := range []struct {
+		expr    string
+		ip, eth bool
+	}{
+		{"", true, true},
+		{"ip and tcp", true, true},
+		{"ip6 or udp", false, false},
+		{"inbound", true, false},
+		{"! inbound", false, true},
+		{"src host 10.0.0.1 && dst port 80", true, true},
+		{"dst host 10.0.0.1", false, false},
+		{"net 10.0.0.0/8 and port 1234", true, true},
+		{"src net 192.168.0.0/16", false, false},
+		{"vlan", false, true},
+		{"vlan 7 and ether src 02:00:00:00:00:01", false, true},
+		{"vlan 8 or ether dst host 02:00:00:00:00:01", false, false},
+		{"not (tcp and port 80) or outbound", false, true},
+		{"arp", false, false},
+	} {
+		f, err := ParseCaptureFilter(c.expr)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", c.expr, err)
+			continue
+		}
+		if got := f(ip); got != c.ip {
+			t.Errorf("filter %q on IP packet: got %v; want %v", c.expr, got, c.ip)
+		}
+		if got := f(eth); got != c.eth {
+			t.Errorf("filter %q on Ethernet frame: got %v; want %v", c.expr, got, c.eth)
+		}
+	}
+
+	for _, expr := range []string{"host", "port foo", "(tcp", "tcp udp", "ether host 1.2.3.4", "and"} {
+		if _, err := ParseCaptureFilter(expr); err == nil {
+			t.Errorf("expected error parsing %q", expr)
+		}
+	}
+}
+
+func TestCaptureInterface(t *testing.T) {
+	var seg EthernetSegment
+	var buf bytes.Buffer
+	filter, _ := ParseCaptureFilter("ip")
+	iface, err := NewCaptureInterface(seg.NewInterface(), &buf, FormatPcapNG, filter)
+	if err != nil {
+		t.Fatalf("unexpected error creating capture interface: %v", err)
+	}
+	var devs []*EthernetDevice
+	for i, iface := range []EthernetInterface{iface, seg.NewInterface()} {
+		dev, err := NewEthernetDevice(iface, MAC{2, 0, 0, 0, 0, byte(i + 1)})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(IPv4{10, 0, 0, byte(i + 1)}, IPv4{255, 0, 0, 0})
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		defer dev.BringDown()
+		devs = append(devs, dev)
+	}
+	c := make(chan []byte, 1)
+	devs[0].RegisterIPv4Callback(func(b []byte) { c <- b })
+	devs[1].RegisterIPv4Callback(func(b []byte) { devs[1].WriteToIPv4(b, IPv4{10, 0, 0, 1}) })
+
+	pkt := make([]byte, 24)
+	writeIPv4Header(&ipv4Header{version: 4, IHL: 5, len: 24, TTL: 1, src: IPv4{10, 0, 0, 1}, dst: IPv4{10, 0, 0, 2}}, pkt)
+	copy(pkt[20:], "ping")
+	if _, err := devs[0].WriteToIPv4(pkt, IPv4{10, 0, 0, 2}); err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	select {
+	case <-c:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for packet")
+	}
+
+	// the section header and interface description blocks,
+	// followed by an enhanced packet block for each of the
+	// IPv4 packets (ARP is filtered out)
+	b := buf.Bytes()
+	le := binary.LittleEndian
+	var blocks []uint32
+	var dirs []Direction
+	for len(b) >= 12 {
+		typ, l := le.Uint32(b), le.Uint32(b[4:])
+		if le.Uint32(b[l-4:]) != l {
+			t.Fatalf("block length mismatch")
+		}
+		blocks = append(blocks, typ)
+		if typ == pcapngIDB && le.Uint16(b[8:]) != linkTypeEthernet {
+			t.Errorf("got link type %v; want %v", le.Uint16(b[8:]), linkTypeEthernet)
+		}
+		if typ == pcapngEPB {
+			caplen := le.Uint32(b[20:])
+			frame := b[28 : 28+caplen]
+			if !bytes.Equal(frame[ethernetHeaderLen:], pkt) {
+				t.Errorf("got frame %v", frame)
+			}
+			dirs = append(dirs, Direction(le.Uint32(b[l-12:])))
+		}
+		b = b[l:]
+	}
+	want := []uint32{pcapngSHB, pcapngIDB, pcapngEPB, pcapngEPB}
+	if len(b) != 0 || len(blocks) != len(want) || blocks[0] != want[0] || blocks[1] != want[1] || blocks[2] != want[2] || blocks[3] != want[3] {
+		t.Fatalf("got blocks %x; want %x", blocks, want)
+	}
+	if dirs[0] != DirectionOutbound || dirs[1] != DirectionInbound {
+		t.Errorf("got directions %v; want [outbound inbound]", dirs)
+	}
+	if err := iface.Err(); err != nil {
+		t.Errorf("unexpected capture error: %v", err)
+	}
+}
@@ -37,18 +37,52 @@ type Device interface {
 type IPv4Device interface {
 	Device
 
-	// IPv4 returns the device's IPv4 address and network mask
-	// if they have been set.
+	// IPv4 returns the device's primary IPv4 address and
+	// network mask if it has any addresses.
 	IPv4() (addr, netmask IPv4, ok bool)
-	// SetIPv4 sets the device's IPv4 address and network mask,
-	// returning any error encountered. SetIPv4 can only be
-	// called when the device is down.
+	// SetIPv4 replaces all of the device's IPv4 addresses with
+	// the given address and network mask, returning any error
+	// encountered. SetIPv4 can only be called when the device
+	// is down.
 	SetIPv4(addr, netmask IPv4) error
-	// UnsetIPv4 unsets the device's IPv4 address and network
-	// mask, returning any error encountered. UnsetIPv4 can
-	// only be called when the device is down.
+	// UnsetIPv4 removes all of the device's IPv4 addresses,
+	// returning any error encountered. UnsetIPv4 can only be
+	// called when the device is down.
 	UnsetIPv4() error
 
+	// IPv4Addrs returns all of the device's IPv4 addresses. The
+	// first is the primary address.
+	IPv4Addrs() []IPv4DeviceAddr
+	// AddIPv4 adds an IPv4 address with the given network mask,
+	// returning any error encountered. If the device has no other
+	// addresses, addr becomes its primary address. It is an error
+	// to add an address which the device already has. AddIPv4
+	// may be called while the device is up.
+	AddIPv4(addr, netmask IPv4) error
+	// RemoveIPv4 removes an IPv4 address, returning any error
+	// encountered. If addr is the primary address, the next
+	// address becomes the primary address. RemoveIPv4 may be
+	// called while the device is up.
+	RemoveIPv4(addr IPv4) error
+	// RegisterIPv4AddrCallback registers f as the function to be
+	// called after the device's IPv4 addresses change. It
+	// overwrites any previously-registered callback. f is
+	// called synchronously, but without any of the device's
+	// locks held, so it may call the device's methods.
+	RegisterIPv4AddrCallback(f func())
+
+	// JoinIPv4Group arranges for the device to receive packets
+	// sent to the multicast group addr, for example by adding
+	// the group's link-layer address to its multicast filter.
+	// Joining a group which the device has already joined is a
+	// no-op. JoinIPv4Group may be called while the device is up
+	// or down. Devices which receive all packets regardless of
+	// their destinations may implement it as a no-op.
+	JoinIPv4Group(addr IPv4) error
+	// LeaveIPv4Group undoes JoinIPv4Group. Leaving a group which
+	// the device hasn't joined is a no-op.
+	LeaveIPv4Group(addr IPv4) error
+
 	// RegisterIPv4Callback registers f as the function
 	// to be called when a new IPv4 packet arrives. It
 	// overwrites any previously-registered callbacks.
@@ -63,18 +97,45 @@ type IPv4Device interface {
 type IPv6Device interface {
 	Device
 
-	// IPv6 returns the device's IPv6 address and network mask
-	// if they have been set.
+	// IPv6 returns the device's primary IPv6 address and
+	// network mask if it has any addresses.
 	IPv6() (addr, netmask IPv6, ok bool)
-	// SetIPv6 sets the device's IPv6 address and network mask,
-	// returning any error encountered. SetIPv6 can only be
-	// called when the device is down.
+	// SetIPv6 replaces all of the device's IPv6 addresses with
+	// the given address and network mask, returning any error
+	// encountered. SetIPv6 can only be called when the device
+	// is down.
 	SetIPv6(addr, netmask IPv6) error
-	// UnsetIPv6 unsets the device's IPv6 address and network
-	// mask, returning any error encountered. UnsetIPv6 can
-	// only be called when the device is down.
+	// UnsetIPv6 removes all of the device's IPv6 addresses,
+	// returning any error encountered. UnsetIPv6 can only be
+	// called when the device is down.
 	UnsetIPv6() error
 
+	// IPv6Addrs returns all of the device's IPv6 addresses. The
+	// first is the primary address.
+	IPv6Addrs() []IPv6DeviceAddr
+	// AddIPv6 adds an IPv6 address with the given network mask,
+	// returning any error encountered. If the device has no other
+	// addresses, addr becomes its primary address. It is an error
+	// to add an address which the device already has. AddIPv6
+	// may be called while the device is up.
+	AddIPv6(addr, netmask IPv6) error
+	// RemoveIPv6 removes an IPv6 address, returning any error
+	// encountered. If addr is the primary address, the next
+	// address becomes the primary address. RemoveIPv6 may be
+	// called while the device is up.
+	RemoveIPv6(addr IPv6) error
+	// RegisterIPv6AddrCallback registers f as the function to be
+	// called after the device's IPv6 addresses change. It
+	// overwrites any previously-registered callback. f is
+	// called synchronously, but without any of the device's
+	// locks held, so it may call the device's methods.
+	RegisterIPv6AddrCallback(f func())
+
+	// JoinIPv6Group and LeaveIPv6Group are like JoinIPv4Group
+	// and LeaveIPv4Group, but for IPv6.
+	JoinIPv6Group(addr IPv6) error
+	LeaveIPv6Group(addr IPv6) error
+
 	// RegisterIPv6Callback registers f as the function
 	// to be called when a new IPv4 packet arrives. It
 	// overwrites any previously-registered callbacks.
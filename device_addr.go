@@ -0,0 +1,257 @@
+package net
+
+import (
+	"sync"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// An IPv4DeviceAddr is an IPv4 address assigned to a device, along
+// with the network mask of the subnet to which it belongs.
+type IPv4DeviceAddr struct {
+	Addr, Netmask IPv4
+}
+
+// Subnet returns the subnet to which a belongs.
+func (a IPv4DeviceAddr) Subnet() IPv4Subnet {
+	sub := IPv4Subnet{Netmask: a.Netmask}
+	for i, b := range a.Addr {
+		sub.Addr[i] = b & a.Netmask[i]
+	}
+	return sub
+}
+
+// IPv4Broadcast is the limited broadcast address, 255.255.255.255. Packets
+// sent to it are delivered to every host on the local link, and are never
+// forwarded.
+var IPv4Broadcast = IPv4{255, 255, 255, 255}
+
+// Broadcast returns the directed broadcast address of a's subnet, whose host
+// part is all ones. Subnets with 31- and 32-bit netmasks have no broadcast
+// address (RFC 3021), in which case ok is false.
+func (a IPv4DeviceAddr) Broadcast() (addr IPv4, ok bool) {
+	hostmask := ^(uint32(a.Netmask[0])<<24 | uint32(a.Netmask[1])<<16 | uint32(a.Netmask[2])<<8 | uint32(a.Netmask[3]))
+	if hostmask <= 1 {
+		return IPv4{}, false
+	}
+	for i, b := range a.Addr {
+		addr[i] = b | ^a.Netmask[i]
+	}
+	return addr, true
+}
+
+// isIPv4Broadcast returns true if addr is the limited broadcast address or
+// the directed broadcast address of one of the subnets of addrs.
+func isIPv4Broadcast(addrs []IPv4DeviceAddr, addr IPv4) bool {
+	if addr == IPv4Broadcast {
+		return true
+	}
+	for _, a := range addrs {
+		if b, ok := a.Broadcast(); ok && b == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// An IPv6DeviceAddr is like an IPv4DeviceAddr, but for IPv6.
+type IPv6DeviceAddr struct {
+	Addr, Netmask IPv6
+}
+
+// Subnet returns the subnet to which a belongs.
+func (a IPv6DeviceAddr) Subnet() IPv6Subnet {
+	sub := IPv6Subnet{Netmask: a.Netmask}
+	for i, b := range a.Addr {
+		sub.Addr[i] = b & a.Netmask[i]
+	}
+	return sub
+}
+
+// isIPv6LinkLocal returns true if addr is a unicast
+// link-local address (fe80::/10, RFC 4291 section 2.5.6).
+func isIPv6LinkLocal(addr IPv6) bool {
+	return addr[0] == 0xfe && addr[1]&0xc0 == 0x80
+}
+
+// ipv4Addrs implements the list of IPv4 addresses common to IPv4Device
+// implementations. It performs no synchronization of its own, but the list is
+// never modified in place, so a copy of an ipv4Addrs can be modified without
+// affecting the original.
+type ipv4Addrs struct {
+	addrs    []IPv4DeviceAddr // the first is the primary address
+	callback func()           // called after the addresses change; unset if nil
+}
+
+// primary returns the primary address, if any.
+func (a *ipv4Addrs) primary() (addr, netmask IPv4, ok bool) {
+	if len(a.addrs) == 0 {
+		return IPv4{}, IPv4{}, false
+	}
+	return a.addrs[0].Addr, a.addrs[0].Netmask, true
+}
+
+func (a *ipv4Addrs) list() []IPv4DeviceAddr {
+	return append([]IPv4DeviceAddr(nil), a.addrs...)
+}
+
+// set replaces all of the addresses with addr.
+func (a *ipv4Addrs) set(addr, netmask IPv4) {
+	a.addrs = []IPv4DeviceAddr{{Addr: addr, Netmask: netmask}}
+}
+
+func (a *ipv4Addrs) unset() { a.addrs = nil }
+
+func (a *ipv4Addrs) add(addr, netmask IPv4) error {
+	if addr == (IPv4{}) {
+		return errors.New("add zero IPv4 address")
+	}
+	if hasIPv4Addr(a.addrs, addr) {
+		return errors.Errorf("add IPv4 address: device already has address %v", addr)
+	}
+	a.addrs = append(a.addrs[:len(a.addrs):len(a.addrs)], IPv4DeviceAddr{Addr: addr, Netmask: netmask})
+	return nil
+}
+
+// remove removes addr. If it is the primary address,
+// the next address (if any) becomes the primary address.
+func (a *ipv4Addrs) remove(addr IPv4) error {
+	for i, da := range a.addrs {
+		if da.Addr == addr {
+			a.addrs = append(a.addrs[:i:i], a.addrs[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Errorf("remove IPv4 address: device has no address %v", addr)
+}
+
+// change calls f, which changes the addresses, with mu held. If f succeeds,
+// the callback is then called with mu released, so that it can call methods
+// of the device.
+func (a *ipv4Addrs) change(mu sync.Locker, f func() error) error {
+	mu.Lock()
+	err := f()
+	callback := a.callback
+	mu.Unlock()
+	if err == nil && callback != nil {
+		callback()
+	}
+	return err
+}
+
+func hasIPv4Addr(addrs []IPv4DeviceAddr, addr IPv4) bool {
+	for _, a := range addrs {
+		if a.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// selectIPv4Source returns the address from addrs to use as the source of
+// packets to dsts: the first whose subnet contains the first of dsts, or
+// otherwise the next of dsts, and so on, or else the primary address. When
+// sending through a gateway, dsts are the packet's destination followed by
+// the gateway.
+func selectIPv4Source(addrs []IPv4DeviceAddr, dsts ...IPv4) (IPv4, bool) {
+	if len(addrs) == 0 {
+		return IPv4{}, false
+	}
+	for _, dst := range dsts {
+		for _, a := range addrs {
+			if a.Subnet().Has(dst) {
+				return a.Addr, true
+			}
+		}
+	}
+	return addrs[0].Addr, true
+}
+
+// ipv6Addrs is like ipv4Addrs, but for IPv6.
+type ipv6Addrs struct {
+	addrs    []IPv6DeviceAddr
+	callback func()
+}
+
+func (a *ipv6Addrs) primary() (addr, netmask IPv6, ok bool) {
+	if len(a.addrs) == 0 {
+		return IPv6{}, IPv6{}, false
+	}
+	return a.addrs[0].Addr, a.addrs[0].Netmask, true
+}
+
+func (a *ipv6Addrs) list() []IPv6DeviceAddr {
+	return append([]IPv6DeviceAddr(nil), a.addrs...)
+}
+
+func (a *ipv6Addrs) set(addr, netmask IPv6) {
+	a.addrs = []IPv6DeviceAddr{{Addr: addr, Netmask: netmask}}
+}
+
+func (a *ipv6Addrs) unset() { a.addrs = nil }
+
+func (a *ipv6Addrs) add(addr, netmask IPv6) error {
+	if addr == (IPv6{}) {
+		return errors.New("add zero IPv6 address")
+	}
+	if hasIPv6Addr(a.addrs, addr) {
+		return errors.Errorf("add IPv6 address: device already has address %v", addr)
+	}
+	a.addrs = append(a.addrs[:len(a.addrs):len(a.addrs)], IPv6DeviceAddr{Addr: addr, Netmask: netmask})
+	return nil
+}
+
+func (a *ipv6Addrs) remove(addr IPv6) error {
+	for i, da := range a.addrs {
+		if da.Addr == addr {
+			a.addrs = append(a.addrs[:i:i], a.addrs[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Errorf("remove IPv6 address: device has no address %v", addr)
+}
+
+func (a *ipv6Addrs) change(mu sync.Locker, f func() error) error {
+	mu.Lock()
+	err := f()
+	callback := a.callback
+	mu.Unlock()
+	if err == nil && callback != nil {
+		callback()
+	}
+	return err
+}
+
+func hasIPv6Addr(addrs []IPv6DeviceAddr, addr IPv6) bool {
+	for _, a := range addrs {
+		if a.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// selectIPv6Source is like selectIPv4Source, but for IPv6. Additionally,
+// link-local addresses are only used as the source of packets to link-local
+// destinations, unless there are no other addresses, and vice versa (a
+// simplification of RFC 6724 section 5).
+func selectIPv6Source(addrs []IPv6DeviceAddr, dsts ...IPv6) (IPv6, bool) {
+	if len(addrs) == 0 {
+		return IPv6{}, false
+	}
+	for _, dst := range dsts {
+		for _, a := range addrs {
+			if a.Subnet().Has(dst) {
+				return a.Addr, true
+			}
+		}
+	}
+	// link-local multicast groups are link-local destinations too
+	linkLocal := len(dsts) > 0 && (isIPv6LinkLocal(dsts[0]) || dsts[0][0] == 0xff && dsts[0][1]&0xf == 2)
+	for _, a := range addrs {
+		if isIPv6LinkLocal(a.Addr) == linkLocal {
+			return a.Addr, true
+		}
+	}
+	return addrs[0].Addr, true
+}
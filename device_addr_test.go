@@ -0,0 +1,219 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMultipleAddresses(t *testing.T) {
+	var seg EthernetSegment
+	netmask := IPv4{255, 255, 255, 0}
+	newDev := func(mac byte, addr IPv4) *EthernetDevice {
+		dev, err := NewEthernetDevice(seg.NewInterface(), MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(addr, netmask)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		return dev
+	}
+	subnets := []IPv4Subnet{
+		{Addr: IPv4{10, 0, 0, 0}, Netmask: netmask},
+		{Addr: IPv4{10, 0, 1, 0}, Netmask: netmask},
+	}
+	newHost := func(dev *EthernetDevice) IPv4Host {
+		host := NewIPv4Host()
+		host.AddIPv4Device(dev)
+		for _, sub := range subnets {
+			host.AddIPv4DeviceRoute(sub, dev)
+		}
+		return host
+	}
+
+	adev, bdev := newDev(1, IPv4{10, 0, 0, 1}), newDev(2, IPv4{10, 0, 0, 2})
+	defer adev.BringDown()
+	defer bdev.BringDown()
+	// addresses can be added while the device is up
+	if err := adev.AddIPv4(IPv4{10, 0, 1, 1}, netmask); err != nil {
+		t.Fatalf("unexpected error adding address: %v", err)
+	}
+	if err := adev.AddIPv4(IPv4{10, 0, 1, 1}, netmask); err == nil {
+		t.Errorf("expected error adding duplicate address")
+	}
+	a, b := newHost(adev), newHost(bdev)
+
+	type packet struct{ src, dst IPv4 }
+	c := make(chan packet, 4)
+	b.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { c <- packet{src, dst} }, 200)
+	expect := func(src, dst IPv4) {
+		select {
+		case p := <-c:
+			if p.src != src || p.dst != dst {
+				t.Errorf("got packet from %v to %v; want from %v to %v", p.src, p.dst, src, dst)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for packet to %v", dst)
+		}
+	}
+	expectNone := func() {
+		select {
+		case p := <-c:
+			t.Errorf("unexpected packet from %v to %v", p.src, p.dst)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	write := func(dst IPv4) {
+		if _, err := a.WriteToIPv4([]byte("hello"), dst, 200); err != nil {
+			t.Fatalf("unexpected error writing packet to %v: %v", dst, err)
+		}
+	}
+
+	write(IPv4{10, 0, 0, 2})
+	expect(IPv4{10, 0, 0, 1}, IPv4{10, 0, 0, 2})
+	if err := bdev.AddIPv4(IPv4{10, 0, 1, 2}, netmask); err != nil {
+		t.Fatalf("unexpected error adding address: %v", err)
+	}
+	// the source is the address in the destination's subnet
+	write(IPv4{10, 0, 1, 2})
+	expect(IPv4{10, 0, 1, 1}, IPv4{10, 0, 1, 2})
+
+	// a's ARP entry for 10.0.1.2 is still valid, so the
+	// packet reaches b, which must no longer accept it
+	if err := bdev.RemoveIPv4(IPv4{10, 0, 1, 2}); err != nil {
+		t.Fatalf("unexpected error removing address: %v", err)
+	}
+	if err := bdev.RemoveIPv4(IPv4{10, 0, 1, 2}); err == nil {
+		t.Errorf("expected error removing missing address")
+	}
+	write(IPv4{10, 0, 1, 2})
+	expectNone()
+
+	// removing the primary address promotes the next one
+	if err := adev.RemoveIPv4(IPv4{10, 0, 0, 1}); err != nil {
+		t.Fatalf("unexpected error removing address: %v", err)
+	}
+	if addr, _, _ := adev.IPv4(); addr != (IPv4{10, 0, 1, 1}) {
+		t.Errorf("got primary address %v; want 10.0.1.1", addr)
+	}
+	write(IPv4{10, 0, 0, 2})
+	expect(IPv4{10, 0, 1, 1}, IPv4{10, 0, 0, 2})
+}
+
+func TestSelectIPv6Source(t *testing.T) {
+	mask64 := IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	linkLocal := IPv6{0xfe, 0x80, 15: 1}
+	global := IPv6{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+	other := IPv6{0x20, 0x01, 0x0d, 0xb8, 1, 15: 1}
+	addrs := []IPv6DeviceAddr{{Addr: linkLocal, Netmask: mask64}, {Addr: global, Netmask: mask64}}
+
+	for _, c := range []struct {
+		dsts []IPv6
+		src  IPv6
+	}{
+		{[]IPv6{{0xfe, 0x80, 15: 2}}, linkLocal},
+		{[]IPv6{{0x20, 0x01, 0x0d, 0xb8, 15: 2}}, global},
+		// not on-link, so prefer the address with the same scope
+		{[]IPv6{other}, global},
+		// through an on-link, link-local gateway
+		{[]IPv6{other, {0xfe, 0x80, 15: 2}}, linkLocal},
+	} {
+		if src, ok := selectIPv6Source(addrs, c.dsts...); !ok || src != c.src {
+			t.Errorf("selectIPv6Source(%v) = %v, %v; want %v", c.dsts, src, ok, c.src)
+		}
+	}
+	if _, ok := selectIPv6Source(nil, global); ok {
+		t.Errorf("selectIPv6Source with no addresses succeeded")
+	}
+}
+
+func TestIPv4Broadcast(t *testing.T) {
+	// host 10.0.0.1 is connected to a router, 10.0.0.2, and a neighbor,
+	// 10.0.0.3; the router is also connected to 10.0.1.2 on 10.0.1.0/24
+	var lan, wan EthernetSegment
+	netmask := IPv4{255, 255, 255, 0}
+	newDev := func(seg *EthernetSegment, mac byte, addr IPv4) *EthernetDevice {
+		dev, err := NewEthernetDevice(seg.NewInterface(), MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(addr, netmask)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		return dev
+	}
+	lanSubnet := IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: netmask}
+	wanSubnet := IPv4Subnet{Addr: IPv4{10, 0, 1, 0}, Netmask: netmask}
+	devs := []*EthernetDevice{newDev(&lan, 1, IPv4{10, 0, 0, 1}), newDev(&lan, 2, IPv4{10, 0, 0, 2}),
+		newDev(&wan, 3, IPv4{10, 0, 1, 1}), newDev(&wan, 4, IPv4{10, 0, 1, 2}), newDev(&lan, 5, IPv4{10, 0, 0, 3})}
+	for _, dev := range devs {
+		defer dev.BringDown()
+	}
+
+	host := NewIPv4Host()
+	host.AddIPv4Device(devs[0])
+	host.AddIPv4DeviceRoute(lanSubnet, devs[0])
+	host.AddIPv4Route(IPv4Subnet{}, IPv4{10, 0, 0, 2})
+	router := NewIPv4Host()
+	router.SetForwarding(true)
+	router.AddIPv4Device(devs[1])
+	router.AddIPv4Device(devs[2])
+	router.AddIPv4DeviceRoute(lanSubnet, devs[1])
+	router.AddIPv4DeviceRoute(wanSubnet, devs[2])
+	remote := NewIPv4Host()
+	remote.AddIPv4Device(devs[3])
+	remote.AddIPv4DeviceRoute(wanSubnet, devs[3])
+	neighbor := NewIPv4Host()
+	neighbor.AddIPv4Device(devs[4])
+	neighbor.AddIPv4DeviceRoute(lanSubnet, devs[4])
+
+	routerc, remotec, neighborc := make(chan IPv4, 4), make(chan IPv4, 4), make(chan IPv4, 4)
+	router.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { routerc <- dst }, 200)
+	remote.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { remotec <- dst }, 200)
+	neighbor.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { neighborc <- dst }, 200)
+	expect := func(c chan IPv4, name string, dst IPv4) {
+		select {
+		case got := <-c:
+			if got != dst {
+				t.Errorf("%v got packet to %v; want %v", name, got, dst)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v timed out waiting for packet to %v", name, dst)
+		}
+	}
+	expectNone := func(c chan IPv4, name string) {
+		select {
+		case got := <-c:
+			t.Errorf("%v got unexpected packet to %v", name, got)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	write := func(dst IPv4) {
+		if _, err := host.WriteToIPv4([]byte("hello"), dst, 200); err != nil {
+			t.Fatalf("unexpected error writing packet to %v: %v", dst, err)
+		}
+	}
+
+	// limited broadcasts aren't sent to the default gateway, and
+	// aren't forwarded
+	write(IPv4Broadcast)
+	expect(routerc, "router", IPv4Broadcast)
+	expect(neighborc, "neighbor", IPv4Broadcast)
+	expectNone(remotec, "remote host")
+	write(IPv4{10, 0, 0, 255})
+	expect(routerc, "router", IPv4{10, 0, 0, 255})
+	expect(neighborc, "neighbor", IPv4{10, 0, 0, 255})
+	expectNone(remotec, "remote host")
+
+	// directed broadcasts are received, but only
+	// forwarded if the router is configured to
+	write(IPv4{10, 0, 1, 255})
+	expect(routerc, "router", IPv4{10, 0, 1, 255})
+	expectNone(remotec, "remote host")
+	router.SetDirectedBroadcastForwarding(true)
+	write(IPv4{10, 0, 1, 255})
+	expect(routerc, "router", IPv4{10, 0, 1, 255})
+	expect(remotec, "remote host", IPv4{10, 0, 1, 255})
+}
@@ -39,12 +39,30 @@ type EthernetInterface interface {
 	// Ethernet frames will be dropped.
 	//
 	// If the interface has its MAC set, only Ethernet frames
-	// whose destination MAC is equal to the interface's MAC or
-	// is the broadcast MAC will be returned.
+	// whose destination MAC is equal to the interface's MAC,
+	// is the broadcast MAC, or is a multicast MAC which has been
+	// added using AddMulticastMAC will be returned.
+	//
+	// Frames with an IEEE 802.1Q tag are returned with the EtherType
+	// EtherTypeVLAN, and b begins with the tag's two-byte tag control
+	// information (TCI) followed by the encapsulated EtherType. Their
+	// payloads may be as long as the MTU plus the four bytes of the tag.
 	//
 	// RegisterCallback can only be called while the interface
 	// is down.
 	RegisterCallback(f func(b []byte, src, dst MAC, et EtherType))
+	// AddMulticastMAC adds mac to the set of multicast MACs for
+	// which incoming frames are delivered. It is an error to call
+	// AddMulticastMAC with a MAC which is not a multicast MAC (see
+	// MAC.IsMulticast). Adding a MAC which is already in the set
+	// is a no-op. AddMulticastMAC may be called while the interface
+	// is up.
+	AddMulticastMAC(mac MAC) error
+	// RemoveMulticastMAC removes mac from the set of multicast MACs
+	// for which incoming frames are delivered. Removing a MAC which
+	// is not in the set is a no-op. RemoveMulticastMAC may be called
+	// while the interface is up.
+	RemoveMulticastMAC(mac MAC) error
 	// WriteFrame writes an Ethernet frame with the payload b.
 	// b is expected to contain space preceding the payload itself
 	// for the Ethernet header, which WriteFrame is responsible
@@ -53,6 +71,11 @@ type EthernetInterface interface {
 	// the frame will not be written, and instead WriteFrame will
 	// return an MTU error (see IsMTU).
 	//
+	// If et is EtherTypeVLAN, the payload must begin with an IEEE
+	// 802.1Q tag's TCI and the encapsulated EtherType, just as in
+	// frames passed to the callback (see RegisterCallback). The tag
+	// does not count towards the MTU.
+	//
 	// If the destination MAC is the broadcast MAC, the frame will
 	// be broadcast to all devices on the local Ethernet network.
 	//
@@ -71,6 +94,7 @@ type EtherType uint16
 const (
 	EtherTypeIPv4 EtherType = 0x0800
 	EtherTypeARP  EtherType = 0x0806
+	EtherTypeVLAN EtherType = 0x8100 // IEEE 802.1Q tag
 	EtherTypeIPv6 EtherType = 0x86DD
 )
 
@@ -80,33 +104,94 @@ type MAC [6]byte
 // BroadcastMAC is the broadcast MAC address.
 var BroadcastMAC = MAC{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 
+// IsMulticast returns true if m is a multicast MAC - that is, if the
+// individual/group bit is set. Note that the broadcast MAC is also
+// a multicast MAC.
+func (m MAC) IsMulticast() bool { return m[0]&1 == 1 }
+
+// macFilter implements the MAC address and multicast MAC set common
+// to EthernetInterface implementations, and decides which incoming
+// frames are delivered (see EthernetInterface's RegisterCallback).
+// It performs no synchronization of its own.
+type macFilter struct {
+	mac       MAC
+	macSet    bool
+	multicast map[MAC]bool // make sure to check if nil before modifying
+}
+
+func (f *macFilter) setMAC(mac MAC) error {
+	if mac.IsMulticast() {
+		return errors.New("set interface MAC: multicast MAC")
+	}
+	f.mac, f.macSet = mac, true
+	return nil
+}
+
+func (f *macFilter) addMulticastMAC(mac MAC) error {
+	if !mac.IsMulticast() {
+		return errors.New("add multicast MAC: not a multicast MAC")
+	}
+	if f.multicast == nil {
+		f.multicast = make(map[MAC]bool)
+	}
+	f.multicast[mac] = true
+	return nil
+}
+
+func (f *macFilter) removeMulticastMAC(mac MAC) {
+	delete(f.multicast, mac)
+}
+
+// accepts returns true if frames sent to dst should be delivered.
+func (f *macFilter) accepts(dst MAC) bool {
+	return !f.macSet || dst == f.mac || dst == BroadcastMAC || f.multicast[dst]
+}
+
+// frame is an Ethernet frame waiting to be written. Protocols which
+// generate frames while holding a lock collect them and write them
+// using writeFrames once the lock has been released, since writing
+// a frame may synchronously cause a frame to be delivered back to
+// the writer.
+type frame struct {
+	b   []byte // includes space for the Ethernet header
+	dst MAC
+	et  EtherType
+}
+
+func writeFrames(iface EthernetInterface, frames []frame) {
+	for _, f := range frames {
+		iface.WriteFrame(f.b, f.dst, f.et)
+		// TODO(joshlf): Log error
+	}
+}
+
 // An EthernetDevice is a device which uses an EthernetInterface
 // as its underlying frame transport mechanism. It implements
 // the Device interface.
 type EthernetDevice struct {
-	iface EthernetInterface
-	up    bool
-	// arp                  *arp         // nil if the device is down
-	addr4, netmask4      IPv4
-	addr6, netmask6      IPv6
-	addr4Set, addr6Set   bool
-	callback4, callback6 func([]byte) // unset if nil
-
-	// ipv4, ipv6 chan []byte // nil if the device is down
-
-	// readDeadline atomic.Value // stores a time.Time value
+	iface                EthernetInterface
+	mac                  MAC
+	up                   bool
+	arp                  *arp // nil if the device is down or has no IPv4 addresses
+	ndp                  *ndp // nil if the device is down or has no IPv6 addresses
+	addrs4               ipv4Addrs
+	addrs6               ipv6Addrs
+	groups4              map[IPv4]bool // joined multicast groups; check if nil before modifying
+	groups6              map[IPv6]bool // joined multicast groups; check if nil before modifying
+	mcast                map[MAC]int   // number of uses of each multicast MAC; see refMACs
+	callback4, callback6 func([]byte)  // unset if nil
 
 	// Acquire a read lock for all operations.
 	// Acquire a write lock to bring the device
-	// up or down. When bringing the device down,
-	// close the down channel and wg.Wait(). Then
-	// arp.Stop() and set arp, ipv4, ipv6 to nil.
-	// When bringing the device up, initialize
-	// ipv4, ipv6, down, wg, and arp, then spawn
-	// worker goroutines.
-	// down chan struct{}
-	// wg   sync.WaitGroup
-	mu sync.RWMutex
+	// up or down or to change its addresses or
+	// multicast groups.
+	// When bringing the device down, arp.Stop()
+	// and ndp.Stop(), and set arp and ndp to nil.
+	// When bringing the device up, initialize arp
+	// if it has IPv4 addresses, and ndp if it has
+	// IPv6 addresses.
+	mu     sync.RWMutex
+	upLock sync.Mutex // held while bringing the device up or down
 }
 
 var _ Device = &EthernetDevice{}     // make sure *EthernetDevice implements Device
@@ -126,6 +211,8 @@ func NewEthernetDevice(iface EthernetInterface, addr MAC) (*EthernetDevice, erro
 	}
 	dev := &EthernetDevice{
 		iface: iface,
+		mac:   addr,
+		mcast: make(map[MAC]int),
 	}
 	iface.RegisterCallback(dev.callback)
 	return dev, nil
@@ -140,12 +227,20 @@ func (dev *EthernetDevice) callback(b []byte, src, dst MAC, et EtherType) {
 
 	switch et {
 	case EtherTypeARP:
-		// TODO(joshlf): Implement ARP
+		if dev.arp != nil {
+			dev.arp.HandlePacket(src, dst, b)
+			// TODO(joshlf): Log error
+		}
 	case EtherTypeIPv4:
 		if dev.callback4 != nil {
 			dev.callback4(b)
 		}
 	case EtherTypeIPv6:
+		if dev.ndp != nil && isNDPPacket(b) {
+			dev.ndp.HandlePacket(src, dst, b)
+			// TODO(joshlf): Log error
+			return
+		}
 		if dev.callback6 != nil {
 			dev.callback6(b)
 		}
@@ -166,99 +261,380 @@ func (dev *EthernetDevice) RegisterIPv6Callback(f func(b []byte)) {
 	dev.mu.Unlock()
 }
 
-// IPv4 returns dev's IPv4 address and network mask if they have been set.
+// IPv4 returns dev's primary IPv4 address and network mask if it has any
+// addresses.
 func (dev *EthernetDevice) IPv4() (addr, netmask IPv4, ok bool) {
 	dev.mu.RLock()
-	addr, netmask, ok = dev.addr4, dev.netmask4, dev.addr4Set
+	addr, netmask, ok = dev.addrs4.primary()
 	dev.mu.RUnlock()
 	return addr, netmask, ok
 }
 
-// SetIPv4 sets dev's IPv4 address and network mask, returning any error
-// encountered. SetIPv4 can only be called when dev is down.
+// SetIPv4 replaces dev's IPv4 addresses with the given address and network
+// mask, returning any error encountered. SetIPv4 can only be called when dev
+// is down.
 func (dev *EthernetDevice) SetIPv4(addr, netmask IPv4) error {
-	dev.mu.Lock()
-	defer dev.mu.Unlock()
-	if dev.isUp() {
-		return errors.New("set device IP address on up device")
-	}
-	dev.addr4, dev.netmask4, dev.addr4Set = addr, netmask, true
-	return nil
+	return dev.addrs4.change(&dev.mu, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		next := dev.addrs4
+		next.set(addr, netmask)
+		return dev.setIPv4Addrs(next)
+	})
 }
 
-// UnsetIPv4 unsets dev's IPv4 address and network mask, returning any error
+// UnsetIPv4 removes all of dev's IPv4 addresses, returning any error
 // encountered. UnsetIPv4 can only be called when dev is down.
 func (dev *EthernetDevice) UnsetIPv4() error {
+	return dev.addrs4.change(&dev.mu, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		next := dev.addrs4
+		next.unset()
+		return dev.setIPv4Addrs(next)
+	})
+}
+
+// IPv4Addrs returns all of dev's IPv4 addresses, starting with the primary
+// address.
+func (dev *EthernetDevice) IPv4Addrs() []IPv4DeviceAddr {
+	dev.mu.RLock()
+	defer dev.mu.RUnlock()
+	return dev.addrs4.list()
+}
+
+// AddIPv4 implements IPv4Device's AddIPv4.
+func (dev *EthernetDevice) AddIPv4(addr, netmask IPv4) error {
+	return dev.addrs4.change(&dev.mu, func() error {
+		next := dev.addrs4
+		if err := next.add(addr, netmask); err != nil {
+			return err
+		}
+		return dev.setIPv4Addrs(next)
+	})
+}
+
+// RemoveIPv4 implements IPv4Device's RemoveIPv4.
+func (dev *EthernetDevice) RemoveIPv4(addr IPv4) error {
+	return dev.addrs4.change(&dev.mu, func() error {
+		next := dev.addrs4
+		if err := next.remove(addr); err != nil {
+			return err
+		}
+		return dev.setIPv4Addrs(next)
+	})
+}
+
+// RegisterIPv4AddrCallback implements IPv4Device's RegisterIPv4AddrCallback.
+func (dev *EthernetDevice) RegisterIPv4AddrCallback(f func()) {
 	dev.mu.Lock()
-	defer dev.mu.Unlock()
-	if dev.isUp() {
-		return errors.New("unset device IP address on up device")
-	}
-	dev.addr4, dev.netmask4, dev.addr4Set = IPv4{}, IPv4{}, false
-	return nil
+	dev.addrs4.callback = f
+	dev.mu.Unlock()
 }
 
-// IPv6 returns dev's IPv6 address and network mask if they have been set.
+// IPv6 returns dev's primary IPv6 address and network mask if it has any
+// addresses.
 func (dev *EthernetDevice) IPv6() (addr, netmask IPv6, ok bool) {
 	dev.mu.RLock()
-	addr, netmask, ok = dev.addr6, dev.netmask6, dev.addr6Set
+	addr, netmask, ok = dev.addrs6.primary()
 	dev.mu.RUnlock()
 	return addr, netmask, ok
 }
 
-// SetIPv6 sets dev's IPv6 address and network mask, returning any error
-// encountered. SetIPv6 can only be called when dev is down.
+// SetIPv6 replaces dev's IPv6 addresses with the given address and network
+// mask, returning any error encountered. SetIPv6 can only be called when dev
+// is down.
 func (dev *EthernetDevice) SetIPv6(addr, netmask IPv6) error {
+	return dev.addrs6.change(&dev.mu, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		next := dev.addrs6
+		next.set(addr, netmask)
+		return dev.setIPv6Addrs(next)
+	})
+}
+
+// UnsetIPv6 removes all of dev's IPv6 addresses, returning any error
+// encountered. UnsetIPv6 can only be called when dev is down.
+func (dev *EthernetDevice) UnsetIPv6() error {
+	return dev.addrs6.change(&dev.mu, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		next := dev.addrs6
+		next.unset()
+		return dev.setIPv6Addrs(next)
+	})
+}
+
+// IPv6Addrs returns all of dev's IPv6 addresses, starting with the primary
+// address.
+func (dev *EthernetDevice) IPv6Addrs() []IPv6DeviceAddr {
+	dev.mu.RLock()
+	defer dev.mu.RUnlock()
+	return dev.addrs6.list()
+}
+
+// AddIPv6 implements IPv6Device's AddIPv6.
+func (dev *EthernetDevice) AddIPv6(addr, netmask IPv6) error {
+	return dev.addrs6.change(&dev.mu, func() error {
+		next := dev.addrs6
+		if err := next.add(addr, netmask); err != nil {
+			return err
+		}
+		return dev.setIPv6Addrs(next)
+	})
+}
+
+// RemoveIPv6 implements IPv6Device's RemoveIPv6.
+func (dev *EthernetDevice) RemoveIPv6(addr IPv6) error {
+	return dev.addrs6.change(&dev.mu, func() error {
+		next := dev.addrs6
+		if err := next.remove(addr); err != nil {
+			return err
+		}
+		return dev.setIPv6Addrs(next)
+	})
+}
+
+// RegisterIPv6AddrCallback implements IPv6Device's RegisterIPv6AddrCallback.
+func (dev *EthernetDevice) RegisterIPv6AddrCallback(f func()) {
 	dev.mu.Lock()
-	defer dev.mu.Unlock()
+	dev.addrs6.callback = f
+	dev.mu.Unlock()
+}
+
+// setIPv4Addrs replaces dev's IPv4 addresses with those in a, updating
+// dev.arp if dev is up, and the multicast MACs on which frames are
+// received. dev.mu must be held.
+func (dev *EthernetDevice) setIPv4Addrs(a ipv4Addrs) error {
+	old, new := ipv4AddrMACs(dev.addrs4.addrs), ipv4AddrMACs(a.addrs)
+	if err := dev.refMACs(new); err != nil {
+		return errors.Annotate(err, "set device IPv4 addresses")
+	}
+	dev.unrefMACs(old)
 	if dev.isUp() {
-		return errors.New("set device IP address on up device")
+		switch {
+		case len(a.addrs) == 0 && dev.arp != nil:
+			dev.arp.Stop()
+			dev.arp = nil
+		case len(a.addrs) > 0 && dev.arp == nil:
+			dev.arp = newARP(dev.iface, dev.mac, a.addrs)
+		case dev.arp != nil:
+			dev.arp.SetAddrs(a.addrs)
+		}
 	}
-	dev.addr6, dev.netmask6, dev.addr4Set = addr, netmask, true
+	dev.addrs4 = a
 	return nil
 }
 
-// UnsetIPv6 unsets dev's IPv6 address and network mask, returning any error
-// encountered. UnsetIPv4 can only be called when dev is down.
-func (dev *EthernetDevice) UnsetIPv6() error {
+// setIPv6Addrs replaces dev's IPv6 addresses with those in a, updating
+// dev.ndp if dev is up, and the multicast MACs on which frames are
+// received. dev.mu must be held.
+func (dev *EthernetDevice) setIPv6Addrs(a ipv6Addrs) error {
+	old, new := ndpMulticastMACs(dev.addrs6.addrs), ndpMulticastMACs(a.addrs)
+	if err := dev.refMACs(new); err != nil {
+		return errors.Annotate(err, "set device IPv6 addresses")
+	}
+	dev.unrefMACs(old)
+	if dev.isUp() {
+		switch {
+		case len(a.addrs) == 0 && dev.ndp != nil:
+			dev.ndp.Stop()
+			dev.ndp = nil
+		case len(a.addrs) > 0 && dev.ndp == nil:
+			dev.ndp = newNDP(dev.iface, dev.mac, a.addrs)
+		case dev.ndp != nil:
+			dev.ndp.SetAddrs(a.addrs)
+		}
+	}
+	dev.addrs6 = a
+	return nil
+}
+
+// JoinIPv4Group implements IPv4Device's JoinIPv4Group by adding the
+// multicast MAC to which addr is mapped to the interface's filter.
+func (dev *EthernetDevice) JoinIPv4Group(addr IPv4) error {
+	if err := checkIPv4Group(addr); err != nil {
+		return errors.Annotate(err, "join IPv4 group")
+	}
 	dev.mu.Lock()
 	defer dev.mu.Unlock()
-	if dev.isUp() {
-		return errors.New("unset device IP address on up device")
+	if dev.groups4[addr] {
+		return nil
+	}
+	if err := dev.refMACs([]MAC{ipv4MulticastMAC(addr)}); err != nil {
+		return errors.Annotate(err, "join IPv4 group")
+	}
+	if dev.groups4 == nil {
+		dev.groups4 = make(map[IPv4]bool)
+	}
+	dev.groups4[addr] = true
+	return nil
+}
+
+// LeaveIPv4Group implements IPv4Device's LeaveIPv4Group.
+func (dev *EthernetDevice) LeaveIPv4Group(addr IPv4) error {
+	if err := checkIPv4Group(addr); err != nil {
+		return errors.Annotate(err, "leave IPv4 group")
+	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.groups4[addr] {
+		delete(dev.groups4, addr)
+		dev.unrefMACs([]MAC{ipv4MulticastMAC(addr)})
 	}
-	dev.addr6, dev.netmask6, dev.addr6Set = IPv6{}, IPv6{}, false
 	return nil
 }
 
+// JoinIPv6Group implements IPv6Device's JoinIPv6Group by adding the
+// multicast MAC to which addr is mapped to the interface's filter.
+func (dev *EthernetDevice) JoinIPv6Group(addr IPv6) error {
+	if err := checkIPv6Group(addr); err != nil {
+		return errors.Annotate(err, "join IPv6 group")
+	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.groups6[addr] {
+		return nil
+	}
+	if err := dev.refMACs([]MAC{ipv6MulticastMAC(addr)}); err != nil {
+		return errors.Annotate(err, "join IPv6 group")
+	}
+	if dev.groups6 == nil {
+		dev.groups6 = make(map[IPv6]bool)
+	}
+	dev.groups6[addr] = true
+	return nil
+}
+
+// LeaveIPv6Group implements IPv6Device's LeaveIPv6Group.
+func (dev *EthernetDevice) LeaveIPv6Group(addr IPv6) error {
+	if err := checkIPv6Group(addr); err != nil {
+		return errors.Annotate(err, "leave IPv6 group")
+	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.groups6[addr] {
+		delete(dev.groups6, addr)
+		dev.unrefMACs([]MAC{ipv6MulticastMAC(addr)})
+	}
+	return nil
+}
+
+// refMACs adds a use of each of macs. Since several groups, as well as ARP
+// and NDP, can need the same multicast MAC, dev.mcast counts the uses of
+// each, and a MAC is only in the interface's filter while it has any uses
+// and dev is up. If adding a MAC to the filter fails, no uses are added.
+// dev.mu must be held.
+func (dev *EthernetDevice) refMACs(macs []MAC) error {
+	for i, mac := range macs {
+		if dev.mcast[mac] == 0 && dev.isUp() {
+			if err := dev.iface.AddMulticastMAC(mac); err != nil {
+				dev.unrefMACs(macs[:i])
+				return err
+			}
+		}
+		dev.mcast[mac]++
+	}
+	return nil
+}
+
+// unrefMACs removes a use of each of macs. dev.mu must be held.
+func (dev *EthernetDevice) unrefMACs(macs []MAC) {
+	for _, mac := range macs {
+		dev.mcast[mac]--
+		if dev.mcast[mac] > 0 {
+			continue
+		}
+		delete(dev.mcast, mac)
+		if dev.isUp() {
+			dev.iface.RemoveMulticastMAC(mac)
+			// TODO(joshlf): Log error
+		}
+	}
+}
+
+// ipv4AddrMACs returns the multicast MACs on which a device with the given
+// IPv4 addresses needs to receive frames: that of the all-systems group, if
+// there are any addresses.
+func ipv4AddrMACs(addrs []IPv4DeviceAddr) []MAC {
+	if len(addrs) == 0 {
+		return nil
+	}
+	return []MAC{ipv4MulticastMAC(ipv4AllSystems)}
+}
+
 // BringUp brings dev up. If it is already up, BringUp is a no-op.
 func (dev *EthernetDevice) BringUp() error {
+	dev.upLock.Lock()
+	defer dev.upLock.Unlock()
 	dev.mu.Lock()
 	defer dev.mu.Unlock()
 	if dev.isUp() {
 		return nil
 	}
 
+	for mac := range dev.mcast {
+		err := dev.iface.AddMulticastMAC(mac)
+		if err != nil {
+			return errors.Annotate(err, "bring device up")
+		}
+	}
 	err := dev.iface.BringUp()
 	if err != nil {
-		errors.Annotate(err, "bring device up")
+		return errors.Annotate(err, "bring device up")
+	}
+	if len(dev.addrs4.addrs) > 0 {
+		dev.arp = newARP(dev.iface, dev.mac, dev.addrs4.addrs)
+	}
+	if len(dev.addrs6.addrs) > 0 {
+		dev.ndp = newNDP(dev.iface, dev.mac, dev.addrs6.addrs)
 	}
 	dev.up = true
 	return nil
 }
 
-// BringDown brings dev down. If it is already up, BringDown is a no-op.
+// BringDown brings dev down. If it is already up, BringDown is a no-op. If
+// the underlying interface can't be brought down, dev remains up.
 func (dev *EthernetDevice) BringDown() error {
-	dev.mu.Lock()
-	defer dev.mu.Unlock()
-	if !dev.isUp() {
+	dev.upLock.Lock()
+	defer dev.upLock.Unlock()
+	if !dev.IsUp() {
 		return nil
 	}
 
+	// NOTE(joshlf): Don't hold dev.mu while bringing the interface
+	// down, since that may wait for in-progress calls to the callback,
+	// which acquire dev.mu. Holding dev.upLock guarantees that dev
+	// remains up in the meantime.
 	err := dev.iface.BringDown()
 	if err != nil {
 		return errors.Annotate(err, "bring device down")
 	}
+
+	dev.mu.Lock()
+	arp, ndp := dev.arp, dev.ndp
+	var macs []MAC
+	for mac := range dev.mcast {
+		macs = append(macs, mac)
+	}
+	dev.arp, dev.ndp = nil, nil
 	dev.up = false
+	dev.mu.Unlock()
+
+	if arp != nil {
+		arp.Stop()
+	}
+	if ndp != nil {
+		ndp.Stop()
+	}
+	for _, mac := range macs {
+		dev.iface.RemoveMulticastMAC(mac)
+	}
 	return nil
 }
 
@@ -282,42 +658,50 @@ func (dev *EthernetDevice) MTU() int {
 	return mtu
 }
 
+// WriteToIPv4 writes the IPv4 packet b in an Ethernet frame to the neighbor
+// with the IPv4 address dst, resolving its MAC address using ARP. If dst has
+// not yet been resolved, the frame is queued until it is, and WriteToIPv4
+// returns without error. If resolution of dst has recently failed, WriteToIPv4
+// returns a host unreachable error (see IsHostUnreachable). If dst is the
+// limited broadcast address or the broadcast address of one of dev's subnets,
+// the frame is sent to the broadcast MAC, and if it is a multicast address, to
+// the multicast MAC to which it is mapped.
 func (dev *EthernetDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
 	dev.mu.RLock()
 	defer dev.mu.RUnlock()
 	if !dev.isUp() {
 		return 0, errors.New("write to down device")
 	}
-
-	buf := make([]byte, ethernetHeaderLen+len(b))
-	copy(buf[ethernetHeaderLen:], b)
-	var mac MAC // TODO(joshlf): Look it up in ARP
-	if err != nil {
-		return 0, errors.Annotate(err, "write to device")
+	if dev.arp == nil {
+		return 0, errors.New("write to device with no IPv4 address")
 	}
-	return dev.writeTo(buf, mac)
+	return dev.writeTo(b, func(frame []byte) (int, error) { return dev.arp.WriteIPv4(frame, dst) })
 }
 
+// WriteToIPv6 writes the IPv6 packet b in an Ethernet frame to the neighbor
+// with the IPv6 address dst, resolving its MAC address using Neighbor
+// Discovery. If dst has not yet been resolved, the frame is queued until it
+// is, and WriteToIPv6 returns without error. If resolution of dst has recently
+// failed, WriteToIPv6 returns a host unreachable error (see IsHostUnreachable).
 func (dev *EthernetDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
 	dev.mu.RLock()
 	defer dev.mu.RUnlock()
 	if !dev.isUp() {
 		return 0, errors.New("write to down device")
 	}
-
-	buf := make([]byte, ethernetHeaderLen+len(b))
-	copy(buf[ethernetHeaderLen:], b)
-	var mac MAC // TODO(joshlf): Look it up
-	if err != nil {
-		return 0, errors.Annotate(err, "write to device")
+	if dev.ndp == nil {
+		return 0, errors.New("write to device with no IPv6 address")
 	}
-	return dev.writeTo(buf, mac)
+	return dev.writeTo(b, func(frame []byte) (int, error) { return dev.ndp.WriteIPv6(frame, dst) })
 }
 
-// writeTo implements logic common to WriteToIPv4 and WriteToIPv6;
-// it writes to the given MAC address and returns the correct values
-func (dev *EthernetDevice) writeTo(b []byte, mac MAC) (n int, err error) {
-	n, err = dev.iface.WriteFrame(b, mac, EtherTypeIPv4)
+// writeTo implements logic common to WriteToIPv4 and WriteToIPv6; it copies
+// b into a new frame with room for the Ethernet header, writes the frame using
+// write, and returns the correct values
+func (dev *EthernetDevice) writeTo(b []byte, write func(frame []byte) (int, error)) (n int, err error) {
+	buf := make([]byte, ethernetHeaderLen+len(b))
+	copy(buf[ethernetHeaderLen:], b)
+	n, err = write(buf)
 	if n < ethernetHeaderLen {
 		n = 0
 	} else {
@@ -36,7 +36,7 @@ func (e ethernetHeader) Has8021Q() bool {
 // Returns the priority code point (3 bits).
 // Assumes e.Has8021Q() == true.
 func (e ethernetHeader) PCP() uint8 {
-	return uint8((e.ieee8021Q >> 13) & 3)
+	return uint8((e.ieee8021Q >> 13) & 7)
 }
 
 // Returns the drop eligible indicator (1 bit).
@@ -51,6 +51,28 @@ func (e ethernetHeader) VID() uint16 {
 	return uint16(e.ieee8021Q & 0xFFF)
 }
 
+// Returns the EtherType of the outermost header: EtherTypeVLAN
+// if e.Has8021Q() == true, and e.et otherwise. This is the EtherType
+// with which frames are passed to an EthernetInterface's callback.
+func (e ethernetHeader) OuterEtherType() EtherType {
+	if e.Has8021Q() {
+		return EtherTypeVLAN
+	}
+	return e.et
+}
+
+// frameHeaderLen returns the length of the header of a frame with the
+// EtherType et as it is passed to an EthernetInterface's WriteFrame. The
+// IEEE 802.1Q tag of a frame with the EtherType EtherTypeVLAN is stored
+// at the beginning of the payload, but is considered part of the header
+// for the purposes of the MTU.
+func frameHeaderLen(et EtherType) int {
+	if et == EtherTypeVLAN {
+		return ethernetHeaderLen8021
+	}
+	return ethernetHeaderLen
+}
+
 func parseEthernetHeader(b []byte) (eh ethernetHeader, err error) {
 	// we use getByte and getBytes to consume b;
 	// they panic with an appropriate error if b
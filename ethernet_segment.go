@@ -0,0 +1,222 @@
+package net
+
+import (
+	"sync"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// number of frames which may be queued for delivery to a single
+// segment interface; when full, further frames are dropped
+const segmentQueueLen = 256
+
+// An EthernetSegment is an in-memory Ethernet segment. It hands out any
+// number of EthernetInterfaces, all of which are attached to the segment.
+// A frame written to one interface is delivered to every other interface
+// which is up and whose MAC filter (see EthernetInterface's RegisterCallback)
+// accepts the frame's destination. An interface with no MAC set receives all
+// frames.
+//
+// Frames are delivered asynchronously, so callbacks are never called from
+// within WriteFrame or WriteFrameSrc. If a receiving interface's queue is
+// full, or if the frame's payload exceeds the receiving interface's MTU, the
+// frame is dropped.
+//
+// The zero value EthernetSegment is a valid EthernetSegment with no
+// interfaces. EthernetSegments are safe for concurrent access.
+type EthernetSegment struct {
+	ifaces []*segmentInterface
+	mu     sync.RWMutex
+}
+
+// NewInterface creates a new EthernetInterface attached to s. The returned
+// interface is down, and has no MAC or MTU set.
+func (s *EthernetSegment) NewInterface() EthernetInterface {
+	iface := &segmentInterface{seg: s}
+	s.mu.Lock()
+	s.ifaces = append(s.ifaces, iface)
+	s.mu.Unlock()
+	return iface
+}
+
+// deliver delivers the frame b, whose Ethernet header has already been
+// written, to all interfaces other than from.
+func (s *EthernetSegment) deliver(from *segmentInterface, b []byte, dst MAC) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, iface := range s.ifaces {
+		if iface != from {
+			iface.enqueue(b, dst)
+		}
+	}
+}
+
+type segmentInterface struct {
+	seg      *EthernetSegment
+	mtu      int
+	callback func(b []byte, src, dst MAC, et EtherType) // unset if nil
+	frames   chan []byte                                // nil if down
+	macFilter
+
+	sync syncer
+}
+
+var _ EthernetInterface = &segmentInterface{} // make sure *segmentInterface implements EthernetInterface
+
+func (iface *segmentInterface) BringUp() error {
+	return iface.sync.BringUp(func() error {
+		iface.sync.Lock()
+		iface.frames = make(chan []byte, segmentQueueLen)
+		iface.sync.Unlock()
+		return nil
+	}, iface.readDaemon)
+}
+
+func (iface *segmentInterface) BringDown() error {
+	return iface.sync.BringDown(func() error {
+		iface.sync.Lock()
+		iface.frames = nil
+		iface.sync.Unlock()
+		return nil
+	})
+}
+
+func (iface *segmentInterface) IsUp() bool {
+	iface.sync.RLock()
+	up := iface.isUp()
+	iface.sync.RUnlock()
+	return up
+}
+
+func (iface *segmentInterface) isUp() bool {
+	return iface.frames != nil
+}
+
+func (iface *segmentInterface) MAC() (ok bool, mac MAC) {
+	iface.sync.RLock()
+	ok, mac = iface.macSet, iface.mac
+	iface.sync.RUnlock()
+	return ok, mac
+}
+
+func (iface *segmentInterface) SetMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MAC on up interface")
+	}
+	return iface.setMAC(mac)
+}
+
+func (iface *segmentInterface) MTU() int {
+	iface.sync.RLock()
+	mtu := iface.mtu
+	iface.sync.RUnlock()
+	return mtu
+}
+
+func (iface *segmentInterface) SetMTU(mtu uint64) error {
+	if mtu == 0 {
+		return errors.New("set interface MTU: zero MTU")
+	}
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MTU on up interface")
+	}
+	iface.mtu = int(mtu)
+	return nil
+}
+
+func (iface *segmentInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.sync.Lock()
+	iface.callback = f
+	iface.sync.Unlock()
+}
+
+func (iface *segmentInterface) AddMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	return iface.addMulticastMAC(mac)
+}
+
+func (iface *segmentInterface) RemoveMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	iface.removeMulticastMAC(mac)
+	iface.sync.Unlock()
+	return nil
+}
+
+func (iface *segmentInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	iface.sync.RLock()
+	src, ok := iface.mac, iface.macSet
+	iface.sync.RUnlock()
+	if !ok {
+		return 0, errors.New("write frame: interface has no MAC")
+	}
+	return iface.WriteFrameSrc(b, src, dst, et)
+}
+
+func (iface *segmentInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	if len(b) < ethernetHeaderLen {
+		return 0, errors.New("write frame: buffer too short for Ethernet header")
+	}
+	iface.sync.RLock()
+	defer iface.sync.RUnlock()
+	if !iface.isUp() {
+		return 0, errors.New("write to down interface")
+	}
+	if iface.mtu != 0 && len(b)-frameHeaderLen(et) > iface.mtu {
+		return 0, errors.MTUf(iface.mtu, "write frame: payload exceeds MTU")
+	}
+
+	writeEthernetHeader(ethernetHeader{src: src, dst: dst, et: et}, b)
+	iface.seg.deliver(iface, b, dst)
+	return len(b), nil
+}
+
+// enqueue queues a copy of the frame b for delivery if iface is up and
+// accepts frames sent to dst.
+func (iface *segmentInterface) enqueue(b []byte, dst MAC) {
+	iface.sync.RLock()
+	defer iface.sync.RUnlock()
+	if !iface.isUp() || !iface.accepts(dst) {
+		return
+	}
+	select {
+	case iface.frames <- append([]byte(nil), b...):
+	default:
+		// TODO(joshlf): Log dropped frame
+	}
+}
+
+func (iface *segmentInterface) readDaemon() {
+	// NOTE(joshlf): It's safe to access iface.frames without synchronization
+	// because it is only modified before the daemon is spawned and after
+	// it has returned.
+	frames := iface.frames
+	for {
+		select {
+		case <-iface.sync.StopChan():
+			return
+		case b := <-frames:
+			eh, err := parseEthernetHeader(b)
+			if err != nil {
+				// TODO(joshlf): Log it
+				continue
+			}
+			// NOTE(joshlf): Don't hold the lock while calling the callback,
+			// since it may write frames or modify the multicast filter
+			iface.sync.RLock()
+			mtu, callback := iface.mtu, iface.callback
+			iface.sync.RUnlock()
+			if mtu != 0 && len(b)-eh.EncodedLen() > mtu {
+				// TODO(joshlf): Log it
+				continue
+			}
+			if callback != nil {
+				callback(b[ethernetHeaderLen:], eh.src, eh.dst, eh.OuterEtherType())
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEthernetSegmentFiltering(t *testing.T) {
+	var seg EthernetSegment
+	macs := []MAC{{2, 0, 0, 0, 0, 1}, {2, 0, 0, 0, 0, 2}, {2, 0, 0, 0, 0, 3}}
+	var ifaces []EthernetInterface
+	var chans []chan MAC
+	for _, mac := range macs {
+		iface := seg.NewInterface()
+		if err := iface.SetMAC(mac); err != nil {
+			t.Fatalf("unexpected error setting MAC: %v", err)
+		}
+		c := make(chan MAC, 16)
+		iface.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) { c <- dst })
+		if err := iface.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing interface up: %v", err)
+		}
+		defer iface.BringDown()
+		ifaces, chans = append(ifaces, iface), append(chans, c)
+	}
+	// a promiscuous interface with no MAC set
+	promisc := seg.NewInterface()
+	pc := make(chan MAC, 16)
+	promisc.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) { pc <- dst })
+	promisc.BringUp()
+	defer promisc.BringDown()
+
+	expect := func(c chan MAC, dst MAC, ok bool) {
+		select {
+		case got := <-c:
+			if !ok {
+				t.Errorf("unexpected frame to %v", got)
+			} else if got != dst {
+				t.Errorf("got frame to %v; want %v", got, dst)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if ok {
+				t.Errorf("expected frame to %v", dst)
+			}
+		}
+	}
+
+	mcast := MAC{0x33, 0x33, 0, 0, 0, 1}
+	ifaces[2].AddMulticastMAC(mcast)
+	for _, dst := range []MAC{macs[1], BroadcastMAC, mcast} {
+		if _, err := ifaces[0].WriteFrame(make([]byte, ethernetHeaderLen+4), dst, EtherTypeIPv4); err != nil {
+			t.Fatalf("unexpected error writing frame: %v", err)
+		}
+		expect(chans[0], dst, false)
+		expect(chans[1], dst, dst == macs[1] || dst == BroadcastMAC)
+		expect(chans[2], dst, dst == BroadcastMAC || dst == mcast)
+		expect(pc, dst, true)
+	}
+
+	ifaces[1].BringDown()
+	ifaces[1].SetMTU(4)
+	ifaces[1].BringUp()
+	_, err := ifaces[1].WriteFrame(make([]byte, ethernetHeaderLen+5), BroadcastMAC, EtherTypeIPv4)
+	if !IsMTU(err) {
+		t.Errorf("expected MTU error; got %v", err)
+	}
+	ifaces[0].WriteFrame(make([]byte, ethernetHeaderLen+5), macs[1], EtherTypeIPv4)
+	expect(chans[1], macs[1], false)
+}
+
+func TestEthernetSegmentDevices(t *testing.T) {
+	var seg EthernetSegment
+	addr4s := []string{"10.0.0.1", "10.0.0.2"}
+	addr6s := []string{"fd00::1", "fd00::2"}
+	var devs []*EthernetDevice
+	var chans []chan []byte
+	for i := range addr4s {
+		dev, err := NewEthernetDevice(seg.NewInterface(), MAC{2, 0, 0, 0, 0, byte(i + 1)})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		addr4, _ := ParseIPv4(addr4s[i])
+		addr6, _ := ParseIPv6(addr6s[i])
+		dev.SetIPv4(addr4, IPv4{255, 0, 0, 0})
+		dev.SetIPv6(addr6, IPv6{0: 0xff, 1: 0xff})
+		c := make(chan []byte, 4)
+		dev.RegisterIPv4Callback(func(b []byte) { c <- b })
+		dev.RegisterIPv6Callback(func(b []byte) { c <- b })
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		defer dev.BringDown()
+		devs, chans = append(devs, dev), append(chans, c)
+	}
+
+	expect := func(c chan []byte, want []byte) {
+		select {
+		case got := <-c:
+			if !bytes.Equal(got, want) {
+				t.Errorf("got packet %v; want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for packet")
+		}
+	}
+
+	// neither address has been resolved, so these exercise ARP and NDP
+	dst4, _ := ParseIPv4(addr4s[1])
+	pkt := []byte("IPv4 packet")
+	if _, err := devs[0].WriteToIPv4(pkt, dst4); err != nil {
+		t.Fatalf("unexpected error writing IPv4 packet: %v", err)
+	}
+	expect(chans[1], pkt)
+	dst6, _ := ParseIPv6(addr6s[0])
+	pkt = []byte("IPv6 packet")
+	if _, err := devs[1].WriteToIPv6(pkt, dst6); err != nil {
+		t.Fatalf("unexpected error writing IPv6 packet: %v", err)
+	}
+	expect(chans[0], pkt)
+}
@@ -0,0 +1,60 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// failingDownInterface is an EthernetInterface which can't be brought down
+// while fail is true.
+type failingDownInterface struct {
+	EthernetInterface
+	fail bool
+}
+
+func (iface *failingDownInterface) BringDown() error {
+	if iface.fail {
+		return errors.New("bring interface down: failed")
+	}
+	return iface.EthernetInterface.BringDown()
+}
+
+func TestEthernetDeviceBringDownError(t *testing.T) {
+	var seg EthernetSegment
+	iface := &failingDownInterface{EthernetInterface: seg.NewInterface(), fail: true}
+	dev, err := NewEthernetDevice(iface, MAC{2, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatalf("unexpected error creating device: %v", err)
+	}
+	dev.SetIPv4(IPv4{10, 0, 0, 1}, IPv4{255, 255, 255, 0})
+	dev.SetIPv6(IPv6{0xfe, 0x80, 15: 1}, IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err := dev.BringUp(); err != nil {
+		t.Fatalf("unexpected error bringing device up: %v", err)
+	}
+
+	if err := dev.BringDown(); err == nil {
+		t.Fatalf("expected error bringing device down")
+	}
+	if !dev.IsUp() || !iface.IsUp() {
+		t.Errorf("got device up: %v, interface up: %v; want both up", dev.IsUp(), iface.IsUp())
+	}
+	dev.mu.RLock()
+	if dev.arp == nil || dev.ndp == nil {
+		t.Errorf("arp or ndp was stopped on the device which is still up")
+	}
+	dev.mu.RUnlock()
+
+	iface.fail = false
+	if err := dev.BringDown(); err != nil {
+		t.Fatalf("unexpected error bringing device down: %v", err)
+	}
+	if dev.IsUp() || iface.IsUp() {
+		t.Errorf("got device up: %v, interface up: %v; want both down", dev.IsUp(), iface.IsUp())
+	}
+	dev.mu.RLock()
+	if dev.arp != nil || dev.ndp != nil {
+		t.Errorf("arp or ndp wasn't stopped on the device which is down")
+	}
+	dev.mu.RUnlock()
+}
@@ -106,7 +106,6 @@ var cmdDev = cli.Command{
 		names := devices.ListNames()
 		sort.Strings(names)
 		fmt.Println("Devices")
-		// TODO(joshlf): Print device's IP addres/subnet
 		fmt.Println("Name      MTU       Up     Driver-Specific")
 		fmt.Println("==========================================")
 		const maxlen = 10
@@ -178,8 +177,148 @@ var cmdDevDown = cli.Command{
 	},
 }
 
+var cmdDevAddr = cli.Command{
+	Name:             "addr",
+	Usage:            "[<device>]",
+	ShortDescription: "Show device addresses",
+	LongDescription: `Show the IP addresses assigned to a device, or to all devices
+if no device is given. A device's primary address is listed first.`,
+
+	Run: func(c *cli.Command, args []string) {
+		if len(args) > 1 {
+			c.PrintUsage()
+			return
+		}
+		names := devices.ListNames()
+		if len(args) == 1 {
+			if _, ok := devices.Get(args[0]); !ok {
+				fmt.Println("no such device")
+				return
+			}
+			names = args
+		}
+		sort.Strings(names)
+		fmt.Println("Name      Address                                   Netmask")
+		fmt.Println("=================================================================================")
+		const maxlen = 10
+		const maxaddrlen = len("0000:0000:0000:0000:0000:0000:0000:0000") + 3
+		for _, name := range names {
+			dev, _ := devices.Get(name)
+			printAddr := func(addr, netmask fmt.Stringer) {
+				a := addr.String()
+				fmt.Printf("%v%v%v\n", name+strings.Repeat(" ", maxlen-len(name)),
+					a+strings.Repeat(" ", maxaddrlen-len(a)), netmask)
+			}
+			if dev4, ok := dev.(net.IPv4Device); ok {
+				for _, a := range dev4.IPv4Addrs() {
+					printAddr(a.Addr, a.Netmask)
+				}
+			}
+			if dev6, ok := dev.(net.IPv6Device); ok {
+				for _, a := range dev6.IPv6Addrs() {
+					printAddr(a.Addr, a.Netmask)
+				}
+			}
+		}
+	},
+}
+
+var cmdDevAddrAdd = cli.Command{
+	Name:             "add",
+	Usage:            "<device> <address-cidr>",
+	ShortDescription: "Add an address to a device",
+	LongDescription: `Add an IP address to a device, which may be up or down. The
+address is given in CIDR notation (for example, 10.0.0.1/24). If
+the device has no other addresses of the same IP version, it
+becomes the device's primary address.`,
+
+	Run: func(c *cli.Command, args []string) {
+		if len(args) != 2 {
+			c.PrintUsage()
+			return
+		}
+		dev, ok := devices.Get(args[0])
+		if !ok {
+			fmt.Println("no such device")
+			return
+		}
+		addr, subnet, err := net.ParseCIDR(args[1])
+		if err != nil {
+			fmt.Println("could not parse address:", err)
+			return
+		}
+		switch addr := addr.(type) {
+		case net.IPv4:
+			dev4, ok := dev.(net.IPv4Device)
+			if !ok {
+				fmt.Println("device does not support IPv4")
+				return
+			}
+			err = dev4.AddIPv4(addr, subnet.(net.IPv4Subnet).Netmask)
+		case net.IPv6:
+			dev6, ok := dev.(net.IPv6Device)
+			if !ok {
+				fmt.Println("device does not support IPv6")
+				return
+			}
+			err = dev6.AddIPv6(addr, subnet.(net.IPv6Subnet).Netmask)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	},
+}
+
+var cmdDevAddrDel = cli.Command{
+	Name:             "del",
+	Usage:            "<device> <address>",
+	ShortDescription: "Remove an address from a device",
+	LongDescription: `Remove an IP address from a device, which may be up or down.
+If it is the device's primary address, the next address of the
+same IP version (if any) becomes the primary address.`,
+
+	Run: func(c *cli.Command, args []string) {
+		if len(args) != 2 {
+			c.PrintUsage()
+			return
+		}
+		dev, ok := devices.Get(args[0])
+		if !ok {
+			fmt.Println("no such device")
+			return
+		}
+		addr, err := net.ParseIP(args[1])
+		if err != nil {
+			fmt.Println("could not parse address:", err)
+			return
+		}
+		switch addr := addr.(type) {
+		case net.IPv4:
+			dev4, ok := dev.(net.IPv4Device)
+			if !ok {
+				fmt.Println("device does not support IPv4")
+				return
+			}
+			err = dev4.RemoveIPv4(addr)
+		case net.IPv6:
+			dev6, ok := dev.(net.IPv6Device)
+			if !ok {
+				fmt.Println("device does not support IPv6")
+				return
+			}
+			err = dev6.RemoveIPv6(addr)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	},
+}
+
 func init() {
 	topLevelCommands = append(topLevelCommands, &cmdDev)
 	cmdDev.AddSubcommand(&cmdDevUp)
 	cmdDev.AddSubcommand(&cmdDevDown)
+	cmdDev.AddSubcommand(&cmdDevAddr)
+	cmdDevAddr.AddSubcommand(&cmdDevAddrAdd)
+	cmdDevAddr.AddSubcommand(&cmdDevAddrDel)
 }
@@ -81,7 +81,148 @@ var udpIPv6Driver = deviceDriver{
 	init: func() {},
 }
 
+var udpEthernetDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) < 5 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		addr, subnet, err := net.ParseCIDR(args[0])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition")
+		}
+		hw, err := gonet.ParseMAC(args[1])
+		if err != nil || len(hw) != 6 {
+			return nil, errors.Errorf("parse device definition: invalid MAC: %v", args[1])
+		}
+		laddr, err := gonet.ResolveUDPAddr("udp", args[2])
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		mtu, err := strconv.Atoi(args[3])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition: parse MTU")
+		}
+		var peers []*gonet.UDPAddr
+		for _, arg := range args[4:] {
+			peer, err := gonet.ResolveUDPAddr("udp", arg)
+			if err != nil {
+				return nil, errors.Annotate(err, "create device from definition")
+			}
+			peers = append(peers, peer)
+		}
+		iface, err := net.NewUDPEthernetInterface(laddr, peers, mtu)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		var mac net.MAC
+		copy(mac[:], hw)
+		dev, err := net.NewEthernetDevice(iface, mac)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		switch addr := addr.(type) {
+		case net.IPv4:
+			err = dev.SetIPv4(addr, subnet.(net.IPv4Subnet).Netmask)
+		case net.IPv6:
+			err = dev.SetIPv6(addr, subnet.(net.IPv6Subnet).Netmask)
+		}
+		udpEthernetIfaces[dev] = iface
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		laddr, peers := udpEthernetIfaces[dev].UDPAddrs()
+		return fmt.Sprintf("%v -> %v", laddr, peers), nil
+	},
+	init: func() {},
+}
+
+// UDP Ethernet interfaces of udpeth devices, used to get UDP
+// addresses, since EthernetDevices don't expose their interfaces
+var udpEthernetIfaces = make(map[net.Device]*net.UDPEthernetInterface)
+
+var vlanDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) < 6 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		addr, subnet, err := net.ParseCIDR(args[0])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition")
+		}
+		hw, err := gonet.ParseMAC(args[1])
+		if err != nil || len(hw) != 6 {
+			return nil, errors.Errorf("parse device definition: invalid MAC: %v", args[1])
+		}
+		vid, err := strconv.ParseUint(args[2], 10, 12)
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition: parse VID")
+		}
+		trunk, ok := vlanTrunks[args[3]]
+		if !ok {
+			// the first definition using a given local address
+			// determines the trunk's MTU and peers
+			laddr, err := gonet.ResolveUDPAddr("udp", args[3])
+			if err != nil {
+				return nil, errors.Annotate(err, "create device from definition")
+			}
+			mtu, err := strconv.Atoi(args[4])
+			if err != nil {
+				return nil, errors.Annotate(err, "parse device definition: parse MTU")
+			}
+			var peers []*gonet.UDPAddr
+			for _, arg := range args[5:] {
+				peer, err := gonet.ResolveUDPAddr("udp", arg)
+				if err != nil {
+					return nil, errors.Annotate(err, "create device from definition")
+				}
+				peers = append(peers, peer)
+			}
+			iface, err := net.NewUDPEthernetInterface(laddr, peers, mtu)
+			if err != nil {
+				return nil, errors.Annotate(err, "create device from definition")
+			}
+			trunk, err = net.NewVLANTrunk(iface)
+			if err != nil {
+				return nil, errors.Annotate(err, "create device from definition")
+			}
+			vlanTrunks[args[3]] = trunk
+		}
+		iface, err := trunk.NewInterface(uint16(vid), 0)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		var mac net.MAC
+		copy(mac[:], hw)
+		dev, err := net.NewEthernetDevice(iface, mac)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		switch addr := addr.(type) {
+		case net.IPv4:
+			err = dev.SetIPv4(addr, subnet.(net.IPv4Subnet).Netmask)
+		case net.IPv6:
+			err = dev.SetIPv6(addr, subnet.(net.IPv6Subnet).Netmask)
+		}
+		vlanIfaces[dev] = iface
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		return fmt.Sprintf("VLAN %v", vlanIfaces[dev].VID()), nil
+	},
+	init: func() {},
+}
+
+var (
+	// VLAN trunks over UDP Ethernet interfaces, keyed
+	// by the local UDP address from the device definition
+	vlanTrunks = make(map[string]*net.VLANTrunk)
+	// VLAN interfaces of vlan devices, used to get VIDs
+	vlanIfaces = make(map[net.Device]*net.VLANInterface)
+)
+
 func init() {
 	deviceDrivers["udp4"] = &udpIPv4Driver
 	deviceDrivers["udp6"] = &udpIPv6Driver
+	deviceDrivers["udpeth"] = &udpEthernetDriver
+	deviceDrivers["vlan"] = &vlanDriver
 }
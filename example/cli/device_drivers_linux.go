@@ -0,0 +1,91 @@
+package main
+
+import (
+	gonet "net"
+	"strconv"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/errors"
+)
+
+var tunDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) != 3 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		addr, subnet, err := net.ParseCIDR(args[0])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition")
+		}
+		mtu, err := strconv.Atoi(args[2])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition: parse MTU")
+		}
+		dev, err := net.NewTUNDevice(net.TUNConfig{Name: args[1], MTU: mtu})
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		switch addr := addr.(type) {
+		case net.IPv4:
+			err = dev.SetIPv4(addr, subnet.(net.IPv4Subnet).Netmask)
+		case net.IPv6:
+			err = dev.SetIPv6(addr, subnet.(net.IPv6Subnet).Netmask)
+		}
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		return "kernel interface " + dev.(*net.TUNDevice).Name(), nil
+	},
+	init: func() {},
+}
+
+// TAP interfaces of tap devices, used to get kernel interface
+// names, since EthernetDevices don't expose their interfaces
+var tapIfaces = make(map[net.Device]*net.TAPInterface)
+
+var tapDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) != 4 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		addr, subnet, err := net.ParseCIDR(args[0])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition")
+		}
+		hw, err := gonet.ParseMAC(args[2])
+		if err != nil || len(hw) != 6 {
+			return nil, errors.Errorf("parse device definition: invalid MAC: %v", args[2])
+		}
+		mtu, err := strconv.Atoi(args[3])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition: parse MTU")
+		}
+		iface, err := net.NewTAPInterface(net.TUNConfig{Name: args[1], MTU: mtu})
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		var mac net.MAC
+		copy(mac[:], hw)
+		dev, err := net.NewEthernetDevice(iface, mac)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		switch addr := addr.(type) {
+		case net.IPv4:
+			err = dev.SetIPv4(addr, subnet.(net.IPv4Subnet).Netmask)
+		case net.IPv6:
+			err = dev.SetIPv6(addr, subnet.(net.IPv6Subnet).Netmask)
+		}
+		tapIfaces[dev] = iface
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		return "kernel interface " + tapIfaces[dev].Name(), nil
+	},
+	init: func() {},
+}
+
+func init() {
+	deviceDrivers["tun"] = &tunDriver
+	deviceDrivers["tap"] = &tapDriver
+}
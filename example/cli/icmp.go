@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/example/internal/cli"
+	"github.com/joshlf/net/icmp"
+)
+
+var (
+	icmpv4Host *icmp.IPv4Host
+	icmpv6Host *icmp.IPv6Host
+)
+
+var cmdPing = cli.Command{
+	Name:             "ping",
+	Usage:            "<destination> [--count <count>] [--size <size>] [--ttl <ttl>] [--timeout <timeout>]",
+	ShortDescription: "Send ICMP echo requests",
+	LongDescription: `Send ICMP or ICMPv6 echo requests to the given destination, one per
+second, and print the round trip time of each reply. By default, 4
+requests are sent with 56 bytes of data each, and each waits 1s for a
+reply. The timeout is given as a duration, such as 500ms. For IPv6
+destinations, --ttl sets the hop limit.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) == 0 || len(args)%2 != 1 {
+			cmd.PrintUsage()
+			return
+		}
+
+		dst, err := net.ParseIP(args[0])
+		if err != nil {
+			fmt.Println("could not parse destination IP:", err)
+			return
+		}
+		count := 4
+		config := icmp.PingConfig{Size: 56}
+		for i := 1; i < len(args); i += 2 {
+			switch args[i] {
+			case "--count":
+				count, err = strconv.Atoi(args[i+1])
+			case "--size":
+				config.Size, err = strconv.Atoi(args[i+1])
+			case "--ttl":
+				var ttl uint64
+				ttl, err = strconv.ParseUint(args[i+1], 10, 8)
+				config.TTL = uint8(ttl)
+			case "--timeout":
+				config.Timeout, err = time.ParseDuration(args[i+1])
+			default:
+				cmd.PrintUsage()
+				return
+			}
+			if err != nil {
+				fmt.Printf("could not parse %v: %v\n", args[i][2:], err)
+				return
+			}
+		}
+
+		var received int
+		for seq := 0; seq < count; seq++ {
+			if seq > 0 {
+				time.Sleep(time.Second)
+			}
+			config.Seq = uint16(seq)
+			var res icmp.PingResult
+			switch dst := dst.(type) {
+			case net.IPv4:
+				res, err = icmpv4Host.Ping(dst, config)
+			case net.IPv6:
+				res, err = icmpv6Host.Ping(dst, config)
+			}
+			if err != nil {
+				fmt.Printf("seq=%v: %v\n", seq, err)
+				continue
+			}
+			received++
+			fmt.Printf("%v bytes from %v: seq=%v time=%v\n", res.Size, dst, res.Seq, res.RTT)
+		}
+		fmt.Printf("%v packets transmitted, %v received\n", count, received)
+	},
+}
+
+func init() {
+	var err error
+	icmpv4Host, err = icmp.NewIPv4Host(host.IPv4Host)
+	if err != nil {
+		panic(err)
+	}
+	icmpv6Host, err = icmp.NewIPv6Host(host.IPv6Host)
+	if err != nil {
+		panic(err)
+	}
+	topLevelCommands = append(topLevelCommands, &cmdPing)
+}
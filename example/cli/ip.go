@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joshlf/net"
 	"github.com/joshlf/net/example/internal"
@@ -174,6 +175,33 @@ With a single argument, "on" or "off", turn IP forwarding on or off.`,
 	},
 }
 
+var cmdIPForwardBroadcast = cli.Command{
+	Name:             "broadcast",
+	Usage:            "[on | off]",
+	ShortDescription: "Get or set IPv4 directed broadcast forwarding state",
+	LongDescription: `Without any arguments, display whether IPv4 directed broadcasts
+are forwarded onto attached subnets. With a single argument, "on"
+or "off", turn directed broadcast forwarding on or off. It has no
+effect unless IP forwarding is on.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		switch {
+		case len(args) == 0:
+			on := "on"
+			if !host.IPv4Host.DirectedBroadcastForwarding() {
+				on = "off"
+			}
+			fmt.Println("IPv4 directed broadcast forwarding is", on)
+		case len(args) == 1 && args[0] == "on":
+			host.IPv4Host.SetDirectedBroadcastForwarding(true)
+		case len(args) == 1 && args[0] == "off":
+			host.IPv4Host.SetDirectedBroadcastForwarding(false)
+		default:
+			cmd.PrintUsage()
+		}
+	},
+}
+
 var cmdIPRoute = cli.Command{
 	Name:             "route",
 	ShortDescription: "view and manipulate the IP routing table",
@@ -194,42 +222,62 @@ var cmdIPRoute = cli.Command{
 		fmt.Println("IPv6 Routes")
 		fmt.Println("===========")
 		for _, r := range ipv6Routes {
-			fmt.Printf("%v %v %v\n", r.Subnet.Addr, r.Subnet.Netmask, r.Nexthop)
+			fmt.Printf("%v%v %v %v %v %v %v %v\n", selectedMarker(r.Selected), r.Subnet.Addr, r.Subnet.Netmask,
+				r.Nexthop, r.Source, r.Distance, r.Metric, tableName(r.Table))
 		}
 		for _, r := range ipv6DevRoutes {
 			name, ok := devices.GetName(r.Device)
 			if !ok {
 				panic(fmt.Errorf("unexpected internal error: could not get name for device %v", r.Device))
 			}
-			fmt.Printf("%v %v %v\n", r.Subnet.Addr, r.Subnet.Netmask, name)
+			fmt.Printf("%v%v %v %v %v\n", selectedMarker(true), r.Subnet.Addr, r.Subnet.Netmask, name, tableName(r.Table))
 		}
 		return
 	},
 }
 
+// tableName returns the name of a routing table
+// as displayed, which is "main" for the main table
+func tableName(table string) string {
+	if table == "" {
+		return "main"
+	}
+	return table
+}
+
+// selectedMarker returns the prefix which marks routes
+// as selected (that is, used to forward packets) or not
+func selectedMarker(selected bool) string {
+	if selected {
+		return "* "
+	}
+	return "  "
+}
+
 func printIPv4Routes(routes []net.IPv4Route, devroutes []net.IPv4DeviceRoute) {
 	// at least three spaces between each element on a line
-	fmt.Println("Address           Netmask           Next Hop")
-	fmt.Println("============================================")
+	fmt.Println("  Address           Netmask           Next Hop          Source   Distance   Metric       Table")
+	fmt.Println("=============================================================================================")
 
 	const maxlen = len("000.000.000.000")
+	pad := func(v interface{}, n int) string {
+		s := fmt.Sprint(v)
+		return s + strings.Repeat(" ", n-len(s))
+	}
 	for _, r := range routes {
-		addr := fmt.Sprint(r.Subnet.Addr)
-		addr += strings.Repeat(" ", maxlen-len(addr))
-		netmask := fmt.Sprint(r.Subnet.Netmask)
-		netmask += strings.Repeat(" ", maxlen-len(netmask))
-		fmt.Printf("%v   %v   %v\n", addr, netmask, r.Nexthop)
+		fmt.Printf("%v%v   %v   %v   %v   %v   %v   %v\n", selectedMarker(r.Selected), pad(r.Subnet.Addr, maxlen),
+			pad(r.Subnet.Netmask, maxlen), pad(r.Nexthop, maxlen), pad(r.Source, len("Source")),
+			pad(r.Distance, len("Distance")), pad(r.Metric, len("4294967295")), tableName(r.Table))
 	}
 	for _, r := range devroutes {
-		addr := fmt.Sprint(r.Subnet.Addr)
-		addr += strings.Repeat(" ", maxlen-len(addr))
-		netmask := fmt.Sprint(r.Subnet.Netmask)
-		netmask += strings.Repeat(" ", maxlen-len(netmask))
 		name, ok := devices.GetName(r.Device)
 		if !ok {
 			panic(fmt.Errorf("unexpected internal error: could not get name for device %v", r.Device))
 		}
-		fmt.Printf("%v   %v   %v\n", addr, netmask, name)
+		// device routes are always used, and the device name spans
+		// the next hop, source, distance, and metric columns
+		fmt.Printf("%v%v   %v   %v   %v\n", selectedMarker(true), pad(r.Subnet.Addr, maxlen),
+			pad(r.Subnet.Netmask, maxlen), pad(name, 48), tableName(r.Table))
 	}
 }
 
@@ -281,17 +329,57 @@ func (s sortableRoutes) Less(i, j int) bool {
 
 var cmdIPRouteAdd = cli.Command{
 	Name:             "add",
-	Usage:            "<network-cidr> <nexthop>",
+	Usage:            "<network-cidr> <nexthop> [--source <source>] [--distance <distance>] [--metric <metric>] [--table <table>]",
 	ShortDescription: "Add an IP route",
 	LongDescription: `Add a route to the IP routing table. The network should be
 specified in CIDR notation, and the nexthop can be either
-an address or a device name.`,
+an address or a device name.
+
+If the nexthop is an address, the route's source (static, rip,
+ospf, or bgp; the default is static), administrative distance
+(the default depends on the source), and metric (the default
+is 0) may also be given. Routes with lower distances are
+preferred, and then routes with lower metrics. If there are
+several equally good routes, traffic is spread among them.
+
+The route is added to the main table unless another table is
+given (see "ip rule").`,
 
 	Run: func(cmd *cli.Command, args []string) {
-		if len(args) != 2 {
+		if len(args) < 2 || len(args)%2 != 0 {
 			cmd.PrintUsage()
 			return
 		}
+		source := net.RouteSourceStatic
+		var distance, metric uint64
+		var table string
+		var hasAttrs bool // whether attributes other than the table were given
+		for i := 2; i < len(args); i += 2 {
+			var err error
+			hasAttrs = hasAttrs || args[i] != "--table"
+			switch args[i] {
+			case "--table":
+				table = parseTableName(args[i+1])
+			case "--source":
+				var ok bool
+				source, ok = parseRouteSource(args[i+1])
+				if !ok {
+					fmt.Println("unknown route source:", args[i+1])
+					return
+				}
+			case "--distance":
+				distance, err = strconv.ParseUint(args[i+1], 10, 8)
+			case "--metric":
+				metric, err = strconv.ParseUint(args[i+1], 10, 32)
+			default:
+				cmd.PrintUsage()
+				return
+			}
+			if err != nil {
+				fmt.Printf("could not parse %v: %v\n", args[i][2:], err)
+				return
+			}
+		}
 
 		_, subnet, err := net.ParseCIDR(args[0])
 		if err != nil {
@@ -308,10 +396,676 @@ an address or a device name.`,
 				return
 			}
 		}
-		if nexthopDev != nil {
-			err = host.AddDeviceRoute(subnet, nexthopDev)
+		switch {
+		case nexthopDev != nil:
+			if hasAttrs {
+				fmt.Println("source, distance, and metric may only be given for routes with nexthop addresses")
+				return
+			}
+			err = addDeviceRoute(subnet, nexthopDev, table)
+		case subnet.IPVersion() != nexthopIP.IPVersion():
+			err = fmt.Errorf("mixed IP subnet and next hop versions")
+		case subnet.IPVersion() == 4:
+			host.IPv4Host.AddIPv4RouteEntry(net.IPv4Route{Subnet: subnet.(net.IPv4Subnet), Nexthop: nexthopIP.(net.IPv4),
+				Source: source, Distance: uint8(distance), Metric: uint32(metric), Table: table})
+		default:
+			host.IPv6Host.AddIPv6RouteEntry(net.IPv6Route{Subnet: subnet.(net.IPv6Subnet), Nexthop: nexthopIP.(net.IPv6),
+				Source: source, Distance: uint8(distance), Metric: uint32(metric), Table: table})
+		}
+		if err != nil {
+			fmt.Println("could not add route:", err)
+		}
+	},
+}
+
+var cmdIPRouteDel = cli.Command{
+	Name:             "del",
+	Usage:            "<network-cidr> <nexthop> [--source <source>] [--table <table>]",
+	ShortDescription: "Delete an IP route",
+	LongDescription: `Delete a route from the IP routing table. The network and
+nexthop are given as for "ip route add". If the nexthop is an
+address, the route's source may also be given; the default is
+static. The route is deleted from the main table unless another
+table is given.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) < 2 || len(args)%2 != 0 {
+			cmd.PrintUsage()
+			return
+		}
+		source := net.RouteSourceStatic
+		var table string
+		var hasSource bool
+		for i := 2; i < len(args); i += 2 {
+			switch args[i] {
+			case "--table":
+				table = parseTableName(args[i+1])
+			case "--source":
+				var ok bool
+				source, ok = parseRouteSource(args[i+1])
+				if !ok {
+					fmt.Println("unknown route source:", args[i+1])
+					return
+				}
+				hasSource = true
+			default:
+				cmd.PrintUsage()
+				return
+			}
+		}
+
+		_, subnet, err := net.ParseCIDR(args[0])
+		if err != nil {
+			fmt.Println("could not parse network:", err)
+			return
+		}
+		nexthopIP, err := net.ParseIP(args[1])
+		if err != nil {
+			if _, ok := devices.Get(args[1]); !ok {
+				fmt.Println("nexthop is neither IP address nor device name")
+				return
+			}
+			if hasSource {
+				fmt.Println("source may only be given for routes with nexthop addresses")
+				return
+			}
+			// NOTE(joshlf): There is at most one device route per
+			// subnet in each table, so the device itself doesn't matter.
+			var ok bool
+			switch subnet := subnet.(type) {
+			case net.IPv4Subnet:
+				ok = host.IPv4Host.DeleteIPv4DeviceRoute(net.IPv4DeviceRoute{Subnet: subnet, Table: table})
+			case net.IPv6Subnet:
+				ok = host.IPv6Host.DeleteIPv6DeviceRoute(net.IPv6DeviceRoute{Subnet: subnet, Table: table})
+			}
+			if !ok {
+				err = fmt.Errorf("no such route")
+			}
 		} else {
-			err = host.AddRoute(subnet, nexthopIP)
+			var ok bool
+			switch {
+			case subnet.IPVersion() != nexthopIP.IPVersion():
+				fmt.Println("mixed IP subnet and next hop versions")
+				return
+			case subnet.IPVersion() == 4:
+				ok = host.IPv4Host.DeleteIPv4Route(net.IPv4Route{Subnet: subnet.(net.IPv4Subnet), Nexthop: nexthopIP.(net.IPv4),
+					Source: source, Table: table})
+			default:
+				ok = host.IPv6Host.DeleteIPv6Route(net.IPv6Route{Subnet: subnet.(net.IPv6Subnet), Nexthop: nexthopIP.(net.IPv6),
+					Source: source, Table: table})
+			}
+			if !ok {
+				err = fmt.Errorf("no such route")
+			}
+		}
+		if err != nil {
+			fmt.Println("could not delete route:", err)
+		}
+	},
+}
+
+// addDeviceRoute adds a device route to the named table
+func addDeviceRoute(subnet net.IPSubnet, dev net.Device, table string) error {
+	if subnet.IPVersion() == 4 {
+		dev4, ok := dev.(net.IPv4Device)
+		if !ok {
+			return fmt.Errorf("IPv4 subnet with non-IPv4-enabled device")
+		}
+		host.IPv4Host.AddIPv4DeviceRouteEntry(net.IPv4DeviceRoute{Subnet: subnet.(net.IPv4Subnet), Device: dev4, Table: table})
+		return nil
+	}
+	dev6, ok := dev.(net.IPv6Device)
+	if !ok {
+		return fmt.Errorf("IPv6 subnet with non-IPv6-enabled device")
+	}
+	host.IPv6Host.AddIPv6DeviceRouteEntry(net.IPv6DeviceRoute{Subnet: subnet.(net.IPv6Subnet), Device: dev6, Table: table})
+	return nil
+}
+
+// parseTableName is the inverse of tableName
+func parseTableName(s string) string {
+	if s == "main" {
+		return ""
+	}
+	return s
+}
+
+// stopRouteMonitor stops the current "ip route monitor", if any
+var stopRouteMonitor func()
+
+var cmdIPRouteMonitor = cli.Command{
+	Name:             "monitor",
+	Usage:            "[on | off]",
+	ShortDescription: "Monitor changes to the IP routing table",
+	LongDescription: `Turn monitoring of the IP routing table on or off. When
+monitoring is on, routes which are added, deleted, or changed
+will be printed to the terminal.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			cmd.PrintUsage()
+			return
+		}
+		if stopRouteMonitor != nil {
+			stopRouteMonitor()
+			stopRouteMonitor = nil
+		}
+		if args[0] == "off" {
+			return
+		}
+
+		c4 := make(chan net.IPv4RouteEvent, 64)
+		c6 := make(chan net.IPv6RouteEvent, 64)
+		stop := host.WatchRoutes(c4, c6)
+		done := make(chan struct{})
+		stopRouteMonitor = func() {
+			stop()
+			close(done)
+		}
+		lost := func(lost bool) {
+			if lost {
+				fmt.Println("some route changes were not printed")
+			}
+		}
+		go func() {
+			for {
+				select {
+				case e := <-c4:
+					lost(e.Lost)
+					switch {
+					case e.Route != nil:
+						r := e.Route
+						fmt.Printf("route %v: %v %v %v %v %v %v %v\n", e.Type, r.Subnet.Addr, r.Subnet.Netmask,
+							r.Nexthop, r.Source, r.Distance, r.Metric, tableName(r.Table))
+					case e.DeviceRoute != nil:
+						r := e.DeviceRoute
+						printDeviceRouteEvent(e.Type, r.Subnet.Addr, r.Subnet.Netmask, r.Device, r.Table)
+					}
+				case e := <-c6:
+					lost(e.Lost)
+					switch {
+					case e.Route != nil:
+						r := e.Route
+						fmt.Printf("route %v: %v %v %v %v %v %v %v\n", e.Type, r.Subnet.Addr, r.Subnet.Netmask,
+							r.Nexthop, r.Source, r.Distance, r.Metric, tableName(r.Table))
+					case e.DeviceRoute != nil:
+						r := e.DeviceRoute
+						printDeviceRouteEvent(e.Type, r.Subnet.Addr, r.Subnet.Netmask, r.Device, r.Table)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	},
+}
+
+func printDeviceRouteEvent(typ net.RouteEventType, addr, netmask interface{}, dev net.Device, table string) {
+	name, ok := devices.GetName(dev)
+	if !ok {
+		// the device may have been removed since
+		name = fmt.Sprint(dev)
+	}
+	fmt.Printf("route %v: %v %v %v %v\n", typ, addr, netmask, name, tableName(table))
+}
+
+var cmdIPRule = cli.Command{
+	Name:             "rule",
+	ShortDescription: "view and manipulate the IP routing policy",
+	LongDescription: `View and manipulate the IP routing policy. Rules select the
+routing table used for the packets which match them; rules
+are tried in order of priority, and if no matching rule's
+table has a route for a packet, the main table is used.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) > 0 {
+			fmt.Println("Usage: ip rule show")
+			return
+		}
+		for _, r := range host.IPv4Host.IPv4Rules() {
+			printRule(r.Priority, r.Source.Addr, r.Source.Netmask, r.Source.Netmask == (net.IPv4{}),
+				r.InDevice, r.DSCP, r.Proto, r.Mark, r.MarkMask, r.Table)
+		}
+		for _, r := range host.IPv6Host.IPv6Rules() {
+			printRule(r.Priority, r.Source.Addr, r.Source.Netmask, r.Source.Netmask == (net.IPv6{}),
+				r.InDevice, r.DSCP, r.Proto, r.Mark, r.MarkMask, r.Table)
+		}
+	},
+}
+
+func printRule(priority uint32, addr, netmask interface{}, all bool, in net.Device, dscp uint8, proto net.IPProtocol, mark, mask uint32, table string) {
+	fmt.Printf("%v:\t", priority)
+	if all {
+		fmt.Print("from all")
+	} else {
+		fmt.Printf("from %v %v", addr, netmask)
+	}
+	if in != nil {
+		name, ok := devices.GetName(in)
+		if !ok {
+			name = fmt.Sprint(in)
+		}
+		fmt.Print(" iif ", name)
+	}
+	if dscp != 0 {
+		fmt.Print(" dscp ", dscp)
+	}
+	if proto != 0 {
+		fmt.Print(" proto ", proto)
+	}
+	if mark != 0 || mask != 0 {
+		fmt.Printf(" fwmark %#x/%#x", mark, mask)
+	}
+	fmt.Println(" lookup", tableName(table))
+}
+
+const ruleUsage = "[--priority <priority>] [--from <network-cidr>] [--iif <device>] [--dscp <dscp>] [--proto <protocol number>] [--fwmark <mark>[/<mask>]] [--table <table>]"
+
+var cmdIPRuleAdd = cli.Command{
+	Name:             "add",
+	Usage:            ruleUsage,
+	ShortDescription: "Add an IP routing rule",
+	LongDescription: `Add a rule to the IP routing policy. Rules with lower
+priorities are tried first (the default is 0). The rule matches
+packets from the given network, received on the given device,
+with the given DSCP, with the given protocol number, and whose
+firewall mark, masked with the given mask, is the given mark;
+criteria which are not given match all packets. Matching packets
+are routed using the given table (the default is main).
+
+If no network is given, the rule is added for both IPv4 and IPv6.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		r4, r6, version, ok := parseRule(cmd, args)
+		if !ok {
+			return
+		}
+		if version != 6 {
+			host.IPv4Host.AddIPv4Rule(r4)
+		}
+		if version != 4 {
+			host.IPv6Host.AddIPv6Rule(r6)
+		}
+	},
+}
+
+var cmdIPRuleDel = cli.Command{
+	Name:             "del",
+	Usage:            ruleUsage,
+	ShortDescription: "Delete an IP routing rule",
+	LongDescription: `Delete a rule from the IP routing policy. The rule is
+given as for "ip rule add", and must match exactly.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		r4, r6, version, ok := parseRule(cmd, args)
+		if !ok {
+			return
+		}
+		var deleted bool
+		if version != 6 {
+			deleted = host.IPv4Host.DeleteIPv4Rule(r4)
+		}
+		if version != 4 {
+			deleted = host.IPv6Host.DeleteIPv6Rule(r6) || deleted
+		}
+		if !deleted {
+			fmt.Println("could not delete rule: no such rule")
+		}
+	},
+}
+
+// parseRule parses the arguments to "ip rule add" and "ip rule del".
+// version is the IP version of the rule, or 0 if the rule applies
+// to both versions, in which case r4 and r6 are equivalent.
+func parseRule(cmd *cli.Command, args []string) (r4 net.IPv4Rule, r6 net.IPv6Rule, version int, ok bool) {
+	if len(args)%2 != 0 {
+		cmd.PrintUsage()
+		return r4, r6, 0, false
+	}
+	for i := 0; i < len(args); i += 2 {
+		var err error
+		var n uint64
+		switch arg := args[i+1]; args[i] {
+		case "--priority":
+			n, err = strconv.ParseUint(arg, 10, 32)
+			r4.Priority, r6.Priority = uint32(n), uint32(n)
+		case "--from":
+			var subnet net.IPSubnet
+			_, subnet, err = net.ParseCIDR(arg)
+			if err == nil {
+				version = subnet.IPVersion()
+				if version == 4 {
+					r4.Source = subnet.(net.IPv4Subnet)
+				} else {
+					r6.Source = subnet.(net.IPv6Subnet)
+				}
+			}
+		case "--iif":
+			dev, ok := devices.Get(arg)
+			if !ok {
+				fmt.Println("no such device:", arg)
+				return r4, r6, 0, false
+			}
+			r4.InDevice, _ = dev.(net.IPv4Device)
+			r6.InDevice, _ = dev.(net.IPv6Device)
+		case "--dscp":
+			n, err = strconv.ParseUint(arg, 10, 6)
+			r4.DSCP, r6.DSCP = uint8(n), uint8(n)
+		case "--proto":
+			n, err = strconv.ParseUint(arg, 10, 8)
+			r4.Proto, r6.Proto = net.IPProtocol(n), net.IPProtocol(n)
+		case "--fwmark":
+			mark := strings.SplitN(arg, "/", 2)
+			n, err = strconv.ParseUint(mark[0], 0, 32)
+			r4.Mark, r6.Mark = uint32(n), uint32(n)
+			if err == nil && len(mark) == 2 {
+				n, err = strconv.ParseUint(mark[1], 0, 32)
+				r4.MarkMask, r6.MarkMask = uint32(n), uint32(n)
+			}
+		case "--table":
+			r4.Table, r6.Table = parseTableName(arg), parseTableName(arg)
+		default:
+			cmd.PrintUsage()
+			return r4, r6, 0, false
+		}
+		if err != nil {
+			fmt.Printf("could not parse %v: %v\n", args[i][2:], err)
+			return r4, r6, 0, false
+		}
+	}
+	switch {
+	case r4.InDevice == nil && r6.InDevice != nil:
+		if version == 4 {
+			fmt.Println("IPv4 rule with non-IPv4-enabled device")
+			return r4, r6, 0, false
+		}
+		version = 6
+	case r6.InDevice == nil && r4.InDevice != nil:
+		if version == 6 {
+			fmt.Println("IPv6 rule with non-IPv6-enabled device")
+			return r4, r6, 0, false
+		}
+		version = 4
+	}
+	return r4, r6, version, true
+}
+
+var cmdIPMaddr = cli.Command{
+	Name:             "maddr",
+	ShortDescription: "view and manipulate multicast group memberships",
+	LongDescription: `Show the multicast groups which devices have joined, along
+with their source filters.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) > 0 {
+			cmd.PrintUsage()
+			return
+		}
+		for _, m := range host.IPv4Host.IPv4Memberships() {
+			printMembership(m.Device, m.Group, m.Mode, m.Sources)
+		}
+		for _, m := range host.IPv6Host.IPv6Memberships() {
+			printMembership(m.Device, m.Group, m.Mode, m.Sources)
+		}
+	},
+}
+
+func printMembership(dev net.Device, group net.IP, mode net.MulticastFilterMode, sources interface{}) {
+	name, ok := devices.GetName(dev)
+	if !ok {
+		name = fmt.Sprint(dev)
+	}
+	fmt.Printf("%v\t%v %v %v\n", name, group, mode, sources)
+}
+
+// groupLeaves holds the functions which leave the groups
+// joined with "ip maddr join", keyed by device name and group.
+var groupLeaves = make(map[string]func())
+
+var cmdIPMaddrJoin = cli.Command{
+	Name:             "join",
+	Usage:            "<device> <group> [include | exclude] [<source> ...]",
+	ShortDescription: "Join a multicast group",
+	LongDescription: `Join a multicast group on a device. In include mode, only
+packets from the given sources are received; in exclude mode, which
+is the default, packets from all other sources are received.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) < 2 {
+			cmd.PrintUsage()
+			return
+		}
+		dev, ok := devices.Get(args[0])
+		if !ok {
+			fmt.Println("no such device:", args[0])
+			return
+		}
+		group, err := net.ParseIP(args[1])
+		if err != nil {
+			fmt.Println("could not parse group:", err)
+			return
+		}
+		key := fmt.Sprint(args[0], " ", group)
+		if groupLeaves[key] != nil {
+			fmt.Println("group already joined")
+			return
+		}
+		mode := net.MulticastExclude
+		args = args[2:]
+		if len(args) > 0 && (args[0] == "include" || args[0] == "exclude") {
+			if args[0] == "include" {
+				mode = net.MulticastInclude
+			}
+			args = args[1:]
+		}
+		var sources []net.IP
+		for _, arg := range args {
+			src, err := net.ParseIP(arg)
+			if err != nil || src.IPVersion() != group.IPVersion() {
+				fmt.Println("invalid source:", arg)
+				return
+			}
+			sources = append(sources, src)
+		}
+
+		var leave func()
+		switch group := group.(type) {
+		case net.IPv4:
+			dev4, ok := dev.(net.IPv4Device)
+			if !ok {
+				fmt.Println("device is not IPv4-enabled")
+				return
+			}
+			var srcs []net.IPv4
+			for _, src := range sources {
+				srcs = append(srcs, src.(net.IPv4))
+			}
+			leave, err = host.IPv4Host.JoinIPv4Group(dev4, group, mode, srcs)
+		case net.IPv6:
+			dev6, ok := dev.(net.IPv6Device)
+			if !ok {
+				fmt.Println("device is not IPv6-enabled")
+				return
+			}
+			var srcs []net.IPv6
+			for _, src := range sources {
+				srcs = append(srcs, src.(net.IPv6))
+			}
+			leave, err = host.IPv6Host.JoinIPv6Group(dev6, group, mode, srcs)
+		}
+		if err != nil {
+			fmt.Println("could not join group:", err)
+			return
+		}
+		groupLeaves[key] = leave
+	},
+}
+
+var cmdIPMaddrLeave = cli.Command{
+	Name:             "leave",
+	Usage:            "<device> <group>",
+	ShortDescription: "Leave a multicast group",
+	LongDescription:  `Leave a multicast group joined with "ip maddr join".`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 2 {
+			cmd.PrintUsage()
+			return
+		}
+		group, err := net.ParseIP(args[1])
+		if err != nil {
+			fmt.Println("could not parse group:", err)
+			return
+		}
+		key := fmt.Sprint(args[0], " ", group)
+		leave := groupLeaves[key]
+		if leave == nil {
+			fmt.Println("group not joined")
+			return
+		}
+		leave()
+		delete(groupLeaves, key)
+	},
+}
+
+var cmdIPMroute = cli.Command{
+	Name:             "mroute",
+	ShortDescription: "view and manipulate the multicast forwarding cache",
+	LongDescription: `View and manipulate the multicast forwarding cache. Routes
+forward multicast packets which arrive on their incoming device
+through each of their outgoing devices, as long as their TTLs
+exceed the outgoing devices' thresholds, and only while IP
+forwarding is on.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) > 0 {
+			cmd.PrintUsage()
+			return
+		}
+		for _, r := range host.IPv4Host.IPv4MulticastRoutes() {
+			var outs []net.Device
+			var ttls []uint8
+			for _, out := range r.Outputs {
+				outs, ttls = append(outs, out.Device), append(ttls, out.TTLThreshold)
+			}
+			printMroute(r.Source, r.Source == (net.IPv4{}), r.Group, r.InDevice, outs, ttls)
+		}
+		for _, r := range host.IPv6Host.IPv6MulticastRoutes() {
+			var outs []net.Device
+			var ttls []uint8
+			for _, out := range r.Outputs {
+				outs, ttls = append(outs, out.Device), append(ttls, out.TTLThreshold)
+			}
+			printMroute(r.Source, r.Source == (net.IPv6{}), r.Group, r.InDevice, outs, ttls)
+		}
+	},
+}
+
+func printMroute(source net.IP, wildcard bool, group net.IP, in net.Device, outs []net.Device, ttls []uint8) {
+	name := func(dev net.Device) string {
+		name, ok := devices.GetName(dev)
+		if !ok {
+			name = fmt.Sprint(dev)
+		}
+		return name
+	}
+	if wildcard {
+		fmt.Print("(*, ", group, ")")
+	} else {
+		fmt.Print("(", source, ", ", group, ")")
+	}
+	fmt.Print(" iif ", name(in), " oifs")
+	for i, out := range outs {
+		fmt.Printf(" %v/%v", name(out), ttls[i])
+	}
+	fmt.Println()
+}
+
+var cmdIPMrouteAdd = cli.Command{
+	Name:             "add",
+	Usage:            "<group> [--from <source>] --iif <device> [--oif <device>[/<ttl>] ...]",
+	ShortDescription: "Add a multicast route",
+	LongDescription: `Add a route to the multicast forwarding cache, replacing any
+route for the same source and group. Without a source, the route
+applies to packets from all sources for which there is no more
+specific route. Packets are only forwarded if they arrive on the
+incoming device, and only through outgoing devices whose TTL
+threshold (the default is 0) their TTL exceeds.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) < 1 || len(args)%2 != 1 {
+			cmd.PrintUsage()
+			return
+		}
+		group, err := net.ParseIP(args[0])
+		if err != nil {
+			fmt.Println("could not parse group:", err)
+			return
+		}
+		var r4 net.IPv4MulticastRoute
+		var r6 net.IPv6MulticastRoute
+		r4.Group, _ = group.(net.IPv4)
+		r6.Group, _ = group.(net.IPv6)
+		getDev := func(name string) (net.Device, bool) {
+			dev, ok := devices.Get(name)
+			if !ok {
+				fmt.Println("no such device:", name)
+				return nil, false
+			}
+			_, ok4 := dev.(net.IPv4Device)
+			_, ok6 := dev.(net.IPv6Device)
+			if group.IPVersion() == 4 && !ok4 || group.IPVersion() == 6 && !ok6 {
+				fmt.Printf("device is not IPv%v-enabled: %v\n", group.IPVersion(), name)
+				return nil, false
+			}
+			return dev, true
+		}
+		for i := 1; i < len(args); i += 2 {
+			switch arg := args[i+1]; args[i] {
+			case "--from":
+				src, err := net.ParseIP(arg)
+				if err != nil || src.IPVersion() != group.IPVersion() {
+					fmt.Println("invalid source:", arg)
+					return
+				}
+				r4.Source, _ = src.(net.IPv4)
+				r6.Source, _ = src.(net.IPv6)
+			case "--iif":
+				dev, ok := getDev(arg)
+				if !ok {
+					return
+				}
+				r4.InDevice, _ = dev.(net.IPv4Device)
+				r6.InDevice, _ = dev.(net.IPv6Device)
+			case "--oif":
+				oif := strings.SplitN(arg, "/", 2)
+				var ttl uint64
+				if len(oif) == 2 {
+					ttl, err = strconv.ParseUint(oif[1], 10, 8)
+					if err != nil {
+						fmt.Println("could not parse ttl:", err)
+						return
+					}
+				}
+				dev, ok := getDev(oif[0])
+				if !ok {
+					return
+				}
+				if dev4, ok := dev.(net.IPv4Device); ok {
+					r4.Outputs = append(r4.Outputs, net.IPv4MulticastOutput{Device: dev4, TTLThreshold: uint8(ttl)})
+				}
+				if dev6, ok := dev.(net.IPv6Device); ok {
+					r6.Outputs = append(r6.Outputs, net.IPv6MulticastOutput{Device: dev6, TTLThreshold: uint8(ttl)})
+				}
+			default:
+				cmd.PrintUsage()
+				return
+			}
+		}
+		if group.IPVersion() == 4 {
+			err = host.IPv4Host.AddIPv4MulticastRoute(r4)
+		} else {
+			err = host.IPv6Host.AddIPv6MulticastRoute(r6)
 		}
 		if err != nil {
 			fmt.Println("could not add route:", err)
@@ -319,11 +1073,232 @@ an address or a device name.`,
 	},
 }
 
+var cmdIPMrouteDel = cli.Command{
+	Name:             "del",
+	Usage:            "<group> [--from <source>]",
+	ShortDescription: "Delete a multicast route",
+	LongDescription:  "Delete a route from the multicast forwarding cache.",
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 1 && (len(args) != 3 || args[1] != "--from") {
+			cmd.PrintUsage()
+			return
+		}
+		group, err := net.ParseIP(args[0])
+		if err != nil {
+			fmt.Println("could not parse group:", err)
+			return
+		}
+		source := net.IP(net.IPv4{})
+		if group.IPVersion() == 6 {
+			source = net.IPv6{}
+		}
+		if len(args) == 3 {
+			source, err = net.ParseIP(args[2])
+			if err != nil || source.IPVersion() != group.IPVersion() {
+				fmt.Println("invalid source:", args[2])
+				return
+			}
+		}
+		var deleted bool
+		if group.IPVersion() == 4 {
+			deleted = host.IPv4Host.DeleteIPv4MulticastRoute(source.(net.IPv4), group.(net.IPv4))
+		} else {
+			deleted = host.IPv6Host.DeleteIPv6MulticastRoute(source.(net.IPv6), group.(net.IPv6))
+		}
+		if !deleted {
+			fmt.Println("could not delete route: no such route")
+		}
+	},
+}
+
+var cmdIPNat = cli.Command{
+	Name:             "nat",
+	ShortDescription: "view and manipulate IPv4 network address translation",
+	LongDescription: `View and manipulate IPv4 network address translation (NAT).
+Rules select forwarded packets whose sources (masquerade and
+snat rules) or destinations (dnat rules) are translated, and
+are matched in the order in which they were added. Shows the
+rules, followed by the connections which are being translated.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) > 0 {
+			cmd.PrintUsage()
+			return
+		}
+		for i, r := range host.IPv4Host.IPv4NATRules() {
+			fmt.Printf("%v:\t%v", i, r.Type)
+			if r.Device != nil {
+				name, ok := devices.GetName(r.Device)
+				if !ok {
+					name = fmt.Sprint(r.Device)
+				}
+				fmt.Print(" dev ", name)
+			}
+			if r.Source.Netmask != (net.IPv4{}) {
+				fmt.Printf(" from %v %v", r.Source.Addr, r.Source.Netmask)
+			}
+			if r.Destination.Netmask != (net.IPv4{}) {
+				fmt.Printf(" to %v %v", r.Destination.Addr, r.Destination.Netmask)
+			}
+			if r.Proto != 0 {
+				fmt.Print(" proto ", r.Proto)
+			}
+			if r.Port != 0 {
+				fmt.Print(" port ", r.Port)
+			}
+			if r.Type != net.NATMasquerade {
+				fmt.Print(" to-addr ", r.ToAddr)
+			}
+			if r.ToPort != 0 {
+				fmt.Print(" to-port ", r.ToPort)
+			}
+			fmt.Println()
+		}
+		now := time.Now()
+		for _, t := range host.IPv4Host.IPv4NATTranslations() {
+			fmt.Printf("proto %v %v:%v -> %v:%v as %v:%v -> %v:%v expires %v\n", t.Proto,
+				t.Source, t.SourcePort, t.Destination, t.DestinationPort,
+				t.ToSource, t.ToSourcePort, t.ToDestination, t.ToDestinationPort,
+				t.Expires.Sub(now)/time.Second*time.Second)
+		}
+	},
+}
+
+const natUsage = "masquerade|snat|dnat [--dev <device>] [--from <network-cidr>] [--to <network-cidr>] [--proto <protocol number>] [--port <port>] [--to-addr <address>] [--to-port <port>]"
+
+var cmdIPNatAdd = cli.Command{
+	Name:             "add",
+	Usage:            natUsage,
+	ShortDescription: "Add a NAT rule",
+	LongDescription: `Add a rule to the end of the NAT rules. The rule matches
+packets forwarded through (masquerade and snat) or received
+on (dnat) the given device, from and to the given networks,
+with the given protocol number, and, for TCP and UDP, to the
+given port; criteria which are not given match all packets.
+
+Masquerade rules translate sources to the address of the
+outgoing device, and snat rules to the given address. Dnat
+rules translate destinations to the given address and port
+(by default, the port is not translated).`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		rule, ok := parseNATRule(cmd, args)
+		if !ok {
+			return
+		}
+		if err := host.IPv4Host.AddIPv4NATRule(rule); err != nil {
+			fmt.Println("could not add rule:", err)
+		}
+	},
+}
+
+var cmdIPNatDel = cli.Command{
+	Name:             "del",
+	Usage:            natUsage,
+	ShortDescription: "Delete a NAT rule",
+	LongDescription: `Delete a NAT rule. The rule is given as for "ip nat add",
+and must match exactly. Connections which are already being
+translated continue to be until they time out.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		rule, ok := parseNATRule(cmd, args)
+		if !ok {
+			return
+		}
+		if !host.IPv4Host.DeleteIPv4NATRule(rule) {
+			fmt.Println("could not delete rule: no such rule")
+		}
+	},
+}
+
+// parseNATRule parses the arguments to "ip nat add" and "ip nat del".
+func parseNATRule(cmd *cli.Command, args []string) (rule net.IPv4NATRule, ok bool) {
+	if len(args)%2 != 1 {
+		cmd.PrintUsage()
+		return rule, false
+	}
+	switch args[0] {
+	case "masquerade":
+		rule.Type = net.NATMasquerade
+	case "snat":
+		rule.Type = net.NATSource
+	case "dnat":
+		rule.Type = net.NATDestination
+	default:
+		cmd.PrintUsage()
+		return rule, false
+	}
+	for i := 1; i < len(args); i += 2 {
+		var err error
+		var n uint64
+		switch arg := args[i+1]; args[i] {
+		case "--dev":
+			dev, ok := devices.Get(arg)
+			if !ok {
+				fmt.Println("no such device:", arg)
+				return rule, false
+			}
+			if rule.Device, ok = dev.(net.IPv4Device); !ok {
+				fmt.Println("device is not IPv4-enabled:", arg)
+				return rule, false
+			}
+		case "--from":
+			_, rule.Source, err = net.ParseCIDRIPv4(arg)
+		case "--to":
+			_, rule.Destination, err = net.ParseCIDRIPv4(arg)
+		case "--proto":
+			n, err = strconv.ParseUint(arg, 10, 8)
+			rule.Proto = net.IPProtocol(n)
+		case "--port":
+			n, err = strconv.ParseUint(arg, 10, 16)
+			rule.Port = uint16(n)
+		case "--to-addr":
+			rule.ToAddr, err = net.ParseIPv4(arg)
+		case "--to-port":
+			n, err = strconv.ParseUint(arg, 10, 16)
+			rule.ToPort = uint16(n)
+		default:
+			cmd.PrintUsage()
+			return rule, false
+		}
+		if err != nil {
+			fmt.Printf("could not parse %v: %v\n", args[i][2:], err)
+			return rule, false
+		}
+	}
+	return rule, true
+}
+
+func parseRouteSource(s string) (net.RouteSource, bool) {
+	for _, source := range []net.RouteSource{net.RouteSourceStatic, net.RouteSourceRIP, net.RouteSourceOSPF, net.RouteSourceBGP} {
+		if s == source.String() {
+			return source, true
+		}
+	}
+	return 0, false
+}
+
 func init() {
 	topLevelCommands = append(topLevelCommands, &cmdIP)
 	cmdIP.AddSubcommand(&cmdIPListen)
 	cmdIP.AddSubcommand(&cmdIPSend)
 	cmdIP.AddSubcommand(&cmdIPForward)
+	cmdIPForward.AddSubcommand(&cmdIPForwardBroadcast)
 	cmdIP.AddSubcommand(&cmdIPRoute)
 	cmdIPRoute.AddSubcommand(&cmdIPRouteAdd)
+	cmdIPRoute.AddSubcommand(&cmdIPRouteDel)
+	cmdIPRoute.AddSubcommand(&cmdIPRouteMonitor)
+	cmdIP.AddSubcommand(&cmdIPRule)
+	cmdIPRule.AddSubcommand(&cmdIPRuleAdd)
+	cmdIPRule.AddSubcommand(&cmdIPRuleDel)
+	cmdIP.AddSubcommand(&cmdIPMaddr)
+	cmdIPMaddr.AddSubcommand(&cmdIPMaddrJoin)
+	cmdIPMaddr.AddSubcommand(&cmdIPMaddrLeave)
+	cmdIP.AddSubcommand(&cmdIPMroute)
+	cmdIPMroute.AddSubcommand(&cmdIPMrouteAdd)
+	cmdIPMroute.AddSubcommand(&cmdIPMrouteDel)
+	cmdIP.AddSubcommand(&cmdIPNat)
+	cmdIPNat.AddSubcommand(&cmdIPNatAdd)
+	cmdIPNat.AddSubcommand(&cmdIPNatDel)
 }
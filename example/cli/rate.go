@@ -10,7 +10,6 @@ import (
 
 	"github.com/joshlf/net"
 	"github.com/joshlf/net/example/internal/cli"
-	"github.com/joshlf/net/internal/errors"
 	"github.com/joshlf/rate"
 )
 
@@ -20,8 +19,7 @@ var cmdIPRead = cli.Command{
 	ShortDescription: "Copy a file over an IP connection",
 	LongDescription: `Copy the given file by sending its body in successive IP packets
 with the given protocol number and, optionally, TTL.
-The size of the IP packets will be automatically adjusted
-based on the MTU of the device.`,
+Packets which exceed the MTU of the device will be fragmented.`,
 
 	Run: func(cmd *cli.Command, args []string) {
 		if len(args) != 3 && (len(args) != 5 || args[3] != "--ttl") {
@@ -57,7 +55,6 @@ based on the MTU of the device.`,
 			return
 		}
 
-		// start the buffer large and shrink if we get an MTU error
 		buf := make([]byte, 32768)
 		for err == nil {
 			var n int
@@ -70,13 +67,6 @@ based on the MTU of the device.`,
 				} else {
 					_, err = host.WriteTo(buf[:n], dst, net.IPProtocol(proto))
 				}
-				if errors.IsMTU(err) && len(buf) > 0 {
-					// check len(buf) > 0 in case we have a pathological device
-					// subtract 20 bytes for the IP header
-					buf = buf[:errors.GetMTU(err)-20]
-					err = nil
-					continue
-				}
 				if err != nil {
 					fmt.Println("could not write IP packet:", err)
 					return
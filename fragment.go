@@ -0,0 +1,205 @@
+package net
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// how long to wait for the rest of a datagram's fragments after
+	// receiving the first of them (RFC 1122 section 3.3.2, RFC 8200
+	// section 4.5)
+	reassemblyTimeout = 60 * time.Second
+	// the maximum number of bytes buffered by a reassembler across all
+	// incomplete datagrams; when it would be exceeded, the oldest
+	// datagrams are discarded
+	reassemblyMemLimit = 4 << 20
+	// the number of bytes accounted for each buffered fragment in
+	// addition to its payload, so that floods of tiny fragments
+	// are also limited
+	fragmentOverhead = 64
+	// the number of independent fragment ID counters per host
+	fragmentIDCounters = 256
+)
+
+// fragmentIDHash hashes the addresses and protocol of a packet to choose a
+// fragment ID counter and an offset for its IDs. IDs only need to be unique
+// among packets with the same addresses (and, for IPv4, protocol), so
+// using a number of counters makes reuse less likely (RFC 6864).
+func fragmentIDHash(src, dst []byte, proto IPProtocol) uint32 {
+	return fnv1a(fnv1a(fnv1a(fnvOffset, src...), dst...), byte(proto))
+}
+
+// a fragmentKey identifies the datagram to which a fragment belongs
+type fragmentKey struct {
+	src, dst IP
+	proto    IPProtocol // always 0 for IPv6
+	id       uint32
+}
+
+// a datagram is a datagram which is being reassembled
+type datagram struct {
+	key   fragmentKey
+	hdr   []byte     // everything preceding the first fragment's data; nil until received
+	frags []fragment // sorted by offset, and non-overlapping
+	total int        // the length of the data; -1 until the last fragment is received
+	mem   int
+	timer *time.Timer
+	elem  *list.Element // in reassembler.order
+}
+
+type fragment struct {
+	off  int
+	data []byte
+}
+
+func (f fragment) end() int { return f.off + len(f.data) }
+
+// reassembler reassembles fragmented datagrams. It is independent
+// of the IP version; callers are responsible for parsing fragments
+// and for fixing up the headers of reassembled datagrams.
+type reassembler struct {
+	datagrams map[fragmentKey]*datagram
+	order     *list.List // of *datagram, from oldest to newest
+	mem       int
+	// called (without the lock held) when a datagram times out, with
+	// its first fragment if that has been received, and nil otherwise
+	timeout func(first []byte)
+
+	mu sync.Mutex
+}
+
+func newReassembler(timeout func(first []byte)) *reassembler {
+	return &reassembler{
+		datagrams: make(map[fragmentKey]*datagram),
+		order:     list.New(),
+		timeout:   timeout,
+	}
+}
+
+// add adds a fragment of the datagram identified by key. off is the offset
+// of data in the datagram, more is whether more fragments follow, and hdr is
+// everything which precedes data in the fragment. If this completes the
+// datagram, add returns the first fragment's hdr followed by all of the data.
+// discarded is the number of datagrams discarded because of the fragment,
+// either because they were invalid or in order to stay within the memory
+// limit; if the fragment is itself invalid, it is counted as a discarded
+// datagram.
+func (r *reassembler) add(key fragmentKey, hdr []byte, off int, more bool, data []byte) (pkt []byte, discarded int) {
+	if more && (len(data) == 0 || len(data)%8 != 0) {
+		// only the last fragment's length may not be a multiple of 8
+		return nil, 1
+	}
+	frag := fragment{off: off, data: data}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.datagrams[key]
+	if !ok {
+		d = &datagram{key: key, total: -1}
+		d.timer = time.AfterFunc(reassemblyTimeout, func() { r.expire(d) })
+		d.elem = r.order.PushBack(d)
+		r.datagrams[key] = d
+	}
+
+	// check that the fragment is consistent with those we already have
+	switch {
+	case !more && d.total >= 0 && frag.end() != d.total:
+		// a different last fragment
+		r.remove(d)
+		return nil, 1
+	case !more && len(d.frags) > 0 && d.frags[len(d.frags)-1].end() > frag.end():
+		// data after the last fragment
+		r.remove(d)
+		return nil, 1
+	case more && d.total >= 0 && frag.end() >= d.total:
+		// data after the last fragment
+		r.remove(d)
+		return nil, 1
+	}
+	i := 0
+	for ; i < len(d.frags) && d.frags[i].off < frag.off; i++ {
+	}
+	for _, other := range d.frags {
+		if other.off < frag.end() && frag.off < other.end() {
+			if other.off == frag.off && string(other.data) == string(frag.data) {
+				// an exact duplicate
+				return nil, 0
+			}
+			// overlapping fragments are likely attacks, and
+			// are forbidden in IPv6 (RFC 5722), so discard
+			// the datagram
+			r.remove(d)
+			return nil, 1
+		}
+	}
+
+	// make room for the fragment
+	size := len(data) + fragmentOverhead
+	for r.mem+size > reassemblyMemLimit && r.order.Len() > 0 {
+		oldest := r.order.Front().Value.(*datagram)
+		r.remove(oldest)
+		discarded++
+		if oldest == d {
+			return nil, discarded
+		}
+	}
+
+	frag.data = append([]byte(nil), data...)
+	d.frags = append(d.frags, fragment{})
+	copy(d.frags[i+1:], d.frags[i:])
+	d.frags[i] = frag
+	d.mem += size
+	r.mem += size
+	if frag.off == 0 {
+		d.hdr = append([]byte(nil), hdr...)
+	}
+	if !more {
+		d.total = frag.end()
+	}
+
+	// check whether the datagram is complete
+	if d.hdr == nil || d.total < 0 {
+		return nil, discarded
+	}
+	end := 0
+	for _, f := range d.frags {
+		if f.off != end {
+			return nil, discarded
+		}
+		end = f.end()
+	}
+	r.remove(d)
+	pkt = make([]byte, len(d.hdr)+d.total)
+	copy(pkt, d.hdr)
+	for _, f := range d.frags {
+		copy(pkt[len(d.hdr)+f.off:], f.data)
+	}
+	return pkt, discarded
+}
+
+// remove removes d. r.mu must be held.
+func (r *reassembler) remove(d *datagram) {
+	d.timer.Stop()
+	r.order.Remove(d.elem)
+	delete(r.datagrams, d.key)
+	r.mem -= d.mem
+}
+
+// expire discards d if it is still being reassembled.
+func (r *reassembler) expire(d *datagram) {
+	r.mu.Lock()
+	if r.datagrams[d.key] != d {
+		// already completed or discarded
+		r.mu.Unlock()
+		return
+	}
+	r.remove(d)
+	var first []byte
+	if d.hdr != nil {
+		first = append(append(first, d.hdr...), d.frags[0].data...)
+	}
+	r.mu.Unlock()
+	r.timeout(first)
+}
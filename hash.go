@@ -0,0 +1,72 @@
+package net
+
+// the parameters of the 32-bit FNV-1a hash, which is used to
+// hash the fields of packets which identify their flows
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+// fnv1a adds b to the FNV-1a hash h, which should initially be fnvOffset.
+func fnv1a(h uint32, b ...byte) uint32 {
+	for _, c := range b {
+		h = (h ^ uint32(c)) * fnvPrime
+	}
+	return h
+}
+
+// mix32 mixes the bits of h so that all of them are affected by all of the
+// input, which FNV-1a doesn't ensure for the low bits used by modulus. It's
+// the finalizer of MurmurHash3.
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// hasPorts returns true if packets of the protocol proto
+// begin with 16-bit source and destination ports.
+func hasPorts(proto IPProtocol) bool {
+	// SCTP has no constant of its own
+	return proto == IPProtocolTCP || proto == IPProtocolUDP || proto == 132
+}
+
+// ipv4FlowHash hashes the 5-tuple of the packet whose header is hdr and
+// whose payload is payload. Since only the first fragment of a fragmented
+// packet contains its ports, the ports of fragments are not used.
+func ipv4FlowHash(hdr *ipv4Header, payload []byte) uint32 {
+	h := fnv1a(fnvOffset, hdr.src[:]...)
+	h = fnv1a(h, hdr.dst[:]...)
+	h = fnv1a(h, byte(hdr.proto))
+	if hasPorts(hdr.proto) && hdr.flags&ipv4FlagMF == 0 && hdr.fragOff == 0 && len(payload) >= 4 {
+		h = fnv1a(h, payload[:4]...)
+	}
+	return mix32(h)
+}
+
+// ipv6FlowHash hashes the addresses and flow label of the packet b, whose
+// header is hdr (RFC 6438). If the flow label is unset, the packet's 5-tuple
+// is hashed instead, although its ports are only used if the upper-layer
+// header immediately follows the IPv6 header.
+func ipv6FlowHash(hdr *ipv6Header, b []byte) uint32 {
+	h := fnv1a(fnvOffset, hdr.src[:]...)
+	h = fnv1a(h, hdr.dst[:]...)
+	if hdr.flowLabel != 0 {
+		return mix32(fnv1a(h, byte(hdr.flowLabel>>16), byte(hdr.flowLabel>>8), byte(hdr.flowLabel)))
+	}
+	h = fnv1a(h, byte(hdr.nextHdr))
+	if hasPorts(hdr.nextHdr) && len(b) >= 44 {
+		h = fnv1a(h, b[40:44]...)
+	}
+	return mix32(h)
+}
+
+// addrHash hashes the address addr. Packets which the host sends itself are
+// spread across equal-cost routes by destination only, so that the route a
+// packet will take can be determined before it is built (see SourceIPv6).
+func addrHash(addr []byte) uint32 {
+	return mix32(fnv1a(fnvOffset, addr...))
+}
@@ -0,0 +1,206 @@
+// Package icmp implements the Internet Control Message Protocol for IPv4
+// (RFC 792) and IPv6 (RFC 4443), including echo responders, ping clients,
+// and the delivery of received error messages to upper layers.
+package icmp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// DefaultPingTimeout is the timeout used by Ping if none is given.
+const DefaultPingTimeout = time.Second
+
+// TypeV4 represents the type field of an ICMPv4 message.
+type TypeV4 uint8
+
+const (
+	TypeV4EchoReply        TypeV4 = 0
+	TypeV4DestUnreachable  TypeV4 = 3
+	TypeV4EchoRequest      TypeV4 = 8
+	TypeV4TimeExceeded     TypeV4 = 11
+	TypeV4ParameterProblem TypeV4 = 12
+)
+
+// TypeV6 represents the type field of an ICMPv6 message.
+type TypeV6 uint8
+
+const (
+	TypeV6DestUnreachable  TypeV6 = 1
+	TypeV6PacketTooBig     TypeV6 = 2
+	TypeV6TimeExceeded     TypeV6 = 3
+	TypeV6ParameterProblem TypeV6 = 4
+	TypeV6EchoRequest      TypeV6 = 128
+	TypeV6EchoReply        TypeV6 = 129
+)
+
+// the length of the header of echo request and reply messages, including
+// the identifier and sequence number, which is also the length of the
+// header of error messages, including the type-specific word which
+// precedes the quoted packet
+const echoHeaderLen = 8
+
+// A PingConfig configures a single echo request.
+type PingConfig struct {
+	// Seq is the sequence number of the request.
+	Seq uint16
+	// Size is the number of bytes of data to send after the ICMP header.
+	Size int
+	// TTL is the TTL (for IPv6, the hop limit) of the request. If TTL
+	// is 0, the host's TTL is used.
+	TTL uint8
+	// Timeout is how long to wait for a reply. If Timeout is 0,
+	// DefaultPingTimeout is used.
+	Timeout time.Duration
+}
+
+// A PingResult describes the reply to an echo request.
+type PingResult struct {
+	Seq  uint16
+	Size int // the number of bytes of data after the ICMP header
+	RTT  time.Duration
+}
+
+type echoHeader struct {
+	typ      uint8
+	code     uint8
+	checksum uint16
+	id       uint16
+	seq      uint16
+}
+
+// assumes b is long enough
+func writeEchoHeader(hdr *echoHeader, b []byte) {
+	parse.PutByte(&b, hdr.typ)
+	parse.PutByte(&b, hdr.code)
+	parse.PutUint16(&b, hdr.checksum)
+	parse.PutUint16(&b, hdr.id)
+	parse.PutUint16(&b, hdr.seq)
+}
+
+// assumes b is long enough
+func readEchoHeader(hdr *echoHeader, b []byte) {
+	hdr.typ = parse.GetByte(&b)
+	hdr.code = parse.GetByte(&b)
+	hdr.checksum = parse.GetUint16(&b)
+	hdr.id = parse.GetUint16(&b)
+	hdr.seq = parse.GetUint16(&b)
+}
+
+// makeEcho makes an echo message with the given header and data. The
+// checksum is not computed.
+func makeEcho(hdr echoHeader, data []byte) []byte {
+	b := make([]byte, echoHeaderLen+len(data))
+	hdr.checksum = 0
+	writeEchoHeader(&hdr, b)
+	copy(b[echoHeaderLen:], data)
+	return b
+}
+
+// setChecksum sets the checksum field of the ICMP message b.
+func setChecksum(b []byte, sum uint16) {
+	b = b[2:]
+	parse.PutUint16(&b, sum)
+}
+
+// makePingData makes size bytes of data for an echo request.
+func makePingData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func validatePingConfig(config *PingConfig) error {
+	if config.Size < 0 {
+		return errors.Errorf("negative payload size: %v", config.Size)
+	}
+	if config.Timeout < 0 {
+		return errors.Errorf("negative timeout: %v", config.Timeout)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultPingTimeout
+	}
+	return nil
+}
+
+type echoKey struct {
+	addr net.IP
+	seq  uint16
+}
+
+// a reply or error received in response to an echo request
+type pingEvent struct {
+	size int
+	t    time.Time
+	err  error // if set, the request resulted in an ICMP error message
+}
+
+// pinger keeps track of outstanding echo requests. It is
+// used by the IPv4 and IPv6 hosts to implement Ping.
+type pinger struct {
+	id    uint16 // the identifier of echo requests sent by Ping
+	pings map[echoKey]chan pingEvent
+
+	mu sync.Mutex
+}
+
+func (p *pinger) init(id uint16) {
+	p.id = id
+	p.pings = make(map[echoKey]chan pingEvent)
+}
+
+// add records an outstanding echo request, returning the channel
+// on which the reply or error will be delivered.
+func (p *pinger) add(key echoKey) (chan pingEvent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pings[key]; ok {
+		return nil, errors.Errorf("request to %v with sequence number %v already outstanding", key.addr, key.seq)
+	}
+	// buffered so that delivery never blocks
+	c := make(chan pingEvent, 1)
+	p.pings[key] = c
+	return c, nil
+}
+
+func (p *pinger) remove(key echoKey) {
+	p.mu.Lock()
+	delete(p.pings, key)
+	p.mu.Unlock()
+}
+
+// deliver delivers ev to the echo request with the given key, if it is
+// outstanding. Only the first event for a given request is delivered.
+func (p *pinger) deliver(key echoKey, ev pingEvent) {
+	p.mu.Lock()
+	c, ok := p.pings[key]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case c <- ev:
+	default:
+	}
+}
+
+// wait waits for the reply to an echo request sent at start.
+func (p *pinger) wait(c chan pingEvent, key echoKey, start time.Time, timeout time.Duration) (PingResult, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ev := <-c:
+		if ev.err != nil {
+			return PingResult{}, ev.err
+		}
+		return PingResult{Seq: key.seq, Size: ev.size, RTT: ev.t.Sub(start)}, nil
+	case <-timer.C:
+		return PingResult{}, errors.Timeoutf("ping %v: no reply within %v", key.addr, timeout)
+	}
+}
@@ -0,0 +1,72 @@
+package icmp
+
+import (
+	"testing"
+
+	"github.com/joshlf/net"
+)
+
+type testNode struct {
+	ipv4  net.IPv4Host
+	ipv6  net.IPv6Host
+	icmp4 *IPv4Host
+	icmp6 *IPv6Host
+}
+
+// newTestNetwork creates a network in which two hosts, A on 10.0.0.0/24
+// (fd00::/64) and B on 10.0.1.0/24 (fd00:0:0:1::/64), are connected by a
+// router, R. Each node's address on a subnet ends in its index (A is 1, R is
+// 2 on A's subnet and 1 on B's, and B is 2). The returned function brings
+// all devices down.
+func newTestNetwork(t *testing.T) (a, r, b *testNode, bringDown func()) {
+	var segs [2]net.EthernetSegment
+	var devs []*net.EthernetDevice
+	var mac byte
+	newNode := func() *testNode {
+		n := &testNode{ipv4: net.NewIPv4Host(), ipv6: net.NewIPv6Host()}
+		var err error
+		if n.icmp4, err = NewIPv4Host(n.ipv4); err != nil {
+			t.Fatalf("unexpected error creating ICMP host: %v", err)
+		}
+		if n.icmp6, err = NewIPv6Host(n.ipv6); err != nil {
+			t.Fatalf("unexpected error creating ICMPv6 host: %v", err)
+		}
+		return n
+	}
+	attach := func(n *testNode, subnet, host byte) {
+		mac++
+		dev, err := net.NewEthernetDevice(segs[subnet].NewInterface(), net.MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		mask4 := net.IPv4{255, 255, 255, 0}
+		mask6 := net.IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		dev.SetIPv4(net.IPv4{10, 0, subnet, host}, mask4)
+		dev.SetIPv6(net.IPv6{0: 0xfd, 7: subnet, 15: host}, mask6)
+		n.ipv4.AddIPv4Device(dev)
+		n.ipv4.AddIPv4DeviceRoute(net.IPv4Subnet{Addr: net.IPv4{10, 0, subnet, 0}, Netmask: mask4}, dev)
+		n.ipv6.AddIPv6Device(dev)
+		n.ipv6.AddIPv6DeviceRoute(net.IPv6Subnet{Addr: net.IPv6{0: 0xfd, 7: subnet}, Netmask: mask6}, dev)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		devs = append(devs, dev)
+	}
+
+	a, r, b = newNode(), newNode(), newNode()
+	attach(a, 0, 1)
+	attach(r, 0, 2)
+	attach(r, 1, 1)
+	attach(b, 1, 2)
+	a.ipv4.AddIPv4Route(net.IPv4Subnet{}, net.IPv4{10, 0, 0, 2})
+	a.ipv6.AddIPv6Route(net.IPv6Subnet{}, net.IPv6{0: 0xfd, 15: 2})
+	b.ipv4.AddIPv4Route(net.IPv4Subnet{}, net.IPv4{10, 0, 1, 1})
+	b.ipv6.AddIPv6Route(net.IPv6Subnet{}, net.IPv6{0: 0xfd, 7: 1, 15: 1})
+	r.ipv4.SetForwarding(true)
+	r.ipv6.SetForwarding(true)
+	return a, r, b, func() {
+		for _, dev := range devs {
+			dev.BringDown()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package icmp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/checksum"
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// An IPv4Error is an ICMPv4 error message received by an IPv4Host. It
+// implements the error interface.
+type IPv4Error struct {
+	Type TypeV4
+	Code uint8
+	// Info is the type-specific word which follows the checksum; for
+	// example, the low-order 16 bits of a fragmentation needed message
+	// hold the next-hop MTU (RFC 1191).
+	Info uint32
+	From net.IPv4 // the sender of the error message
+
+	// The source, destination, and protocol of the packet which caused the
+	// error, and the part of its payload quoted in the error message, which
+	// is usually truncated.
+	Src, Dst net.IPv4
+	Proto    net.IPProtocol
+	Data     []byte
+}
+
+func (e *IPv4Error) Error() string {
+	var desc string
+	switch e.Type {
+	case TypeV4DestUnreachable:
+		desc = "destination unreachable"
+	case TypeV4TimeExceeded:
+		desc = "time exceeded"
+	case TypeV4ParameterProblem:
+		desc = "parameter problem"
+	default:
+		desc = fmt.Sprintf("type %v", e.Type)
+	}
+	return fmt.Sprintf("%v (code %v) from %v", desc, e.Code, e.From)
+}
+
+// parseIPv4Error parses the ICMPv4 error message b, which was
+// sent by from. It assumes that b is long enough for the header.
+func parseIPv4Error(b []byte, from net.IPv4) (*IPv4Error, error) {
+	e := &IPv4Error{From: from}
+	e.Type = TypeV4(parse.GetByte(&b))
+	e.Code = parse.GetByte(&b)
+	parse.GetUint16(&b) // checksum
+	e.Info = parse.GetUint32(&b)
+	if len(b) < 20 {
+		return nil, errors.Errorf("quoted packet too short: %v", len(b))
+	}
+	ihl := int(b[0]&0xF) * 4
+	if b[0]>>4 != 4 || ihl < 20 || ihl > len(b) {
+		return nil, errors.New("invalid quoted IPv4 header")
+	}
+	e.Proto = net.IPProtocol(b[9])
+	copy(e.Src[:], b[12:16])
+	copy(e.Dst[:], b[16:20])
+	e.Data = b[ihl:]
+	return e, nil
+}
+
+// IPv4Host implements ICMP for an IPv4 host. It replies to echo requests
+// addressed to the host, sends echo requests on behalf of Ping, and delivers
+// received error messages to callbacks registered with RegisterErrorCallback.
+// The zero value is not a valid IPv4Host.
+type IPv4Host struct {
+	iphost         net.IPv4Host
+	errorCallbacks [256]func(e *IPv4Error)
+	pinger
+
+	mu sync.RWMutex
+}
+
+// NewIPv4Host creates a new IPv4Host, registering it as the
+// ICMP callback of iphost.
+func NewIPv4Host(iphost net.IPv4Host) (*IPv4Host, error) {
+	host := &IPv4Host{iphost: iphost}
+	host.pinger.init(uint16(rand.Intn(1 << 16)))
+	iphost.RegisterIPv4Callback(host.callback, net.IPProtocolICMPv4)
+	return host, nil
+}
+
+// RegisterErrorCallback registers f to be called with any error message
+// received in response to a packet with the given protocol. It overwrites
+// any previously-registered callback. If f is nil, any previously-registered
+// callback is cleared.
+func (host *IPv4Host) RegisterErrorCallback(f func(e *IPv4Error), proto net.IPProtocol) {
+	host.mu.Lock()
+	host.errorCallbacks[int(proto)] = f
+	host.mu.Unlock()
+}
+
+func (host *IPv4Host) callback(b []byte, src, dst net.IPv4) {
+	now := time.Now()
+	if len(b) < echoHeaderLen || checksum.Checksum(b) != 0 {
+		// TODO(joshlf): Log it
+		return
+	}
+	var hdr echoHeader
+	readEchoHeader(&hdr, b)
+	switch TypeV4(hdr.typ) {
+	case TypeV4EchoRequest:
+		hdr.typ = uint8(TypeV4EchoReply)
+		reply := makeEcho(hdr, b[echoHeaderLen:])
+		setChecksum(reply, checksum.Checksum(reply))
+		host.iphost.WriteToIPv4From(reply, host.replySource(dst), src, net.IPProtocolICMPv4)
+		// TODO(joshlf): Log error
+	case TypeV4EchoReply:
+		if hdr.id == host.id {
+			host.deliver(echoKey{addr: src, seq: hdr.seq}, pingEvent{size: len(b) - echoHeaderLen, t: now})
+		}
+	case TypeV4DestUnreachable, TypeV4TimeExceeded, TypeV4ParameterProblem:
+		e, err := parseIPv4Error(b, src)
+		if err != nil {
+			// TODO(joshlf): Log it
+			return
+		}
+		host.handleError(e)
+	}
+}
+
+// replySource returns the source address of a reply to an echo request sent
+// to dst. Replies come from the address to which the request was sent, so that
+// rules which match it are used, unless it was sent to a broadcast or
+// multicast address, in which case the host chooses one of its unicast
+// addresses (RFC 1122 section 3.2.2.6).
+func (host *IPv4Host) replySource(dst net.IPv4) net.IPv4 {
+	if host.iphost.IsLocalIPv4(dst) {
+		return dst
+	}
+	return net.IPv4{}
+}
+
+func (host *IPv4Host) handleError(e *IPv4Error) {
+	if e.Proto == net.IPProtocolICMPv4 && len(e.Data) >= echoHeaderLen {
+		var hdr echoHeader
+		readEchoHeader(&hdr, e.Data)
+		if TypeV4(hdr.typ) == TypeV4EchoRequest && hdr.id == host.id {
+			host.deliver(echoKey{addr: e.Dst, seq: hdr.seq}, pingEvent{err: e})
+		}
+	}
+	host.mu.RLock()
+	f := host.errorCallbacks[int(e.Proto)]
+	host.mu.RUnlock()
+	if f != nil {
+		f(e)
+	}
+}
+
+// Ping sends an echo request to dst as configured by config, and waits for
+// the reply. If an error message is received in response to the request,
+// Ping returns it as an *IPv4Error. If nothing is received before the
+// timeout, Ping returns a timeout error (see net.IsTimeout). Concurrent
+// calls to Ping must not use the same destination and sequence number.
+func (host *IPv4Host) Ping(dst net.IPv4, config PingConfig) (PingResult, error) {
+	if err := validatePingConfig(&config); err != nil {
+		return PingResult{}, errors.Annotate(err, "ping")
+	}
+	key := echoKey{addr: dst, seq: config.Seq}
+	c, err := host.add(key)
+	if err != nil {
+		return PingResult{}, errors.Annotate(err, "ping")
+	}
+	defer host.remove(key)
+
+	iphost := host.iphost
+	if config.TTL != 0 {
+		iphost = iphost.GetConfigCopyIPv4()
+		iphost.SetTTL(config.TTL)
+	}
+	b := makeEcho(echoHeader{typ: uint8(TypeV4EchoRequest), id: host.id, seq: config.Seq}, makePingData(config.Size))
+	setChecksum(b, checksum.Checksum(b))
+	start := time.Now()
+	if _, err := iphost.WriteToIPv4(b, dst, net.IPProtocolICMPv4); err != nil {
+		return PingResult{}, errors.Annotate(err, "ping")
+	}
+	return host.wait(c, key, start, config.Timeout)
+}
@@ -0,0 +1,80 @@
+package icmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/checksum"
+)
+
+func TestPingIPv4(t *testing.T) {
+	a, _, b, bringDown := newTestNetwork(t)
+	defer bringDown()
+
+	for seq := uint16(0); seq < 3; seq++ {
+		res, err := a.icmp4.Ping(net.IPv4{10, 0, 1, 2}, PingConfig{Seq: seq, Size: 56})
+		if err != nil {
+			t.Fatalf("unexpected error pinging: %v", err)
+		}
+		if res.Seq != seq || res.Size != 56 || res.RTT <= 0 {
+			t.Errorf("unexpected result: %+v", res)
+		}
+	}
+
+	// the router reports that the TTL expired
+	errs := make(chan *IPv4Error, 1)
+	a.icmp4.RegisterErrorCallback(func(e *IPv4Error) { errs <- e }, net.IPProtocolICMPv4)
+	_, err := a.icmp4.Ping(net.IPv4{10, 0, 1, 2}, PingConfig{TTL: 1})
+	e, ok := err.(*IPv4Error)
+	if !ok || e.Type != TypeV4TimeExceeded || e.From != (net.IPv4{10, 0, 0, 2}) || e.Dst != (net.IPv4{10, 0, 1, 2}) {
+		t.Errorf("got error %v; want time exceeded from 10.0.0.2", err)
+	}
+	select {
+	case e := <-errs:
+		if e.Type != TypeV4TimeExceeded {
+			t.Errorf("got error callback with %v; want time exceeded", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timed out waiting for error callback")
+	}
+
+	// nothing answers for 10.0.1.3
+	_, err = b.icmp4.Ping(net.IPv4{10, 0, 1, 3}, PingConfig{Timeout: 50 * time.Millisecond})
+	if !net.IsTimeout(err) {
+		t.Errorf("got error %v; want timeout", err)
+	}
+}
+
+func TestEchoBroadcastIPv4(t *testing.T) {
+	a, _, _, bringDown := newTestNetwork(t)
+	defer bringDown()
+
+	// replace A's ICMP host to see the replies themselves
+	type reply struct{ src, dst net.IPv4 }
+	replies := make(chan reply, 4)
+	a.ipv4.RegisterIPv4Callback(func(b []byte, src, dst net.IPv4) {
+		if len(b) >= echoHeaderLen && TypeV4(b[0]) == TypeV4EchoReply {
+			replies <- reply{src, dst}
+		}
+	}, net.IPProtocolICMPv4)
+
+	// R replies from its own unicast address to requests sent to the
+	// limited broadcast address, the directed broadcast address of its
+	// subnet, and the all-systems multicast group
+	for _, dst := range []net.IPv4{net.IPv4Broadcast, {10, 0, 0, 255}, {224, 0, 0, 1}} {
+		req := makeEcho(echoHeader{typ: uint8(TypeV4EchoRequest), id: 1}, []byte{1, 2, 3, 4})
+		setChecksum(req, checksum.Checksum(req))
+		if _, err := a.ipv4.WriteToIPv4(req, dst, net.IPProtocolICMPv4); err != nil {
+			t.Fatalf("unexpected error writing echo request to %v: %v", dst, err)
+		}
+		select {
+		case r := <-replies:
+			if r != (reply{net.IPv4{10, 0, 0, 2}, net.IPv4{10, 0, 0, 1}}) {
+				t.Errorf("got reply to %v from %v to %v; want from 10.0.0.2 to 10.0.0.1", dst, r.src, r.dst)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for reply to %v", dst)
+		}
+	}
+}
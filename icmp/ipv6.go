@@ -0,0 +1,234 @@
+package icmp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/checksum"
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// An IPv6Error is an ICMPv6 error message received by an IPv6Host. It
+// implements the error interface.
+type IPv6Error struct {
+	Type TypeV6
+	Code uint8
+	// Info is the type-specific word which follows the checksum; it holds
+	// the MTU of a Packet Too Big message, and the pointer of a Parameter
+	// Problem message.
+	Info uint32
+	From net.IPv6 // the sender of the error message
+
+	// The source, destination, and next header of the packet which caused
+	// the error, and the part of its payload quoted in the error message,
+	// which is usually truncated.
+	Src, Dst net.IPv6
+	Proto    net.IPProtocol
+	Data     []byte
+}
+
+func (e *IPv6Error) Error() string {
+	var desc string
+	switch e.Type {
+	case TypeV6DestUnreachable:
+		desc = "destination unreachable"
+	case TypeV6PacketTooBig:
+		desc = "packet too big"
+	case TypeV6TimeExceeded:
+		desc = "time exceeded"
+	case TypeV6ParameterProblem:
+		desc = "parameter problem"
+	default:
+		desc = fmt.Sprintf("type %v", e.Type)
+	}
+	return fmt.Sprintf("%v (code %v) from %v", desc, e.Code, e.From)
+}
+
+// parseIPv6Error parses the ICMPv6 error message b, which was
+// sent by from. It assumes that b is long enough for the header.
+func parseIPv6Error(b []byte, from net.IPv6) (*IPv6Error, error) {
+	e := &IPv6Error{From: from}
+	e.Type = TypeV6(parse.GetByte(&b))
+	e.Code = parse.GetByte(&b)
+	parse.GetUint16(&b) // checksum
+	e.Info = parse.GetUint32(&b)
+	if len(b) < 40 {
+		return nil, errors.Errorf("quoted packet too short: %v", len(b))
+	}
+	if b[0]>>4 != 6 {
+		return nil, errors.New("invalid quoted IPv6 header")
+	}
+	copy(e.Src[:], b[8:24])
+	copy(e.Dst[:], b[24:40])
+	e.Proto, e.Data = upperLayer(b)
+	return e, nil
+}
+
+// next header values of the extension headers (RFC 8200 section 4)
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6DestOpts = 60
+)
+
+// upperLayer returns the type of the first header in the quoted packet b
+// which is not an extension header, and the rest of b starting with that
+// header. If the chain is truncated, the type of the truncated header and the
+// rest of b starting with it are returned.
+func upperLayer(b []byte) (proto net.IPProtocol, rest []byte) {
+	proto, rest = net.IPProtocol(b[6]), b[40:]
+	for proto == ipv6HopByHop || proto == ipv6Routing || proto == ipv6Fragment || proto == ipv6DestOpts {
+		// all extension headers are at least 8 bytes long
+		if len(rest) < 8 {
+			break
+		}
+		// the length is in 8-byte units, not counting the first
+		// 8 bytes, except for the Fragment header, which has none
+		n := (int(rest[1]) + 1) * 8
+		if proto == ipv6Fragment {
+			n = 8
+		}
+		if n > len(rest) {
+			break
+		}
+		proto, rest = net.IPProtocol(rest[0]), rest[n:]
+	}
+	return proto, rest
+}
+
+// IPv6Host implements ICMPv6 for an IPv6 host. It replies to echo requests
+// addressed to the host, sends echo requests on behalf of Ping, and delivers
+// received error messages to callbacks registered with RegisterErrorCallback.
+// Neighbor Discovery messages are handled by devices, and are never
+// delivered to an IPv6Host. The zero value is not a valid IPv6Host.
+type IPv6Host struct {
+	iphost         net.IPv6Host
+	errorCallbacks [256]func(e *IPv6Error)
+	pinger
+
+	mu sync.RWMutex
+}
+
+// NewIPv6Host creates a new IPv6Host, registering it as the
+// ICMPv6 callback of iphost.
+func NewIPv6Host(iphost net.IPv6Host) (*IPv6Host, error) {
+	host := &IPv6Host{iphost: iphost}
+	host.pinger.init(uint16(rand.Intn(1 << 16)))
+	iphost.RegisterIPv6Callback(host.callback, net.IPProtocolICMPv6)
+	return host, nil
+}
+
+// RegisterErrorCallback registers f to be called with any error message
+// received in response to a packet with the given next header. It
+// overwrites any previously-registered callback. If f is nil, any
+// previously-registered callback is cleared.
+func (host *IPv6Host) RegisterErrorCallback(f func(e *IPv6Error), proto net.IPProtocol) {
+	host.mu.Lock()
+	host.errorCallbacks[int(proto)] = f
+	host.mu.Unlock()
+}
+
+// sum computes the checksum of the ICMPv6 message b sent from src to dst.
+func sum(b []byte, src, dst net.IPv6) uint16 {
+	s := checksum.IPv6PseudoHeaderSum(src, dst, len(b), uint8(net.IPProtocolICMPv6))
+	return checksum.Finish(checksum.Add(s, b))
+}
+
+func (host *IPv6Host) callback(b []byte, src, dst net.IPv6) {
+	now := time.Now()
+	if len(b) < echoHeaderLen || sum(b, src, dst) != 0 {
+		// TODO(joshlf): Log it
+		return
+	}
+	var hdr echoHeader
+	readEchoHeader(&hdr, b)
+	switch TypeV6(hdr.typ) {
+	case TypeV6EchoRequest:
+		hdr.typ = uint8(TypeV6EchoReply)
+		host.write(makeEcho(hdr, b[echoHeaderLen:]), host.replySource(dst), src, host.iphost)
+		// TODO(joshlf): Log error
+	case TypeV6EchoReply:
+		if hdr.id == host.id {
+			host.deliver(echoKey{addr: src, seq: hdr.seq}, pingEvent{size: len(b) - echoHeaderLen, t: now})
+		}
+	case TypeV6DestUnreachable, TypeV6PacketTooBig, TypeV6TimeExceeded, TypeV6ParameterProblem:
+		e, err := parseIPv6Error(b, src)
+		if err != nil {
+			// TODO(joshlf): Log it
+			return
+		}
+		host.handleError(e)
+	}
+}
+
+// replySource is like IPv4Host.replySource, but for IPv6.
+func (host *IPv6Host) replySource(dst net.IPv6) net.IPv6 {
+	if host.iphost.IsLocalIPv6(dst) {
+		return dst
+	}
+	return net.IPv6{}
+}
+
+// write computes the checksum of the ICMPv6 message b and writes it from
+// src to dst using iphost. If src is the zero address, the address which
+// iphost would choose is used.
+func (host *IPv6Host) write(b []byte, src, dst net.IPv6, iphost net.IPv6Host) (n int, err error) {
+	if src == (net.IPv6{}) {
+		src, err = iphost.SourceIPv6(dst)
+		if err != nil {
+			return 0, err
+		}
+	}
+	setChecksum(b, sum(b, src, dst))
+	return iphost.WriteToIPv6From(b, src, dst, net.IPProtocolICMPv6)
+}
+
+func (host *IPv6Host) handleError(e *IPv6Error) {
+	if e.Proto == net.IPProtocolICMPv6 && len(e.Data) >= echoHeaderLen {
+		var hdr echoHeader
+		readEchoHeader(&hdr, e.Data)
+		if TypeV6(hdr.typ) == TypeV6EchoRequest && hdr.id == host.id {
+			host.deliver(echoKey{addr: e.Dst, seq: hdr.seq}, pingEvent{err: e})
+		}
+	}
+	host.mu.RLock()
+	f := host.errorCallbacks[int(e.Proto)]
+	host.mu.RUnlock()
+	if f != nil {
+		f(e)
+	}
+}
+
+// Ping sends an echo request to dst as configured by config, and waits for
+// the reply. If an error message is received in response to the request,
+// Ping returns it as an *IPv6Error. If nothing is received before the
+// timeout, Ping returns a timeout error (see net.IsTimeout). Concurrent
+// calls to Ping must not use the same destination and sequence number.
+func (host *IPv6Host) Ping(dst net.IPv6, config PingConfig) (PingResult, error) {
+	if err := validatePingConfig(&config); err != nil {
+		return PingResult{}, errors.Annotate(err, "ping")
+	}
+	key := echoKey{addr: dst, seq: config.Seq}
+	c, err := host.add(key)
+	if err != nil {
+		return PingResult{}, errors.Annotate(err, "ping")
+	}
+	defer host.remove(key)
+
+	iphost := host.iphost
+	if config.TTL != 0 {
+		iphost = iphost.GetConfigCopyIPv6()
+		iphost.SetTTL(config.TTL)
+	}
+	b := makeEcho(echoHeader{typ: uint8(TypeV6EchoRequest), id: host.id, seq: config.Seq}, makePingData(config.Size))
+	start := time.Now()
+	if _, err := host.write(b, net.IPv6{}, dst, iphost); err != nil {
+		return PingResult{}, errors.Annotate(err, "ping")
+	}
+	return host.wait(c, key, start, config.Timeout)
+}
@@ -0,0 +1,95 @@
+package icmp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net"
+)
+
+func TestPingIPv6(t *testing.T) {
+	a, _, _, bringDown := newTestNetwork(t)
+	defer bringDown()
+
+	dst := net.IPv6{0: 0xfd, 7: 1, 15: 2}
+	for seq := uint16(0); seq < 3; seq++ {
+		res, err := a.icmp6.Ping(dst, PingConfig{Seq: seq, Size: 56})
+		if err != nil {
+			t.Fatalf("unexpected error pinging: %v", err)
+		}
+		if res.Seq != seq || res.Size != 56 || res.RTT <= 0 {
+			t.Errorf("unexpected result: %+v", res)
+		}
+	}
+
+	// the router reports that the hop limit was exceeded
+	_, err := a.icmp6.Ping(dst, PingConfig{TTL: 1})
+	if e, ok := err.(*IPv6Error); !ok || e.Type != TypeV6TimeExceeded || e.From != (net.IPv6{0: 0xfd, 15: 2}) {
+		t.Errorf("got error %v; want time exceeded from fd00::2", err)
+	}
+
+	// and that it has no route
+	_, err = a.icmp6.Ping(net.IPv6{0: 0xfd, 7: 2, 15: 1}, PingConfig{})
+	if e, ok := err.(*IPv6Error); !ok || e.Type != TypeV6DestUnreachable {
+		t.Errorf("got error %v; want destination unreachable", err)
+	}
+}
+
+func TestParseIPv6Error(t *testing.T) {
+	// a Time Exceeded message quoting a UDP packet with Hop-by-Hop Options
+	// and Fragment headers
+	quoted := make([]byte, 40)
+	quoted[0] = 6 << 4
+	quoted[6] = ipv6HopByHop
+	quoted = append(quoted, ipv6Fragment, 0, 1, 4, 0, 0, 0, 0) // PadN
+	quoted = append(quoted, byte(net.IPProtocolUDP), 0, 0, 0, 0, 0, 0, 1)
+	udp := []byte{0, 1, 0, 2, 0, 8, 0, 0}
+	msg := append([]byte{byte(TypeV6TimeExceeded), 0, 0, 0, 0, 0, 0, 0}, append(quoted, udp...)...)
+	e, err := parseIPv6Error(msg, net.IPv6{})
+	if err != nil {
+		t.Fatalf("unexpected error parsing message: %v", err)
+	}
+	if e.Proto != net.IPProtocolUDP || !reflect.DeepEqual(e.Data, udp) {
+		t.Errorf("got protocol %v and data %v; want %v and %v", e.Proto, e.Data, net.IPProtocolUDP, udp)
+	}
+
+	// if the chain is truncated, the truncated header is reported
+	e, err = parseIPv6Error(msg[:8+40+12], net.IPv6{})
+	if err != nil {
+		t.Fatalf("unexpected error parsing message: %v", err)
+	}
+	if e.Proto != ipv6Fragment || len(e.Data) != 4 {
+		t.Errorf("got protocol %v and data %v; want %v and 4 bytes", e.Proto, e.Data, ipv6Fragment)
+	}
+}
+
+func TestEchoMulticastIPv6(t *testing.T) {
+	a, _, _, bringDown := newTestNetwork(t)
+	defer bringDown()
+
+	// replace A's ICMPv6 host to see the replies themselves
+	type reply struct{ src, dst net.IPv6 }
+	replies := make(chan reply, 4)
+	a.ipv6.RegisterIPv6Callback(func(b []byte, src, dst net.IPv6) {
+		if len(b) >= echoHeaderLen && TypeV6(b[0]) == TypeV6EchoReply {
+			replies <- reply{src, dst}
+		}
+	}, net.IPProtocolICMPv6)
+
+	// R replies from its own unicast address to a request sent to the
+	// all-nodes multicast group
+	dst := net.IPv6{0: 0xff, 1: 0x02, 15: 1}
+	req := makeEcho(echoHeader{typ: uint8(TypeV6EchoRequest), id: 1}, []byte{1, 2, 3, 4})
+	if _, err := a.icmp6.write(req, net.IPv6{0: 0xfd, 15: 1}, dst, a.ipv6); err != nil {
+		t.Fatalf("unexpected error writing echo request: %v", err)
+	}
+	select {
+	case r := <-replies:
+		if want := (reply{net.IPv6{0: 0xfd, 15: 2}, net.IPv6{0: 0xfd, 15: 1}}); r != want {
+			t.Errorf("got reply from %v to %v; want from %v to %v", r.src, r.dst, want.src, want.dst)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timed out waiting for reply")
+	}
+}
@@ -0,0 +1,263 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// ICMP error messages sent by IPv4Hosts (RFC 792 and RFC 1812) and
+// IPv6Hosts (RFC 4443)
+
+const (
+	icmpv4TypeDestUnreachable  = 3
+	icmpv4TypeSourceQuench     = 4
+	icmpv4TypeRedirect         = 5
+	icmpv4TypeTimeExceeded     = 11
+	icmpv4TypeParameterProblem = 12
+
+	// Destination Unreachable codes
+	icmpv4CodeNetUnreachable      = 0
+	icmpv4CodeHostUnreachable     = 1
+	icmpv4CodeProtocolUnreachable = 2
+	icmpv4CodePortUnreachable     = 3
+	icmpv4CodeFragmentationNeeded = 4
+
+	// Time Exceeded codes
+	icmpv4CodeTTLExceeded        = 0
+	icmpv4CodeReassemblyExceeded = 1
+
+	// the maximum length of the IP packet containing an ICMPv4
+	// error message (RFC 1812 section 4.3.2.3)
+	icmpv4ErrorMaxLen = 576
+)
+
+const (
+	icmpv6TypeDestUnreachable  = 1
+	icmpv6TypePacketTooBig     = 2
+	icmpv6TypeTimeExceeded     = 3
+	icmpv6TypeParameterProblem = 4
+
+	// Destination Unreachable codes
+	icmpv6CodeNoRoute            = 0
+	icmpv6CodeAddressUnreachable = 3
+	icmpv6CodePortUnreachable    = 4
+
+	// Time Exceeded codes
+	icmpv6CodeHopLimitExceeded   = 0
+	icmpv6CodeReassemblyExceeded = 1
+
+	// Parameter Problem codes
+	icmpv6CodeErroneousHeaderField   = 0
+	icmpv6CodeUnrecognizedNextHeader = 1
+	icmpv6CodeUnrecognizedOption     = 2
+
+	// the maximum length of the IP packet containing an ICMPv6
+	// error message, which is the minimum IPv6 MTU (RFC 4443
+	// section 2.4)
+	icmpv6ErrorMaxLen = 1280
+
+	// the offset of the next header field in the IPv6 header
+	ipv6NextHeaderOffset = 6
+
+	// the next header value indicating that nothing follows
+	ipv6NoNextHeader = 59
+)
+
+const (
+	// the default rate limit on ICMP error messages, in
+	// messages per second, and the default burst size
+	defaultICMPRate  = 100
+	defaultICMPBurst = 50
+)
+
+// icmpErrorLen is the length of the header of an ICMP error message,
+// including the type-specific word which precedes the quoted packet.
+const icmpErrorLen = 8
+
+// makeICMPError makes an ICMP error message with the given type, code, and
+// type-specific word which quotes as much of the packet b as fits in max
+// bytes. The checksum is not computed.
+func makeICMPError(typ, code uint8, word uint32, b []byte, max int) []byte {
+	if len(b) > max-icmpErrorLen {
+		b = b[:max-icmpErrorLen]
+	}
+	msg := make([]byte, icmpErrorLen+len(b))
+	buf := msg
+	parse.PutByte(&buf, typ)
+	parse.PutByte(&buf, code)
+	parse.PutUint16(&buf, 0) // checksum
+	parse.PutUint32(&buf, word)
+	copy(buf, b)
+	return msg
+}
+
+// setICMPChecksum sets the checksum field of the ICMP message
+// msg given the partial sum of any pseudo-header.
+func setICMPChecksum(msg []byte, sum uint32) {
+	sum = checksum.Add(sum, msg)
+	buf := msg[2:]
+	parse.PutUint16(&buf, checksum.Finish(sum))
+}
+
+// writeICMPv4Error sends an ICMPv4 error message with the given type, code,
+// and type-specific word in response to the packet b, whose header is hdr,
+// subject to the rules of RFC 1812 section 4.3.2.7 and to the host's rate
+// limit. host.mu must be held.
+func (host *ipv4Host) writeICMPv4Error(b []byte, hdr *ipv4Header, typ, code uint8, word uint32) {
+	if !shouldSendICMPv4Error(b, hdr) {
+		return
+	}
+	// shouldSendICMPv4Error can only recognize the limited broadcast
+	// address; directed broadcasts depend on the host's subnets
+	if _, ok := host.isBroadcast(hdr.dst); ok {
+		return
+	}
+	if _, ok := host.isBroadcast(hdr.src); ok {
+		return
+	}
+	if !host.icmpLimit.allow(time.Now()) {
+		return
+	}
+	msg := makeICMPError(typ, code, word, b, icmpv4ErrorMaxLen-20)
+	setICMPChecksum(msg, 0)
+	host.write(msg, IPv4{}, hdr.src, IPProtocolICMPv4, defaultTTL)
+	// TODO(joshlf): Log error
+}
+
+// shouldSendICMPv4Error returns false if an ICMPv4 error message must not be
+// sent in response to the packet b, whose header is hdr (see RFC 1812 section
+// 4.3.2.7).
+func shouldSendICMPv4Error(b []byte, hdr *ipv4Header) bool {
+	if hdr.fragOff != 0 {
+		// only the first fragment
+		return false
+	}
+	if hdr.proto == IPProtocolICMPv4 {
+		off := int(hdr.IHL) * 4
+		if len(b) <= off {
+			return false
+		}
+		if isICMPv4Error(b[off]) {
+			return false
+		}
+	}
+	if hdr.dst.IsMulticast() || hdr.dst == IPv4Broadcast {
+		return false
+	}
+	// the source must identify a single host
+	src := hdr.src
+	return !(src == IPv4{} || src[0] == 127 || src[0] >= 224)
+}
+
+// isICMPv4Error returns true for ICMP error messages: destination unreachable,
+// source quench, redirect, time exceeded, and parameter problem.
+func isICMPv4Error(typ uint8) bool {
+	switch typ {
+	case icmpv4TypeDestUnreachable, icmpv4TypeSourceQuench, icmpv4TypeRedirect,
+		icmpv4TypeTimeExceeded, icmpv4TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// writeICMPv6Error sends an ICMPv6 error message with the given type, code,
+// and type-specific word in response to the packet b, whose header is hdr,
+// subject to the rules of RFC 4443 section 2.4 and to the host's rate limit.
+// host.mu must be held.
+func (host *ipv6Host) writeICMPv6Error(b []byte, hdr *ipv6Header, typ, code uint8, word uint32) {
+	if !shouldSendICMPv6Error(b, hdr, typ, code) || !host.icmpLimit.allow(time.Now()) {
+		return
+	}
+	src, err := host.source(hdr.src)
+	if err != nil {
+		return
+	}
+	msg := makeICMPError(typ, code, word, b, icmpv6ErrorMaxLen-40)
+	setICMPChecksum(msg, checksum.IPv6PseudoHeaderSum(src, hdr.src, len(msg), uint8(IPProtocolICMPv6)))
+	host.write(msg, IPv6{}, hdr.src, IPProtocolICMPv6, defaultTTL)
+	// TODO(joshlf): Log error
+}
+
+// shouldSendICMPv6Error returns false if an ICMPv6 error message of the
+// given type and code must not be sent in response to the packet b, whose
+// header is hdr (see RFC 4443 section 2.4).
+func shouldSendICMPv6Error(b []byte, hdr *ipv6Header, typ, code uint8) bool {
+	if proto, off := ipv6UpperLayer(b); proto == IPProtocolICMPv6 && (len(b) <= off || b[off] < 128) {
+		// an error message (or a truncated message)
+		return false
+	}
+	if hdr.dst[0] == 0xff && typ != icmpv6TypePacketTooBig &&
+		(typ != icmpv6TypeParameterProblem || code != icmpv6CodeUnrecognizedOption) {
+		// unrecognized options whose types ask for errors
+		// even for multicast packets are the other exception
+		return false
+	}
+	// the source must identify a single host
+	return hdr.src != IPv6{} && hdr.src[0] != 0xff
+}
+
+// reconstructIPv4Packet reconstructs a packet with the given payload,
+// addresses, and protocol which was delivered to a callback.
+func reconstructIPv4Packet(b []byte, src, dst IPv4, proto IPProtocol) ([]byte, *ipv4Header) {
+	hdr := &ipv4Header{version: 4, IHL: 5, len: uint16(20 + len(b)), proto: proto, src: src, dst: dst}
+	pkt := make([]byte, 20+len(b))
+	writeIPv4Header(hdr, pkt)
+	setIPv4Checksum(pkt)
+	copy(pkt[20:], b)
+	return pkt, hdr
+}
+
+// reconstructIPv6Packet is like reconstructIPv4Packet, but for IPv6.
+func reconstructIPv6Packet(b []byte, src, dst IPv6, proto IPProtocol) ([]byte, *ipv6Header) {
+	hdr := &ipv6Header{version: 6, len: uint16(len(b)), nextHdr: proto, src: src, dst: dst}
+	pkt := make([]byte, 40+len(b))
+	writeIPv6Header(hdr, pkt)
+	copy(pkt[40:], b)
+	return pkt, hdr
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  int     // the capacity of the bucket
+	tokens float64
+	last   time.Time // when tokens was last updated
+
+	mu sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// set sets the rate and capacity of tb.
+func (tb *tokenBucket) set(rate float64, burst int) {
+	tb.mu.Lock()
+	tb.rate, tb.burst = rate, burst
+	if tb.tokens > float64(burst) {
+		tb.tokens = float64(burst)
+	}
+	tb.mu.Unlock()
+}
+
+// allow takes a token from tb if one is available
+// at time now, and returns whether it did so.
+func (tb *tokenBucket) allow(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		tb.last = now
+	}
+	if tb.tokens > float64(tb.burst) {
+		tb.tokens = float64(tb.burst)
+	}
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
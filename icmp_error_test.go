@@ -0,0 +1,102 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+)
+
+func TestICMPv4Errors(t *testing.T) {
+	// host 10.0.0.1 is connected to a router, 10.0.0.2, which
+	// is also connected to 10.0.1.0/24
+	var lan, wan EthernetSegment
+	newDev := func(seg *EthernetSegment, mac byte, addr IPv4) *EthernetDevice {
+		dev, err := NewEthernetDevice(seg.NewInterface(), MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(addr, IPv4{255, 255, 255, 0})
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		return dev
+	}
+	hostdev := newDev(&lan, 1, IPv4{10, 0, 0, 1})
+	defer hostdev.BringDown()
+	lanSubnet := IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: IPv4{255, 255, 255, 0}}
+	host := NewIPv4Host()
+	host.AddIPv4Device(hostdev)
+	host.AddIPv4DeviceRoute(lanSubnet, hostdev)
+	host.AddIPv4Route(IPv4Subnet{}, IPv4{10, 0, 0, 2})
+
+	routerdevs := []*EthernetDevice{newDev(&lan, 2, IPv4{10, 0, 0, 2}), newDev(&wan, 3, IPv4{10, 0, 1, 1})}
+	router := NewIPv4Host()
+	router.SetForwarding(true)
+	for i, dev := range routerdevs {
+		defer dev.BringDown()
+		router.AddIPv4Device(dev)
+		router.AddIPv4DeviceRoute(IPv4Subnet{Addr: IPv4{10, 0, byte(i), 0}, Netmask: lanSubnet.Netmask}, dev)
+	}
+
+	c := make(chan []byte, 4)
+	host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { c <- b }, IPProtocolICMPv4)
+	expect := func(typ, code uint8, dst IPv4) {
+		select {
+		case b := <-c:
+			if len(b) < icmpErrorLen+20 {
+				t.Fatalf("message too short: %v", b)
+			}
+			if checksum.Checksum(b) != 0 {
+				t.Errorf("invalid checksum")
+			}
+			var hdr ipv4Header
+			readIPv4Header(&hdr, b[icmpErrorLen:])
+			if b[0] != typ || b[1] != code || hdr.dst != dst {
+				t.Errorf("got type %v, code %v for %v; want type %v, code %v for %v", b[0], b[1], hdr.dst, typ, code, dst)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for ICMP message")
+		}
+	}
+
+	write := func(host IPv4Host, dst IPv4, proto IPProtocol) {
+		if _, err := host.WriteToIPv4([]byte("hello"), dst, proto); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+	}
+	write(host, IPv4{10, 0, 0, 2}, 200)
+	expect(icmpv4TypeDestUnreachable, icmpv4CodeProtocolUnreachable, IPv4{10, 0, 0, 2})
+	ttlhost := host.GetConfigCopyIPv4()
+	ttlhost.SetTTL(1)
+	write(ttlhost, IPv4{10, 0, 1, 2}, 200)
+	expect(icmpv4TypeTimeExceeded, icmpv4CodeTTLExceeded, IPv4{10, 0, 1, 2})
+	write(host, IPv4{192, 168, 0, 1}, 200)
+	expect(icmpv4TypeDestUnreachable, icmpv4CodeNetUnreachable, IPv4{192, 168, 0, 1})
+
+	router.SetICMPv4RateLimit(0, 0)
+	write(host, IPv4{192, 168, 0, 1}, 200)
+	select {
+	case b := <-c:
+		t.Errorf("unexpected ICMP message with rate limiting: %v", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 2)
+	tb.last = now
+	for i, want := range []bool{true, true, false} {
+		if got := tb.allow(now); got != want {
+			t.Errorf("allow %v: got %v; want %v", i, got, want)
+		}
+	}
+	// half a second is enough for one more token
+	if !tb.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected token after refill")
+	}
+	if tb.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("unexpected token")
+	}
+}
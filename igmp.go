@@ -0,0 +1,142 @@
+package net
+
+import (
+	"math"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// IGMPv3 (RFC 3376), the protocol with which IPv4 hosts report their
+// multicast group memberships to multicast routers
+
+const (
+	igmpTypeQuery    = 0x11
+	igmpTypeReportV3 = 0x22
+
+	// the length of an IGMPv1 or IGMPv2 message, and
+	// the minimum length of an IGMPv3 query
+	igmpV2Len      = 8
+	igmpV3QueryLen = 12
+
+	// the Max Resp Time of IGMPv1 queries, which leave the field zero
+	// (RFC 3376 section 7.1)
+	igmpV1MaxResp = 10 * time.Second
+)
+
+// igmpv3Routers is the all-IGMPv3-capable-multicast-routers
+// group, 224.0.0.22, to which reports are sent.
+var igmpv3Routers = IPv4{224, 0, 0, 22}
+
+// ipv4RouterAlert is the Router Alert option (RFC 2113), which IGMP messages
+// carry so that routers examine them even though they aren't addressed to
+// the router.
+var ipv4RouterAlert = []byte{0x94, 0x04, 0, 0}
+
+// igmpReportable returns false for the all-systems group, whose membership
+// is never reported (RFC 3376 section 5).
+func igmpReportable(group string) bool {
+	return group != string(ipv4AllSystems[:])
+}
+
+// handleIGMP handles the IGMP message b, which was received on dev in a
+// packet whose header is hdr. Only queries are handled; we don't act as a
+// multicast router, so reports are ignored. host.mu must be held.
+func (host *ipv4Host) handleIGMP(dev IPv4Device, b []byte, hdr *ipv4Header) {
+	if len(b) < igmpV2Len || b[0] != igmpTypeQuery || checksum.Checksum(b) != 0 {
+		// TODO(joshlf): Log it
+		return
+	}
+	// TODO(joshlf): Implement compatibility with IGMPv1 and IGMPv2 routers
+	// (RFC 3376 section 7), which requires sending older reports while such
+	// routers are present
+	var maxResp time.Duration
+	var group IPv4
+	var sources []string
+	buf := b[1:]
+	code := parse.GetByte(&buf)
+	parse.GetUint16(&buf) // checksum
+	copy(group[:], parse.GetBytes(&buf, 4))
+	switch {
+	case len(b) == igmpV2Len:
+		maxResp = time.Duration(code) * time.Second / 10
+		if code == 0 {
+			maxResp = igmpV1MaxResp
+		}
+	case len(b) >= igmpV3QueryLen:
+		maxResp = time.Duration(mcastDecodeCode(uint(code), 3, 4)) * time.Second / 10
+		parse.GetBytes(&buf, 2) // flags and QQIC
+		n := int(parse.GetUint16(&buf))
+		if len(buf) < n*4 {
+			return
+		}
+		for i := 0; i < n; i++ {
+			sources = append(sources, string(parse.GetBytes(&buf, 4)))
+		}
+	default:
+		return
+	}
+
+	switch {
+	case group == IPv4{}:
+		if hdr.dst != ipv4AllSystems {
+			return
+		}
+		host.igmp.query(dev, "", nil, maxResp)
+	case group.IsMulticast():
+		host.igmp.query(dev, string(group[:]), sources, maxResp)
+	}
+}
+
+// mcastDecodeCode decodes the exponential encoding of the Max Resp Code of
+// IGMPv3 and MLDv2 queries, which have exp-bit exponents and mant-bit
+// mantissas (RFC 3376 section 4.1.1, RFC 3810 section 5.1.3). Codes less
+// than 1<<(exp+mant) are not encoded.
+func mcastDecodeCode(code uint, exp, mant uint) uint {
+	if code < 1<<(exp+mant) {
+		return code
+	}
+	e := (code >> mant) & (1<<exp - 1)
+	m := code & (1<<mant - 1)
+	return (m | 1<<mant) << (e + 3)
+}
+
+// writeIGMPReports sends IGMPv3 reports containing records on dev, which
+// must be an IPv4Device. host.mu must not be held.
+func (host *ipv4Host) writeIGMPReports(d interface{}, records []mcastRecord) {
+	dev := d.(IPv4Device)
+	host.mu.RLock()
+	// reports are sent from 0.0.0.0 if the device has
+	// no address (RFC 3376 section 4.2.13)
+	src, _ := selectIPv4Source(host.addrs[dev])
+	host.mu.RUnlock()
+
+	const hdrLen = 24 // including the Router Alert option
+	max := dev.MTU() - hdrLen
+	if dev.MTU() == 0 {
+		max = math.MaxUint16 - hdrLen
+	}
+	for _, msg := range makeMcastReports(igmpTypeReportV3, records, max) {
+		setICMPChecksum(msg, 0)
+		hdr := ipv4Header{
+			version: 4,
+			IHL:     hdrLen / 4,
+			// Internetwork Control (RFC 3376 section 4)
+			DSCP:  0x30,
+			len:   uint16(hdrLen + len(msg)),
+			id:    host.nextID(src, igmpv3Routers, IPProtocolIGMP),
+			TTL:   1,
+			proto: IPProtocolIGMP,
+			src:   src,
+			dst:   igmpv3Routers,
+		}
+		buf := make([]byte, hdrLen+len(msg))
+		writeIPv4Header(&hdr, buf)
+		copy(buf[20:], ipv4RouterAlert)
+		setIPv4Checksum(buf)
+		copy(buf[hdrLen:], msg)
+		dev.WriteToIPv4(buf, igmpv3Routers)
+		// TODO(joshlf): Log error
+	}
+}
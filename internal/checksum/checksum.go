@@ -0,0 +1,44 @@
+// Package checksum implements the Internet checksum.
+//
+// See RFC 1071 for a description of the Internet checksum
+// and techniques for computing it.
+package checksum
+
+// Add adds the 16-bit big endian words of b to the running one's complement
+// sum sum, returning the new sum. If b has an odd length, it is padded with a
+// trailing zero byte. Since the final result is folded before use, sums of up
+// to many kilobytes cannot overflow.
+func Add(sum uint32, b []byte) uint32 {
+	for len(b) > 1 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// Finish folds sum into 16 bits and returns its one's complement,
+// which is the value to be stored in a checksum field.
+func Finish(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+// Checksum computes the Internet checksum of b.
+func Checksum(b []byte) uint16 {
+	return Finish(Add(0, b))
+}
+
+// IPv6PseudoHeaderSum returns the partial sum of the IPv6 pseudo-header
+// described in RFC 8200 section 8.1, for use in computing the checksum of an
+// upper-layer packet of the given length.
+func IPv6PseudoHeaderSum(src, dst [16]byte, length int, proto uint8) uint32 {
+	sum := Add(0, src[:])
+	sum = Add(sum, dst[:])
+	sum += uint32(length>>16) + uint32(length&0xFFFF)
+	return sum + uint32(proto)
+}
@@ -106,3 +106,28 @@ func IsNoRoute(err error) bool {
 	_, ok := errors.Cause(err).(*noRoute)
 	return ok
 }
+
+type hostUnreachable struct {
+	errors.Err
+}
+
+// NewHostUnreachable constructs a new error indicating that the given host,
+// though routable, could not be reached on the local link (for example,
+// because address resolution failed).
+func NewHostUnreachable(host string) error {
+	var err errors.Err
+	if host == "" {
+		err = errors.NewErr("host unreachable")
+	} else {
+		err = errors.NewErr(host + ": host unreachable")
+	}
+	err.SetLocation(1)
+	return &hostUnreachable{err}
+}
+
+// IsHostUnreachable returns true if err is a host unreachable error as
+// constructed using NewHostUnreachable.
+func IsHostUnreachable(err error) bool {
+	_, ok := errors.Cause(err).(*hostUnreachable)
+	return ok
+}
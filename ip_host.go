@@ -9,17 +9,172 @@ type IPv4Host interface {
 	RemoveIPv4Device(dev IPv4Device)
 	RegisterIPv4Callback(f func(b []byte, src, dst IPv4), proto IPProtocol)
 	AddIPv4Route(subnet IPv4Subnet, nexthop IPv4)
+
+	// AddIPv4RouteEntry adds route to the table named by route.Table,
+	// replacing any route for the same subnet with the same source and next
+	// hop. AddIPv4Route(subnet, nexthop) is equivalent to adding a static
+	// route with a metric of 0 to the main table.
+	AddIPv4RouteEntry(route IPv4Route)
+
+	// AddIPv4DeviceRoute adds a device route to the main table.
+	// AddIPv4DeviceRouteEntry adds one to the table named by route.Table.
 	AddIPv4DeviceRoute(subnet IPv4Subnet, dev IPv4Device)
+	AddIPv4DeviceRouteEntry(route IPv4DeviceRoute)
+
+	// IPv4Routes returns all of the host's routes in all tables, including
+	// those which aren't currently used, which have Selected unset.
 	IPv4Routes() []IPv4Route
 	IPv4DeviceRoutes() []IPv4DeviceRoute
+
+	// DeleteIPv4Route deletes the route for route.Subnet with route.Source
+	// and route.Nexthop from the table named by route.Table, returning false
+	// if there is no such route.
+	DeleteIPv4Route(route IPv4Route) bool
+
+	// DeleteIPv4DeviceRoute deletes the device route for route.Subnet from
+	// the table named by route.Table, returning false if there is no such
+	// route.
+	DeleteIPv4DeviceRoute(route IPv4DeviceRoute) bool
+
+	// ReplaceIPv4Routes atomically replaces all of the routes for subnet
+	// from source in the named table with routes, whose Subnet, Source, and
+	// Table fields are ignored. Routing protocols can use it to change the
+	// paths to a subnet without packets being misrouted while some of the
+	// routes have been changed.
+	ReplaceIPv4Routes(table string, subnet IPv4Subnet, source RouteSource, routes []IPv4Route)
+
+	// WatchIPv4Routes arranges for events describing subsequent changes to
+	// the host's routes and device routes to be sent on c until stop is
+	// called. Sends on c never block; if c is full, events are dropped, and
+	// the next event which is sent has Lost set. The last slot in c is
+	// reserved for an event which only has Lost set, so that dropped events
+	// are always reported; c should have a capacity of at least 2.
+	WatchIPv4Routes(c chan<- IPv4RouteEvent) (stop func())
+
+	// AddIPv4Rule adds a routing policy rule. Rules are consulted in order
+	// of priority (and, among rules with the same priority, in the order in
+	// which they were added), and the first which matches a packet selects
+	// the table used to route it. If the table has no route for the packet,
+	// the next matching rule is tried, and if no rule's table has a route,
+	// the main table is used.
+	AddIPv4Rule(rule IPv4Rule)
+	// DeleteIPv4Rule deletes the first rule equal to rule, returning false
+	// if there is no such rule.
+	DeleteIPv4Rule(rule IPv4Rule) bool
+	IPv4Rules() []IPv4Rule
+
+	// SetIPv4Marker sets the function which computes the mark of forwarded
+	// packets, which rules can match, from the packet (including its IP
+	// header) and the device on which it was received. If f is nil, which is
+	// the default, packets' marks are 0.
+	SetIPv4Marker(f func(b []byte, dev IPv4Device) (mark uint32))
+
 	SetForwarding(on bool)
 	Forwarding() bool
+
+	// SetDirectedBroadcastForwarding sets whether the host, if forwarding is
+	// on, forwards packets sent to the directed broadcast address of a
+	// subnet to which one of its devices is attached onto that subnet, as
+	// well as receiving them. It is off by default, since directed
+	// broadcasts can be used to amplify denial of service attacks (RFC
+	// 2644). Packets sent to the limited broadcast address are never
+	// forwarded.
+	SetDirectedBroadcastForwarding(on bool)
+	DirectedBroadcastForwarding() bool
+
+	// JoinIPv4Group joins the multicast group on dev, which must have been
+	// added to the host, with the given source filter: in include mode,
+	// only packets from sources are received, and in exclude mode, packets
+	// from all other sources are received. The group may be joined several
+	// times, for example by different applications, in which case packets
+	// accepted by any of the filters are received. The host reports its
+	// memberships using IGMPv3 (RFC 3376), and answers multicast routers'
+	// queries. Received packets sent to groups of which a device is a
+	// member are delivered to the registered callbacks like any others, but
+	// are only forwarded according to the host's multicast routes (see
+	// AddIPv4MulticastRoute). Calling leave undoes the join.
+	JoinIPv4Group(dev IPv4Device, group IPv4, mode MulticastFilterMode, sources []IPv4) (leave func(), err error)
+	// IPv4Memberships returns the host's memberships in multicast groups,
+	// except for the all-systems group, of which every device is always a
+	// member, in no particular order.
+	IPv4Memberships() []IPv4Membership
+
+	// AddIPv4MulticastRoute adds route to the host's multicast forwarding
+	// cache, replacing any route for the same source and group, and
+	// arranges for route.InDevice to receive the group's packets. Routes
+	// only take effect while forwarding is on. All of the route's devices
+	// must have been added to the host. When a device is removed from the
+	// host, the routes whose incoming device it is are deleted, and it is
+	// removed from the outputs of the others.
+	AddIPv4MulticastRoute(route IPv4MulticastRoute) error
+	// DeleteIPv4MulticastRoute deletes the multicast route for source and
+	// group, returning false if there is no such route. A zero source
+	// identifies a (*, G) route.
+	DeleteIPv4MulticastRoute(source, group IPv4) bool
+	// IPv4MulticastRoutes returns the host's multicast routes, sorted by
+	// group and then by source.
+	IPv4MulticastRoutes() []IPv4MulticastRoute
+
+	// AddIPv4NATRule adds rule to the end of the host's NAT rules, which
+	// translate the addresses and ports of forwarded packets. Rules only
+	// take effect while forwarding is on.
+	AddIPv4NATRule(rule IPv4NATRule) error
+	// DeleteIPv4NATRule deletes the first NAT rule equal to rule, returning
+	// false if there is none. The translations of connections which matched
+	// it last until they time out.
+	DeleteIPv4NATRule(rule IPv4NATRule) bool
+	// IPv4NATRules returns the host's NAT rules in the order in which they
+	// are matched.
+	IPv4NATRules() []IPv4NATRule
+	// IPv4NATTranslations returns the connections which the host is
+	// translating, sorted by source and then by destination.
+	IPv4NATTranslations() []IPv4NATTranslation
+
+	// WriteToIPv4 writes a packet to addr. If addr is the limited
+	// broadcast address (IPv4Broadcast), the packet is broadcast on the
+	// link through which the routing table would send it, and if it is the
+	// directed broadcast address of a subnet to which one of the host's
+	// devices is attached, it is broadcast on that subnet. Packets to
+	// multicast groups are likewise sent on the link through which the
+	// routing table would send them, and never through a gateway.
 	WriteToIPv4(b []byte, addr IPv4, proto IPProtocol) (n int, err error)
 
+	// WriteToIPv4From is like WriteToIPv4, but sends the packet from src,
+	// which must be one of the host's addresses, and which rules with a
+	// Source can match. WriteToIPv4(b, addr, proto) is equivalent to
+	// WriteToIPv4From(b, IPv4{}, addr, proto), in which case the address
+	// of the device through which the packet is sent is used. Packets from
+	// src to the limited broadcast address or to a multicast group are sent
+	// on the link of the device with the address src.
+	WriteToIPv4From(b []byte, src, dst IPv4, proto IPProtocol) (n int, err error)
+
+	// IsLocalIPv4 returns true if addr is the unicast address of one of the
+	// host's devices, and so may be used as the source of WriteToIPv4From.
+	IsLocalIPv4(addr IPv4) bool
+
 	// SetTTL sets the TTL for all outoing packets. If ttl is 0, a default TTL
 	// will be used.
 	SetTTL(ttl uint8)
 
+	// IPv4Stats returns the current values of the host's counters.
+	IPv4Stats() IPv4Stats
+
+	// SetICMPv4RateLimit sets the rate limit on the ICMP error messages the
+	// host sends (for example, when a forwarded packet's TTL expires) to rate
+	// messages per second, with bursts of up to burst messages. If burst is
+	// 0, no ICMP error messages are sent.
+	SetICMPv4RateLimit(rate float64, burst int)
+
+	// WritePortUnreachableIPv4 sends an ICMP Port Unreachable message in
+	// response to the packet with payload b, addresses src and dst, and
+	// protocol proto, which was delivered to a callback registered with
+	// RegisterIPv4Callback. It is meant for use by transport protocols which
+	// have nothing listening on the packet's port. Since callbacks are not
+	// given packets' headers, the quoted header is reconstructed, and may
+	// differ from the original in fields other than the addresses, protocol,
+	// and length.
+	WritePortUnreachableIPv4(b []byte, src, dst IPv4, proto IPProtocol)
+
 	// GetConfigCopyIPv4 returns an IPv4Host which is simply a wrapper around
 	// the original host, but which allows setting configuration values
 	// without setting those values on the original host. In particular, all
@@ -32,17 +187,127 @@ type IPv6Host interface {
 	RemoveIPv6Device(dev IPv6Device)
 	RegisterIPv6Callback(f func(b []byte, src, dst IPv6), proto IPProtocol)
 	AddIPv6Route(subnet IPv6Subnet, nexthop IPv6)
+
+	// AddIPv6RouteEntry adds route to the table named by route.Table,
+	// replacing any route for the same subnet with the same source and next
+	// hop. AddIPv6Route(subnet, nexthop) is equivalent to adding a static
+	// route with a metric of 0 to the main table.
+	AddIPv6RouteEntry(route IPv6Route)
+
+	// AddIPv6DeviceRoute adds a device route to the main table.
+	// AddIPv6DeviceRouteEntry adds one to the table named by route.Table.
 	AddIPv6DeviceRoute(subnet IPv6Subnet, dev IPv6Device)
+	AddIPv6DeviceRouteEntry(route IPv6DeviceRoute)
+
+	// IPv6Routes returns all of the host's routes in all tables, including
+	// those which aren't currently used, which have Selected unset.
 	IPv6Routes() []IPv6Route
 	IPv6DeviceRoutes() []IPv6DeviceRoute
+
+	// DeleteIPv6Route deletes the route for route.Subnet with route.Source
+	// and route.Nexthop from the table named by route.Table, returning false
+	// if there is no such route.
+	DeleteIPv6Route(route IPv6Route) bool
+
+	// DeleteIPv6DeviceRoute deletes the device route for route.Subnet from
+	// the table named by route.Table, returning false if there is no such
+	// route.
+	DeleteIPv6DeviceRoute(route IPv6DeviceRoute) bool
+
+	// ReplaceIPv6Routes atomically replaces all of the routes for subnet
+	// from source in the named table with routes, whose Subnet, Source, and
+	// Table fields are ignored. Routing protocols can use it to change the
+	// paths to a subnet without packets being misrouted while some of the
+	// routes have been changed.
+	ReplaceIPv6Routes(table string, subnet IPv6Subnet, source RouteSource, routes []IPv6Route)
+
+	// WatchIPv6Routes arranges for events describing subsequent changes to
+	// the host's routes and device routes to be sent on c until stop is
+	// called. Sends on c never block; if c is full, events are dropped, and
+	// the next event which is sent has Lost set. The last slot in c is
+	// reserved for an event which only has Lost set, so that dropped events
+	// are always reported; c should have a capacity of at least 2.
+	WatchIPv6Routes(c chan<- IPv6RouteEvent) (stop func())
+
+	// AddIPv6Rule adds a routing policy rule. Rules are consulted in order
+	// of priority (and, among rules with the same priority, in the order in
+	// which they were added), and the first which matches a packet selects
+	// the table used to route it. If the table has no route for the packet,
+	// the next matching rule is tried, and if no rule's table has a route,
+	// the main table is used.
+	AddIPv6Rule(rule IPv6Rule)
+	// DeleteIPv6Rule deletes the first rule equal to rule, returning false
+	// if there is no such rule.
+	DeleteIPv6Rule(rule IPv6Rule) bool
+	IPv6Rules() []IPv6Rule
+
+	// SetIPv6Marker sets the function which computes the mark of forwarded
+	// packets, which rules can match, from the packet (including its IP
+	// header) and the device on which it was received. If f is nil, which is
+	// the default, packets' marks are 0.
+	SetIPv6Marker(f func(b []byte, dev IPv6Device) (mark uint32))
+
 	SetForwarding(on bool)
 	Forwarding() bool
+
+	// JoinIPv6Group is like JoinIPv4Group, but for IPv6. Memberships are
+	// reported using MLDv2 (RFC 3810).
+	JoinIPv6Group(dev IPv6Device, group IPv6, mode MulticastFilterMode, sources []IPv6) (leave func(), err error)
+	// IPv6Memberships is like IPv4Memberships, but for IPv6. The all-nodes
+	// group takes the place of the all-systems group.
+	IPv6Memberships() []IPv6Membership
+
+	// AddIPv6MulticastRoute, DeleteIPv6MulticastRoute, and
+	// IPv6MulticastRoutes are like their IPv4 equivalents, but for IPv6.
+	AddIPv6MulticastRoute(route IPv6MulticastRoute) error
+	DeleteIPv6MulticastRoute(source, group IPv6) bool
+	IPv6MulticastRoutes() []IPv6MulticastRoute
+
+	// WriteToIPv6 writes a packet to addr. Packets to multicast groups are
+	// sent on the link through which the routing table would send them,
+	// and never through a gateway.
 	WriteToIPv6(b []byte, addr IPv6, proto IPProtocol) (n int, err error)
 
+	// WriteToIPv6From is like WriteToIPv6, but sends the packet from src,
+	// which must be one of the host's addresses, and which rules with a
+	// Source can match. WriteToIPv6(b, addr, proto) is equivalent to
+	// WriteToIPv6From(b, IPv6{}, addr, proto), in which case the address
+	// of the device through which the packet is sent is used. Packets from
+	// src to a multicast group are sent on the link of the device with the
+	// address src.
+	WriteToIPv6From(b []byte, src, dst IPv6, proto IPProtocol) (n int, err error)
+
+	// SourceIPv6 returns the source address of packets written to addr by
+	// WriteToIPv6, which upper-layer protocols need in order to compute
+	// checksums over the IPv6 pseudo-header.
+	SourceIPv6(addr IPv6) (IPv6, error)
+
+	// IsLocalIPv6 is like IsLocalIPv4, but for IPv6.
+	IsLocalIPv6(addr IPv6) bool
+
 	// SetTTL sets the TTL for all outoing packets. If ttl is 0, a default TTL
 	// will be used.
 	SetTTL(ttl uint8)
 
+	// IPv6Stats returns the current values of the host's counters.
+	IPv6Stats() IPv6Stats
+
+	// SetICMPv6RateLimit sets the rate limit on the ICMP error messages the
+	// host sends (for example, when a forwarded packet's TTL expires) to rate
+	// messages per second, with bursts of up to burst messages. If burst is
+	// 0, no ICMP error messages are sent.
+	SetICMPv6RateLimit(rate float64, burst int)
+
+	// WritePortUnreachableIPv6 sends an ICMP Port Unreachable message in
+	// response to the packet with payload b, addresses src and dst, and
+	// protocol proto, which was delivered to a callback registered with
+	// RegisterIPv6Callback. It is meant for use by transport protocols which
+	// have nothing listening on the packet's port. Since callbacks are not
+	// given packets' headers, the quoted header is reconstructed, and may
+	// differ from the original in fields other than the addresses, protocol,
+	// and length.
+	WritePortUnreachableIPv6(b []byte, src, dst IPv6, proto IPProtocol)
+
 	// GetConfigCopyIPv6 returns an IPv6Host which is simply a wrapper around
 	// the original host, but which allows setting configuration values
 	// without setting those values on the original host. In particular, all
@@ -109,6 +374,64 @@ func (host *IPHost) AddDeviceRoute(subnet IPSubnet, dev Device) error {
 	return nil
 }
 
+// DeleteRoute deletes the static route for subnet through nexthop.
+func (host *IPHost) DeleteRoute(subnet IPSubnet, nexthop IP) error {
+	if subnet.IPVersion() != nexthop.IPVersion() {
+		return errors.New("delete route: mixed IP subnet and next hop versions")
+	}
+	var ok bool
+	switch subnet.IPVersion() {
+	case 4:
+		ok = host.IPv4Host.DeleteIPv4Route(IPv4Route{Subnet: subnet.(IPv4Subnet), Nexthop: nexthop.(IPv4), Source: RouteSourceStatic})
+	case 6:
+		ok = host.IPv6Host.DeleteIPv6Route(IPv6Route{Subnet: subnet.(IPv6Subnet), Nexthop: nexthop.(IPv6), Source: RouteSourceStatic})
+	}
+	if !ok {
+		return errors.New("delete route: no such route")
+	}
+	return nil
+}
+
+// ReplaceRoute atomically replaces the static routes for
+// subnet with a single route through nexthop.
+func (host *IPHost) ReplaceRoute(subnet IPSubnet, nexthop IP) error {
+	if subnet.IPVersion() != nexthop.IPVersion() {
+		return errors.New("replace route: mixed IP subnet and next hop versions")
+	}
+	switch subnet.IPVersion() {
+	case 4:
+		host.IPv4Host.ReplaceIPv4Routes("", subnet.(IPv4Subnet), RouteSourceStatic, []IPv4Route{{Nexthop: nexthop.(IPv4)}})
+	case 6:
+		host.IPv6Host.ReplaceIPv6Routes("", subnet.(IPv6Subnet), RouteSourceStatic, []IPv6Route{{Nexthop: nexthop.(IPv6)}})
+	}
+	return nil
+}
+
+func (host *IPHost) DeleteDeviceRoute(subnet IPSubnet) error {
+	var ok bool
+	switch subnet := subnet.(type) {
+	case IPv4Subnet:
+		ok = host.IPv4Host.DeleteIPv4DeviceRoute(IPv4DeviceRoute{Subnet: subnet})
+	case IPv6Subnet:
+		ok = host.IPv6Host.DeleteIPv6DeviceRoute(IPv6DeviceRoute{Subnet: subnet})
+	}
+	if !ok {
+		return errors.New("delete device route: no such route")
+	}
+	return nil
+}
+
+// WatchRoutes calls WatchIPv4Routes with c4 and WatchIPv6Routes
+// with c6. Calling stop stops both.
+func (host *IPHost) WatchRoutes(c4 chan<- IPv4RouteEvent, c6 chan<- IPv6RouteEvent) (stop func()) {
+	stop4 := host.IPv4Host.WatchIPv4Routes(c4)
+	stop6 := host.IPv6Host.WatchIPv6Routes(c6)
+	return func() {
+		stop4()
+		stop6()
+	}
+}
+
 func (host *IPHost) SetForwarding(on bool) {
 	host.IPv4Host.SetForwarding(on)
 	host.IPv6Host.SetForwarding(on)
@@ -130,6 +453,11 @@ func (host *IPHost) SetTTL(ttl uint8) {
 	host.IPv6Host.SetTTL(ttl)
 }
 
+func (host *IPHost) SetICMPRateLimit(rate float64, burst int) {
+	host.IPv4Host.SetICMPv4RateLimit(rate, burst)
+	host.IPv6Host.SetICMPv6RateLimit(rate, burst)
+}
+
 func (host *IPHost) GetConfigCopy() *IPHost {
 	return &IPHost{
 		IPv4Host: host.IPv4Host.GetConfigCopyIPv4(),
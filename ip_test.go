@@ -2,6 +2,8 @@ package net
 
 import (
 	"testing"
+
+	"github.com/joshlf/net/internal/checksum"
 )
 
 func TestIPv4Packet(t *testing.T) {
@@ -33,6 +35,31 @@ func TestIPv4Packet(t *testing.T) {
 	}
 }
 
+func TestIPv4Checksum(t *testing.T) {
+	buf := make([]byte, 20)
+	writeIPv4Header(&ipv4Header{version: 4, IHL: 5, len: 20, TTL: 64, proto: IPProtocolTCP,
+		src: IPv4{10, 0, 0, 1}, dst: IPv4{192, 168, 1, 1}}, buf)
+	setIPv4Checksum(buf)
+	if checksum.Checksum(buf) != 0 {
+		t.Fatalf("invalid checksum: %x", buf[10:12])
+	}
+	for ttl := 255; ttl >= 0; ttl-- {
+		setTTL(buf, uint8(ttl))
+		want := append([]byte(nil), buf...)
+		setIPv4Checksum(want)
+		if checksum.Checksum(buf) != 0 {
+			t.Fatalf("invalid checksum after setting TTL to %v: got %x; want %x", ttl, buf[10:12], want[10:12])
+		}
+	}
+
+	host := NewIPv4Host().(*ipv4ConfigurationHost)
+	buf[10]++
+	host.callback(nil, buf)
+	if stats := host.IPv4Stats(); stats.BadChecksum != 1 {
+		t.Errorf("got %v bad checksums; want 1", stats.BadChecksum)
+	}
+}
+
 func TestIPv6Packet(t *testing.T) {
 	src, _ := ParseIPv6("fd00::1")
 	dst, _ := ParseIPv6("fe80::b449:e9ff:fe84:8d8a")
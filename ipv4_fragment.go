@@ -0,0 +1,98 @@
+package net
+
+// fragmentIPv4 splits the packet b, whose header is hdr, into fragments no
+// larger than mtu bytes (RFC 791 section 3.2). The fragments' headers are
+// based on hdr rather than b, so the caller may modify fields such as the
+// TTL in hdr. Options are copied into every fragment only if their copied
+// flags are set. b may itself be a fragment. fragmentIPv4 does not check
+// the DF flag.
+func fragmentIPv4(b []byte, hdr *ipv4Header, mtu int) ([][]byte, bool) {
+	hlen := int(hdr.IHL) * 4
+	opts, laterOpts := b[20:hlen], copiedIPv4Options(b[20:hlen])
+	if mtu < 20+len(opts)+8 {
+		return nil, false
+	}
+
+	var frags [][]byte
+	payload := b[hlen:]
+	off := int(hdr.fragOff) * 8
+	for len(payload) > 0 {
+		n := (mtu - 20 - len(opts)) &^ 7
+		if n > len(payload) {
+			n = len(payload)
+		}
+		fhdr := *hdr
+		fhdr.IHL = uint8((20 + len(opts)) / 4)
+		fhdr.len = uint16(20 + len(opts) + n)
+		fhdr.fragOff = uint16(off / 8)
+		if n < len(payload) {
+			fhdr.flags |= ipv4FlagMF
+		}
+		frag := make([]byte, int(fhdr.len))
+		writeIPv4Header(&fhdr, frag)
+		copy(frag[20:], opts)
+		setIPv4Checksum(frag)
+		copy(frag[20+len(opts):], payload[:n])
+		frags = append(frags, frag)
+
+		payload = payload[n:]
+		off += n
+		opts = laterOpts
+	}
+	return frags, true
+}
+
+// copiedIPv4Options returns those of the options opts whose copied flags
+// are set, padded to a multiple of four bytes.
+func copiedIPv4Options(opts []byte) []byte {
+	var copied []byte
+	for len(opts) > 0 {
+		typ := opts[0]
+		if typ == 0 {
+			// end of option list
+			break
+		}
+		l := 1
+		if typ != 1 {
+			// all options other than end of
+			// option list and no-op have lengths
+			if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+				break
+			}
+			l = int(opts[1])
+		}
+		if typ&0x80 != 0 {
+			copied = append(copied, opts[:l]...)
+		}
+		opts = opts[l:]
+	}
+	for len(copied)%4 != 0 {
+		copied = append(copied, 0)
+	}
+	return copied
+}
+
+// reassembleIPv4 adds the fragment b, whose header is hdr, to r. If this
+// completes a packet, the reassembled packet is returned. discarded is as
+// for reassembler.add.
+func reassembleIPv4(r *reassembler, b []byte, hdr *ipv4Header) (pkt []byte, discarded int) {
+	hlen := int(hdr.IHL) * 4
+	off := int(hdr.fragOff) * 8
+	if off+len(b) > 0xFFFF {
+		// the reassembled packet wouldn't fit in a single IPv4 packet
+		return nil, 1
+	}
+	key := fragmentKey{src: hdr.src, dst: hdr.dst, proto: hdr.proto, id: uint32(hdr.id)}
+	pkt, discarded = r.add(key, b[:hlen], off, hdr.flags&ipv4FlagMF != 0, b[hlen:])
+	if pkt == nil {
+		return nil, discarded
+	}
+	var phdr ipv4Header
+	readIPv4Header(&phdr, pkt)
+	phdr.len = uint16(len(pkt))
+	phdr.flags &^= ipv4FlagMF
+	phdr.fragOff = 0
+	writeIPv4Header(&phdr, pkt)
+	setIPv4Checksum(pkt)
+	return pkt, discarded
+}
@@ -0,0 +1,174 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+)
+
+// makeTestIPv4Packet makes a packet with the given payload
+// length and options, returning it and its header.
+func makeTestIPv4Packet(n int, opts []byte) ([]byte, ipv4Header) {
+	hdr := ipv4Header{version: 4, IHL: uint8(5 + len(opts)/4), id: 7, TTL: 64, proto: 200,
+		src: IPv4{10, 0, 0, 1}, dst: IPv4{10, 0, 0, 2}}
+	hdr.len = uint16(int(hdr.IHL)*4 + n)
+	b := make([]byte, int(hdr.len))
+	writeIPv4Header(&hdr, b)
+	copy(b[20:], opts)
+	for i := int(hdr.IHL) * 4; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	setIPv4Checksum(b)
+	return b, hdr
+}
+
+func TestIPv4Fragmentation(t *testing.T) {
+	// a copied option (security) followed by one which isn't (record route)
+	opts := []byte{130, 4, 0, 0, 7, 3, 4, 0}
+	b, hdr := makeTestIPv4Packet(1000, opts)
+	frags, ok := fragmentIPv4(b, &hdr, 300)
+	if !ok {
+		t.Fatalf("could not fragment packet")
+	}
+	if len(frags) != 4 {
+		t.Fatalf("got %v fragments; want 4", len(frags))
+	}
+	for i, frag := range frags {
+		var fhdr ipv4Header
+		readIPv4Header(&fhdr, frag)
+		switch {
+		case len(frag) > 300:
+			t.Errorf("fragment %v exceeds MTU: %v bytes", i, len(frag))
+		case checksum.Checksum(frag[:int(fhdr.IHL)*4]) != 0:
+			t.Errorf("fragment %v has invalid checksum", i)
+		case (fhdr.flags&ipv4FlagMF != 0) != (i < len(frags)-1):
+			t.Errorf("fragment %v has unexpected flags %v", i, fhdr.flags)
+		case i == 0 && fhdr.IHL != 7, i > 0 && fhdr.IHL != 6:
+			t.Errorf("fragment %v has unexpected IHL %v", i, fhdr.IHL)
+		}
+	}
+
+	r := newReassembler(func(first []byte) {})
+	// deliver the fragments out of order, with a duplicate
+	for _, i := range []int{3, 1, 1, 0} {
+		var fhdr ipv4Header
+		readIPv4Header(&fhdr, frags[i])
+		pkt, discarded := reassembleIPv4(r, frags[i], &fhdr)
+		if pkt != nil || discarded != 0 {
+			t.Fatalf("unexpected result adding fragment %v: %v, %v", i, pkt, discarded)
+		}
+	}
+	var fhdr ipv4Header
+	readIPv4Header(&fhdr, frags[2])
+	pkt, discarded := reassembleIPv4(r, frags[2], &fhdr)
+	if discarded != 0 {
+		t.Errorf("got %v discarded datagrams; want 0", discarded)
+	}
+	if !bytes.Equal(pkt, b) {
+		t.Errorf("reassembled packet differs from original:\ngot  %v\nwant %v", pkt, b)
+	}
+	if r.order.Len() != 0 || r.mem != 0 {
+		t.Errorf("reassembler not empty: %v datagrams, %v bytes", r.order.Len(), r.mem)
+	}
+
+	// overlapping fragments discard the datagram
+	b, hdr = makeTestIPv4Packet(1000, nil)
+	frags, _ = fragmentIPv4(b, &hdr, 300)
+	readIPv4Header(&fhdr, frags[0])
+	reassembleIPv4(r, frags[0], &fhdr)
+	overlap := append([]byte(nil), frags[1]...)
+	readIPv4Header(&fhdr, overlap)
+	fhdr.fragOff--
+	writeIPv4Header(&fhdr, overlap)
+	if pkt, discarded := reassembleIPv4(r, overlap, &fhdr); pkt != nil || discarded != 1 {
+		t.Errorf("unexpected result adding overlapping fragment: %v, %v", pkt, discarded)
+	}
+	if r.order.Len() != 0 || r.mem != 0 {
+		t.Errorf("reassembler not empty: %v datagrams, %v bytes", r.order.Len(), r.mem)
+	}
+
+	if _, ok := fragmentIPv4(b, &hdr, 27); ok {
+		t.Errorf("unexpectedly fragmented packet with MTU smaller than minimum")
+	}
+}
+
+func TestIPv4ForwardFragmented(t *testing.T) {
+	// host 10.0.0.1 is connected to a router, 10.0.0.2, which is
+	// connected to 10.0.1.2 through a link with a smaller MTU
+	var lan, wan EthernetSegment
+	newDev := func(seg *EthernetSegment, mac byte, addr IPv4, mtu uint64) *EthernetDevice {
+		iface := seg.NewInterface()
+		iface.SetMTU(mtu)
+		dev, err := NewEthernetDevice(iface, MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(addr, IPv4{255, 255, 255, 0})
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		return dev
+	}
+	mask := IPv4{255, 255, 255, 0}
+	newHost := func(dev *EthernetDevice, subnet, gateway IPv4) IPv4Host {
+		host := NewIPv4Host()
+		host.AddIPv4Device(dev)
+		host.AddIPv4DeviceRoute(IPv4Subnet{Addr: subnet, Netmask: mask}, dev)
+		host.AddIPv4Route(IPv4Subnet{}, gateway)
+		return host
+	}
+	srcdev := newDev(&lan, 1, IPv4{10, 0, 0, 1}, 1500)
+	defer srcdev.BringDown()
+	src := newHost(srcdev, IPv4{10, 0, 0, 0}, IPv4{10, 0, 0, 2})
+	dstdev := newDev(&wan, 4, IPv4{10, 0, 1, 2}, 576)
+	defer dstdev.BringDown()
+	dst := newHost(dstdev, IPv4{10, 0, 1, 0}, IPv4{10, 0, 1, 1})
+
+	routerdevs := []*EthernetDevice{newDev(&lan, 2, IPv4{10, 0, 0, 2}, 1500), newDev(&wan, 3, IPv4{10, 0, 1, 1}, 576)}
+	router := NewIPv4Host()
+	router.SetForwarding(true)
+	for i, dev := range routerdevs {
+		defer dev.BringDown()
+		router.AddIPv4Device(dev)
+		router.AddIPv4DeviceRoute(IPv4Subnet{Addr: IPv4{10, 0, byte(i), 0}, Netmask: mask}, dev)
+	}
+
+	c := make(chan []byte, 1)
+	dst.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { c <- append([]byte(nil), b...) }, 200)
+	expect := func(want []byte) {
+		select {
+		case b := <-c:
+			if !bytes.Equal(b, want) {
+				t.Errorf("got %v bytes; want %v", len(b), len(want))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for packet")
+		}
+	}
+
+	// fragmented by the router
+	payload := make([]byte, 1400)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	if _, err := src.WriteToIPv4(payload, IPv4{10, 0, 1, 2}, 200); err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	expect(payload)
+
+	// fragmented by the sender, and again by the router
+	payload = append(payload, payload...)
+	if n, err := src.WriteToIPv4(payload, IPv4{10, 0, 1, 2}, 200); err != nil || n != len(payload) {
+		t.Fatalf("unexpected result writing packet: %v, %v", n, err)
+	}
+	expect(payload)
+
+	if stats := router.IPv4Stats(); stats.Fragmented != 3 {
+		t.Errorf("got %v packets fragmented by router; want 3", stats.Fragmented)
+	}
+	if stats := dst.IPv4Stats(); stats.Reassembled != 2 || stats.ReassemblyFailed != 0 {
+		t.Errorf("got %v reassembled and %v failed; want 2 and 0", stats.Reassembled, stats.ReassemblyFailed)
+	}
+}
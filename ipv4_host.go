@@ -3,7 +3,9 @@ package net
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 
+	"github.com/joshlf/net/internal/checksum"
 	"github.com/joshlf/net/internal/errors"
 	"github.com/joshlf/net/internal/parse"
 )
@@ -18,16 +20,52 @@ const (
 type IPProtocol uint8
 
 const (
-	IPProtocolTCP IPProtocol = 6
+	IPProtocolICMPv4 IPProtocol = 1
+	IPProtocolIGMP   IPProtocol = 2
+	IPProtocolTCP    IPProtocol = 6
+	IPProtocolUDP    IPProtocol = 17
+	IPProtocolICMPv6 IPProtocol = 58
 )
 
+// IPv4Stats holds counters of notable events on an IPv4Host.
+type IPv4Stats struct {
+	// BadChecksum is the number of received packets which were
+	// dropped because their header checksums were invalid.
+	BadChecksum uint64
+	// Fragmented is the number of packets which were fragmented,
+	// either when they were sent or when they were forwarded.
+	Fragmented uint64
+	// Reassembled is the number of packets which were
+	// successfully reassembled from fragments.
+	Reassembled uint64
+	// ReassemblyFailed is the number of fragmented packets which were
+	// discarded because they timed out, were invalid, or would have
+	// exceeded the memory limit for reassembly.
+	ReassemblyFailed uint64
+}
+
 type ipv4Host struct {
-	table     ipv4RoutingTable
-	devices   map[IPv4Device]bool // make sure to check if nil before modifying
+	stats     IPv4Stats                       // first for alignment; only accessed atomically
+	routes    ipv4RoutingPolicy               // lock-free for readers; host.mu need not be held
+	devices   map[IPv4Device]bool             // make sure to check if nil before modifying
+	addrs     map[IPv4Device][]IPv4DeviceAddr // the addresses of devices
+	local     map[IPv4]IPv4Device             // all of the addresses in addrs
+	broadcast map[IPv4]IPv4Device             // the directed broadcast addresses of their subnets
 	callbacks [256]func(b []byte, src, dst IPv4)
 	forward   bool
-
-	mu sync.RWMutex
+	fwdBcast  bool                       // whether to forward directed broadcasts
+	icmpLimit *tokenBucket               // rate limit on ICMP error messages
+	ids       [fragmentIDCounters]uint32 // only accessed atomically
+	reasm     *reassembler
+	marker    func(b []byte, dev IPv4Device) (mark uint32)
+	igmp      *mcastListener                       // multicast group memberships
+	groupRefs map[ipv4DeviceGroup]int              // see refGroup; only accessed with groupMu held
+	mroutes   map[ipv4MrouteKey]IPv4MulticastRoute // multicast forwarding cache
+	nat       *ipv4NAT                             // NAT rules and translations
+
+	mu      sync.RWMutex
+	addrMu  sync.Mutex // held while updating addrs, local, and broadcast; acquired before mu
+	groupMu sync.Mutex // held while joining and leaving groups; acquired before mu
 }
 
 type ipv4ConfigurationHost struct {
@@ -43,10 +81,18 @@ func (host *ipv4ConfigurationHost) lock()    { host.mu.Lock(); host.ipv4Host.mu.
 func (host *ipv4ConfigurationHost) unlock()  { host.ipv4Host.mu.Unlock(); host.mu.Unlock() }
 
 func NewIPv4Host() IPv4Host {
-	return &ipv4ConfigurationHost{
-		ipv4Host: &ipv4Host{devices: make(map[IPv4Device]bool)},
-		ttl:      defaultTTL,
+	host := &ipv4Host{
+		devices:   make(map[IPv4Device]bool),
+		addrs:     make(map[IPv4Device][]IPv4DeviceAddr),
+		local:     make(map[IPv4]IPv4Device),
+		icmpLimit: newTokenBucket(defaultICMPRate, defaultICMPBurst),
+		groupRefs: make(map[ipv4DeviceGroup]int),
+		mroutes:   make(map[ipv4MrouteKey]IPv4MulticastRoute),
 	}
+	host.nat = newIPv4NAT(host.isLocal)
+	host.reasm = newReassembler(host.reassemblyTimeout)
+	host.igmp = newMcastListener(host.writeIGMPReports, igmpReportable)
+	return &ipv4ConfigurationHost{ipv4Host: host, ttl: defaultTTL}
 }
 
 func (host *ipv4ConfigurationHost) SetTTL(ttl uint8) {
@@ -68,45 +114,93 @@ func (host *ipv4ConfigurationHost) GetConfigCopyIPv4() IPv4Host {
 
 func (host *ipv4ConfigurationHost) AddIPv4Device(dev IPv4Device) {
 	host.lock()
-	defer host.unlock()
 	dev.RegisterIPv4Callback(func(b []byte) { host.callback(dev, b) })
+	dev.RegisterIPv4AddrCallback(func() { host.updateAddrs(dev) })
 	host.devices[dev] = true
+	host.unlock()
+	host.updateAddrs(dev)
 }
 
 func (host *ipv4ConfigurationHost) RemoveIPv4Device(dev IPv4Device) {
 	host.lock()
-	defer host.unlock()
 	if !host.devices[dev] {
+		host.unlock()
 		return
 	}
 	dev.RegisterIPv4Callback(nil)
+	dev.RegisterIPv4AddrCallback(nil)
 	delete(host.devices, dev)
+	host.unlock()
+	host.updateAddrs(dev)
+
+	host.groupMu.Lock()
+	for _, group := range host.igmp.removeDevice(dev) {
+		var addr IPv4
+		copy(addr[:], group)
+		host.unrefGroup(dev, addr)
+	}
+	host.removeMroutes(dev)
+	host.groupMu.Unlock()
 }
 
 func (host *ipv4ConfigurationHost) AddIPv4Route(subnet IPv4Subnet, nexthop IPv4) {
-	host.lock()
-	host.table.AddRoute(subnet, nexthop)
-	host.unlock()
+	host.routes.main.AddRoute(IPv4Route{Subnet: subnet, Nexthop: nexthop, Source: RouteSourceStatic})
+}
+
+func (host *ipv4ConfigurationHost) AddIPv4RouteEntry(route IPv4Route) {
+	host.routes.tableForUpdate(route.Table).AddRoute(route)
 }
 
 func (host *ipv4ConfigurationHost) AddIPv4DeviceRoute(subnet IPv4Subnet, dev IPv4Device) {
-	host.lock()
-	host.table.AddDeviceRoute(subnet, dev)
-	host.unlock()
+	host.routes.main.AddDeviceRoute(subnet, dev)
+}
+
+func (host *ipv4ConfigurationHost) AddIPv4DeviceRouteEntry(route IPv4DeviceRoute) {
+	host.routes.tableForUpdate(route.Table).AddDeviceRoute(route.Subnet, route.Device)
 }
 
 func (host *ipv4ConfigurationHost) IPv4Routes() []IPv4Route {
-	host.rlock()
-	routes := host.table.Routes()
-	host.runlock()
-	return routes
+	return host.routes.Routes()
 }
 
 func (host *ipv4ConfigurationHost) IPv4DeviceRoutes() []IPv4DeviceRoute {
-	host.rlock()
-	routes := host.table.DeviceRoutes()
-	host.runlock()
-	return routes
+	return host.routes.DeviceRoutes()
+}
+
+func (host *ipv4ConfigurationHost) DeleteIPv4Route(route IPv4Route) bool {
+	rt := host.routes.table(route.Table)
+	return rt != nil && rt.DeleteRoute(route)
+}
+
+func (host *ipv4ConfigurationHost) DeleteIPv4DeviceRoute(route IPv4DeviceRoute) bool {
+	rt := host.routes.table(route.Table)
+	return rt != nil && rt.DeleteDeviceRoute(route.Subnet)
+}
+
+func (host *ipv4ConfigurationHost) ReplaceIPv4Routes(table string, subnet IPv4Subnet, source RouteSource, routes []IPv4Route) {
+	host.routes.tableForUpdate(table).ReplaceRoutes(subnet, source, routes)
+}
+
+func (host *ipv4ConfigurationHost) WatchIPv4Routes(c chan<- IPv4RouteEvent) (stop func()) {
+	return host.routes.Watch(c)
+}
+
+func (host *ipv4ConfigurationHost) AddIPv4Rule(rule IPv4Rule) {
+	host.routes.AddRule(rule)
+}
+
+func (host *ipv4ConfigurationHost) DeleteIPv4Rule(rule IPv4Rule) bool {
+	return host.routes.DeleteRule(rule)
+}
+
+func (host *ipv4ConfigurationHost) IPv4Rules() []IPv4Rule {
+	return host.routes.Rules()
+}
+
+func (host *ipv4ConfigurationHost) SetIPv4Marker(f func(b []byte, dev IPv4Device) (mark uint32)) {
+	host.lock()
+	host.marker = f
+	host.unlock()
 }
 
 // SetForwarding turns forwarding on or off for host. If forwarding is on,
@@ -126,6 +220,74 @@ func (host *ipv4ConfigurationHost) Forwarding() bool {
 	return on
 }
 
+func (host *ipv4ConfigurationHost) SetDirectedBroadcastForwarding(on bool) {
+	host.lock()
+	host.fwdBcast = on
+	host.unlock()
+}
+
+func (host *ipv4ConfigurationHost) DirectedBroadcastForwarding() bool {
+	host.rlock()
+	on := host.fwdBcast
+	host.runlock()
+	return on
+}
+
+func (host *ipv4ConfigurationHost) JoinIPv4Group(dev IPv4Device, group IPv4, mode MulticastFilterMode, sources []IPv4) (leave func(), err error) {
+	if !group.IsMulticast() {
+		return nil, errors.Errorf("join IPv4 group: %v is not a multicast address", group)
+	}
+	if mode == MulticastInclude && len(sources) == 0 {
+		return nil, errors.New("join IPv4 group: include mode with no sources")
+	}
+	f := &mcastFilter{mode: mode, sources: make(mcastAddrs)}
+	for _, src := range sources {
+		f.sources[string(src[:])] = true
+	}
+	key := string(group[:])
+
+	host.groupMu.Lock()
+	defer host.groupMu.Unlock()
+	host.rlock()
+	ok := host.devices[dev]
+	host.runlock()
+	if !ok {
+		return nil, errors.New("join IPv4 group: device has not been added to host")
+	}
+	if !host.igmp.joined(dev, key) {
+		if err := host.refGroup(dev, group); err != nil {
+			return nil, errors.Annotate(err, "join IPv4 group")
+		}
+	}
+	host.igmp.join(dev, key, f)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			host.groupMu.Lock()
+			defer host.groupMu.Unlock()
+			if host.igmp.leave(dev, key, f) {
+				host.unrefGroup(dev, group)
+			}
+		})
+	}, nil
+}
+
+func (host *ipv4ConfigurationHost) IPv4Memberships() []IPv4Membership {
+	var ms []IPv4Membership
+	host.igmp.memberships(func(dev interface{}, group string, f mcastFilter) {
+		m := IPv4Membership{Device: dev.(IPv4Device), Mode: f.mode}
+		copy(m.Group[:], group)
+		for _, src := range f.sources.sorted() {
+			var addr IPv4
+			copy(addr[:], src)
+			m.Sources = append(m.Sources, addr)
+		}
+		ms = append(ms, m)
+	})
+	return ms
+}
+
 // RegisterCallback registers f to be called whenever an IP packet of the given
 // protocol is received. It overwrites any previously-registered callbacks.
 // If f is nil, any previously-registered callbacks are cleared.
@@ -137,20 +299,81 @@ func (host *ipv4ConfigurationHost) RegisterIPv4Callback(f func(b []byte, src, ds
 
 func (host *ipv4ConfigurationHost) WriteToIPv4(b []byte, addr IPv4, proto IPProtocol) (n int, err error) {
 	host.rlock()
-	n, err = host.write(b, addr, proto, host.ttl)
+	n, err = host.write(b, IPv4{}, addr, proto, host.ttl)
 	host.runlock()
 	return n, err
 }
 
-func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n int, err error) {
-	nexthop, dev, ok := host.table.Lookup(addr)
+func (host *ipv4ConfigurationHost) WriteToIPv4From(b []byte, src, dst IPv4, proto IPProtocol) (n int, err error) {
+	host.rlock()
+	n, err = host.write(b, src, dst, proto, host.ttl)
+	host.runlock()
+	return n, err
+}
+
+func (host *ipv4ConfigurationHost) IsLocalIPv4(addr IPv4) bool {
+	host.rlock()
+	defer host.runlock()
+	return host.isLocal(addr)
+}
+
+func (host *ipv4ConfigurationHost) IPv4Stats() IPv4Stats {
+	return IPv4Stats{
+		BadChecksum:      atomic.LoadUint64(&host.stats.BadChecksum),
+		Fragmented:       atomic.LoadUint64(&host.stats.Fragmented),
+		Reassembled:      atomic.LoadUint64(&host.stats.Reassembled),
+		ReassemblyFailed: atomic.LoadUint64(&host.stats.ReassemblyFailed),
+	}
+}
+
+func (host *ipv4ConfigurationHost) SetICMPv4RateLimit(rate float64, burst int) {
+	host.icmpLimit.set(rate, burst)
+}
+
+func (host *ipv4ConfigurationHost) WritePortUnreachableIPv4(b []byte, src, dst IPv4, proto IPProtocol) {
+	pkt, hdr := reconstructIPv4Packet(b, src, dst, proto)
+	host.rlock()
+	host.writeICMPv4Error(pkt, hdr, icmpv4TypeDestUnreachable, icmpv4CodePortUnreachable, 0)
+	host.runlock()
+}
+
+// write writes a packet from src to addr. If src is the zero address, the
+// address of the device through which the packet is sent is used. host.mu
+// must be held.
+//
+// Packets to the limited broadcast address or to a multicast group are sent
+// through the device with the address src, or, if src is the zero address,
+// the device to which the routing table would send them, but never through a
+// gateway. Packets to the directed broadcast address of a subnet to which one
+// of the host's devices is attached are routed normally; the device maps them
+// onto a link-layer broadcast.
+func (host *ipv4Host) write(b []byte, src, addr IPv4, proto IPProtocol, ttl uint8) (n int, err error) {
+	flow := ipv4Flow{src: src, hasSrc: src != IPv4{}, proto: proto, hash: addrHash(addr[:])}
+	if flow.hasSrc && !host.isLocal(src) {
+		return 0, errors.Errorf("write IPv4 packet: %v is not a local address", src)
+	}
+	var nexthop IPv4
+	var dev IPv4Device
+	var ok bool
+	onLink := addr == IPv4Broadcast || addr.IsMulticast()
+	if onLink && flow.hasSrc {
+		dev, ok = host.local[src], true
+	} else {
+		nexthop, dev, ok = host.routes.Lookup(addr, &flow)
+	}
 	if !ok {
 		return 0, errors.Annotate(errors.NewNoRoute(addr.String()), "write IPv4 packet")
 	}
-	devaddr, _, ok := dev.(IPv4Device).IPv4()
+	if onLink {
+		nexthop = addr
+	}
+	devaddr, ok := selectIPv4Source(host.addrs[dev], addr, nexthop)
 	if !ok {
 		return 0, errors.New("device has no IPv4 address")
 	}
+	if flow.hasSrc {
+		devaddr = src
+	}
 
 	if len(b) > math.MaxUint16-20 {
 		// MTU errors are only for link-layer payloads
@@ -160,6 +383,7 @@ func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n
 	hdr.version = 4
 	hdr.IHL = 5
 	hdr.len = 20 + uint16(len(b))
+	hdr.id = host.nextID(devaddr, addr, proto)
 	hdr.TTL = ttl
 	hdr.proto = proto
 	hdr.src = devaddr
@@ -167,7 +391,26 @@ func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n
 
 	buf := make([]byte, int(hdr.len))
 	writeIPv4Header(&hdr, buf)
+	setIPv4Checksum(buf)
 	copy(buf[20:], b)
+	if host.forward && host.nat.enabled() {
+		host.nat.output(buf, &hdr)
+	}
+
+	if mtu := dev.MTU(); mtu != 0 && len(buf) > mtu {
+		frags, ok := fragmentIPv4(buf, &hdr, mtu)
+		if !ok {
+			return 0, errors.MTUf(mtu, "write IPv4 packet: MTU too small to fragment")
+		}
+		atomic.AddUint64(&host.stats.Fragmented, 1)
+		for _, frag := range frags {
+			_, err = dev.WriteToIPv4(frag, nexthop)
+			if err != nil {
+				return 0, errors.Annotate(err, "write IPv4 fragment")
+			}
+		}
+		return len(b), nil
+	}
 
 	n, err = dev.WriteToIPv4(buf, nexthop)
 	if n < 20 {
@@ -178,62 +421,268 @@ func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n
 	return n, errors.Annotate(err, "write IPv4 packet")
 }
 
+// nextID returns the identification field for a new packet with the given
+// addresses and protocol.
+func (host *ipv4Host) nextID(src, dst IPv4, proto IPProtocol) uint16 {
+	h := fragmentIDHash(src[:], dst[:], proto)
+	// offset each counter so that different flows' IDs differ
+	return uint16(atomic.AddUint32(&host.ids[h%fragmentIDCounters], 1) + h>>16)
+}
+
+// reassemblyTimeout is called when a fragmented packet times out. If
+// first is non-nil, it is the packet's first fragment.
+func (host *ipv4Host) reassemblyTimeout(first []byte) {
+	atomic.AddUint64(&host.stats.ReassemblyFailed, 1)
+	if first == nil {
+		return
+	}
+	// RFC 792 defines a Time Exceeded code for this case
+	var hdr ipv4Header
+	readIPv4Header(&hdr, first)
+	host.mu.RLock()
+	host.writeICMPv4Error(first, &hdr, icmpv4TypeTimeExceeded, icmpv4CodeReassemblyExceeded, 0)
+	host.mu.RUnlock()
+}
+
 func (host *ipv4Host) callback(dev IPv4Device, b []byte) {
-	// We accept the device as an argument
-	// because we may use it in the future,
-	// for example for a NAT server to tell
-	// which of multiple private-addressed
-	// networks a packet came from.
 	if len(b) < 20 {
 		return
 	}
 	var hdr ipv4Header
 	readIPv4Header(&hdr, b)
-	if int(hdr.len) != len(b) {
+	if int(hdr.len) != len(b) || hdr.IHL < 5 || int(hdr.IHL)*4 > len(b) {
 		// TODO(joshlf): Log it
 		return
 	}
+	if checksum.Checksum(b[:int(hdr.IHL)*4]) != 0 {
+		atomic.AddUint64(&host.stats.BadChecksum, 1)
+		return
+	}
 
 	host.mu.RLock()
-	defer host.mu.RUnlock()
-	var us bool
-	for dev := range host.devices {
-		addr, _, ok := dev.IPv4()
-		if ok && addr == hdr.dst {
-			us = true
-			break
+	bdev, bcast := host.isBroadcast(hdr.dst)
+	if bcast && bdev != nil && bdev != dev && host.forward && host.fwdBcast {
+		// a directed broadcast to a subnet attached to another device is
+		// both forwarded onto that subnet and received (RFC 1812 section
+		// 5.3.5.2); forward a copy, since delivery may modify b
+		host.forwardPacket(dev, append([]byte(nil), b...), &hdr, nil)
+	}
+	mcast := hdr.dst.IsMulticast()
+	var nat *ipv4NATTuple
+	if host.forward && !bcast && !mcast && host.nat.enabled() {
+		// like Linux's connection tracking, only translate whole
+		// packets, since only the first fragment has ports
+		if hdr.flags&ipv4FlagMF != 0 || hdr.fragOff != 0 {
+			if b = host.reassemble(b, &hdr); b == nil {
+				host.mu.RUnlock()
+				return
+			}
 		}
+		nat = host.nat.prerouting(dev, b, &hdr)
 	}
-
-	if us {
+	if mcast && host.forward {
+		host.forwardMulticast(dev, b, &hdr)
+	}
+	if mcast && !host.acceptsMulticast(dev, &hdr) {
+		host.mu.RUnlock()
+		return
+	}
+	if mcast || bcast || host.isLocal(hdr.dst) {
 		// deliver
+		if hdr.flags&ipv4FlagMF != 0 || hdr.fragOff != 0 {
+			if b = host.reassemble(b, &hdr); b == nil {
+				host.mu.RUnlock()
+				return
+			}
+		}
+		if hdr.proto == IPProtocolIGMP {
+			host.handleIGMP(dev, b[int(hdr.IHL)*4:], &hdr)
+		}
 		c := host.callbacks[int(hdr.proto)]
 		if c == nil {
+			if hdr.proto != IPProtocolICMPv4 && hdr.proto != IPProtocolIGMP {
+				host.writeICMPv4Error(b, &hdr, icmpv4TypeDestUnreachable, icmpv4CodeProtocolUnreachable, 0)
+			}
+			host.mu.RUnlock()
 			return
 		}
-		c(b[20:], hdr.src, hdr.dst)
-	} else if host.forward {
-		// forward
-		if hdr.TTL < 2 {
-			// TTL is or would become 0 after decrement
-			// See "TTL" section, https://tools.ietf.org/html/rfc791#page-14
-			return
-		}
-		hdr.TTL--
+		host.mu.RUnlock()
+		// NOTE(joshlf): Don't hold the lock while calling the callback,
+		// since it may write packets in response (e.g., ICMP echo replies)
+		c(b[int(hdr.IHL)*4:], hdr.src, hdr.dst)
+		return
+	}
+	defer host.mu.RUnlock()
+	if host.forward {
+		host.forwardPacket(dev, b, &hdr, nat)
+	}
+}
+
+// reassemble adds the fragment b, whose header is hdr, to the host's
+// reassembly buffers, returning the reassembled packet and updating hdr to
+// match it if b was the last missing fragment, or nil otherwise.
+func (host *ipv4Host) reassemble(b []byte, hdr *ipv4Header) []byte {
+	pkt, discarded := reassembleIPv4(host.reasm, b, hdr)
+	atomic.AddUint64(&host.stats.ReassemblyFailed, uint64(discarded))
+	if pkt == nil {
+		return nil
+	}
+	atomic.AddUint64(&host.stats.Reassembled, 1)
+	readIPv4Header(hdr, pkt)
+	return pkt
+}
+
+// forwardPacket forwards the packet b, whose header is hdr and which was
+// received on the device in. If nat is not nil, the packet's source is
+// translated to match it once it has been routed (see ipv4NAT.postrouting).
+// host.mu must be held.
+func (host *ipv4Host) forwardPacket(in IPv4Device, b []byte, hdr *ipv4Header, nat *ipv4NATTuple) {
+	if hdr.TTL < 2 {
+		// TTL is or would become 0 after decrement
+		// See "TTL" section, https://tools.ietf.org/html/rfc791#page-14
+		host.writeICMPv4Error(b, hdr, icmpv4TypeTimeExceeded, icmpv4CodeTTLExceeded, 0)
+		return
+	}
+	flow := ipv4Flow{src: hdr.src, hasSrc: true, in: in, dscp: hdr.DSCP, proto: hdr.proto,
+		hash: ipv4FlowHash(hdr, b[int(hdr.IHL)*4:])}
+	if host.marker != nil {
+		flow.mark = host.marker(b, in)
+	}
+	nexthop, dev, ok := host.routes.Lookup(hdr.dst, &flow)
+	if !ok {
+		host.writeICMPv4Error(b, hdr, icmpv4TypeDestUnreachable, icmpv4CodeNetUnreachable, 0)
+		return
+	}
+	if (nat != nil || host.nat.enabled()) && !host.nat.postrouting(dev, host.addrs[dev], nexthop, b, hdr, nat) {
+		return
+	}
+	if mtu := dev.MTU(); mtu != 0 && len(b) > mtu {
+		host.forwardFragments(b, hdr, nexthop, dev, mtu)
+		return
+	}
+	setTTL(b, hdr.TTL-1)
+	_, err := dev.WriteToIPv4(b, nexthop)
+	if err != nil {
+		// quote the packet as it was received
 		setTTL(b, hdr.TTL)
-		nexthop, dev, ok := host.table.Lookup(hdr.dst)
-		if !ok {
-			// TODO(joshlf): ICMP reply
+	}
+	switch {
+	case errors.IsHostUnreachable(err):
+		host.writeICMPv4Error(b, hdr, icmpv4TypeDestUnreachable, icmpv4CodeHostUnreachable, 0)
+	case errors.IsMTU(err) && hdr.flags&ipv4FlagDF != 0:
+		// the device's MTU changed after we checked it
+		mtu := uint32(errors.GetMTU(err))
+		host.writeICMPv4Error(b, hdr, icmpv4TypeDestUnreachable, icmpv4CodeFragmentationNeeded, mtu)
+	}
+	// TODO(joshlf): Log error
+}
+
+// isLocal returns true if addr is the address of one of the
+// host's devices. host.mu must be held.
+func (host *ipv4Host) isLocal(addr IPv4) bool {
+	_, ok := host.local[addr]
+	return ok
+}
+
+// acceptsMulticast returns true if a packet whose header is hdr, which was
+// sent to a multicast address, and which was received on dev, should be
+// delivered: if it was sent to the all-systems group, or if dev is a member of
+// the group and the group's source filter accepts it. IGMP messages are
+// accepted regardless of the filter, since queries about a group are sent to
+// the group. host.mu must be held.
+func (host *ipv4Host) acceptsMulticast(dev IPv4Device, hdr *ipv4Header) bool {
+	if hdr.dst == ipv4AllSystems {
+		return true
+	}
+	group := string(hdr.dst[:])
+	if hdr.proto == IPProtocolIGMP {
+		return host.igmp.joined(dev, group)
+	}
+	return host.igmp.accepts(dev, group, string(hdr.src[:]))
+}
+
+// isBroadcast returns true if addr is the limited broadcast address or the
+// directed broadcast address of a subnet to which one of the host's devices
+// is attached, in which case dev is that device; for the limited broadcast
+// address, dev is nil. host.mu must be held.
+func (host *ipv4Host) isBroadcast(addr IPv4) (dev IPv4Device, ok bool) {
+	if addr == IPv4Broadcast {
+		return nil, true
+	}
+	dev, ok = host.broadcast[addr]
+	return dev, ok
+}
+
+// updateAddrs updates host.addrs, host.local, and host.broadcast after dev has been added or
+// removed, or its addresses have changed. host.mu must not be held.
+func (host *ipv4Host) updateAddrs(dev IPv4Device) {
+	// NOTE(joshlf): Don't hold host.mu while reading the addresses, since
+	// devices hold their own locks while calling host.callback. host.addrMu
+	// ensures that the addresses recorded are the most recent ones.
+	host.addrMu.Lock()
+	defer host.addrMu.Unlock()
+	var addrs []IPv4DeviceAddr
+	host.mu.RLock()
+	ok := host.devices[dev]
+	host.mu.RUnlock()
+	if ok {
+		addrs = dev.IPv4Addrs()
+	}
+
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if len(addrs) > 0 {
+		host.addrs[dev] = addrs
+	} else {
+		delete(host.addrs, dev)
+	}
+	host.local = make(map[IPv4]IPv4Device)
+	host.broadcast = make(map[IPv4]IPv4Device)
+	for dev, addrs := range host.addrs {
+		for _, a := range addrs {
+			host.local[a.Addr] = dev
+			if b, ok := a.Broadcast(); ok {
+				host.broadcast[b] = dev
+			}
+		}
+	}
+}
+
+// forwardFragments forwards the packet b, whose header is hdr and which
+// exceeds mtu, to nexthop through dev by fragmenting it, or sends a
+// fragmentation needed message if b has its DF flag set. host.mu must be
+// held.
+func (host *ipv4Host) forwardFragments(b []byte, hdr *ipv4Header, nexthop IPv4, dev IPv4Device, mtu int) {
+	if hdr.flags&ipv4FlagDF != 0 {
+		// the next-hop MTU goes in the low-order 16 bits (RFC 1191)
+		host.writeICMPv4Error(b, hdr, icmpv4TypeDestUnreachable, icmpv4CodeFragmentationNeeded, uint32(mtu))
+		return
+	}
+	fhdr := *hdr
+	fhdr.TTL--
+	frags, ok := fragmentIPv4(b, &fhdr, mtu)
+	if !ok {
+		// TODO(joshlf): Log it
+		return
+	}
+	atomic.AddUint64(&host.stats.Fragmented, 1)
+	for _, frag := range frags {
+		_, err := dev.WriteToIPv4(frag, nexthop)
+		if errors.IsHostUnreachable(err) {
+			host.writeICMPv4Error(b, hdr, icmpv4TypeDestUnreachable, icmpv4CodeHostUnreachable, 0)
 			return
 		}
-		dev.WriteToIPv4(b, nexthop)
 		// TODO(joshlf): Log error
 	}
 }
 
-// TODO(joshlf):
-//   - support options
-//   - compute and validate checksums
+// TODO(joshlf): support options
+
+// the flags in ipv4Header.flags
+const (
+	ipv4FlagDF = 2 // don't fragment
+	ipv4FlagMF = 1 // more fragments
+)
 
 type ipv4Header struct {
 	version  uint8
@@ -285,9 +734,24 @@ func readIPv4Header(hdr *ipv4Header, buf []byte) {
 	copy(hdr.dst[:], parse.GetBytes(&buf, 4))
 }
 
-// setTTL sets the TTL in the IP header encoded in b
-// without having to expensively rewrite the entire
-// header using writeIPv4Header
+// setIPv4Checksum computes the checksum of the IPv4 header
+// encoded in b and stores it in the header's checksum field.
+func setIPv4Checksum(b []byte) {
+	b[10], b[11] = 0, 0
+	sum := checksum.Checksum(b[:int(b[0]&0xF)*4])
+	b[10], b[11] = byte(sum>>8), byte(sum)
+}
+
+// setTTL sets the TTL in the IP header encoded in b without having to
+// expensively rewrite the entire header using writeIPv4Header. The header
+// checksum is updated incrementally as described in RFC 1624.
 func setTTL(b []byte, ttl uint8) {
+	// the TTL shares a 16-bit word with the protocol
+	oldWord := uint16(b[8])<<8 | uint16(b[9])
 	b[8] = ttl
+	newWord := uint16(b[8])<<8 | uint16(b[9])
+	// HC' = ~(~HC + ~m + m') (RFC 1624, equation 3)
+	oldSum := uint16(b[10])<<8 | uint16(b[11])
+	sum := checksum.Finish(uint32(^oldSum) + uint32(^oldWord) + uint32(newWord))
+	b[10], b[11] = byte(sum>>8), byte(sum)
 }
@@ -0,0 +1,153 @@
+package net
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// ipv4Trie is a path-compressed binary trie of IPv4 prefixes which supports
+// longest-prefix-match lookups. Each node holds a prefix and any routes and
+// device route for that prefix; nodes which hold neither are only kept as
+// branching points. Tries are never modified; updates return new versions,
+// which share most of their nodes with the old ones, so that any number of
+// goroutines may read a trie while a new version is being built. The zero
+// value is an empty trie.
+type ipv4Trie struct {
+	root *ipv4TrieNode
+}
+
+type ipv4TrieNode struct {
+	key      uint32 // the prefix, with all bits after the first len cleared
+	len      uint8
+	child    [2]*ipv4TrieNode // children, whose prefixes are longer, by their next bit
+	routes   []IPv4Route      // from the most to the least preferred (see ipv4RouteLess)
+	devRoute *IPv4DeviceRoute
+}
+
+func (n *ipv4TrieNode) empty() bool { return len(n.routes) == 0 && n.devRoute == nil }
+
+// ipv4Prefix returns the prefix of subnet as an integer, and its length.
+func ipv4Prefix(subnet IPv4Subnet) (key uint32, l uint8) {
+	mask := binary.BigEndian.Uint32(subnet.Netmask[:])
+	l = uint8(bits.LeadingZeros32(^mask))
+	return binary.BigEndian.Uint32(subnet.Addr[:]) & ipv4Mask(l), l
+}
+
+// ipv4Mask returns a mask of the first l bits.
+func ipv4Mask(l uint8) uint32 { return ^uint32(0) << (32 - l) }
+
+// ipv4Bit returns bit i of key, counting from the most significant bit.
+func ipv4Bit(key uint32, i uint8) int { return int(key>>(31-i)) & 1 }
+
+// update returns a new version of t in which the node for subnet has been
+// replaced by a copy which has been modified by f, creating the node if it
+// doesn't exist, and removing it if f leaves it without routes. t itself is
+// not modified, and shares all nodes except those on the path to subnet's
+// node with the new version.
+func (t ipv4Trie) update(subnet IPv4Subnet, f func(n *ipv4TrieNode)) ipv4Trie {
+	key, l := ipv4Prefix(subnet)
+	return ipv4Trie{root: t.root.update(key, l, f)}
+}
+
+func (n *ipv4TrieNode) update(key uint32, l uint8, f func(n *ipv4TrieNode)) *ipv4TrieNode {
+	if n == nil {
+		leaf := &ipv4TrieNode{key: key, len: l}
+		f(leaf)
+		if leaf.empty() {
+			return nil
+		}
+		return leaf
+	}
+	common := uint8(bits.LeadingZeros32(n.key ^ key))
+	if common > n.len {
+		common = n.len
+	}
+	if common > l {
+		common = l
+	}
+	if common == n.len {
+		c := new(ipv4TrieNode)
+		*c = *n
+		if n.len == l {
+			f(c)
+		} else {
+			b := ipv4Bit(key, n.len)
+			c.child[b] = n.child[b].update(key, l, f)
+		}
+		return c.compact()
+	}
+
+	// n's prefix isn't a prefix of subnet's
+	leaf := &ipv4TrieNode{key: key, len: l}
+	f(leaf)
+	if leaf.empty() {
+		return n
+	}
+	if common == l {
+		// but subnet's is a prefix of n's
+		leaf.child[ipv4Bit(n.key, l)] = n
+		return leaf
+	}
+	// they diverge, so a new branching point is needed
+	branch := &ipv4TrieNode{key: key & ipv4Mask(common), len: common}
+	branch.child[ipv4Bit(n.key, common)] = n
+	branch.child[ipv4Bit(key, common)] = leaf
+	return branch
+}
+
+// compact returns n, or, if n holds no routes and so is only needed as a
+// branching point, whichever of its children are left if it has fewer than
+// two of them.
+func (n *ipv4TrieNode) compact() *ipv4TrieNode {
+	if !n.empty() || (n.child[0] != nil && n.child[1] != nil) {
+		return n
+	}
+	if n.child[0] != nil {
+		return n.child[0]
+	}
+	return n.child[1]
+}
+
+// lookup returns the node with the longest prefix which matches addr and
+// which holds a device route or, unless devOnly is true, a route. If there
+// is no such node, lookup returns nil.
+func (t ipv4Trie) lookup(addr IPv4, devOnly bool) *ipv4TrieNode {
+	var buf [33]*ipv4TrieNode
+	nodes := t.lookupAll(addr, devOnly, buf[:0])
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[len(nodes)-1]
+}
+
+// lookupAll is like lookup, but appends every such node to nodes, from the
+// shortest prefix to the longest.
+func (t ipv4Trie) lookupAll(addr IPv4, devOnly bool, nodes []*ipv4TrieNode) []*ipv4TrieNode {
+	key := binary.BigEndian.Uint32(addr[:])
+	for n := t.root; n != nil; n = n.child[ipv4Bit(key, n.len)] {
+		if (key^n.key)&ipv4Mask(n.len) != 0 {
+			break
+		}
+		if n.devRoute != nil || (!devOnly && len(n.routes) > 0) {
+			nodes = append(nodes, n)
+		}
+		if n.len == 32 {
+			break
+		}
+	}
+	return nodes
+}
+
+// walk calls f on each node in order of prefix.
+func (t ipv4Trie) walk(f func(n *ipv4TrieNode)) {
+	var walk func(n *ipv4TrieNode)
+	walk = func(n *ipv4TrieNode) {
+		if n == nil {
+			return
+		}
+		f(n)
+		walk(n.child[0])
+		walk(n.child[1])
+	}
+	walk(t.root)
+}
@@ -0,0 +1,264 @@
+package net
+
+import (
+	"sync/atomic"
+
+	"github.com/joshlf/net/internal/parse"
+)
+
+// next header values of the extension headers (RFC 8200 section 4)
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6DestOpts = 60
+)
+
+// option types which are recognized in Hop-by-Hop and Destination Options
+// headers (RFC 8200 section 4.2)
+const (
+	ipv6OptionPad1 = 0
+	ipv6OptionPadN = 1
+)
+
+// the length of the Fragment header
+const ipv6FragmentHeaderLen = 8
+
+func isIPv6ExtHeader(proto IPProtocol) bool {
+	switch proto {
+	case ipv6HopByHop, ipv6Routing, ipv6Fragment, ipv6DestOpts:
+		return true
+	}
+	return false
+}
+
+// nextIPv6Header returns the type of the header which follows the extension
+// header of type proto at offset off in the packet b, and its offset. It
+// returns false if the extension header is truncated. proto must be an
+// extension header.
+func nextIPv6Header(b []byte, proto IPProtocol, off int) (next IPProtocol, nextOff int, ok bool) {
+	// all extension headers are at least 8 bytes long
+	if len(b) < off+8 {
+		return 0, 0, false
+	}
+	if proto == ipv6Fragment {
+		nextOff = off + ipv6FragmentHeaderLen
+	} else {
+		// the length is in 8-byte units, not counting the first 8 bytes
+		nextOff = off + (int(b[off+1])+1)*8
+	}
+	if nextOff > len(b) {
+		return 0, 0, false
+	}
+	return IPProtocol(b[off]), nextOff, true
+}
+
+// ipv6UpperLayer returns the type and offset of the first header in the
+// packet b which is not an extension header, skipping extension headers
+// without processing them. If the chain is truncated, the type and offset
+// of the truncated header are returned.
+func ipv6UpperLayer(b []byte) (proto IPProtocol, off int) {
+	proto, off = IPProtocol(b[ipv6NextHeaderOffset]), 40
+	for isIPv6ExtHeader(proto) {
+		next, nextOff, ok := nextIPv6Header(b, proto, off)
+		if !ok {
+			break
+		}
+		proto, off = next, nextOff
+	}
+	return proto, off
+}
+
+// an ipv6Chain is a position in a packet's header chain
+type ipv6Chain struct {
+	proto      IPProtocol // the type of the header at off
+	off        int
+	nextHdrOff int // the offset of the next header field which holds proto
+}
+
+// walkIPv6Headers processes the extension headers of the packet b, whose
+// header is hdr, starting at c, until it reaches an upper-layer header or a
+// Fragment header, whose position it returns. If the packet must be
+// discarded, it returns false, having sent any ICMPv6 error message which is
+// required. host.mu must be held.
+func (host *ipv6Host) walkIPv6Headers(b []byte, hdr *ipv6Header, c ipv6Chain) (ipv6Chain, bool) {
+	for isIPv6ExtHeader(c.proto) && c.proto != ipv6Fragment {
+		next, nextOff, ok := nextIPv6Header(b, c.proto, c.off)
+		if !ok {
+			// TODO(joshlf): Log it
+			return c, false
+		}
+		switch c.proto {
+		case ipv6HopByHop:
+			if c.off != 40 {
+				// Hop-by-Hop Options may only immediately
+				// follow the IPv6 header (RFC 8200 section 4.1)
+				host.writeICMPv6Error(b, hdr, icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedNextHeader, uint32(c.nextHdrOff))
+				return c, false
+			}
+			if !host.processIPv6Options(b, hdr, c.off, nextOff) {
+				return c, false
+			}
+		case ipv6DestOpts:
+			if !host.processIPv6Options(b, hdr, c.off, nextOff) {
+				return c, false
+			}
+		case ipv6Routing:
+			// NOTE(joshlf): We don't support any routing types (type 0,
+			// the only one which isn't specific to other protocols, is
+			// deprecated by RFC 5095), so a Routing header with segments
+			// left is always an error (RFC 8200 section 4.4).
+			if b[c.off+3] != 0 {
+				host.writeICMPv6Error(b, hdr, icmpv6TypeParameterProblem, icmpv6CodeErroneousHeaderField, uint32(c.off+2))
+				return c, false
+			}
+		}
+		c = ipv6Chain{proto: next, off: nextOff, nextHdrOff: c.off}
+	}
+	return c, true
+}
+
+// processIPv6Options processes the options in the Hop-by-Hop or Destination
+// Options header which spans b[start:end] in the packet b, whose header is
+// hdr (RFC 8200 section 4.2). If the packet must be discarded, it returns
+// false, having sent any ICMPv6 error message which is required. host.mu
+// must be held.
+func (host *ipv6Host) processIPv6Options(b []byte, hdr *ipv6Header, start, end int) bool {
+	// skip the next header and length fields
+	for i := start + 2; i < end; {
+		typ := b[i]
+		if typ == ipv6OptionPad1 {
+			i++
+			continue
+		}
+		if i+2 > end || i+2+int(b[i+1]) > end {
+			// TODO(joshlf): Log it
+			return false
+		}
+		if typ != ipv6OptionPadN {
+			// the highest-order two bits of the type
+			// say what to do with unrecognized options
+			switch typ >> 6 {
+			case 1:
+				return false
+			case 2:
+				host.writeICMPv6Error(b, hdr, icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedOption, uint32(i))
+				return false
+			case 3:
+				if hdr.dst[0] != 0xff {
+					host.writeICMPv6Error(b, hdr, icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedOption, uint32(i))
+				}
+				return false
+			}
+		}
+		i += 2 + int(b[i+1])
+	}
+	return true
+}
+
+// fragmentIPv6 splits the packet b, whose header is hdr, into fragments no
+// larger than mtu bytes with the given identification (RFC 8200 section
+// 4.5). Everything after the IPv6 header is treated as fragmentable, so b
+// must not have any extension headers which are part of the unfragmentable
+// part, such as Hop-by-Hop Options.
+func fragmentIPv6(b []byte, hdr *ipv6Header, id uint32, mtu int) ([][]byte, bool) {
+	if mtu < 40+ipv6FragmentHeaderLen+8 {
+		return nil, false
+	}
+	var frags [][]byte
+	payload := b[40:]
+	n := (mtu - 40 - ipv6FragmentHeaderLen) &^ 7
+	for off := 0; off < len(payload); off += n {
+		end := off + n
+		var more uint16
+		if end < len(payload) {
+			more = 1
+		} else {
+			end = len(payload)
+		}
+		fhdr := *hdr
+		fhdr.len = uint16(ipv6FragmentHeaderLen + end - off)
+		fhdr.nextHdr = ipv6Fragment
+		frag := make([]byte, 40+int(fhdr.len))
+		writeIPv6Header(&fhdr, frag)
+		buf := frag[40:]
+		parse.PutByte(&buf, uint8(hdr.nextHdr))
+		parse.PutByte(&buf, 0) // reserved
+		// the offset is in 8-byte units, and is followed by two
+		// reserved bits and the more fragments flag
+		parse.PutUint16(&buf, uint16(off)|more)
+		parse.PutUint32(&buf, id)
+		copy(buf, payload[off:end])
+		frags = append(frags, frag)
+	}
+	return frags, true
+}
+
+// reassembleIPv6 handles the packet b, whose header is hdr, and whose
+// Fragment header is at c. If b completes a packet, it returns the
+// reassembled packet, without a Fragment header, and the position of its
+// upper-layer header (see walkIPv6Headers). If b is an atomic fragment, it
+// returns b itself. Otherwise, it returns false, having sent any ICMPv6
+// error message which is required. hdr is updated to match the returned
+// packet. host.mu must be held.
+func (host *ipv6Host) reassembleIPv6(b []byte, hdr *ipv6Header, c ipv6Chain) ([]byte, ipv6Chain, bool) {
+	if len(b) < c.off+ipv6FragmentHeaderLen {
+		// TODO(joshlf): Log it
+		return nil, c, false
+	}
+	buf := b[c.off:]
+	next := IPProtocol(parse.GetByte(&buf))
+	parse.GetByte(&buf) // reserved
+	offMore := parse.GetUint16(&buf)
+	id := parse.GetUint32(&buf)
+	off, more := int(offMore&^7), offMore&1 != 0
+	data := b[c.off+ipv6FragmentHeaderLen:]
+
+	if off == 0 && !more {
+		// an atomic fragment, which isn't part of any
+		// other packet, and needn't be reassembled
+		// (RFC 8200 section 4.5)
+		c, ok := host.walkIPv6Headers(b, hdr, ipv6Chain{proto: next, off: c.off + ipv6FragmentHeaderLen, nextHdrOff: c.off})
+		return b, c, ok
+	}
+	if more && len(data)%8 != 0 {
+		// point to the payload length field
+		host.writeICMPv6Error(b, hdr, icmpv6TypeParameterProblem, icmpv6CodeErroneousHeaderField, 4)
+		atomic.AddUint64(&host.stats.ReassemblyFailed, 1)
+		return nil, c, false
+	}
+	if c.off-40+off+len(data) > 0xFFFF {
+		// the reassembled payload would be too long; point
+		// to the fragment offset field
+		host.writeICMPv6Error(b, hdr, icmpv6TypeParameterProblem, icmpv6CodeErroneousHeaderField, uint32(c.off+2))
+		atomic.AddUint64(&host.stats.ReassemblyFailed, 1)
+		return nil, c, false
+	}
+
+	key := fragmentKey{src: hdr.src, dst: hdr.dst, id: id}
+	pkt, discarded := host.reasm.add(key, b[:c.off+ipv6FragmentHeaderLen], off, more, data)
+	atomic.AddUint64(&host.stats.ReassemblyFailed, uint64(discarded))
+	if pkt == nil {
+		return nil, c, false
+	}
+	atomic.AddUint64(&host.stats.Reassembled, 1)
+
+	// find the first fragment's Fragment header, whose unfragmentable
+	// part was already processed when it was received, and remove it
+	prev, fragOff := ipv6NextHeaderOffset, 40
+	for pkt[prev] != ipv6Fragment {
+		proto := IPProtocol(pkt[prev])
+		_, nextOff, ok := nextIPv6Header(pkt, proto, fragOff)
+		if !isIPv6ExtHeader(proto) || !ok {
+			return nil, c, false
+		}
+		prev, fragOff = fragOff, nextOff
+	}
+	pkt[prev] = pkt[fragOff]
+	pkt = append(pkt[:fragOff], pkt[fragOff+ipv6FragmentHeaderLen:]...)
+	readIPv6Header(hdr, pkt)
+	hdr.len = uint16(len(pkt) - 40)
+	writeIPv6Header(hdr, pkt)
+	c, ok := host.walkIPv6Headers(pkt, hdr, ipv6Chain{proto: IPProtocol(pkt[prev]), off: fragOff, nextHdrOff: prev})
+	return pkt, c, ok
+}
@@ -0,0 +1,185 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// newIPv6TestPair creates two hosts, fd00::1 and fd00::2, connected by an
+// Ethernet segment with the given MTU. The returned function brings both
+// devices down.
+func newIPv6TestPair(t *testing.T, mtu uint64) (a, b *ipv6ConfigurationHost, bringDown func()) {
+	var seg EthernetSegment
+	mask := IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	var devs []*EthernetDevice
+	newHost := func(n byte) *ipv6ConfigurationHost {
+		iface := seg.NewInterface()
+		iface.SetMTU(mtu)
+		dev, err := NewEthernetDevice(iface, MAC{2, 0, 0, 0, 0, n})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv6(IPv6{0: 0xfd, 15: n}, mask)
+		host := NewIPv6Host().(*ipv6ConfigurationHost)
+		host.AddIPv6Device(dev)
+		host.AddIPv6DeviceRoute(IPv6Subnet{Addr: IPv6{0: 0xfd}, Netmask: mask}, dev)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		devs = append(devs, dev)
+		return host
+	}
+	a, b = newHost(1), newHost(2)
+	return a, b, func() {
+		for _, dev := range devs {
+			dev.BringDown()
+		}
+	}
+}
+
+// makeTestIPv6Packet makes a packet from fd00::1 to fd00::2 whose
+// first next header is proto, and which is followed by rest.
+func makeTestIPv6Packet(proto IPProtocol, rest ...[]byte) ([]byte, ipv6Header) {
+	hdr := ipv6Header{version: 6, nextHdr: proto, hopLimit: 64, src: IPv6{0: 0xfd, 15: 1}, dst: IPv6{0: 0xfd, 15: 2}}
+	b := make([]byte, 40)
+	for _, r := range rest {
+		b = append(b, r...)
+	}
+	hdr.len = uint16(len(b) - 40)
+	writeIPv6Header(&hdr, b)
+	return b, hdr
+}
+
+// makeTestIPv6Options makes a Hop-by-Hop or Destination Options header
+// containing opts, padded to a multiple of 8 bytes.
+func makeTestIPv6Options(next IPProtocol, opts ...byte) []byte {
+	b := append([]byte{byte(next), 0}, opts...)
+	switch pad := (8 - len(b)%8) % 8; pad {
+	case 0:
+	case 1:
+		b = append(b, ipv6OptionPad1)
+	default:
+		b = append(b, ipv6OptionPadN, byte(pad-2))
+		b = append(b, make([]byte, pad-2)...)
+	}
+	b[1] = byte(len(b)/8 - 1)
+	return b
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	a, b, bringDown := newIPv6TestPair(t, 1500)
+	defer bringDown()
+
+	icmp := make(chan []byte, 4)
+	a.RegisterIPv6Callback(func(b []byte, src, dst IPv6) { icmp <- append([]byte(nil), b...) }, IPProtocolICMPv6)
+	delivered := make(chan []byte, 4)
+	b.RegisterIPv6Callback(func(b []byte, src, dst IPv6) { delivered <- append([]byte(nil), b...) }, 200)
+
+	payload := []byte("hello, world")
+	expectDelivered := func(name string) {
+		select {
+		case got := <-delivered:
+			if !bytes.Equal(got, payload) {
+				t.Errorf("%v: got payload %q; want %q", name, got, payload)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: timed out waiting for packet", name)
+		}
+	}
+	expectError := func(name string, typ, code uint8, pointer uint32) {
+		select {
+		case msg := <-icmp:
+			if len(msg) < icmpErrorLen {
+				t.Fatalf("%v: message too short: %v", name, msg)
+			}
+			word := binary.BigEndian.Uint32(msg[4:])
+			if msg[0] != typ || msg[1] != code || word != pointer {
+				t.Errorf("%v: got type %v, code %v, pointer %v; want %v, %v, %v", name, msg[0], msg[1], word, typ, code, pointer)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: timed out waiting for ICMPv6 error", name)
+		}
+		select {
+		case <-delivered:
+			t.Errorf("%v: packet unexpectedly delivered", name)
+		default:
+		}
+	}
+
+	pkt, _ := makeTestIPv6Packet(ipv6HopByHop, makeTestIPv6Options(ipv6DestOpts),
+		makeTestIPv6Options(200, ipv6OptionPad1, 5, 1, 0), payload)
+	b.callback(nil, pkt)
+	expectDelivered("options to skip")
+
+	pkt, _ = makeTestIPv6Packet(ipv6DestOpts, makeTestIPv6Options(200, 0x85, 1, 0), payload)
+	b.callback(nil, pkt)
+	expectError("option requiring error", icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedOption, 42)
+
+	pkt, _ = makeTestIPv6Packet(ipv6DestOpts, makeTestIPv6Options(ipv6HopByHop), makeTestIPv6Options(200), payload)
+	b.callback(nil, pkt)
+	expectError("misplaced Hop-by-Hop Options", icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedNextHeader, 40)
+
+	pkt, _ = makeTestIPv6Packet(ipv6Routing, []byte{200, 0, 0, 1, 0, 0, 0, 0}, payload)
+	b.callback(nil, pkt)
+	expectError("Routing header with segments left", icmpv6TypeParameterProblem, icmpv6CodeErroneousHeaderField, 42)
+
+	pkt, _ = makeTestIPv6Packet(ipv6Routing, []byte{200, 0, 0, 0, 0, 0, 0, 0}, payload)
+	b.callback(nil, pkt)
+	expectDelivered("Routing header without segments left")
+
+	pkt, _ = makeTestIPv6Packet(ipv6DestOpts, makeTestIPv6Options(201), payload)
+	b.callback(nil, pkt)
+	expectError("unrecognized next header", icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedNextHeader, 40)
+
+	pkt, _ = makeTestIPv6Packet(ipv6Fragment, []byte{200, 0, 0, 0, 0, 0, 0, 1}, payload)
+	b.callback(nil, pkt)
+	expectDelivered("atomic fragment")
+
+	// fragments delivered out of order, whose fragmentable
+	// part includes a Destination Options header
+	payload = bytes.Repeat([]byte("0123456789"), 100)
+	pkt, hdr := makeTestIPv6Packet(ipv6DestOpts, makeTestIPv6Options(200), payload)
+	frags, _ := fragmentIPv6(pkt, &hdr, 1, 300)
+	for i := len(frags) - 1; i >= 0; i-- {
+		b.callback(nil, frags[i])
+	}
+	expectDelivered("fragments")
+
+	// a non-final fragment whose length isn't a multiple of 8
+	frags[0] = frags[0][:len(frags[0])-1]
+	binary.BigEndian.PutUint16(frags[0][4:], uint16(len(frags[0])-40))
+	b.callback(nil, frags[0])
+	expectError("short fragment", icmpv6TypeParameterProblem, icmpv6CodeErroneousHeaderField, 4)
+
+	if stats := b.IPv6Stats(); stats.Reassembled != 1 || stats.ReassemblyFailed != 1 {
+		t.Errorf("got %v reassembled and %v failed; want 1 and 1", stats.Reassembled, stats.ReassemblyFailed)
+	}
+}
+
+func TestIPv6Fragmentation(t *testing.T) {
+	a, b, bringDown := newIPv6TestPair(t, 1280)
+	defer bringDown()
+
+	c := make(chan []byte, 1)
+	b.RegisterIPv6Callback(func(b []byte, src, dst IPv6) { c <- append([]byte(nil), b...) }, 200)
+	payload := bytes.Repeat([]byte("0123456789"), 400)
+	if n, err := a.WriteToIPv6(payload, IPv6{0: 0xfd, 15: 2}, 200); err != nil || n != len(payload) {
+		t.Fatalf("unexpected result writing packet: %v, %v", n, err)
+	}
+	select {
+	case got := <-c:
+		if !bytes.Equal(got, payload) {
+			t.Errorf("got %v bytes; want %v", len(got), len(payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for packet")
+	}
+	if stats := a.IPv6Stats(); stats.Fragmented != 1 {
+		t.Errorf("got %v packets fragmented; want 1", stats.Fragmented)
+	}
+	if stats := b.IPv6Stats(); stats.Reassembled != 1 {
+		t.Errorf("got %v packets reassembled; want 1", stats.Reassembled)
+	}
+}
@@ -3,18 +3,45 @@ package net
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/joshlf/net/internal/errors"
 	"github.com/joshlf/net/internal/parse"
 )
 
+// IPv6Stats holds counters of notable events on an IPv6Host.
+type IPv6Stats struct {
+	// Fragmented is the number of packets which were fragmented
+	// when they were sent. Forwarded packets are never fragmented.
+	Fragmented uint64
+	// Reassembled is the number of packets which were
+	// successfully reassembled from fragments.
+	Reassembled uint64
+	// ReassemblyFailed is the number of fragmented packets which were
+	// discarded because they timed out, were invalid, or would have
+	// exceeded the memory limit for reassembly.
+	ReassemblyFailed uint64
+}
+
 type ipv6Host struct {
-	table     ipv6RoutingTable
+	stats     IPv6Stats         // first for alignment; only accessed atomically
+	routes    ipv6RoutingPolicy // lock-free for readers; host.mu need not be held
 	devices   map[IPv6Device]bool
+	addrs     map[IPv6Device][]IPv6DeviceAddr
+	local     map[IPv6]IPv6Device
 	callbacks [256]func(b []byte, src, dst IPv6)
 	forward   bool
-
-	mu sync.RWMutex
+	icmpLimit *tokenBucket               // rate limit on ICMPv6 error messages
+	ids       [fragmentIDCounters]uint32 // only accessed atomically
+	reasm     *reassembler
+	marker    func(b []byte, dev IPv6Device) (mark uint32)
+	mld       *mcastListener
+	groupRefs map[ipv6DeviceGroup]int
+	mroutes   map[ipv6MrouteKey]IPv6MulticastRoute
+
+	mu      sync.RWMutex
+	addrMu  sync.Mutex
+	groupMu sync.Mutex
 }
 
 type ipv6ConfigurationHost struct {
@@ -30,10 +57,17 @@ func (host *ipv6ConfigurationHost) lock()    { host.mu.Lock(); host.ipv6Host.mu.
 func (host *ipv6ConfigurationHost) unlock()  { host.ipv6Host.mu.Unlock(); host.mu.Unlock() }
 
 func NewIPv6Host() IPv6Host {
-	return &ipv6ConfigurationHost{
-		ipv6Host: &ipv6Host{devices: make(map[IPv6Device]bool)},
-		ttl:      defaultTTL,
+	host := &ipv6Host{
+		devices:   make(map[IPv6Device]bool),
+		addrs:     make(map[IPv6Device][]IPv6DeviceAddr),
+		local:     make(map[IPv6]IPv6Device),
+		icmpLimit: newTokenBucket(defaultICMPRate, defaultICMPBurst),
+		groupRefs: make(map[ipv6DeviceGroup]int),
+		mroutes:   make(map[ipv6MrouteKey]IPv6MulticastRoute),
 	}
+	host.reasm = newReassembler(host.reassemblyTimeout)
+	host.mld = newMcastListener(host.writeMLDReports, mldReportable)
+	return &ipv6ConfigurationHost{ipv6Host: host, ttl: defaultTTL}
 }
 
 func (host *ipv6ConfigurationHost) SetTTL(ttl uint8) {
@@ -55,45 +89,93 @@ func (host *ipv6ConfigurationHost) GetConfigCopyIPv6() IPv6Host {
 
 func (host *ipv6ConfigurationHost) AddIPv6Device(dev IPv6Device) {
 	host.lock()
-	defer host.unlock()
 	dev.RegisterIPv6Callback(func(b []byte) { host.callback(dev, b) })
+	dev.RegisterIPv6AddrCallback(func() { host.updateAddrs(dev) })
 	host.devices[dev] = true
+	host.unlock()
+	host.updateAddrs(dev)
 }
 
 func (host *ipv6ConfigurationHost) RemoveIPv6Device(dev IPv6Device) {
 	host.lock()
-	defer host.unlock()
 	if !host.devices[dev] {
+		host.unlock()
 		return
 	}
 	dev.RegisterIPv6Callback(nil)
+	dev.RegisterIPv6AddrCallback(nil)
 	delete(host.devices, dev)
+	host.unlock()
+	host.updateAddrs(dev)
+
+	host.groupMu.Lock()
+	for _, group := range host.mld.removeDevice(dev) {
+		var addr IPv6
+		copy(addr[:], group)
+		host.unrefGroup(dev, addr)
+	}
+	host.removeMroutes(dev)
+	host.groupMu.Unlock()
 }
 
 func (host *ipv6ConfigurationHost) AddIPv6Route(subnet IPv6Subnet, nexthop IPv6) {
-	host.lock()
-	host.table.AddRoute(subnet, nexthop)
-	host.unlock()
+	host.routes.main.AddRoute(IPv6Route{Subnet: subnet, Nexthop: nexthop, Source: RouteSourceStatic})
+}
+
+func (host *ipv6ConfigurationHost) AddIPv6RouteEntry(route IPv6Route) {
+	host.routes.tableForUpdate(route.Table).AddRoute(route)
 }
 
 func (host *ipv6ConfigurationHost) AddIPv6DeviceRoute(subnet IPv6Subnet, dev IPv6Device) {
-	host.lock()
-	host.table.AddDeviceRoute(subnet, dev)
-	host.unlock()
+	host.routes.main.AddDeviceRoute(subnet, dev)
+}
+
+func (host *ipv6ConfigurationHost) AddIPv6DeviceRouteEntry(route IPv6DeviceRoute) {
+	host.routes.tableForUpdate(route.Table).AddDeviceRoute(route.Subnet, route.Device)
 }
 
 func (host *ipv6ConfigurationHost) IPv6Routes() []IPv6Route {
-	host.rlock()
-	routes := host.table.Routes()
-	host.runlock()
-	return routes
+	return host.routes.Routes()
 }
 
 func (host *ipv6ConfigurationHost) IPv6DeviceRoutes() []IPv6DeviceRoute {
-	host.rlock()
-	routes := host.table.DeviceRoutes()
-	host.runlock()
-	return routes
+	return host.routes.DeviceRoutes()
+}
+
+func (host *ipv6ConfigurationHost) DeleteIPv6Route(route IPv6Route) bool {
+	rt := host.routes.table(route.Table)
+	return rt != nil && rt.DeleteRoute(route)
+}
+
+func (host *ipv6ConfigurationHost) DeleteIPv6DeviceRoute(route IPv6DeviceRoute) bool {
+	rt := host.routes.table(route.Table)
+	return rt != nil && rt.DeleteDeviceRoute(route.Subnet)
+}
+
+func (host *ipv6ConfigurationHost) ReplaceIPv6Routes(table string, subnet IPv6Subnet, source RouteSource, routes []IPv6Route) {
+	host.routes.tableForUpdate(table).ReplaceRoutes(subnet, source, routes)
+}
+
+func (host *ipv6ConfigurationHost) WatchIPv6Routes(c chan<- IPv6RouteEvent) (stop func()) {
+	return host.routes.Watch(c)
+}
+
+func (host *ipv6ConfigurationHost) AddIPv6Rule(rule IPv6Rule) {
+	host.routes.AddRule(rule)
+}
+
+func (host *ipv6ConfigurationHost) DeleteIPv6Rule(rule IPv6Rule) bool {
+	return host.routes.DeleteRule(rule)
+}
+
+func (host *ipv6ConfigurationHost) IPv6Rules() []IPv6Rule {
+	return host.routes.Rules()
+}
+
+func (host *ipv6ConfigurationHost) SetIPv6Marker(f func(b []byte, dev IPv6Device) (mark uint32)) {
+	host.lock()
+	host.marker = f
+	host.unlock()
 }
 
 func (host *ipv6ConfigurationHost) SetForwarding(on bool) {
@@ -109,6 +191,61 @@ func (host *ipv6ConfigurationHost) Forwarding() bool {
 	return on
 }
 
+func (host *ipv6ConfigurationHost) JoinIPv6Group(dev IPv6Device, group IPv6, mode MulticastFilterMode, sources []IPv6) (leave func(), err error) {
+	if !group.IsMulticast() {
+		return nil, errors.Errorf("join IPv6 group: %v is not a multicast address", group)
+	}
+	if mode == MulticastInclude && len(sources) == 0 {
+		return nil, errors.New("join IPv6 group: include mode with no sources")
+	}
+	f := &mcastFilter{mode: mode, sources: make(mcastAddrs)}
+	for _, src := range sources {
+		f.sources[string(src[:])] = true
+	}
+	key := string(group[:])
+
+	host.groupMu.Lock()
+	defer host.groupMu.Unlock()
+	host.rlock()
+	ok := host.devices[dev]
+	host.runlock()
+	if !ok {
+		return nil, errors.New("join IPv6 group: device has not been added to host")
+	}
+	if !host.mld.joined(dev, key) {
+		if err := host.refGroup(dev, group); err != nil {
+			return nil, errors.Annotate(err, "join IPv6 group")
+		}
+	}
+	host.mld.join(dev, key, f)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			host.groupMu.Lock()
+			defer host.groupMu.Unlock()
+			if host.mld.leave(dev, key, f) {
+				host.unrefGroup(dev, group)
+			}
+		})
+	}, nil
+}
+
+func (host *ipv6ConfigurationHost) IPv6Memberships() []IPv6Membership {
+	var ms []IPv6Membership
+	host.mld.memberships(func(dev interface{}, group string, f mcastFilter) {
+		m := IPv6Membership{Device: dev.(IPv6Device), Mode: f.mode}
+		copy(m.Group[:], group)
+		for _, src := range f.sources.sorted() {
+			var addr IPv6
+			copy(addr[:], src)
+			m.Sources = append(m.Sources, addr)
+		}
+		ms = append(ms, m)
+	})
+	return ms
+}
+
 func (host *ipv6ConfigurationHost) RegisterIPv6Callback(f func(b []byte, src, dst IPv6), proto IPProtocol) {
 	host.lock()
 	host.callbacks[int(proto)] = f
@@ -117,40 +254,124 @@ func (host *ipv6ConfigurationHost) RegisterIPv6Callback(f func(b []byte, src, ds
 
 func (host *ipv6ConfigurationHost) WriteToIPv6(b []byte, addr IPv6, proto IPProtocol) (n int, err error) {
 	host.rlock()
-	n, err = host.write(b, addr, proto, host.ttl)
+	n, err = host.write(b, IPv6{}, addr, proto, host.ttl)
 	host.runlock()
 	return n, err
 }
 
-func (host *ipv6Host) write(b []byte, addr IPv6, proto IPProtocol, hops uint8) (n int, err error) {
-	host.mu.RLock()
-	defer host.mu.RUnlock()
-	nexthop, dev, ok := host.table.Lookup(addr)
+func (host *ipv6ConfigurationHost) WriteToIPv6From(b []byte, src, dst IPv6, proto IPProtocol) (n int, err error) {
+	host.rlock()
+	n, err = host.write(b, src, dst, proto, host.ttl)
+	host.runlock()
+	return n, err
+}
+
+func (host *ipv6ConfigurationHost) IPv6Stats() IPv6Stats {
+	return IPv6Stats{
+		Fragmented:       atomic.LoadUint64(&host.stats.Fragmented),
+		Reassembled:      atomic.LoadUint64(&host.stats.Reassembled),
+		ReassemblyFailed: atomic.LoadUint64(&host.stats.ReassemblyFailed),
+	}
+}
+
+func (host *ipv6ConfigurationHost) SetICMPv6RateLimit(rate float64, burst int) {
+	host.icmpLimit.set(rate, burst)
+}
+
+func (host *ipv6ConfigurationHost) WritePortUnreachableIPv6(b []byte, src, dst IPv6, proto IPProtocol) {
+	pkt, hdr := reconstructIPv6Packet(b, src, dst, proto)
+	host.rlock()
+	host.writeICMPv6Error(pkt, hdr, icmpv6TypeDestUnreachable, icmpv6CodePortUnreachable, 0)
+	host.runlock()
+}
+
+func (host *ipv6ConfigurationHost) SourceIPv6(addr IPv6) (IPv6, error) {
+	host.rlock()
+	defer host.runlock()
+	src, err := host.source(addr)
+	return src, errors.Annotate(err, "look up IPv6 source address")
+}
+
+func (host *ipv6ConfigurationHost) IsLocalIPv6(addr IPv6) bool {
+	host.rlock()
+	defer host.runlock()
+	return host.isLocal(addr)
+}
+
+// source returns the address of the device through which packets to addr
+// are routed. host.mu must be held.
+func (host *ipv6Host) source(addr IPv6) (IPv6, error) {
+	nexthop, dev, ok := host.routes.Lookup(addr, &ipv6Flow{hash: addrHash(addr[:])})
+	if !ok {
+		return IPv6{}, errors.NewNoRoute(addr.String())
+	}
+	devaddr, ok := selectIPv6Source(host.addrs[dev], addr, nexthop)
+	if !ok {
+		return IPv6{}, errors.New("device has no IPv6 address")
+	}
+	return devaddr, nil
+}
+
+// write is like ipv4Host.write, but for IPv6.
+func (host *ipv6Host) write(b []byte, src, addr IPv6, proto IPProtocol, hops uint8) (n int, err error) {
+	flow := ipv6Flow{src: src, hasSrc: src != IPv6{}, proto: proto, hash: addrHash(addr[:])}
+	if flow.hasSrc && !host.isLocal(src) {
+		return 0, errors.Errorf("write IPv6 packet: %v is not a local address", src)
+	}
+	var nexthop IPv6
+	var dev IPv6Device
+	var ok bool
+	if addr.IsMulticast() && flow.hasSrc {
+		dev, ok = host.local[src], true
+	} else {
+		nexthop, dev, ok = host.routes.Lookup(addr, &flow)
+	}
 	if !ok {
 		return 0, errors.Annotate(errors.NewNoRoute(addr.String()), "write IPv6 packet")
 	}
-	devaddr, _, ok := dev.(IPv6Device).IPv6()
+	if addr.IsMulticast() {
+		nexthop = addr
+	}
+	devaddr, ok := selectIPv6Source(host.addrs[dev], addr, nexthop)
 	if !ok {
 		return 0, errors.New("device has no IPv6 address")
 	}
+	if flow.hasSrc {
+		devaddr = src
+	}
 
-	if len(b) > math.MaxUint16-40 {
+	if len(b) > math.MaxUint16 {
 		// MTU errors are only for link-layer payloads
 		return 0, errors.New("IPv6 payload exceeds maximum IPv6 packet size")
 	}
 
 	var hdr ipv6Header
 	hdr.version = 6
-	hdr.len = 40 + uint16(len(b))
+	hdr.len = uint16(len(b))
 	hdr.nextHdr = proto
 	hdr.hopLimit = hops
 	hdr.src = devaddr
 	hdr.dst = addr
 
-	buf := make([]byte, int(hdr.len))
+	buf := make([]byte, 40+len(b))
 	writeIPv6Header(&hdr, buf)
 	copy(buf[40:], b)
 
+	if mtu := dev.MTU(); mtu != 0 && len(buf) > mtu {
+		frags, ok := fragmentIPv6(buf, &hdr, host.nextID(devaddr, addr), mtu)
+		if !ok {
+			return 0, errors.MTUf(mtu, "write IPv6 packet: MTU too small to fragment")
+		}
+		atomic.AddUint64(&host.stats.Fragmented, 1)
+		for _, frag := range frags {
+			_, err = dev.WriteToIPv6(frag, nexthop)
+			if err != nil {
+				return 0, errors.Annotate(err, "write IPv6 fragment")
+			}
+		}
+		return len(b), nil
+	}
+
 	n, err = dev.WriteToIPv6(buf, nexthop)
 	if n < 40 {
 		n = 0
@@ -161,11 +382,35 @@ func (host *ipv6Host) write(b []byte, addr IPv6, proto IPProtocol, hops uint8) (
 	return n, errors.Annotate(err, "write IPv6 packet")
 }
 
+// nextID returns the identification field for the Fragment
+// header of a new packet with the given addresses.
+func (host *ipv6Host) nextID(src, dst IPv6) uint32 {
+	h := fragmentIDHash(src[:], dst[:], 0)
+	// offset each counter so that different flows' IDs differ
+	return atomic.AddUint32(&host.ids[h%fragmentIDCounters], 1) + h
+}
+
+// reassemblyTimeout is called when a fragmented packet times out. If
+// first is non-nil, it is the packet's first fragment.
+func (host *ipv6Host) reassemblyTimeout(first []byte) {
+	atomic.AddUint64(&host.stats.ReassemblyFailed, 1)
+	if first == nil {
+		// no error is sent unless the first fragment
+		// was received (RFC 8200 section 4.5)
+		return
+	}
+	var hdr ipv6Header
+	readIPv6Header(&hdr, first)
+	host.mu.RLock()
+	host.writeICMPv6Error(first, &hdr, icmpv6TypeTimeExceeded, icmpv6CodeReassemblyExceeded, 0)
+	host.mu.RUnlock()
+}
+
 type ipv6Header struct {
 	version      uint8
 	trafficClass uint8
 	flowLabel    uint32
-	len          uint16
+	len          uint16 // payload length; does not include the header
 	nextHdr      IPProtocol
 	hopLimit     uint8
 	src, dst     IPv6
@@ -174,7 +419,7 @@ type ipv6Header struct {
 func writeIPv6Header(hdr *ipv6Header, buf []byte) {
 	parse.GetBytes(&buf, 1)[0] = (hdr.version << 4) | (hdr.trafficClass >> 4)
 	parse.GetBytes(&buf, 1)[0] = (hdr.trafficClass << 4) | uint8(hdr.flowLabel>>16)
-	parse.PutUint16(&buf, uint16(hdr.flowLabel&0xff))
+	parse.PutUint16(&buf, uint16(hdr.flowLabel))
 	parse.PutUint16(&buf, hdr.len)
 	parse.GetBytes(&buf, 1)[0] = byte(hdr.nextHdr)
 	parse.GetBytes(&buf, 1)[0] = hdr.hopLimit
@@ -202,43 +447,148 @@ func (host *ipv6Host) callback(dev IPv6Device, b []byte) {
 	}
 	var hdr ipv6Header
 	readIPv6Header(&hdr, b)
-	if int(hdr.len) != len(b) {
+	if int(hdr.len) > len(b)-40 {
 		// TODO(joshlf): Log it
 		return
 	}
+	// strip any link-layer padding
+	b = b[:40+int(hdr.len)]
 
 	host.mu.RLock()
-	defer host.mu.RUnlock()
-	var us bool
-	for dev := range host.devices {
-		addr, _, ok := dev.IPv6()
-		if ok && addr == hdr.dst {
-			us = true
-			break
-		}
+	mcast := hdr.dst.IsMulticast()
+	if mcast && host.forward {
+		host.forwardMulticast(dev, b, &hdr)
 	}
-
-	if us {
+	if mcast && !host.acceptsMulticast(dev, b, &hdr) {
+		host.mu.RUnlock()
+		return
+	}
+	if mcast || host.isLocal(hdr.dst) {
 		// deliver
-		c := host.callbacks[int(hdr.nextHdr)]
+		chain, ok := host.walkIPv6Headers(b, &hdr, ipv6Chain{proto: hdr.nextHdr, off: 40, nextHdrOff: ipv6NextHeaderOffset})
+		if ok && chain.proto == ipv6Fragment {
+			b, chain, ok = host.reassembleIPv6(b, &hdr, chain)
+			// a second Fragment header is never valid
+			ok = ok && chain.proto != ipv6Fragment
+		}
+		if !ok {
+			host.mu.RUnlock()
+			return
+		}
+		if chain.proto == IPProtocolICMPv6 && isMLDQuery(b[chain.off:]) {
+			host.handleMLD(dev, b[chain.off:], &hdr)
+		}
+		c := host.callbacks[int(chain.proto)]
 		if c == nil {
+			// ICMPv6 is handled by the caller if at all, and the
+			// no next header value means there's nothing to deliver
+			if chain.proto != IPProtocolICMPv6 && chain.proto != ipv6NoNextHeader {
+				host.writeICMPv6Error(b, &hdr, icmpv6TypeParameterProblem, icmpv6CodeUnrecognizedNextHeader, uint32(chain.nextHdrOff))
+			}
+			host.mu.RUnlock()
 			return
 		}
-		c(b[40:], hdr.src, hdr.dst)
-	} else if host.forward {
+		host.mu.RUnlock()
+		// NOTE(joshlf): Don't hold the lock while calling the callback,
+		// since it may write packets in response (e.g., ICMPv6 echo replies)
+		c(b[chain.off:], hdr.src, hdr.dst)
+		return
+	}
+	defer host.mu.RUnlock()
+	if host.forward {
 		// forward
 		if hdr.hopLimit < 2 {
 			// TTL is or would become 0 after decrement
 			// See "TTL" section, https://tools.ietf.org/html/rfc791#page-14
+			host.writeICMPv6Error(b, &hdr, icmpv6TypeTimeExceeded, icmpv6CodeHopLimitExceeded, 0)
 			return
 		}
-		hdr.hopLimit--
-		setTTL(b, hdr.hopLimit)
-		nexthop, dev, ok := host.table.Lookup(hdr.dst)
+		if hdr.nextHdr == ipv6HopByHop {
+			// Hop-by-Hop Options are processed by every
+			// node along the path (RFC 8200 section 4.3)
+			_, end, ok := nextIPv6Header(b, ipv6HopByHop, 40)
+			if !ok || !host.processIPv6Options(b, &hdr, 40, end) {
+				return
+			}
+		}
+		flow := ipv6Flow{src: hdr.src, hasSrc: true, in: dev, dscp: hdr.trafficClass >> 2,
+			hash: ipv6FlowHash(&hdr, b)}
+		flow.proto, _ = ipv6UpperLayer(b)
+		if host.marker != nil {
+			flow.mark = host.marker(b, dev)
+		}
+		nexthop, dev, ok := host.routes.Lookup(hdr.dst, &flow)
 		if !ok {
-			// XXX: ICMPv6 reply
+			host.writeICMPv6Error(b, &hdr, icmpv6TypeDestUnreachable, icmpv6CodeNoRoute, 0)
 			return
 		}
-		dev.WriteToIPv6(b, nexthop)
+		setHopLimit(b, hdr.hopLimit-1)
+		_, err := dev.WriteToIPv6(b, nexthop)
+		if err != nil {
+			// quote the packet as it was received
+			setHopLimit(b, hdr.hopLimit)
+		}
+		switch {
+		case errors.IsHostUnreachable(err):
+			host.writeICMPv6Error(b, &hdr, icmpv6TypeDestUnreachable, icmpv6CodeAddressUnreachable, 0)
+		case errors.IsMTU(err):
+			// routers never fragment IPv6 packets
+			mtu := uint32(errors.GetMTU(err))
+			host.writeICMPv6Error(b, &hdr, icmpv6TypePacketTooBig, 0, mtu)
+		}
+		// TODO(joshlf): Log error
 	}
 }
+
+// isLocal is like ipv4Host.isLocal, but for IPv6.
+func (host *ipv6Host) isLocal(addr IPv6) bool {
+	_, ok := host.local[addr]
+	return ok
+}
+
+// acceptsMulticast is like ipv4Host.acceptsMulticast, but for IPv6. The
+// all-nodes group takes the place of the all-systems group, and MLD queries
+// that of IGMP messages.
+func (host *ipv6Host) acceptsMulticast(dev IPv6Device, b []byte, hdr *ipv6Header) bool {
+	if hdr.dst == ipv6AllNodes {
+		return true
+	}
+	group := string(hdr.dst[:])
+	if proto, off := ipv6UpperLayer(b); proto == IPProtocolICMPv6 && isMLDQuery(b[off:]) {
+		return host.mld.joined(dev, group)
+	}
+	return host.mld.accepts(dev, group, string(hdr.src[:]))
+}
+
+// updateAddrs is like ipv4Host.updateAddrs, but for IPv6.
+func (host *ipv6Host) updateAddrs(dev IPv6Device) {
+	host.addrMu.Lock()
+	defer host.addrMu.Unlock()
+	var addrs []IPv6DeviceAddr
+	host.mu.RLock()
+	ok := host.devices[dev]
+	host.mu.RUnlock()
+	if ok {
+		addrs = dev.IPv6Addrs()
+	}
+
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if len(addrs) > 0 {
+		host.addrs[dev] = addrs
+	} else {
+		delete(host.addrs, dev)
+	}
+	host.local = make(map[IPv6]IPv6Device)
+	for dev, addrs := range host.addrs {
+		for _, a := range addrs {
+			host.local[a.Addr] = dev
+		}
+	}
+}
+
+// setHopLimit sets the hop limit in the IPv6 header encoded in b
+// without having to rewrite the entire header using writeIPv6Header
+func setHopLimit(b []byte, hops uint8) {
+	b[7] = hops
+}
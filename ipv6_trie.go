@@ -0,0 +1,172 @@
+package net
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// ipv6Trie is like ipv4Trie, but for IPv6 prefixes.
+type ipv6Trie struct {
+	root *ipv6TrieNode
+}
+
+type ipv6TrieNode struct {
+	key      ipv6Key // the prefix, with all bits after the first len cleared
+	len      uint8
+	child    [2]*ipv6TrieNode // children, whose prefixes are longer, by their next bit
+	routes   []IPv6Route      // from the most to the least preferred (see ipv6RouteLess)
+	devRoute *IPv6DeviceRoute
+}
+
+func (n *ipv6TrieNode) empty() bool { return len(n.routes) == 0 && n.devRoute == nil }
+
+// ipv6Key is an IPv6 address or prefix as a pair of integers,
+// which are faster to operate on than a [16]byte.
+type ipv6Key struct {
+	hi, lo uint64
+}
+
+func ipv6KeyOf(addr IPv6) ipv6Key {
+	return ipv6Key{hi: binary.BigEndian.Uint64(addr[:8]), lo: binary.BigEndian.Uint64(addr[8:])}
+}
+
+// mask returns k with all bits after the first l cleared.
+func (k ipv6Key) mask(l uint8) ipv6Key {
+	if l <= 64 {
+		return ipv6Key{hi: k.hi & (^uint64(0) << (64 - l))}
+	}
+	return ipv6Key{hi: k.hi, lo: k.lo & (^uint64(0) << (128 - l))}
+}
+
+// bit returns bit i of k, counting from the most significant bit.
+func (k ipv6Key) bit(i uint8) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// commonLen returns the length of the longest common prefix of k and other.
+func (k ipv6Key) commonLen(other ipv6Key) uint8 {
+	if x := k.hi ^ other.hi; x != 0 {
+		return uint8(bits.LeadingZeros64(x))
+	}
+	return 64 + uint8(bits.LeadingZeros64(k.lo^other.lo))
+}
+
+// ipv6Prefix returns the prefix of subnet as an ipv6Key, and its length.
+func ipv6Prefix(subnet IPv6Subnet) (key ipv6Key, l uint8) {
+	mask := ipv6KeyOf(subnet.Netmask)
+	l = uint8(bits.LeadingZeros64(^mask.hi))
+	if l == 64 {
+		l += uint8(bits.LeadingZeros64(^mask.lo))
+	}
+	return ipv6KeyOf(subnet.Addr).mask(l), l
+}
+
+// update is like ipv4Trie.update.
+func (t ipv6Trie) update(subnet IPv6Subnet, f func(n *ipv6TrieNode)) ipv6Trie {
+	key, l := ipv6Prefix(subnet)
+	return ipv6Trie{root: t.root.update(key, l, f)}
+}
+
+func (n *ipv6TrieNode) update(key ipv6Key, l uint8, f func(n *ipv6TrieNode)) *ipv6TrieNode {
+	if n == nil {
+		leaf := &ipv6TrieNode{key: key, len: l}
+		f(leaf)
+		if leaf.empty() {
+			return nil
+		}
+		return leaf
+	}
+	common := n.key.commonLen(key)
+	if common > n.len {
+		common = n.len
+	}
+	if common > l {
+		common = l
+	}
+	if common == n.len {
+		c := new(ipv6TrieNode)
+		*c = *n
+		if n.len == l {
+			f(c)
+		} else {
+			b := key.bit(n.len)
+			c.child[b] = n.child[b].update(key, l, f)
+		}
+		return c.compact()
+	}
+
+	// n's prefix isn't a prefix of subnet's
+	leaf := &ipv6TrieNode{key: key, len: l}
+	f(leaf)
+	if leaf.empty() {
+		return n
+	}
+	if common == l {
+		// but subnet's is a prefix of n's
+		leaf.child[n.key.bit(l)] = n
+		return leaf
+	}
+	// they diverge, so a new branching point is needed
+	branch := &ipv6TrieNode{key: key.mask(common), len: common}
+	branch.child[n.key.bit(common)] = n
+	branch.child[key.bit(common)] = leaf
+	return branch
+}
+
+// compact is like ipv4TrieNode.compact.
+func (n *ipv6TrieNode) compact() *ipv6TrieNode {
+	if !n.empty() || (n.child[0] != nil && n.child[1] != nil) {
+		return n
+	}
+	if n.child[0] != nil {
+		return n.child[0]
+	}
+	return n.child[1]
+}
+
+// lookup returns the node with the longest prefix which matches addr and
+// which holds a device route or, unless devOnly is true, a route. If there
+// is no such node, lookup returns nil.
+func (t ipv6Trie) lookup(addr IPv6, devOnly bool) *ipv6TrieNode {
+	var buf [129]*ipv6TrieNode
+	nodes := t.lookupAll(addr, devOnly, buf[:0])
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[len(nodes)-1]
+}
+
+// lookupAll is like lookup, but appends every such node to nodes, from the
+// shortest prefix to the longest.
+func (t ipv6Trie) lookupAll(addr IPv6, devOnly bool, nodes []*ipv6TrieNode) []*ipv6TrieNode {
+	key := ipv6KeyOf(addr)
+	for n := t.root; n != nil; n = n.child[key.bit(n.len)] {
+		if key.mask(n.len) != n.key {
+			break
+		}
+		if n.devRoute != nil || (!devOnly && len(n.routes) > 0) {
+			nodes = append(nodes, n)
+		}
+		if n.len == 128 {
+			break
+		}
+	}
+	return nodes
+}
+
+// walk calls f on each node in order of prefix.
+func (t ipv6Trie) walk(f func(n *ipv6TrieNode)) {
+	var walk func(n *ipv6TrieNode)
+	walk = func(n *ipv6TrieNode) {
+		if n == nil {
+			return
+		}
+		f(n)
+		walk(n.child[0])
+		walk(n.child[1])
+	}
+	walk(t.root)
+}
@@ -0,0 +1,132 @@
+package net
+
+import (
+	"math"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// MLDv2 (RFC 3810), the IPv6 equivalent of IGMPv3, whose messages are ICMPv6
+// messages
+
+const (
+	mldTypeQuery    = 130
+	mldTypeReportV2 = 143
+
+	// the length of an MLDv1 message, and
+	// the minimum length of an MLDv2 query
+	mldV1Len      = 24
+	mldV2QueryLen = 28
+)
+
+// mldv2Routers is the all-MLDv2-capable-routers group,
+// ff02::16, to which reports are sent.
+var mldv2Routers = IPv6{0xff, 0x02, 15: 0x16}
+
+// mldHopByHop is a Hop-by-Hop Options header containing the Router Alert
+// option (RFC 2711) with the value for MLD, followed by padding.
+var mldHopByHop = []byte{byte(IPProtocolICMPv6), 0, 5, 2, 0, 0, ipv6OptionPadN, 0}
+
+// mldReportable returns false for groups whose memberships are never
+// reported: the all-nodes group and groups of reserved or
+// interface-local scope (RFC 3810 section 6).
+func mldReportable(group string) bool {
+	scope := group[1] & 0xf
+	return group != string(ipv6AllNodes[:]) && scope > 1
+}
+
+// handleMLD handles the MLD query b, which was received on dev in a packet
+// whose header is hdr. host.mu must be held.
+func (host *ipv6Host) handleMLD(dev IPv6Device, b []byte, hdr *ipv6Header) {
+	if len(b) < mldV1Len || !isIPv6LinkLocal(hdr.src) || hdr.hopLimit != 1 {
+		// queries are always sent from link-local addresses
+		// with a hop limit of 1 (RFC 3810 section 5.1.14)
+		return
+	}
+	sum := checksum.IPv6PseudoHeaderSum(hdr.src, hdr.dst, len(b), uint8(IPProtocolICMPv6))
+	if checksum.Finish(checksum.Add(sum, b)) != 0 {
+		// TODO(joshlf): Log it
+		return
+	}
+	// TODO(joshlf): Implement compatibility with MLDv1 routers
+	// (RFC 3810 section 8)
+	var maxResp time.Duration
+	var group IPv6
+	var sources []string
+	buf := b[4:]
+	code := parse.GetUint16(&buf)
+	parse.GetUint16(&buf) // reserved
+	copy(group[:], parse.GetBytes(&buf, 16))
+	switch {
+	case len(b) == mldV1Len:
+		maxResp = time.Duration(code) * time.Millisecond
+	case len(b) >= mldV2QueryLen:
+		maxResp = time.Duration(mcastDecodeCode(uint(code), 3, 12)) * time.Millisecond
+		parse.GetBytes(&buf, 2) // flags and QQIC
+		n := int(parse.GetUint16(&buf))
+		if len(buf) < n*16 {
+			return
+		}
+		for i := 0; i < n; i++ {
+			sources = append(sources, string(parse.GetBytes(&buf, 16)))
+		}
+	default:
+		return
+	}
+
+	switch {
+	case group == IPv6{}:
+		if hdr.dst != ipv6AllNodes {
+			return
+		}
+		host.mld.query(dev, "", nil, maxResp)
+	case group.IsMulticast():
+		host.mld.query(dev, string(group[:]), sources, maxResp)
+	}
+}
+
+// isMLDQuery returns true if the ICMPv6 message b is an MLD query.
+func isMLDQuery(b []byte) bool {
+	return len(b) > 0 && b[0] == mldTypeQuery
+}
+
+// writeMLDReports is like ipv4Host.writeIGMPReports, but for MLDv2.
+func (host *ipv6Host) writeMLDReports(d interface{}, records []mcastRecord) {
+	dev := d.(IPv6Device)
+	host.mu.RLock()
+	// reports are sent from the link-local address, or from
+	// :: if there is none yet (RFC 3810 section 5.2.13)
+	var src IPv6
+	for _, a := range host.addrs[dev] {
+		if isIPv6LinkLocal(a.Addr) {
+			src = a.Addr
+			break
+		}
+	}
+	host.mu.RUnlock()
+
+	hdrLen := 40 + len(mldHopByHop)
+	max := dev.MTU() - hdrLen
+	if dev.MTU() == 0 {
+		max = math.MaxUint16 - len(mldHopByHop)
+	}
+	for _, msg := range makeMcastReports(mldTypeReportV2, records, max) {
+		setICMPChecksum(msg, checksum.IPv6PseudoHeaderSum(src, mldv2Routers, len(msg), uint8(IPProtocolICMPv6)))
+		hdr := ipv6Header{
+			version:  6,
+			len:      uint16(len(mldHopByHop) + len(msg)),
+			nextHdr:  ipv6HopByHop,
+			hopLimit: 1,
+			src:      src,
+			dst:      mldv2Routers,
+		}
+		buf := make([]byte, hdrLen+len(msg))
+		writeIPv6Header(&hdr, buf)
+		copy(buf[40:], mldHopByHop)
+		copy(buf[hdrLen:], msg)
+		dev.WriteToIPv6(buf, mldv2Routers)
+		// TODO(joshlf): Log error
+	}
+}
@@ -0,0 +1,376 @@
+package net
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// An IPv4MulticastRoute is an entry in a host's multicast forwarding cache.
+// If the host is forwarding, multicast packets which arrive on InDevice are
+// forwarded through each of the devices in Outputs, subject to their TTL
+// thresholds, in addition to being delivered to the host if it is a member
+// of the group.
+//
+// A route with a zero Source is a (*, G) route, which applies to packets from
+// sources for which there is no (S, G) route. Packets which arrive on devices
+// other than InDevice fail the reverse path forwarding (RPF) check, which
+// prevents loops, and are not forwarded. Packets sent to link-local groups
+// (224.0.0.0/24) are never forwarded.
+type IPv4MulticastRoute struct {
+	Source, Group IPv4
+	InDevice      IPv4Device
+	Outputs       []IPv4MulticastOutput
+}
+
+// An IPv4MulticastOutput is a device through which a multicast route forwards
+// packets. Packets are only forwarded through it if their TTL exceeds
+// TTLThreshold, which allows sites to scope multicast traffic by TTL.
+type IPv4MulticastOutput struct {
+	Device       IPv4Device
+	TTLThreshold uint8
+}
+
+// An IPv6MulticastRoute is like an IPv4MulticastRoute, but for IPv6. Packets
+// sent to groups of link-local or smaller scope are never forwarded.
+type IPv6MulticastRoute struct {
+	Source, Group IPv6
+	InDevice      IPv6Device
+	Outputs       []IPv6MulticastOutput
+}
+
+// An IPv6MulticastOutput is like an IPv4MulticastOutput, but for IPv6. The
+// threshold applies to packets' hop limits.
+type IPv6MulticastOutput struct {
+	Device       IPv6Device
+	TTLThreshold uint8
+}
+
+type ipv4MrouteKey struct{ source, group IPv4 }
+type ipv6MrouteKey struct{ source, group IPv6 }
+
+type ipv4DeviceGroup struct {
+	dev   IPv4Device
+	group IPv4
+}
+
+type ipv6DeviceGroup struct {
+	dev   IPv6Device
+	group IPv6
+}
+
+// refGroup adds a use of dev's link-layer membership in group. Both joins of
+// the group by the host and multicast routes whose incoming device is dev
+// need the device to receive the group's packets, so dev only leaves the
+// group when none remain. host.groupMu must be held.
+func (host *ipv4Host) refGroup(dev IPv4Device, group IPv4) error {
+	key := ipv4DeviceGroup{dev, group}
+	if host.groupRefs[key] == 0 {
+		if err := dev.JoinIPv4Group(group); err != nil {
+			return err
+		}
+	}
+	host.groupRefs[key]++
+	return nil
+}
+
+// unrefGroup removes a use added by refGroup. host.groupMu must be held.
+func (host *ipv4Host) unrefGroup(dev IPv4Device, group IPv4) {
+	key := ipv4DeviceGroup{dev, group}
+	host.groupRefs[key]--
+	if host.groupRefs[key] > 0 {
+		return
+	}
+	delete(host.groupRefs, key)
+	dev.LeaveIPv4Group(group)
+	// TODO(joshlf): Log error
+}
+
+func (host *ipv4ConfigurationHost) AddIPv4MulticastRoute(route IPv4MulticastRoute) error {
+	if !route.Group.IsMulticast() {
+		return errors.Errorf("add IPv4 multicast route: %v is not a multicast address", route.Group)
+	}
+	if route.InDevice == nil {
+		return errors.New("add IPv4 multicast route: no incoming device")
+	}
+	route.Outputs = append([]IPv4MulticastOutput(nil), route.Outputs...)
+
+	host.groupMu.Lock()
+	defer host.groupMu.Unlock()
+	host.rlock()
+	ok := host.devices[route.InDevice]
+	for _, out := range route.Outputs {
+		ok = ok && host.devices[out.Device]
+	}
+	host.runlock()
+	if !ok {
+		return errors.New("add IPv4 multicast route: device has not been added to host")
+	}
+	if err := host.refGroup(route.InDevice, route.Group); err != nil {
+		return errors.Annotate(err, "add IPv4 multicast route")
+	}
+	key := ipv4MrouteKey{route.Source, route.Group}
+	host.lock()
+	old, replaced := host.mroutes[key]
+	host.mroutes[key] = route
+	host.unlock()
+	if replaced {
+		host.unrefGroup(old.InDevice, old.Group)
+	}
+	return nil
+}
+
+func (host *ipv4ConfigurationHost) DeleteIPv4MulticastRoute(source, group IPv4) bool {
+	host.groupMu.Lock()
+	defer host.groupMu.Unlock()
+	key := ipv4MrouteKey{source, group}
+	host.lock()
+	old, ok := host.mroutes[key]
+	delete(host.mroutes, key)
+	host.unlock()
+	if ok {
+		host.unrefGroup(old.InDevice, old.Group)
+	}
+	return ok
+}
+
+// removeMroutes deletes the multicast routes whose incoming device is dev,
+// which is being removed from the host, and removes dev from the outputs of
+// the others. host.groupMu must be held.
+func (host *ipv4ConfigurationHost) removeMroutes(dev IPv4Device) {
+	var deleted []IPv4MulticastRoute
+	host.lock()
+	for key, route := range host.mroutes {
+		if route.InDevice == dev {
+			delete(host.mroutes, key)
+			deleted = append(deleted, route)
+			continue
+		}
+		var outs []IPv4MulticastOutput
+		for _, out := range route.Outputs {
+			if out.Device != dev {
+				outs = append(outs, out)
+			}
+		}
+		if len(outs) != len(route.Outputs) {
+			// route.Outputs may be in use by forwardMulticast, so
+			// replace it rather than modifying it
+			route.Outputs = outs
+			host.mroutes[key] = route
+		}
+	}
+	host.unlock()
+	for _, route := range deleted {
+		host.unrefGroup(route.InDevice, route.Group)
+	}
+}
+
+func (host *ipv4ConfigurationHost) IPv4MulticastRoutes() []IPv4MulticastRoute {
+	host.rlock()
+	routes := make([]IPv4MulticastRoute, 0, len(host.mroutes))
+	for _, route := range host.mroutes {
+		route.Outputs = append([]IPv4MulticastOutput(nil), route.Outputs...)
+		routes = append(routes, route)
+	}
+	host.runlock()
+	sort.Slice(routes, func(i, j int) bool {
+		if c := bytes.Compare(routes[i].Group[:], routes[j].Group[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(routes[i].Source[:], routes[j].Source[:]) < 0
+	})
+	return routes
+}
+
+// forwardMulticast forwards copies of the multicast packet b, whose header is
+// hdr and which was received on the device in, using the route for its source
+// and group, or the (*, G) route for its group if there is none. Since ICMP
+// error messages are never sent about multicast packets, packets which can't
+// be forwarded are silently dropped. host.mu must be held.
+func (host *ipv4Host) forwardMulticast(in IPv4Device, b []byte, hdr *ipv4Header) {
+	if hdr.dst[0] == 224 && hdr.dst[1] == 0 && hdr.dst[2] == 0 || hdr.TTL < 2 {
+		return
+	}
+	route, ok := host.mroutes[ipv4MrouteKey{hdr.src, hdr.dst}]
+	if !ok {
+		route, ok = host.mroutes[ipv4MrouteKey{group: hdr.dst}]
+	}
+	if !ok || route.InDevice != in {
+		// TODO(joshlf): Log RPF failures
+		return
+	}
+	var buf []byte
+	for _, out := range route.Outputs {
+		if out.Device == in || hdr.TTL <= out.TTLThreshold {
+			continue
+		}
+		if mtu := out.Device.MTU(); mtu != 0 && len(b) > mtu {
+			host.forwardFragments(b, hdr, hdr.dst, out.Device, mtu)
+			continue
+		}
+		if buf == nil {
+			// b may be modified when it is delivered
+			buf = append([]byte(nil), b...)
+			setTTL(buf, hdr.TTL-1)
+		}
+		out.Device.WriteToIPv4(buf, hdr.dst)
+		// TODO(joshlf): Log error
+	}
+}
+
+// refGroup is like ipv4Host.refGroup, but for IPv6.
+func (host *ipv6Host) refGroup(dev IPv6Device, group IPv6) error {
+	key := ipv6DeviceGroup{dev, group}
+	if host.groupRefs[key] == 0 {
+		if err := dev.JoinIPv6Group(group); err != nil {
+			return err
+		}
+	}
+	host.groupRefs[key]++
+	return nil
+}
+
+func (host *ipv6Host) unrefGroup(dev IPv6Device, group IPv6) {
+	key := ipv6DeviceGroup{dev, group}
+	host.groupRefs[key]--
+	if host.groupRefs[key] > 0 {
+		return
+	}
+	delete(host.groupRefs, key)
+	dev.LeaveIPv6Group(group)
+	// TODO(joshlf): Log error
+}
+
+func (host *ipv6ConfigurationHost) AddIPv6MulticastRoute(route IPv6MulticastRoute) error {
+	if !route.Group.IsMulticast() {
+		return errors.Errorf("add IPv6 multicast route: %v is not a multicast address", route.Group)
+	}
+	if route.InDevice == nil {
+		return errors.New("add IPv6 multicast route: no incoming device")
+	}
+	route.Outputs = append([]IPv6MulticastOutput(nil), route.Outputs...)
+
+	host.groupMu.Lock()
+	defer host.groupMu.Unlock()
+	host.rlock()
+	ok := host.devices[route.InDevice]
+	for _, out := range route.Outputs {
+		ok = ok && host.devices[out.Device]
+	}
+	host.runlock()
+	if !ok {
+		return errors.New("add IPv6 multicast route: device has not been added to host")
+	}
+	if err := host.refGroup(route.InDevice, route.Group); err != nil {
+		return errors.Annotate(err, "add IPv6 multicast route")
+	}
+	key := ipv6MrouteKey{route.Source, route.Group}
+	host.lock()
+	old, replaced := host.mroutes[key]
+	host.mroutes[key] = route
+	host.unlock()
+	if replaced {
+		host.unrefGroup(old.InDevice, old.Group)
+	}
+	return nil
+}
+
+func (host *ipv6ConfigurationHost) DeleteIPv6MulticastRoute(source, group IPv6) bool {
+	host.groupMu.Lock()
+	defer host.groupMu.Unlock()
+	key := ipv6MrouteKey{source, group}
+	host.lock()
+	old, ok := host.mroutes[key]
+	delete(host.mroutes, key)
+	host.unlock()
+	if ok {
+		host.unrefGroup(old.InDevice, old.Group)
+	}
+	return ok
+}
+
+// removeMroutes is like ipv4ConfigurationHost.removeMroutes, but for IPv6.
+func (host *ipv6ConfigurationHost) removeMroutes(dev IPv6Device) {
+	var deleted []IPv6MulticastRoute
+	host.lock()
+	for key, route := range host.mroutes {
+		if route.InDevice == dev {
+			delete(host.mroutes, key)
+			deleted = append(deleted, route)
+			continue
+		}
+		var outs []IPv6MulticastOutput
+		for _, out := range route.Outputs {
+			if out.Device != dev {
+				outs = append(outs, out)
+			}
+		}
+		if len(outs) != len(route.Outputs) {
+			route.Outputs = outs
+			host.mroutes[key] = route
+		}
+	}
+	host.unlock()
+	for _, route := range deleted {
+		host.unrefGroup(route.InDevice, route.Group)
+	}
+}
+
+func (host *ipv6ConfigurationHost) IPv6MulticastRoutes() []IPv6MulticastRoute {
+	host.rlock()
+	routes := make([]IPv6MulticastRoute, 0, len(host.mroutes))
+	for _, route := range host.mroutes {
+		route.Outputs = append([]IPv6MulticastOutput(nil), route.Outputs...)
+		routes = append(routes, route)
+	}
+	host.runlock()
+	sort.Slice(routes, func(i, j int) bool {
+		if c := bytes.Compare(routes[i].Group[:], routes[j].Group[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(routes[i].Source[:], routes[j].Source[:]) < 0
+	})
+	return routes
+}
+
+// forwardMulticast is like ipv4Host.forwardMulticast, but for IPv6. Like
+// unicast packets, multicast packets are never fragmented, and Packet Too
+// Big messages, which are the exception to the rule against ICMPv6 error
+// messages about multicast packets (RFC 4443 section 2.4), are sent instead.
+func (host *ipv6Host) forwardMulticast(in IPv6Device, b []byte, hdr *ipv6Header) {
+	if hdr.dst[1]&0xf <= 2 || hdr.hopLimit < 2 {
+		// the scope is link-local or smaller
+		return
+	}
+	route, ok := host.mroutes[ipv6MrouteKey{hdr.src, hdr.dst}]
+	if !ok {
+		route, ok = host.mroutes[ipv6MrouteKey{group: hdr.dst}]
+	}
+	if !ok || route.InDevice != in {
+		// TODO(joshlf): Log RPF failures
+		return
+	}
+	if hdr.nextHdr == ipv6HopByHop {
+		_, end, ok := nextIPv6Header(b, ipv6HopByHop, 40)
+		if !ok || !host.processIPv6Options(b, hdr, 40, end) {
+			return
+		}
+	}
+	var buf []byte
+	for _, out := range route.Outputs {
+		if out.Device == in || hdr.hopLimit <= out.TTLThreshold {
+			continue
+		}
+		if mtu := out.Device.MTU(); mtu != 0 && len(b) > mtu {
+			host.writeICMPv6Error(b, hdr, icmpv6TypePacketTooBig, 0, uint32(mtu))
+			continue
+		}
+		if buf == nil {
+			buf = append([]byte(nil), b...)
+			setHopLimit(buf, hdr.hopLimit-1)
+		}
+		out.Device.WriteToIPv6(buf, hdr.dst)
+		// TODO(joshlf): Log error
+	}
+}
@@ -0,0 +1,140 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMulticastForwarding(t *testing.T) {
+	// a router connects 10.0.0.0/24, on which the sender 10.0.0.2 is, to
+	// 10.0.1.0/24 and 10.0.2.0/24, on which receivers 10.0.1.2 and
+	// 10.0.2.2 are; the router's address on each subnet ends in .1
+	segs := make([]EthernetSegment, 3)
+	netmask := IPv4{255, 255, 255, 0}
+	newDev := func(i int, host byte) *EthernetDevice {
+		dev, err := NewEthernetDevice(segs[i].NewInterface(), MAC{2, 0, 0, 0, byte(i), host})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(IPv4{10, 0, byte(i), host}, netmask)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		return dev
+	}
+	router := NewIPv4Host()
+	router.SetForwarding(true)
+	routerdevs := []*EthernetDevice{newDev(0, 1), newDev(1, 1), newDev(2, 1)}
+	for _, dev := range routerdevs {
+		defer dev.BringDown()
+		router.AddIPv4Device(dev)
+	}
+	group := IPv4{239, 1, 2, 3}
+	hosts := make([]IPv4Host, 3)
+	received := make([]chan IPv4, 3)
+	for i := range hosts {
+		dev := newDev(i, 2)
+		defer dev.BringDown()
+		hosts[i] = NewIPv4Host()
+		hosts[i].AddIPv4Device(dev)
+		if i == 0 {
+			continue
+		}
+		c := make(chan IPv4, 4)
+		received[i] = c
+		hosts[i].RegisterIPv4Callback(func(b []byte, src, dst IPv4) { c <- src }, 200)
+		if _, err := hosts[i].JoinIPv4Group(dev, group, MulticastExclude, nil); err != nil {
+			t.Fatalf("unexpected error joining group: %v", err)
+		}
+	}
+	sender, senderAddr := hosts[0], IPv4{10, 0, 0, 2}
+	// send sends a packet to the group from src on host, and
+	// checks which of the receivers receive it
+	send := func(host IPv4Host, src IPv4, want1, want2 bool) {
+		if _, err := host.WriteToIPv4From([]byte("hello"), src, group, 200); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+		for i, want := range []bool{want1, want2} {
+			select {
+			case got := <-received[i+1]:
+				if !want || got != src {
+					t.Errorf("receiver %v got unexpected packet from %v", i+1, got)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if want {
+					t.Errorf("receiver %v timed out waiting for packet from %v", i+1, src)
+				}
+			}
+		}
+	}
+
+	// nothing is forwarded without a route
+	send(sender, senderAddr, false, false)
+	err := router.AddIPv4MulticastRoute(IPv4MulticastRoute{
+		Group:    group,
+		InDevice: routerdevs[0],
+		Outputs:  []IPv4MulticastOutput{{Device: routerdevs[1]}, {Device: routerdevs[2], TTLThreshold: 5}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error adding route: %v", err)
+	}
+	send(sender, senderAddr, true, true)
+	sender.SetTTL(5)
+	send(sender, senderAddr, true, false)
+	sender.SetTTL(0)
+	// packets from the wrong direction fail the RPF check (and
+	// aren't looped back to the sender)
+	send(hosts[1], IPv4{10, 0, 1, 2}, false, false)
+
+	// (S, G) routes take precedence over (*, G) routes
+	err = router.AddIPv4MulticastRoute(IPv4MulticastRoute{
+		Source:   senderAddr,
+		Group:    group,
+		InDevice: routerdevs[0],
+		Outputs:  []IPv4MulticastOutput{{Device: routerdevs[2]}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error adding route: %v", err)
+	}
+	if routes := router.IPv4MulticastRoutes(); len(routes) != 2 || routes[0].Source != (IPv4{}) || routes[1].Source != senderAddr {
+		t.Errorf("got routes %v; want the (*, G) route followed by the (S, G) route", routes)
+	}
+	send(sender, senderAddr, false, true)
+
+	if !router.DeleteIPv4MulticastRoute(senderAddr, group) {
+		t.Errorf("failed to delete route")
+	}
+	send(sender, senderAddr, true, true)
+	if !router.DeleteIPv4MulticastRoute(IPv4{}, group) {
+		t.Errorf("failed to delete route")
+	}
+	if router.DeleteIPv4MulticastRoute(IPv4{}, group) {
+		t.Errorf("deleted nonexistent route")
+	}
+	send(sender, senderAddr, false, false)
+
+	// removing a device removes it from the routes' outputs, and deletes
+	// the routes whose incoming device it is, leaving the groups which they
+	// joined
+	err = router.AddIPv4MulticastRoute(IPv4MulticastRoute{
+		Group:    group,
+		InDevice: routerdevs[0],
+		Outputs:  []IPv4MulticastOutput{{Device: routerdevs[1]}, {Device: routerdevs[2]}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error adding route: %v", err)
+	}
+	router.RemoveIPv4Device(routerdevs[2])
+	routes := router.IPv4MulticastRoutes()
+	if len(routes) != 1 || len(routes[0].Outputs) != 1 || routes[0].Outputs[0].Device != routerdevs[1] {
+		t.Errorf("got routes %v; want a single route through the remaining device", routes)
+	}
+	send(sender, senderAddr, true, false)
+	router.RemoveIPv4Device(routerdevs[0])
+	if routes := router.IPv4MulticastRoutes(); len(routes) != 0 {
+		t.Errorf("got routes %v after removing their incoming device", routes)
+	}
+	if refs := router.(*ipv4ConfigurationHost).groupRefs; len(refs) != 0 {
+		t.Errorf("got group references %v after removing all routes", refs)
+	}
+}
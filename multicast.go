@@ -0,0 +1,627 @@
+package net
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// ipv4AllSystems is the all-systems multicast group, 224.0.0.1, of which
+// every host is a member on each of its multicast-capable devices (RFC 1112
+// section 4).
+var ipv4AllSystems = IPv4{224, 0, 0, 1}
+
+// IsMulticast returns true if i is a multicast address
+// (224.0.0.0/4; RFC 5771).
+func (i IPv4) IsMulticast() bool { return i[0]&0xf0 == 224 }
+
+// IsMulticast returns true if i is a multicast address
+// (ff00::/8; RFC 4291 section 2.7).
+func (i IPv6) IsMulticast() bool { return i[0] == 0xff }
+
+// ipv4MulticastMAC returns the MAC to which frames addressed to the multicast
+// IPv4 address addr are sent: the low 23 bits of addr appended to 01:00:5e
+// (RFC 1112 section 6.4). Since the other 5 bits of the group are dropped,
+// 32 groups share each MAC.
+func ipv4MulticastMAC(addr IPv4) MAC {
+	return MAC{0x01, 0x00, 0x5e, addr[1] & 0x7f, addr[2], addr[3]}
+}
+
+// checkIPv4Group returns an error if addr, the argument to a
+// device's JoinIPv4Group or LeaveIPv4Group method, isn't a
+// multicast address.
+func checkIPv4Group(addr IPv4) error {
+	if !addr.IsMulticast() {
+		return errors.Errorf("%v is not a multicast address", addr)
+	}
+	return nil
+}
+
+func checkIPv6Group(addr IPv6) error {
+	if !addr.IsMulticast() {
+		return errors.Errorf("%v is not a multicast address", addr)
+	}
+	return nil
+}
+
+// A MulticastFilterMode is the filter mode of a multicast group membership,
+// which says how its list of sources is interpreted (RFC 3376 section 3.1).
+type MulticastFilterMode uint8
+
+const (
+	// MulticastInclude means that only packets from the listed sources are
+	// received.
+	MulticastInclude MulticastFilterMode = iota
+	// MulticastExclude means that packets from all sources except those
+	// listed are received. A membership in exclude mode with no sources
+	// receives packets from all sources.
+	MulticastExclude
+)
+
+func (m MulticastFilterMode) String() string {
+	switch m {
+	case MulticastInclude:
+		return "include"
+	case MulticastExclude:
+		return "exclude"
+	}
+	return "unknown"
+}
+
+// An IPv4Membership describes a device's membership in a multicast group.
+// Its filter combines those of all of the host's joins of the group on the
+// device (see JoinIPv4Group).
+type IPv4Membership struct {
+	Device  IPv4Device
+	Group   IPv4
+	Mode    MulticastFilterMode
+	Sources []IPv4
+}
+
+// An IPv6Membership is like an IPv4Membership, but for IPv6.
+type IPv6Membership struct {
+	Device  IPv6Device
+	Group   IPv6
+	Mode    MulticastFilterMode
+	Sources []IPv6
+}
+
+const (
+	// the defaults of the Robustness Variable and the Unsolicited Report
+	// Interval (RFC 3376 section 8, RFC 3810 section 9)
+	mcastRobustness     = 2
+	mcastReportInterval = time.Second
+
+	// group record types, which are the same for IGMPv3
+	// and MLDv2 (RFC 3376 section 4.2.12, RFC 3810 section 5.2.12)
+	mcastModeIsInclude   = 1
+	mcastModeIsExclude   = 2
+	mcastChangeToInclude = 3
+	mcastChangeToExclude = 4
+	mcastAllowNewSources = 5
+	mcastBlockOldSources = 6
+)
+
+// mcastAddrs is a set of addresses. Addresses are stored as strings of their
+// bytes so that the same code can implement both IGMPv3 and MLDv2.
+type mcastAddrs map[string]bool
+
+func newMcastAddrs(addrs []string) mcastAddrs {
+	set := make(mcastAddrs)
+	for _, a := range addrs {
+		set[a] = true
+	}
+	return set
+}
+
+func (a mcastAddrs) sorted() []string {
+	addrs := make([]string, 0, len(a))
+	for addr := range a {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// minus returns the addresses in a which aren't in b.
+func (a mcastAddrs) minus(b mcastAddrs) mcastAddrs {
+	c := make(mcastAddrs)
+	for addr := range a {
+		if !b[addr] {
+			c[addr] = true
+		}
+	}
+	return c
+}
+
+// and returns the addresses which are in both a and b.
+func (a mcastAddrs) and(b mcastAddrs) mcastAddrs {
+	c := make(mcastAddrs)
+	for addr := range a {
+		if b[addr] {
+			c[addr] = true
+		}
+	}
+	return c
+}
+
+// or returns the addresses which are in either a or b.
+func (a mcastAddrs) or(b mcastAddrs) mcastAddrs {
+	c := make(mcastAddrs)
+	for addr := range a {
+		c[addr] = true
+	}
+	for addr := range b {
+		c[addr] = true
+	}
+	return c
+}
+
+// mcastFilter is a source filter. The zero value, an include
+// filter with no sources, means that there is no membership.
+type mcastFilter struct {
+	mode    MulticastFilterMode
+	sources mcastAddrs
+}
+
+func (f *mcastFilter) member() bool {
+	return f.mode == MulticastExclude || len(f.sources) > 0
+}
+
+func (f *mcastFilter) accepts(src string) bool {
+	return f.sources[src] == (f.mode == MulticastInclude)
+}
+
+// mergeMcastFilters returns the filter of a device's membership in a group
+// given those of the joins of the group (RFC 3376 section 3.2): if any is in
+// exclude mode, the sources which all exclude filters exclude and no include
+// filter includes are excluded, and otherwise, the sources which any include
+// filter includes are included.
+func mergeMcastFilters(filters map[*mcastFilter]bool) mcastFilter {
+	var merged mcastFilter
+	includes := make(mcastAddrs)
+	for f := range filters {
+		switch {
+		case f.mode == MulticastInclude:
+			includes = includes.or(f.sources)
+		case merged.mode == MulticastInclude:
+			merged = mcastFilter{mode: MulticastExclude, sources: f.sources}
+		default:
+			merged.sources = merged.sources.and(f.sources)
+		}
+	}
+	if merged.mode == MulticastInclude {
+		return mcastFilter{mode: MulticastInclude, sources: includes}
+	}
+	merged.sources = merged.sources.minus(includes)
+	return merged
+}
+
+// mcastRecord is a group record in an IGMPv3 or MLDv2 report.
+type mcastRecord struct {
+	typ     uint8
+	group   string
+	sources []string
+}
+
+// makeMcastReports makes reports of the given type containing records,
+// splitting them among as many reports as are needed to keep each within
+// max bytes. The header of IGMPv3 and MLDv2 reports is the same, except for
+// the type; the checksum is left zero.
+func makeMcastReports(typ uint8, records []mcastRecord, max int) [][]byte {
+	var reports [][]byte
+	var b []byte
+	n := 0
+	for _, r := range records {
+		rec := []byte{r.typ, 0, byte(len(r.sources) >> 8), byte(len(r.sources))}
+		rec = append(rec, r.group...)
+		for _, src := range r.sources {
+			rec = append(rec, src...)
+		}
+		// TODO(joshlf): Split records whose source lists
+		// are too long to fit in a single report
+		if b != nil && len(b)+len(rec) > max {
+			reports = append(reports, b)
+			b = nil
+		}
+		if b == nil {
+			b, n = make([]byte, 8), 0
+			b[0] = typ
+		}
+		b = append(b, rec...)
+		n++
+		b[6], b[7] = byte(n>>8), byte(n)
+	}
+	if b != nil {
+		reports = append(reports, b)
+	}
+	return reports
+}
+
+// mcastGroup is the state of a device's membership in a group.
+type mcastGroup struct {
+	joins map[*mcastFilter]bool
+	state mcastFilter // the combination of the filters in joins
+
+	// A pending state-change report (RFC 3376 section 5.1), which will be
+	// sent retransmits more times, next at changeAt. If the filter mode has
+	// changed, modeChange is set; otherwise, the sources which have been
+	// allowed or blocked are recorded.
+	retransmits  int
+	changeAt     time.Time
+	modeChange   bool
+	allow, block mcastAddrs
+
+	// A pending response to a group-specific or group-and-source-specific
+	// query (RFC 3376 section 5.2), which is due at queryAt, or which isn't
+	// pending if queryAt is zero. querySources is nil for group-specific
+	// queries.
+	queryAt      time.Time
+	querySources mcastAddrs
+}
+
+func (g *mcastGroup) idle() bool {
+	return len(g.joins) == 0 && g.retransmits == 0 && g.queryAt.IsZero()
+}
+
+// addChange records the change of g.state from old in g's pending
+// state-change report, returning false if nothing has changed.
+func (g *mcastGroup) addChange(old mcastFilter) bool {
+	new := g.state
+	if old.mode != new.mode {
+		g.modeChange, g.allow, g.block = true, nil, nil
+	} else {
+		allow, block := new.sources.minus(old.sources), old.sources.minus(new.sources)
+		if new.mode == MulticastExclude {
+			allow, block = block, allow
+		}
+		if len(allow) == 0 && len(block) == 0 {
+			return false
+		}
+		if !g.modeChange {
+			// if a mode change is pending, its records
+			// always describe the current state
+			g.allow = g.allow.minus(block).or(allow)
+			g.block = g.block.minus(allow).or(block)
+		}
+	}
+	g.retransmits = mcastRobustness
+	return true
+}
+
+// changeRecords returns the records of g's pending state-change report.
+func (g *mcastGroup) changeRecords(group string) []mcastRecord {
+	if g.modeChange {
+		typ := uint8(mcastChangeToInclude)
+		if g.state.mode == MulticastExclude {
+			typ = mcastChangeToExclude
+		}
+		return []mcastRecord{{typ: typ, group: group, sources: g.state.sources.sorted()}}
+	}
+	var records []mcastRecord
+	if len(g.allow) > 0 {
+		records = append(records, mcastRecord{typ: mcastAllowNewSources, group: group, sources: g.allow.sorted()})
+	}
+	if len(g.block) > 0 {
+		records = append(records, mcastRecord{typ: mcastBlockOldSources, group: group, sources: g.block.sorted()})
+	}
+	return records
+}
+
+// sentChange is called after g's pending state-change report has been sent.
+func (g *mcastGroup) sentChange(now time.Time) {
+	g.retransmits--
+	if g.retransmits > 0 {
+		g.changeAt = now.Add(randDelay(mcastReportInterval))
+		return
+	}
+	g.modeChange, g.allow, g.block = false, nil, nil
+}
+
+// currentRecords returns the record describing g's current state.
+func (g *mcastGroup) currentRecords(group string) []mcastRecord {
+	if !g.state.member() {
+		return nil
+	}
+	typ := uint8(mcastModeIsInclude)
+	if g.state.mode == MulticastExclude {
+		typ = mcastModeIsExclude
+	}
+	return []mcastRecord{{typ: typ, group: group, sources: g.state.sources.sorted()}}
+}
+
+// queryRecords returns the records of the response to g's pending query.
+func (g *mcastGroup) queryRecords(group string) []mcastRecord {
+	if g.querySources == nil {
+		return g.currentRecords(group)
+	}
+	// only report which of the queried sources we want to receive
+	sources := g.querySources.minus(g.state.sources)
+	if g.state.mode == MulticastInclude {
+		sources = g.querySources.and(g.state.sources)
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	return []mcastRecord{{typ: mcastModeIsInclude, group: group, sources: sources.sorted()}}
+}
+
+// mcastIface is the multicast state of a device.
+type mcastIface struct {
+	groups map[string]*mcastGroup
+	// when the response to a general query is due, or zero if none is pending
+	generalAt time.Time
+}
+
+// mcastListener implements the multicast listener part of IGMPv3 (RFC 3376)
+// and MLDv2 (RFC 3810), which only differ in their message formats. It keeps
+// track of the memberships of each of a host's devices and of which reports
+// are due, and uses a function provided by the host to send them. Devices are
+// IPv4Devices or IPv6Devices, and addresses are strings of their bytes.
+type mcastListener struct {
+	ifaces map[interface{}]*mcastIface
+	timer  *time.Timer // nil until the first report is scheduled
+
+	// report sends a report containing records on dev. It is
+	// called without mu held.
+	report func(dev interface{}, records []mcastRecord)
+	// reportable returns false for groups whose memberships
+	// are never reported, such as the all-systems group.
+	reportable func(group string) bool
+
+	mu sync.Mutex
+}
+
+func newMcastListener(report func(dev interface{}, records []mcastRecord), reportable func(group string) bool) *mcastListener {
+	return &mcastListener{
+		ifaces:     make(map[interface{}]*mcastIface),
+		report:     report,
+		reportable: reportable,
+	}
+}
+
+// joined returns true if dev has any joins of group.
+func (l *mcastListener) joined(dev interface{}, group string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	iface := l.ifaces[dev]
+	return iface != nil && iface.groups[group] != nil && len(iface.groups[group].joins) > 0
+}
+
+// join adds a join of group on dev with the filter f, sending a state-change
+// report if that changes dev's membership.
+func (l *mcastListener) join(dev interface{}, group string, f *mcastFilter) {
+	l.update(dev, group, func(g *mcastGroup) { g.joins[f] = true })
+}
+
+// leave removes a join added by join, returning true if it was dev's last
+// join of group. If the join has already been removed, for example by
+// removeDevice, leave is a no-op.
+func (l *mcastListener) leave(dev interface{}, group string, f *mcastFilter) (last bool) {
+	l.update(dev, group, func(g *mcastGroup) {
+		if g.joins[f] {
+			delete(g.joins, f)
+			last = len(g.joins) == 0
+		}
+	})
+	return last
+}
+
+func (l *mcastListener) update(dev interface{}, group string, f func(g *mcastGroup)) {
+	now := time.Now()
+	l.mu.Lock()
+	iface := l.ifaces[dev]
+	if iface == nil {
+		iface = &mcastIface{groups: make(map[string]*mcastGroup)}
+		l.ifaces[dev] = iface
+	}
+	g := iface.groups[group]
+	if g == nil {
+		g = &mcastGroup{joins: make(map[*mcastFilter]bool)}
+		iface.groups[group] = g
+	}
+	f(g)
+	old := g.state
+	g.state = mergeMcastFilters(g.joins)
+	var records []mcastRecord
+	if l.reportable(group) && g.addChange(old) {
+		records = g.changeRecords(group)
+		g.sentChange(now)
+	}
+	l.cleanup(dev, group)
+	l.schedule(now)
+	l.mu.Unlock()
+
+	if len(records) > 0 {
+		l.report(dev, records)
+	}
+}
+
+// cleanup removes the state of dev's membership in group if nothing remains
+// to be done. l.mu must be held.
+func (l *mcastListener) cleanup(dev interface{}, group string) {
+	iface := l.ifaces[dev]
+	if g := iface.groups[group]; g != nil && g.idle() {
+		delete(iface.groups, group)
+	}
+	if len(iface.groups) == 0 && iface.generalAt.IsZero() {
+		delete(l.ifaces, dev)
+	}
+}
+
+// removeDevice forgets dev's memberships without reporting anything,
+// returning the groups of which it had joins.
+func (l *mcastListener) removeDevice(dev interface{}) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	iface := l.ifaces[dev]
+	if iface == nil {
+		return nil
+	}
+	var groups []string
+	for group, g := range iface.groups {
+		if len(g.joins) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	delete(l.ifaces, dev)
+	return groups
+}
+
+// accepts returns true if a packet from src to group which
+// was received on dev passes dev's membership's filter.
+func (l *mcastListener) accepts(dev interface{}, group, src string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	iface := l.ifaces[dev]
+	if iface == nil {
+		return false
+	}
+	g := iface.groups[group]
+	return g != nil && g.state.accepts(src)
+}
+
+// memberships calls f for each group of which a device is a member.
+func (l *mcastListener) memberships(f func(dev interface{}, group string, filter mcastFilter)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for dev, iface := range l.ifaces {
+		for group, g := range iface.groups {
+			if g.state.member() {
+				f(dev, group, g.state)
+			}
+		}
+	}
+}
+
+// query handles a query received on dev for group, or for all groups if
+// group is empty, with the given sources and maximum response time, by
+// scheduling a response (RFC 3376 section 5.2).
+func (l *mcastListener) query(dev interface{}, group string, sources []string, maxResp time.Duration) {
+	now := time.Now()
+	at := now.Add(randDelay(maxResp))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	iface := l.ifaces[dev]
+	if iface == nil {
+		return
+	}
+	if !iface.generalAt.IsZero() && iface.generalAt.Before(at) {
+		// the response to a general query will be sent first
+		return
+	}
+	if group == "" {
+		iface.generalAt = at
+		l.schedule(now)
+		return
+	}
+	g := iface.groups[group]
+	if g == nil || !g.state.member() || !l.reportable(group) {
+		return
+	}
+	switch {
+	case g.queryAt.IsZero():
+		g.queryAt, g.querySources = at, nil
+		if len(sources) > 0 {
+			g.querySources = newMcastAddrs(sources)
+		}
+	default:
+		// combine with the pending response
+		if at.Before(g.queryAt) {
+			g.queryAt = at
+		}
+		if len(sources) == 0 {
+			g.querySources = nil
+		} else if g.querySources != nil {
+			g.querySources = g.querySources.or(newMcastAddrs(sources))
+		}
+	}
+	l.schedule(now)
+}
+
+// tick sends the reports which are due.
+func (l *mcastListener) tick() {
+	now := time.Now()
+	l.mu.Lock()
+	reports := make(map[interface{}][]mcastRecord)
+	for dev, iface := range l.ifaces {
+		groups := make([]string, 0, len(iface.groups))
+		for group := range iface.groups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+
+		var records []mcastRecord
+		general := !iface.generalAt.IsZero() && !now.Before(iface.generalAt)
+		if general {
+			iface.generalAt = time.Time{}
+		}
+		for _, group := range groups {
+			g := iface.groups[group]
+			if general && l.reportable(group) {
+				records = append(records, g.currentRecords(group)...)
+			}
+			if !g.queryAt.IsZero() && !now.Before(g.queryAt) {
+				if !general {
+					records = append(records, g.queryRecords(group)...)
+				}
+				g.queryAt, g.querySources = time.Time{}, nil
+			}
+			if g.retransmits > 0 && !now.Before(g.changeAt) {
+				records = append(records, g.changeRecords(group)...)
+				g.sentChange(now)
+			}
+			l.cleanup(dev, group)
+		}
+		if len(records) > 0 {
+			reports[dev] = records
+		}
+	}
+	l.schedule(now)
+	l.mu.Unlock()
+
+	for dev, records := range reports {
+		l.report(dev, records)
+	}
+}
+
+// schedule arranges for tick to be called when the
+// next report is due. l.mu must be held.
+func (l *mcastListener) schedule(now time.Time) {
+	var next time.Time
+	earliest := func(t time.Time) {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	for _, iface := range l.ifaces {
+		earliest(iface.generalAt)
+		for _, g := range iface.groups {
+			earliest(g.queryAt)
+			if g.retransmits > 0 {
+				earliest(g.changeAt)
+			}
+		}
+	}
+	switch {
+	case next.IsZero():
+		if l.timer != nil {
+			l.timer.Stop()
+		}
+	case l.timer == nil:
+		l.timer = time.AfterFunc(next.Sub(now), l.tick)
+	default:
+		l.timer.Reset(next.Sub(now))
+	}
+}
+
+// randDelay returns a random duration in [0, max] (RFC 3376 section 5.2).
+func randDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
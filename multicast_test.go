@@ -0,0 +1,223 @@
+package net
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+)
+
+func TestMergeMcastFilters(t *testing.T) {
+	a, b, c := "a", "b", "c"
+	include := func(srcs ...string) *mcastFilter {
+		return &mcastFilter{mode: MulticastInclude, sources: newMcastAddrs(srcs)}
+	}
+	exclude := func(srcs ...string) *mcastFilter {
+		return &mcastFilter{mode: MulticastExclude, sources: newMcastAddrs(srcs)}
+	}
+	for _, c := range []struct {
+		filters []*mcastFilter
+		want    *mcastFilter
+	}{
+		{nil, include()},
+		{[]*mcastFilter{include(a), include(b)}, include(a, b)},
+		{[]*mcastFilter{exclude(a, b), exclude(b, c)}, exclude(b)},
+		{[]*mcastFilter{exclude(a, b), include(b)}, exclude(a)},
+		{[]*mcastFilter{exclude(), include(a)}, exclude()},
+	} {
+		filters := make(map[*mcastFilter]bool)
+		for _, f := range c.filters {
+			filters[f] = true
+		}
+		got := mergeMcastFilters(filters)
+		if got.mode != c.want.mode || !reflect.DeepEqual(got.sources.sorted(), c.want.sources.sorted()) {
+			t.Errorf("mergeMcastFilters(%v) = %v %v; want %v %v", c.filters, got.mode, got.sources.sorted(),
+				c.want.mode, c.want.sources.sorted())
+		}
+	}
+}
+
+func TestIGMP(t *testing.T) {
+	// host 10.0.0.1 joins a group; 10.0.0.2 acts as a multicast
+	// router, and 10.0.0.3 and 10.0.0.4 send to the group
+	var seg EthernetSegment
+	lanSubnet := IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: IPv4{255, 255, 255, 0}}
+	newHost := func(mac byte) (IPv4Host, *EthernetDevice) {
+		dev, err := NewEthernetDevice(seg.NewInterface(), MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(IPv4{10, 0, 0, mac}, lanSubnet.Netmask)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		host := NewIPv4Host()
+		host.AddIPv4Device(dev)
+		host.AddIPv4DeviceRoute(lanSubnet, dev)
+		return host, dev
+	}
+	host, hostdev := newHost(1)
+	router, routerdev := newHost(2)
+	sender, senderdev := newHost(3)
+	other, otherdev := newHost(4)
+	for _, dev := range []*EthernetDevice{hostdev, routerdev, senderdev, otherdev} {
+		defer dev.BringDown()
+	}
+	group := IPv4{239, 1, 1, 1}
+
+	if _, err := router.JoinIPv4Group(routerdev, igmpv3Routers, MulticastExclude, nil); err != nil {
+		t.Fatalf("unexpected error joining group: %v", err)
+	}
+	reports := make(chan []byte, 16)
+	router.RegisterIPv4Callback(func(b []byte, src, dst IPv4) {
+		if src != (IPv4{10, 0, 0, 1}) || dst != igmpv3Routers || checksum.Checksum(b) != 0 || b[0] != igmpTypeReportV3 {
+			t.Errorf("got invalid report from %v to %v: %v", src, dst, b)
+			return
+		}
+		reports <- append([]byte(nil), b...)
+	}, IPProtocolIGMP)
+	// expectRecord waits for a report whose first record has the given type,
+	// skipping retransmissions of earlier reports
+	expectRecord := func(typ uint8, sources ...IPv4) {
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case b := <-reports:
+				if b[8] != typ {
+					continue
+				}
+				want := []byte{typ, 0, 0, byte(len(sources))}
+				want = append(want, group[:]...)
+				for _, src := range sources {
+					want = append(want, src[:]...)
+				}
+				if b[7] != 1 || !reflect.DeepEqual(b[8:], want) {
+					t.Errorf("got report %v; want a single record %v", b, want)
+				}
+				return
+			case <-timeout:
+				t.Errorf("timed out waiting for record of type %v", typ)
+				return
+			}
+		}
+	}
+
+	received := make(chan IPv4, 4)
+	host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { received <- src }, 200)
+	send := func(h IPv4Host, src IPv4, ok bool) {
+		if _, err := h.WriteToIPv4From([]byte("hello"), src, group, 200); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+		select {
+		case got := <-received:
+			if !ok || got != src {
+				t.Errorf("unexpected packet from %v", got)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if ok {
+				t.Errorf("timed out waiting for packet from %v", src)
+			}
+		}
+	}
+
+	// packets to groups which haven't been joined are filtered by MAC
+	send(sender, IPv4{10, 0, 0, 3}, false)
+	if _, err := host.JoinIPv4Group(hostdev, group, MulticastInclude, nil); err == nil {
+		t.Errorf("expected error joining in include mode with no sources")
+	}
+	leave, err := host.JoinIPv4Group(hostdev, group, MulticastInclude, []IPv4{{10, 0, 0, 3}})
+	if err != nil {
+		t.Fatalf("unexpected error joining group: %v", err)
+	}
+	// INCLUDE() to INCLUDE(B) is reported as ALLOW(B) (RFC 3376 section 5.1)
+	expectRecord(mcastAllowNewSources, IPv4{10, 0, 0, 3})
+	send(sender, IPv4{10, 0, 0, 3}, true)
+	send(other, IPv4{10, 0, 0, 4}, false)
+
+	want := []IPv4Membership{{Device: hostdev, Group: group, Mode: MulticastInclude, Sources: []IPv4{{10, 0, 0, 3}}}}
+	if got := host.IPv4Memberships(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got memberships %v; want %v", got, want)
+	}
+
+	// a general query with a Max Resp Code of 1 second
+	query := []byte{igmpTypeQuery, 10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	setICMPChecksum(query, 0)
+	if _, err := router.WriteToIPv4From(query, IPv4{10, 0, 0, 2}, ipv4AllSystems, IPProtocolIGMP); err != nil {
+		t.Fatalf("unexpected error writing query: %v", err)
+	}
+	expectRecord(mcastModeIsInclude, IPv4{10, 0, 0, 3})
+
+	leave()
+	expectRecord(mcastBlockOldSources, IPv4{10, 0, 0, 3})
+	send(sender, IPv4{10, 0, 0, 3}, false)
+	if got := host.IPv4Memberships(); len(got) != 0 {
+		t.Errorf("got memberships %v after leaving", got)
+	}
+}
+
+func TestMLD(t *testing.T) {
+	// like TestIGMP, but for IPv6, and with fewer cases
+	var seg EthernetSegment
+	netmask := IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	newHost := func(mac byte) (IPv6Host, *EthernetDevice) {
+		dev, err := NewEthernetDevice(seg.NewInterface(), MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv6(IPv6{0xfe, 0x80, 15: mac}, netmask)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		host := NewIPv6Host()
+		host.AddIPv6Device(dev)
+		host.AddIPv6DeviceRoute(IPv6Subnet{Addr: IPv6{0xfe, 0x80}, Netmask: netmask}, dev)
+		return host, dev
+	}
+	host, hostdev := newHost(1)
+	router, routerdev := newHost(2)
+	sender, senderdev := newHost(3)
+	for _, dev := range []*EthernetDevice{hostdev, routerdev, senderdev} {
+		defer dev.BringDown()
+	}
+	group := IPv6{0xff, 0x15, 15: 1}
+
+	if _, err := router.JoinIPv6Group(routerdev, mldv2Routers, MulticastExclude, nil); err != nil {
+		t.Fatalf("unexpected error joining group: %v", err)
+	}
+	reports := make(chan []byte, 16)
+	router.RegisterIPv6Callback(func(b []byte, src, dst IPv6) {
+		if b[0] == mldTypeReportV2 {
+			reports <- append([]byte(nil), b...)
+		}
+	}, IPProtocolICMPv6)
+
+	leave, err := host.JoinIPv6Group(hostdev, group, MulticastExclude, nil)
+	if err != nil {
+		t.Fatalf("unexpected error joining group: %v", err)
+	}
+	select {
+	case b := <-reports:
+		want := append([]byte{mcastChangeToExclude, 0, 0, 0}, group[:]...)
+		if !reflect.DeepEqual(b[8:], want) {
+			t.Errorf("got report %v; want a single record %v", b, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timed out waiting for report")
+	}
+
+	received := make(chan IPv6, 4)
+	host.RegisterIPv6Callback(func(b []byte, src, dst IPv6) { received <- dst }, 200)
+	if _, err := sender.WriteToIPv6From([]byte("hello"), IPv6{0xfe, 0x80, 15: 3}, group, 200); err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	select {
+	case dst := <-received:
+		if dst != group {
+			t.Errorf("got packet to %v; want %v", dst, group)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timed out waiting for packet")
+	}
+	leave()
+}
@@ -0,0 +1,740 @@
+package net
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+	"github.com/joshlf/net/internal/errors"
+)
+
+// A NATType is the kind of translation performed by a NAT rule.
+type NATType uint8
+
+const (
+	// NATMasquerade translates the sources of matching packets to the
+	// address of the device through which they are forwarded, as home
+	// gateways do.
+	NATMasquerade NATType = iota
+	// NATSource translates the sources of matching packets to ToAddr, as
+	// carrier gateways with pools of public addresses do.
+	NATSource
+	// NATDestination translates the destinations of matching packets to
+	// ToAddr and ToPort, for example to forward a port of a gateway's
+	// public address to a server on a private network.
+	NATDestination
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATMasquerade:
+		return "masquerade"
+	case NATSource:
+		return "snat"
+	case NATDestination:
+		return "dnat"
+	}
+	return "unknown"
+}
+
+// An IPv4NATRule selects forwarded packets whose addresses (and ports) an
+// IPv4Host translates, like the rules configured with Linux's "iptables -t
+// nat". When a forwarded packet which doesn't belong to a connection which
+// is already being translated matches a rule, a translation is created for
+// its connection, and the connection's subsequent packets in both directions,
+// as well as ICMP error messages about them, are translated until it times
+// out.
+//
+// Destination NAT rules are matched when packets are received, before they
+// are routed, and source NAT rules after they are routed. In each case, the
+// first matching rule, in the order in which they were added, is used. Only
+// TCP, UDP, and ICMP query messages (such as echo requests) are translated;
+// the identifiers of ICMP queries take the place of ports. The translated
+// source ports of connections are chosen to avoid conflicts, preferring the
+// original ports.
+//
+// While any rules are configured, the connections of packets which the host
+// itself sends and receives are tracked too. Replies which the host sends to
+// connections whose destinations were translated to one of its addresses are
+// translated back, and the ports which the host's connections use on its
+// addresses are not chosen as the translated source ports of other
+// connections.
+type IPv4NATRule struct {
+	Type NATType
+
+	// The following fields select packets. The zero value of each
+	// matches all packets.
+
+	// Device matches packets forwarded through the device, for source NAT
+	// rules, or received from the device, for destination NAT rules.
+	Device IPv4Device
+	// Source and Destination match packets whose source and destination
+	// addresses are in the subnets.
+	Source, Destination IPv4Subnet
+	// Proto matches packets with the protocol, and Port, for TCP and UDP,
+	// packets with the destination port.
+	Proto IPProtocol
+	Port  uint16
+
+	// ToAddr is the address to which sources or destinations are
+	// translated. It is unused by masquerade rules. If it is one of the
+	// host's addresses, packets whose destinations are translated to it
+	// are delivered to the host. Otherwise, packets to it must be routed
+	// to the host.
+	ToAddr IPv4
+	// ToPort is the port to which destination NAT rules translate the
+	// destination ports of TCP and UDP packets; if it is 0, they are not
+	// translated.
+	ToPort uint16
+}
+
+// An IPv4NATTranslation describes a connection whose packets an IPv4Host is
+// translating. Its addresses and ports are those of the packets sent by the
+// connection's originator, before and after translation. For ICMP queries,
+// SourcePort and ToSourcePort are the query identifiers, and the destination
+// ports are 0.
+type IPv4NATTranslation struct {
+	Proto                           IPProtocol
+	Source, Destination             IPv4
+	SourcePort, DestinationPort     uint16
+	ToSource, ToDestination         IPv4
+	ToSourcePort, ToDestinationPort uint16
+	// Expires is when the translation will be removed unless more of the
+	// connection's packets are forwarded.
+	Expires time.Time
+}
+
+const (
+	// how long translations last after a connection's last packet (RFC
+	// 5382 REQ-5, RFC 4787 REQ-5, and RFC 5508 REQ-1); TCP connections
+	// which haven't been established or are closing use the transitory
+	// timeout
+	natTCPEstablishedTimeout = 2*time.Hour + 4*time.Minute
+	natTCPTransitoryTimeout  = 4 * time.Minute
+	natUDPTimeout            = 2 * time.Minute
+	natICMPTimeout           = time.Minute
+
+	// how often expired translations are removed
+	natSweepInterval = 30 * time.Second
+
+	// the lowest port to which TCP and UDP sources are translated
+	// other than to preserve the original port
+	natMinPort = 1024
+
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+)
+
+// an ipv4NATTuple identifies the packets of one direction of a connection.
+// For ICMP queries, the identifier is the source port of requests and the
+// destination port of replies, so that reversing the tuple of a request
+// yields the tuple of its reply.
+type ipv4NATTuple struct {
+	proto            IPProtocol
+	src, dst         IPv4
+	srcPort, dstPort uint16
+}
+
+func (t ipv4NATTuple) reverse() ipv4NATTuple {
+	return ipv4NATTuple{proto: t.proto, src: t.dst, dst: t.src, srcPort: t.dstPort, dstPort: t.srcPort}
+}
+
+// an ipv4NATPort is a port (or ICMP query identifier) of one of the host's
+// addresses.
+type ipv4NATPort struct {
+	proto IPProtocol
+	addr  IPv4
+	port  uint16
+}
+
+// an ipv4NATConn is a connection whose packets are translated. Packets with
+// the tuple orig are translated to the reverse of reply, and vice versa. The
+// connections of the host's own packets are tracked with reply equal to the
+// reverse of orig, so that their packets are not translated.
+type ipv4NATConn struct {
+	orig, reply ipv4NATTuple
+	local       *ipv4NATPort // the host's end of the connection, if any
+	replied     bool         // whether any packets with the tuple reply have been seen
+	closing     bool         // whether a TCP FIN or RST has been seen
+	expires     time.Time
+}
+
+// translated returns the tuple to which a packet with the tuple t, which is
+// either c.orig or c.reply, is translated.
+func (c *ipv4NATConn) translated(t ipv4NATTuple) ipv4NATTuple {
+	if t == c.reply {
+		return c.orig.reverse()
+	}
+	return c.reply.reverse()
+}
+
+func (c *ipv4NATConn) timeout() time.Duration {
+	switch {
+	case c.orig.proto == IPProtocolUDP:
+		return natUDPTimeout
+	case c.orig.proto == IPProtocolICMPv4:
+		return natICMPTimeout
+	case c.replied && !c.closing:
+		return natTCPEstablishedTimeout
+	}
+	return natTCPTransitoryTimeout
+}
+
+// update records that the packet whose transport header is l4 and whose
+// tuple is t has been translated.
+func (c *ipv4NATConn) update(t ipv4NATTuple, l4 []byte, now time.Time) {
+	if t == c.reply {
+		c.replied = true
+	}
+	if t.proto == IPProtocolTCP && len(l4) > 13 && l4[13]&(tcpFlagFIN|tcpFlagRST) != 0 {
+		// TODO(joshlf): Track the closing handshake, and remove
+		// connections which are reset sooner
+		c.closing = true
+	}
+	c.expires = now.Add(c.timeout())
+}
+
+// ipv4NAT holds a host's NAT rules and the translations of connections. It
+// performs its own synchronization; host.mu need not be held.
+//
+// Like the routing tables, the rules are published as immutable snapshots,
+// and the number of connections is published atomically, so that packets
+// which don't need to be translated are forwarded without acquiring mu.
+type ipv4NAT struct {
+	nconns     uint32                        // the number of connections; only accessed atomically
+	rules      atomic.Value                  // []IPv4NATRule; never modified once stored
+	conns      map[ipv4NATTuple]*ipv4NATConn // keyed by both orig and reply
+	localPorts map[ipv4NATPort]int           // the number of connections using each local port
+	lastSweep  time.Time
+
+	// isLocal returns true if addr is one of the host's addresses; the
+	// host's mu must be held, as it is when the hooks are called
+	isLocal func(addr IPv4) bool
+
+	mu sync.Mutex // held while accessing conns and while replacing rules
+}
+
+func newIPv4NAT(isLocal func(addr IPv4) bool) *ipv4NAT {
+	n := &ipv4NAT{
+		conns:      make(map[ipv4NATTuple]*ipv4NATConn),
+		localPorts: make(map[ipv4NATPort]int),
+		isLocal:    isLocal,
+	}
+	n.rules.Store([]IPv4NATRule(nil))
+	return n
+}
+
+// enabled returns true if any packets may need to be translated. It never
+// blocks.
+func (n *ipv4NAT) enabled() bool {
+	return len(n.loadRules()) > 0 || atomic.LoadUint32(&n.nconns) > 0
+}
+
+func (n *ipv4NAT) loadRules() []IPv4NATRule {
+	return n.rules.Load().([]IPv4NATRule)
+}
+
+func (n *ipv4NAT) addRule(rule IPv4NATRule) {
+	n.mu.Lock()
+	rules := n.loadRules()
+	n.rules.Store(append(rules[:len(rules):len(rules)], rule))
+	n.mu.Unlock()
+}
+
+// deleteRule deletes the first rule equal to rule. Connections which are
+// already being translated continue to be until they time out.
+func (n *ipv4NAT) deleteRule(rule IPv4NATRule) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rules := n.loadRules()
+	for i, r := range rules {
+		if r == rule {
+			n.rules.Store(append(rules[:i:i], rules[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+func (n *ipv4NAT) listRules() []IPv4NATRule {
+	return append([]IPv4NATRule(nil), n.loadRules()...)
+}
+
+func (n *ipv4NAT) translations() []IPv4NATTranslation {
+	now := time.Now()
+	n.mu.Lock()
+	var ts []IPv4NATTranslation
+	for t, c := range n.conns {
+		if t != c.orig || c.reply == t.reverse() || now.After(c.expires) {
+			// not a translation
+			continue
+		}
+		to := c.reply.reverse()
+		ts = append(ts, IPv4NATTranslation{
+			Proto:  t.proto,
+			Source: t.src, SourcePort: t.srcPort, Destination: t.dst, DestinationPort: t.dstPort,
+			ToSource: to.src, ToSourcePort: to.srcPort, ToDestination: to.dst, ToDestinationPort: to.dstPort,
+			Expires: c.expires,
+		})
+	}
+	n.mu.Unlock()
+	sort.Slice(ts, func(i, j int) bool {
+		if c := bytes.Compare(ts[i].Source[:], ts[j].Source[:]); c != 0 {
+			return c < 0
+		}
+		if ts[i].SourcePort != ts[j].SourcePort {
+			return ts[i].SourcePort < ts[j].SourcePort
+		}
+		if c := bytes.Compare(ts[i].Destination[:], ts[j].Destination[:]); c != 0 {
+			return c < 0
+		}
+		return ts[i].DestinationPort < ts[j].DestinationPort
+	})
+	return ts
+}
+
+// lookup returns the connection to which the packet with the tuple t
+// belongs, if any. n.mu must be held.
+func (n *ipv4NAT) lookup(t ipv4NATTuple, now time.Time) *ipv4NATConn {
+	c := n.conns[t]
+	if c != nil && now.After(c.expires) {
+		n.remove(c)
+		return nil
+	}
+	return c
+}
+
+// remove removes the connection c. n.mu must be held.
+func (n *ipv4NAT) remove(c *ipv4NATConn) {
+	delete(n.conns, c.orig)
+	delete(n.conns, c.reply)
+	if c.local != nil {
+		if n.localPorts[*c.local]--; n.localPorts[*c.local] == 0 {
+			delete(n.localPorts, *c.local)
+		}
+	}
+	atomic.StoreUint32(&n.nconns, uint32(len(n.conns)/2))
+}
+
+// add adds a connection whose packets with the tuple orig are translated to
+// the tuple to, and returns it, or returns nil if another connection's
+// replies already have the reply tuple. n.mu and the host's mu must be held.
+func (n *ipv4NAT) add(orig, to ipv4NATTuple, now time.Time) *ipv4NATConn {
+	if now.Sub(n.lastSweep) > natSweepInterval {
+		for t, c := range n.conns {
+			if t == c.orig && now.After(c.expires) {
+				n.remove(c)
+			}
+		}
+		n.lastSweep = now
+	}
+	reply := to.reverse()
+	if n.lookup(reply, now) != nil {
+		return nil
+	}
+	c := &ipv4NATConn{orig: orig, reply: reply}
+	switch {
+	case n.isLocal(reply.src):
+		// the host receives the connection's packets
+		c.local = &ipv4NATPort{reply.proto, reply.src, reply.srcPort}
+	case n.isLocal(orig.src):
+		// the host sends the connection's packets
+		c.local = &ipv4NATPort{orig.proto, orig.src, orig.srcPort}
+	}
+	if c.local != nil {
+		n.localPorts[*c.local]++
+	}
+	n.conns[orig], n.conns[reply] = c, c
+	atomic.StoreUint32(&n.nconns, uint32(len(n.conns)/2))
+	return c
+}
+
+// allocate adds a connection whose packets with the tuple orig have their
+// sources translated to addr, choosing a source port (or ICMP query
+// identifier) for which the translated tuple doesn't conflict with any other
+// connection's, and which none of the host's connections use. It returns nil
+// if there is none. n.mu and the host's mu must be held.
+func (n *ipv4NAT) allocate(orig ipv4NATTuple, addr IPv4, now time.Time) *ipv4NATConn {
+	to := orig
+	to.src = addr
+	if c := n.addUnused(orig, to, now); c != nil {
+		return c
+	}
+	min := natMinPort
+	if orig.proto == IPProtocolICMPv4 {
+		min = 0
+	}
+	start := min + rand.Intn(0x10000-min)
+	for i := 0; i < 0x10000-min; i++ {
+		to.srcPort = uint16(min + (start-min+i)%(0x10000-min))
+		if c := n.addUnused(orig, to, now); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// addUnused is like add, but returns nil if any of the host's connections
+// use the translated source port. n.mu and the host's mu must be held.
+func (n *ipv4NAT) addUnused(orig, to ipv4NATTuple, now time.Time) *ipv4NATConn {
+	if n.localPorts[ipv4NATPort{to.proto, to.src, to.srcPort}] > 0 {
+		return nil
+	}
+	return n.add(orig, to, now)
+}
+
+// prerouting is called with each packet b, whose header is hdr, which is
+// received on the device in and isn't sent to a broadcast or multicast
+// address, before it is routed or delivered. It translates the destinations
+// of packets which belong to translated connections, including those which
+// match destination NAT rules, and the addresses in ICMP error messages
+// about them. If the packet's source must be translated after it is routed,
+// the tuple to which it must be translated is returned (see postrouting).
+// hdr is updated to match b. The connection table is only locked if the
+// packet may belong to a connection, matches a destination NAT rule, or is
+// sent to the host and must be tracked. The host's mu must be held.
+//
+// TODO(joshlf): ICMP error messages which the host itself sends about
+// translated packets quote them as translated, which their sources can't make
+// sense of; translate them back. Also support hairpinning (RFC 4787 REQ-9), in
+// which packets from private hosts to the public address of another private
+// host need both their destinations and their sources translated.
+func (n *ipv4NAT) prerouting(in IPv4Device, b []byte, hdr *ipv4Header) (to *ipv4NATTuple) {
+	l4 := b[int(hdr.IHL)*4:]
+	if hdr.proto == IPProtocolICMPv4 && len(l4) > 0 && isICMPv4Error(l4[0]) {
+		n.translateICMPError(b, hdr)
+		return nil
+	}
+	t, ok := ipv4NATTupleOf(b, hdr)
+	if !ok {
+		return nil
+	}
+	rule := n.match(NATDestination, in, t)
+	track := rule == nil && len(n.loadRules()) > 0 && n.isLocal(t.dst)
+	if rule == nil && !track && atomic.LoadUint32(&n.nconns) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c := n.lookup(t, now)
+	if c == nil {
+		dst := t
+		switch {
+		case rule != nil:
+			dst.dst = rule.ToAddr
+			if rule.ToPort != 0 && t.proto != IPProtocolICMPv4 {
+				dst.dstPort = rule.ToPort
+			}
+		case !track:
+			return nil
+		}
+		if c = n.add(t, dst, now); c == nil {
+			return nil
+		}
+	}
+	c.update(t, l4, now)
+	to = new(ipv4NATTuple)
+	*to = c.translated(t)
+	if to.dst != t.dst || to.dstPort != t.dstPort {
+		natRewrite(b, hdr, false, to.dst, to.dstPort)
+	}
+	return to
+}
+
+// postrouting is called with each packet b, whose header is hdr, after it is
+// routed through the device out, whose addresses are addrs, to nexthop. If
+// prerouting returned a tuple, to is that tuple, and the packet's source is
+// translated to match it. Otherwise, if the packet matches a source NAT rule,
+// a translation is created for its connection; only then is the connection
+// table locked. It returns false if the packet must be dropped because no
+// translation could be created. hdr is updated to match b.
+func (n *ipv4NAT) postrouting(out IPv4Device, addrs []IPv4DeviceAddr, nexthop IPv4, b []byte, hdr *ipv4Header, to *ipv4NATTuple) bool {
+	if to != nil {
+		natRewrite(b, hdr, true, to.src, to.srcPort)
+		return true
+	}
+	t, ok := ipv4NATTupleOf(b, hdr)
+	if !ok {
+		return true
+	}
+	rule := n.match(NATMasquerade, out, t)
+	if rule == nil {
+		return true
+	}
+
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr := rule.ToAddr
+	if rule.Type == NATMasquerade {
+		if addr, ok = selectIPv4Source(addrs, t.dst, nexthop); !ok {
+			return false
+		}
+	}
+	c := n.allocate(t, addr, now)
+	if c == nil {
+		// TODO(joshlf): Log it
+		return false
+	}
+	c.update(t, b[int(hdr.IHL)*4:], now)
+	src := c.reply.reverse()
+	natRewrite(b, hdr, true, src.src, src.srcPort)
+	return true
+}
+
+// output is called with each packet b, whose header is hdr, which the host
+// itself sends, once it has been routed. If the packet belongs to a
+// translated connection, such as a reply to a packet whose destination was
+// translated to one of the host's addresses, it is translated. Otherwise,
+// while there are any rules, its connection is tracked so that the host's
+// port isn't chosen as the translated source port of another connection.
+// hdr is updated to match b. The host's mu must be held.
+func (n *ipv4NAT) output(b []byte, hdr *ipv4Header) {
+	t, ok := ipv4NATTupleOf(b, hdr)
+	if !ok {
+		return
+	}
+	track := len(n.loadRules()) > 0
+	if !track && atomic.LoadUint32(&n.nconns) == 0 {
+		return
+	}
+
+	now := time.Now()
+	n.mu.Lock()
+	c := n.lookup(t, now)
+	if c == nil && track {
+		c = n.add(t, t, now)
+	}
+	if c == nil {
+		n.mu.Unlock()
+		return
+	}
+	c.update(t, b[int(hdr.IHL)*4:], now)
+	to := c.translated(t)
+	n.mu.Unlock()
+
+	// NOTE(joshlf): Only sources need to be translated, since destination
+	// NAT rules only match received packets, and the replies of source
+	// NAT connections are sent to the host rather than by it.
+	if to.src != t.src || to.srcPort != t.srcPort {
+		natRewrite(b, hdr, true, to.src, to.srcPort)
+	}
+}
+
+// match returns the first rule which matches the packet with the tuple t
+// which was received from or will be forwarded through dev. If typ is
+// NATDestination, only destination NAT rules are considered, and otherwise,
+// only source NAT rules. n.mu need not be held.
+func (n *ipv4NAT) match(typ NATType, dev IPv4Device, t ipv4NATTuple) *IPv4NATRule {
+	rules := n.loadRules()
+	for i := range rules {
+		r := &rules[i]
+		switch {
+		case (r.Type == NATDestination) != (typ == NATDestination):
+		case r.Device != nil && r.Device != dev:
+		case r.Source.Netmask != (IPv4{}) && !r.Source.Has(t.src):
+		case r.Destination.Netmask != (IPv4{}) && !r.Destination.Has(t.dst):
+		case r.Proto != 0 && r.Proto != t.proto:
+		case r.Port != 0 && (t.proto == IPProtocolICMPv4 || r.Port != t.dstPort):
+		default:
+			return r
+		}
+	}
+	return nil
+}
+
+// translateICMPError translates the ICMP error message in the packet b, whose
+// header is hdr, if the packet which it quotes belongs to a translated
+// connection (RFC 5508 section 4.2). The quoted packet was translated when it
+// was forwarded, so the error is translated as a packet travelling in the
+// opposite direction: both its destination and the quoted packet's source
+// are translated, as well as its source if it was sent by the quoted
+// packet's destination.
+func (n *ipv4NAT) translateICMPError(b []byte, hdr *ipv4Header) {
+	msg := b[int(hdr.IHL)*4:]
+	if len(msg) < icmpErrorLen+20 || atomic.LoadUint32(&n.nconns) == 0 {
+		return
+	}
+	inner := msg[icmpErrorLen:]
+	var ihdr ipv4Header
+	readIPv4Header(&ihdr, inner)
+	if ihdr.IHL < 5 || len(inner) < int(ihdr.IHL)*4+8 {
+		return
+	}
+	it, ok := ipv4NATTupleOf(inner, &ihdr)
+	if !ok {
+		return
+	}
+	t := it.reverse()
+
+	now := time.Now()
+	n.mu.Lock()
+	c := n.lookup(t, now)
+	if c == nil {
+		n.mu.Unlock()
+		return
+	}
+	to := c.translated(t)
+	n.mu.Unlock()
+	if to == t {
+		return
+	}
+
+	if hdr.src == t.src {
+		natRewrite(b, hdr, true, to.src, 0)
+	}
+	natRewrite(b, hdr, false, to.dst, 0)
+	// the quoted packet was sent in the other direction
+	natRewrite(inner, &ihdr, true, to.dst, to.dstPort)
+	natRewrite(inner, &ihdr, false, to.src, to.srcPort)
+	msg[2], msg[3] = 0, 0
+	setICMPChecksum(msg, 0)
+}
+
+// ipv4NATTupleOf returns the tuple of the packet b, whose header is hdr. It
+// returns false if the packet can't be translated. b may be a packet quoted
+// in an ICMP error message, which may be truncated after 8 bytes of its
+// transport header.
+func ipv4NATTupleOf(b []byte, hdr *ipv4Header) (t ipv4NATTuple, ok bool) {
+	l4 := b[int(hdr.IHL)*4:]
+	t = ipv4NATTuple{proto: hdr.proto, src: hdr.src, dst: hdr.dst}
+	switch hdr.proto {
+	case IPProtocolTCP, IPProtocolUDP:
+		if len(l4) < 4 {
+			return t, false
+		}
+		t.srcPort = uint16(l4[0])<<8 | uint16(l4[1])
+		t.dstPort = uint16(l4[2])<<8 | uint16(l4[3])
+	case IPProtocolICMPv4:
+		if len(l4) < 8 {
+			return t, false
+		}
+		id := uint16(l4[4])<<8 | uint16(l4[5])
+		switch {
+		case isICMPv4Request(l4[0]):
+			t.srcPort = id
+		case isICMPv4Reply(l4[0]):
+			t.dstPort = id
+		default:
+			return t, false
+		}
+	default:
+		return t, false
+	}
+	return t, true
+}
+
+// ICMP query messages (RFC 792 and RFC 950): echo, timestamp,
+// information, and address mask requests, and their replies
+func isICMPv4Request(typ uint8) bool { return typ == 8 || typ == 13 || typ == 15 || typ == 17 }
+func isICMPv4Reply(typ uint8) bool   { return typ == 0 || typ == 14 || typ == 16 || typ == 18 }
+
+// natRewrite rewrites the source (if src is true) or destination address of
+// the packet b, whose header is hdr, to addr, and the corresponding port to
+// port, updating hdr and the packet's checksums. For ICMP queries, the
+// identifier is the source port of requests and the destination port of
+// replies. b may be a packet quoted in an ICMP error message, in which case
+// checksums which have been truncated are not updated.
+func natRewrite(b []byte, hdr *ipv4Header, src bool, addr IPv4, port uint16) {
+	hlen := int(hdr.IHL) * 4
+	l4 := b[hlen:]
+	addrOff, portOff, sumOff := 16, -1, -1
+	if src {
+		addrOff = 12
+	}
+	pseudo := false // whether the checksum covers the pseudo-header
+	switch hdr.proto {
+	case IPProtocolTCP:
+		portOff, sumOff, pseudo = 2, 16, true
+		if src {
+			portOff = 0
+		}
+	case IPProtocolUDP:
+		portOff, sumOff, pseudo = 2, 6, true
+		if src {
+			portOff = 0
+		}
+		if len(l4) >= 8 && l4[6] == 0 && l4[7] == 0 {
+			// no checksum
+			sumOff = -1
+		}
+	case IPProtocolICMPv4:
+		sumOff = 2
+		if len(l4) > 0 && (src && isICMPv4Request(l4[0]) || !src && isICMPv4Reply(l4[0])) {
+			portOff = 4
+		}
+	}
+	if sumOff+2 > len(l4) {
+		sumOff = -1
+	}
+
+	var newPort [2]byte
+	newPort[0], newPort[1] = byte(port>>8), byte(port)
+	if sumOff >= 0 {
+		sum := uint16(l4[sumOff])<<8 | uint16(l4[sumOff+1])
+		if pseudo {
+			sum = updateChecksum(sum, b[addrOff:addrOff+4], addr[:])
+		}
+		if portOff >= 0 {
+			sum = updateChecksum(sum, l4[portOff:portOff+2], newPort[:])
+		}
+		if sum == 0 && hdr.proto == IPProtocolUDP {
+			// a computed checksum of zero is sent as all ones
+			// (RFC 768)
+			sum = 0xffff
+		}
+		l4[sumOff], l4[sumOff+1] = byte(sum>>8), byte(sum)
+	}
+	copy(b[addrOff:], addr[:])
+	if portOff >= 0 && portOff+2 <= len(l4) {
+		copy(l4[portOff:], newPort[:])
+	}
+	setIPv4Checksum(b)
+	if src {
+		hdr.src = addr
+	} else {
+		hdr.dst = addr
+	}
+}
+
+// updateChecksum returns the checksum field which results from replacing
+// old, which is an even number of bytes starting at an even offset of the
+// checksummed data, with new, given the original checksum field sum (RFC
+// 1624, equation 3).
+func updateChecksum(sum uint16, old, new []byte) uint16 {
+	s := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		s += uint32(^(uint16(old[i])<<8 | uint16(old[i+1])))
+		s += uint32(uint16(new[i])<<8 | uint16(new[i+1]))
+	}
+	return checksum.Finish(s)
+}
+
+func (host *ipv4ConfigurationHost) AddIPv4NATRule(rule IPv4NATRule) error {
+	if rule.Type > NATDestination {
+		return errors.New("add IPv4 NAT rule: unknown type")
+	}
+	if rule.Type != NATMasquerade && rule.ToAddr == (IPv4{}) {
+		return errors.New("add IPv4 NAT rule: no address to translate to")
+	}
+	host.nat.addRule(rule)
+	return nil
+}
+
+func (host *ipv4ConfigurationHost) DeleteIPv4NATRule(rule IPv4NATRule) bool {
+	return host.nat.deleteRule(rule)
+}
+
+func (host *ipv4ConfigurationHost) IPv4NATRules() []IPv4NATRule {
+	return host.nat.listRules()
+}
+
+func (host *ipv4ConfigurationHost) IPv4NATTranslations() []IPv4NATTranslation {
+	return host.nat.translations()
+}
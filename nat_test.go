@@ -0,0 +1,249 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+)
+
+func TestNAT(t *testing.T) {
+	// a router, 10.0.0.1 and 192.0.2.1, connects a private host,
+	// 10.0.0.2, to a public host, 192.0.2.2, which has no route to
+	// 10.0.0.0/24
+	var lan, wan EthernetSegment
+	netmask := IPv4{255, 255, 255, 0}
+	newDev := func(seg *EthernetSegment, mac byte, addr IPv4) *EthernetDevice {
+		dev, err := NewEthernetDevice(seg.NewInterface(), MAC{2, 0, 0, 0, 0, mac})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(addr, netmask)
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		return dev
+	}
+	lanSubnet := IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: netmask}
+	wanSubnet := IPv4Subnet{Addr: IPv4{192, 0, 2, 0}, Netmask: netmask}
+	privAddr, pubAddr, routerAddr := IPv4{10, 0, 0, 2}, IPv4{192, 0, 2, 2}, IPv4{192, 0, 2, 1}
+
+	privdev := newDev(&lan, 1, privAddr)
+	defer privdev.BringDown()
+	priv := NewIPv4Host()
+	priv.AddIPv4Device(privdev)
+	priv.AddIPv4DeviceRoute(lanSubnet, privdev)
+	priv.AddIPv4Route(IPv4Subnet{}, IPv4{10, 0, 0, 1})
+
+	pubdev := newDev(&wan, 2, pubAddr)
+	defer pubdev.BringDown()
+	pub := NewIPv4Host()
+	pub.AddIPv4Device(pubdev)
+	pub.AddIPv4DeviceRoute(wanSubnet, pubdev)
+
+	landev, wandev := newDev(&lan, 3, IPv4{10, 0, 0, 1}), newDev(&wan, 4, routerAddr)
+	defer landev.BringDown()
+	defer wandev.BringDown()
+	router := NewIPv4Host()
+	router.SetForwarding(true)
+	router.AddIPv4Device(landev)
+	router.AddIPv4DeviceRoute(lanSubnet, landev)
+	router.AddIPv4Device(wandev)
+	router.AddIPv4DeviceRoute(wanSubnet, wandev)
+	if err := router.AddIPv4NATRule(IPv4NATRule{Type: NATMasquerade, Device: wandev}); err != nil {
+		t.Fatalf("unexpected error adding rule: %v", err)
+	}
+
+	type packet struct {
+		b        []byte
+		src, dst IPv4
+	}
+	listen := func(host IPv4Host, proto IPProtocol) chan packet {
+		c := make(chan packet, 4)
+		host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) {
+			c <- packet{append([]byte(nil), b...), src, dst}
+		}, proto)
+		return c
+	}
+	expect := func(c chan packet, src, dst IPv4, proto IPProtocol, srcPort, dstPort uint16) []byte {
+		select {
+		case p := <-c:
+			if p.src != src || p.dst != dst {
+				t.Errorf("got packet from %v to %v; want from %v to %v", p.src, p.dst, src, dst)
+			}
+			if !natChecksumOK(p.b, p.src, p.dst, proto) {
+				t.Errorf("got packet with invalid checksum: %v", p.b)
+			}
+			tuple, _ := ipv4NATTupleOf(append(make([]byte, 20), p.b...), &ipv4Header{IHL: 5, proto: proto})
+			if tuple.srcPort != srcPort || tuple.dstPort != dstPort {
+				t.Errorf("got ports %v and %v; want %v and %v", tuple.srcPort, tuple.dstPort, srcPort, dstPort)
+			}
+			return p.b
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for packet from %v to %v", src, dst)
+		}
+		return nil
+	}
+	send := func(host IPv4Host, src, dst IPv4, b []byte, proto IPProtocol) {
+		if _, err := host.WriteToIPv4From(b, src, dst, proto); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+	}
+	privUDP, pubUDP := listen(priv, IPProtocolUDP), listen(pub, IPProtocolUDP)
+	privICMP, pubICMP := listen(priv, IPProtocolICMPv4), listen(pub, IPProtocolICMPv4)
+
+	// UDP is masqueraded as the router, preserving the source port, and
+	// replies are translated back
+	send(priv, privAddr, pubAddr, makeNATUDP(privAddr, pubAddr, 5000, 53), IPProtocolUDP)
+	req := expect(pubUDP, routerAddr, pubAddr, IPProtocolUDP, 5000, 53)
+	send(pub, pubAddr, routerAddr, makeNATUDP(pubAddr, routerAddr, 53, 5000), IPProtocolUDP)
+	expect(privUDP, pubAddr, privAddr, IPProtocolUDP, 53, 5000)
+
+	// the packet quoted by an ICMP error is translated too
+	quoted := make([]byte, 20)
+	writeIPv4Header(&ipv4Header{version: 4, IHL: 5, len: uint16(20 + len(req)), TTL: 63, proto: IPProtocolUDP,
+		src: routerAddr, dst: pubAddr}, quoted)
+	setIPv4Checksum(quoted)
+	msg := makeICMPError(icmpv4TypeDestUnreachable, 3, 0, append(quoted, req...), 576)
+	setICMPChecksum(msg, 0)
+	send(pub, pubAddr, routerAddr, msg, IPProtocolICMPv4)
+	msg = expect(privICMP, pubAddr, privAddr, IPProtocolICMPv4, 0, 0)
+	var hdr ipv4Header
+	readIPv4Header(&hdr, msg[icmpErrorLen:])
+	if tuple, _ := ipv4NATTupleOf(msg[icmpErrorLen:], &hdr); tuple != (ipv4NATTuple{IPProtocolUDP, privAddr, pubAddr, 5000, 53}) {
+		t.Errorf("got quoted packet %v; want the original packet", tuple)
+	}
+	if checksum.Checksum(msg[icmpErrorLen:icmpErrorLen+20]) != 0 {
+		t.Errorf("invalid checksum in quoted packet")
+	}
+
+	// ICMP echo requests are translated by their identifiers
+	echo := []byte{8, 0, 0, 0, 0, 7, 0, 1}
+	setICMPChecksum(echo, 0)
+	send(priv, privAddr, pubAddr, echo, IPProtocolICMPv4)
+	expect(pubICMP, routerAddr, pubAddr, IPProtocolICMPv4, 7, 0)
+	reply := []byte{0, 0, 0, 0, 0, 7, 0, 1}
+	setICMPChecksum(reply, 0)
+	send(pub, pubAddr, routerAddr, reply, IPProtocolICMPv4)
+	expect(privICMP, pubAddr, privAddr, IPProtocolICMPv4, 0, 7)
+
+	if ts := router.IPv4NATTranslations(); len(ts) != 2 {
+		t.Errorf("got translations %v; want 2", ts)
+	}
+
+	// port forwarding
+	err := router.AddIPv4NATRule(IPv4NATRule{Type: NATDestination, Device: wandev,
+		Proto: IPProtocolUDP, Port: 8080, ToAddr: privAddr, ToPort: 80})
+	if err != nil {
+		t.Fatalf("unexpected error adding rule: %v", err)
+	}
+	send(pub, pubAddr, routerAddr, makeNATUDP(pubAddr, routerAddr, 6000, 8080), IPProtocolUDP)
+	expect(privUDP, pubAddr, privAddr, IPProtocolUDP, 6000, 80)
+	send(priv, privAddr, pubAddr, makeNATUDP(privAddr, pubAddr, 80, 6000), IPProtocolUDP)
+	expect(pubUDP, routerAddr, pubAddr, IPProtocolUDP, 8080, 6000)
+
+	// port forwarding to the router itself; its replies are translated
+	// back
+	err = router.AddIPv4NATRule(IPv4NATRule{Type: NATDestination, Device: wandev,
+		Proto: IPProtocolUDP, Port: 9090, ToAddr: routerAddr, ToPort: 7000})
+	if err != nil {
+		t.Fatalf("unexpected error adding rule: %v", err)
+	}
+	routerUDP := listen(router, IPProtocolUDP)
+	send(pub, pubAddr, routerAddr, makeNATUDP(pubAddr, routerAddr, 6001, 9090), IPProtocolUDP)
+	expect(routerUDP, pubAddr, routerAddr, IPProtocolUDP, 6001, 7000)
+	send(router, routerAddr, pubAddr, makeNATUDP(routerAddr, pubAddr, 7000, 6001), IPProtocolUDP)
+	expect(pubUDP, routerAddr, pubAddr, IPProtocolUDP, 9090, 6001)
+
+	// ports which the router uses aren't chosen for masqueraded
+	// connections, even to other destinations
+	send(router, routerAddr, pubAddr, makeNATUDP(routerAddr, pubAddr, 5001, 53), IPProtocolUDP)
+	expect(pubUDP, routerAddr, pubAddr, IPProtocolUDP, 5001, 53)
+	send(priv, privAddr, pubAddr, makeNATUDP(privAddr, pubAddr, 5001, 54), IPProtocolUDP)
+	select {
+	case p := <-pubUDP:
+		tuple, _ := ipv4NATTupleOf(append(make([]byte, 20), p.b...), &ipv4Header{IHL: 5, proto: IPProtocolUDP})
+		if p.src != routerAddr || tuple.srcPort == 5001 || tuple.dstPort != 54 {
+			t.Errorf("got packet from %v:%v to port %v; want from %v, not port 5001, to port 54",
+				p.src, tuple.srcPort, tuple.dstPort, routerAddr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for masqueraded packet")
+	}
+
+	// the router's own connections aren't translations
+	for _, tr := range router.IPv4NATTranslations() {
+		if tr.Source == routerAddr {
+			t.Errorf("got translation of the router's own connection: %v", tr)
+		}
+	}
+}
+
+// makeNATUDP makes a UDP packet with a valid checksum.
+func makeNATUDP(src, dst IPv4, srcPort, dstPort uint16) []byte {
+	b := []byte{byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort), 0, 12, 0, 0, 'h', 'e', 'l', 'o'}
+	sum := checksum.Add(natPseudoHeaderSum(src, dst, IPProtocolUDP, len(b)), b)
+	s := checksum.Finish(sum)
+	b[6], b[7] = byte(s>>8), byte(s)
+	return b
+}
+
+// natChecksumOK returns true if the UDP or ICMP message b has a valid checksum.
+func natChecksumOK(b []byte, src, dst IPv4, proto IPProtocol) bool {
+	if proto == IPProtocolICMPv4 {
+		return checksum.Checksum(b) == 0
+	}
+	return checksum.Finish(checksum.Add(natPseudoHeaderSum(src, dst, proto, len(b)), b)) == 0
+}
+
+func natPseudoHeaderSum(src, dst IPv4, proto IPProtocol, length int) uint32 {
+	pseudo := append(append([]byte(nil), src[:]...), dst[:]...)
+	pseudo = append(pseudo, 0, byte(proto), byte(length>>8), byte(length))
+	return checksum.Add(0, pseudo)
+}
+
+func TestNATFastPath(t *testing.T) {
+	n := newIPv4NAT(func(IPv4) bool { return false })
+	if n.enabled() {
+		t.Fatalf("NAT with no rules is enabled")
+	}
+	var other EthernetSegment
+	dev, err := NewEthernetDevice(other.NewInterface(), MAC{2, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatalf("unexpected error creating device: %v", err)
+	}
+	rule := IPv4NATRule{Type: NATMasquerade, Device: dev}
+	n.addRule(rule)
+	if !n.enabled() {
+		t.Fatalf("NAT with a rule is not enabled")
+	}
+
+	// packets which match no rule and belong to no connection are
+	// handled without locking the connection table
+	src, dst := IPv4{10, 0, 0, 2}, IPv4{192, 0, 2, 2}
+	b := append(make([]byte, 20), makeNATUDP(src, dst, 5000, 53)...)
+	hdr := ipv4Header{version: 4, IHL: 5, len: uint16(len(b)), TTL: 64, proto: IPProtocolUDP, src: src, dst: dst}
+	writeIPv4Header(&hdr, b)
+	n.mu.Lock()
+	done := make(chan bool)
+	go func() {
+		to := n.prerouting(nil, b, &hdr)
+		done <- to == nil && n.postrouting(nil, nil, dst, b, &hdr, nil)
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("packet matching no rule was translated or dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for packet matching no rule")
+	}
+	n.mu.Unlock()
+
+	if !n.deleteRule(rule) {
+		t.Fatalf("failed to delete rule")
+	}
+	if n.enabled() {
+		t.Errorf("NAT with no rules or connections is enabled")
+	}
+}
@@ -0,0 +1,552 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/checksum"
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// See RFC 4861 for a description of IPv6 Neighbor Discovery. Router
+// discovery, redirects, and duplicate address detection of our own
+// address are not implemented; only address resolution and Neighbor
+// Unreachability Detection (NUD) are.
+
+const (
+	// how often the NDP daemon checks the timers of cache entries
+	ndpTickInterval = 100 * time.Millisecond
+
+	// See section 10 of RFC 4861 for these values
+	ndpMaxMulticastSolicit = 3
+	ndpMaxUnicastSolicit   = 3
+	ndpRetransTimer        = time.Second
+	ndpReachableTime       = 30 * time.Second
+	ndpDelayFirstProbeTime = 5 * time.Second
+	ndpHopLimit            = 255
+
+	// how long an unused stale entry is kept before being evicted
+	ndpStaleTime = 60 * time.Second
+	// how long a failed entry is kept; while it is, writes to the
+	// address fail immediately rather than triggering new solicitations
+	ndpFailedTime = 5 * time.Second
+	// maximum number of frames queued per entry while resolution
+	// is pending; when full, the oldest frame is dropped
+	ndpMaxPending = 8
+)
+
+// Neighbor cache entry states; see section 7.3.2 of RFC 4861
+type ndpState uint8
+
+const (
+	ndpStateIncomplete ndpState = iota
+	ndpStateReachable
+	ndpStateStale
+	ndpStateDelay
+	ndpStateProbe
+	// resolution or NUD failed; not an RFC 4861 state (the RFC deletes
+	// such entries), but kept briefly so that writes can report an error
+	ndpStateFailed
+)
+
+type ndpEntry struct {
+	state ndpState
+	mac   MAC // unset if state is ndpStateIncomplete or ndpStateFailed
+	// for incomplete and probe entries, the time at which the last
+	// solicitation was sent; for all others, the time of the last
+	// state change
+	updated  time.Time
+	requests int      // number of solicitations sent while incomplete or probing
+	pending  [][]byte // frames waiting for resolution
+}
+
+// ndp represents an instance of the Neighbor Discovery Protocol. It resolves
+// IPv6 addresses on the link attached to iface, and answers solicitations for
+// its own addresses.
+type ndp struct {
+	iface EthernetInterface
+	hw    MAC
+	addrs []IPv6DeviceAddr // never modified in place
+	cache map[IPv6]*ndpEntry
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+}
+
+// newNDP creates a new NDP instance which uses iface to write frames, and
+// spawns its daemon goroutine; call Stop to terminate it. hw must be non-zero,
+// and addrs must be non-empty. It is the caller's responsibility to ensure
+// that iface receives frames sent to the MACs of the all-nodes multicast
+// address and of addrs' solicited-node multicast addresses (see
+// ndpMulticastMACs).
+func newNDP(iface EthernetInterface, hw MAC, addrs []IPv6DeviceAddr) *ndp {
+	if hw == (MAC{}) || len(addrs) == 0 {
+		panic("new ndp instance with zero addr")
+	}
+	d := &ndp{
+		iface: iface,
+		hw:    hw,
+		addrs: addrs,
+		cache: make(map[IPv6]*ndpEntry),
+		stop:  make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go d.daemon()
+	return d
+}
+
+// ndpMulticastMACs returns the multicast MACs on which an NDP instance with
+// the given addresses needs to receive frames, without duplicates. Since
+// solicited-node addresses only depend on the last 24 bits of an address,
+// several addresses often share one.
+func ndpMulticastMACs(addrs []IPv6DeviceAddr) []MAC {
+	if len(addrs) == 0 {
+		return nil
+	}
+	macs := []MAC{ipv6MulticastMAC(ipv6AllNodes)}
+	for _, a := range addrs {
+		if mac := ipv6MulticastMAC(solicitedNodeAddr(a.Addr)); !hasMAC(macs, mac) {
+			macs = append(macs, mac)
+		}
+	}
+	return macs
+}
+
+func hasMAC(macs []MAC, mac MAC) bool {
+	for _, m := range macs {
+		if m == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// isNDPPacket returns true if the IPv6 packet in b is a Neighbor Solicitation
+// or Neighbor Advertisement. It does not validate the packet.
+func isNDPPacket(b []byte) bool {
+	return len(b) > 40 && IPProtocol(b[6]) == IPProtocolICMPv6 &&
+		(b[40] == ndpNeighborSolicitation || b[40] == ndpNeighborAdvert)
+}
+
+// HandlePacket handles an incoming IPv6 packet containing a Neighbor
+// Solicitation or Neighbor Advertisement (see isNDPPacket).
+func (d *ndp) HandlePacket(src, dst MAC, b []byte) error {
+	if len(b) < 40 {
+		return errors.Errorf("handle NDP packet: invalid IPv6 packet length: %v", len(b))
+	}
+	var hdr ipv6Header
+	readIPv6Header(&hdr, b)
+	if int(hdr.len) > len(b)-40 {
+		return errors.New("handle NDP packet: IPv6 payload length exceeds packet length")
+	}
+	payload := b[40 : 40+int(hdr.len)]
+
+	// See section 7.1 of RFC 4861 for validation rules
+	if hdr.hopLimit != ndpHopLimit {
+		return errors.Errorf("handle NDP packet: invalid hop limit: %v", hdr.hopLimit)
+	}
+	sum := checksum.IPv6PseudoHeaderSum(hdr.src, hdr.dst, len(payload), uint8(IPProtocolICMPv6))
+	if checksum.Finish(checksum.Add(sum, payload)) != 0 {
+		return errors.New("handle NDP packet: invalid checksum")
+	}
+	msg, err := parseNDPMessage(payload)
+	if err != nil {
+		return errors.Annotate(err, "handle NDP packet")
+	}
+
+	now := time.Now()
+	var frames []frame
+	d.mu.Lock()
+	switch msg.typ {
+	case ndpNeighborSolicitation:
+		frames = d.handleSolicitation(&hdr, &msg, src, now)
+	case ndpNeighborAdvert:
+		if hdr.dst[0] == 0xff && msg.flags&ndpFlagSolicited != 0 {
+			d.mu.Unlock()
+			return errors.New("handle NDP packet: solicited advertisement to multicast address")
+		}
+		frames = d.handleAdvertisement(&msg, now)
+	}
+	d.mu.Unlock()
+
+	d.send(frames)
+	return nil
+}
+
+// See sections 7.2.3 and 7.2.4 of RFC 4861. Assumes d.mu is held.
+func (d *ndp) handleSolicitation(hdr *ipv6Header, msg *ndpMessage, src MAC, now time.Time) []frame {
+	if !hasIPv6Addr(d.addrs, msg.target) {
+		return nil
+	}
+	reply := ndpMessage{
+		typ:       ndpNeighborAdvert,
+		flags:     ndpFlagOverride,
+		target:    msg.target,
+		lladdr:    d.hw,
+		lladdrSet: true,
+	}
+	if hdr.src == (IPv6{}) {
+		// duplicate address detection by another node
+		return []frame{d.makeFrame(&reply, msg.target, ipv6AllNodes, ipv6MulticastMAC(ipv6AllNodes))}
+	}
+
+	var frames []frame
+	if msg.lladdrSet {
+		e, ok := d.cache[hdr.src]
+		if !ok {
+			e = &ndpEntry{}
+			d.cache[hdr.src] = e
+		}
+		if !ok || e.state == ndpStateIncomplete || e.state == ndpStateFailed || e.mac != msg.lladdr {
+			frames = d.update(e, msg.lladdr, ndpStateStale, now)
+		}
+		src = msg.lladdr
+	}
+	reply.flags |= ndpFlagSolicited
+	return append(frames, d.makeFrame(&reply, msg.target, hdr.src, src))
+}
+
+// See section 7.2.5 of RFC 4861. Assumes d.mu is held.
+func (d *ndp) handleAdvertisement(msg *ndpMessage, now time.Time) []frame {
+	e, ok := d.cache[msg.target]
+	if !ok || e.state == ndpStateFailed {
+		return nil
+	}
+	solicited := msg.flags&ndpFlagSolicited != 0
+	override := msg.flags&ndpFlagOverride != 0
+
+	if e.state == ndpStateIncomplete {
+		if !msg.lladdrSet {
+			return nil
+		}
+		state := ndpStateStale
+		if solicited {
+			state = ndpStateReachable
+		}
+		return d.update(e, msg.lladdr, state, now)
+	}
+
+	changed := msg.lladdrSet && msg.lladdr != e.mac
+	switch {
+	case !override && changed:
+		if e.state == ndpStateReachable {
+			e.state, e.updated = ndpStateStale, now
+		}
+	case solicited:
+		mac := e.mac
+		if msg.lladdrSet {
+			mac = msg.lladdr
+		}
+		return d.update(e, mac, ndpStateReachable, now)
+	case changed:
+		return d.update(e, msg.lladdr, ndpStateStale, now)
+	}
+	return nil
+}
+
+// LookupIPv6 looks up the hardware address of ip in the cache. It does not
+// send any solicitations. If resolution of ip has recently failed, the
+// returned error will be a host unreachable error (see IsHostUnreachable).
+func (d *ndp) LookupIPv6(ip IPv6) (MAC, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.cache[ip]
+	switch {
+	case !ok || e.state == ndpStateIncomplete:
+		return MAC{}, errors.Errorf("lookup %v: address not resolved", ip)
+	case e.state == ndpStateFailed:
+		return MAC{}, errors.Annotate(errors.NewHostUnreachable(ip.String()), "lookup")
+	default:
+		return e.mac, nil
+	}
+}
+
+// WriteIPv6 writes the IPv6 packet in b to the neighbor with address ip. Like
+// EthernetInterface's WriteFrame, b must contain space for the Ethernet header
+// preceding the packet itself.
+//
+// If ip has not yet been resolved, a solicitation is sent, and b is queued
+// until an advertisement arrives; in this case, WriteIPv6 returns len(b) and a
+// nil error, and b must not be modified by the caller. If resolution fails,
+// any queued frames are dropped, and subsequent calls to WriteIPv6 with ip will
+// return a host unreachable error (see IsHostUnreachable) for a short period.
+func (d *ndp) WriteIPv6(b []byte, ip IPv6) (n int, err error) {
+	if ip[0] == 0xff {
+		// multicast addresses are mapped directly (RFC 2464)
+		return d.iface.WriteFrame(b, ipv6MulticastMAC(ip), EtherTypeIPv6)
+	}
+
+	now := time.Now()
+	var frames []frame
+	d.mu.Lock()
+	e, ok := d.cache[ip]
+	if !ok {
+		e = &ndpEntry{state: ndpStateIncomplete, updated: now, requests: 1}
+		d.cache[ip] = e
+		frames = append(frames, d.makeSolicitation(ip, false, MAC{}))
+	}
+
+	switch e.state {
+	case ndpStateIncomplete:
+		if len(e.pending) == ndpMaxPending {
+			e.pending = e.pending[1:]
+		}
+		e.pending = append(e.pending, b)
+		d.mu.Unlock()
+		d.send(frames)
+		return len(b), nil
+	case ndpStateFailed:
+		d.mu.Unlock()
+		return 0, errors.Annotate(errors.NewHostUnreachable(ip.String()), "resolve IPv6 address")
+	case ndpStateStale:
+		e.state, e.updated = ndpStateDelay, now
+	}
+	mac := e.mac
+	d.mu.Unlock()
+
+	d.send(frames)
+	return d.iface.WriteFrame(b, mac, EtherTypeIPv6)
+}
+
+// Stop terminates d's daemon goroutine. Any frames pending resolution are
+// dropped.
+func (d *ndp) Stop() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// update records mac as the hardware address in e, and sets e's state.
+// Any frames which were pending resolution are returned so that they may
+// be sent once d.mu has been released.
+//
+// update assumes d.mu is held.
+func (d *ndp) update(e *ndpEntry, mac MAC, state ndpState, now time.Time) []frame {
+	e.state, e.mac, e.updated, e.requests = state, mac, now, 0
+	var frames []frame
+	for _, b := range e.pending {
+		frames = append(frames, frame{b: b, dst: mac, et: EtherTypeIPv6})
+	}
+	e.pending = nil
+	return frames
+}
+
+// tick advances the timers of all cache entries, returning any solicitations
+// which need to be sent. tick assumes d.mu is held.
+func (d *ndp) tick(now time.Time) []frame {
+	var frames []frame
+	for ip, e := range d.cache {
+		elapsed := now.Sub(e.updated)
+		switch e.state {
+		case ndpStateIncomplete, ndpStateProbe:
+			if elapsed < ndpRetransTimer {
+				continue
+			}
+			max := ndpMaxMulticastSolicit
+			if e.state == ndpStateProbe {
+				max = ndpMaxUnicastSolicit
+			}
+			if e.requests == max {
+				e.state, e.mac, e.updated, e.pending = ndpStateFailed, MAC{}, now, nil
+				continue
+			}
+			e.updated = now
+			e.requests++
+			frames = append(frames, d.makeSolicitation(ip, e.state == ndpStateProbe, e.mac))
+		case ndpStateReachable:
+			if elapsed >= ndpReachableTime {
+				e.state, e.updated = ndpStateStale, now
+			}
+		case ndpStateDelay:
+			if elapsed >= ndpDelayFirstProbeTime {
+				e.state, e.updated, e.requests = ndpStateProbe, now, 1
+				frames = append(frames, d.makeSolicitation(ip, true, e.mac))
+			}
+		case ndpStateStale:
+			if elapsed >= ndpStaleTime {
+				delete(d.cache, ip)
+			}
+		case ndpStateFailed:
+			if elapsed >= ndpFailedTime {
+				delete(d.cache, ip)
+			}
+		}
+	}
+	return frames
+}
+
+func (d *ndp) daemon() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(ndpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-ticker.C:
+			d.mu.Lock()
+			frames := d.tick(now)
+			d.mu.Unlock()
+			d.send(frames)
+		}
+	}
+}
+
+// makeSolicitation constructs a Neighbor Solicitation for target. If unicast
+// is true, it is addressed directly to target at the given MAC (as is done by
+// NUD); otherwise, it is sent to target's solicited-node multicast address.
+// It assumes d.mu is held.
+func (d *ndp) makeSolicitation(target IPv6, unicast bool, mac MAC) frame {
+	src, _ := selectIPv6Source(d.addrs, target)
+	msg := ndpMessage{
+		typ:       ndpNeighborSolicitation,
+		target:    target,
+		lladdr:    d.hw,
+		lladdrSet: true,
+	}
+	if unicast {
+		return d.makeFrame(&msg, src, target, mac)
+	}
+	dst := solicitedNodeAddr(target)
+	return d.makeFrame(&msg, src, dst, ipv6MulticastMAC(dst))
+}
+
+// SetAddrs replaces the addresses for which solicitations are answered. It is
+// the caller's responsibility to update the multicast MACs on which iface
+// receives frames.
+func (d *ndp) SetAddrs(addrs []IPv6DeviceAddr) {
+	d.mu.Lock()
+	d.addrs = addrs
+	d.mu.Unlock()
+}
+
+// makeFrame encapsulates msg in an IPv6 packet from our address src
+// to dst, addressed to the link-layer destination mac.
+func (d *ndp) makeFrame(msg *ndpMessage, src, dst IPv6, mac MAC) frame {
+	msglen := msg.EncodedLen()
+	b := make([]byte, ethernetHeaderLen+40+msglen)
+	hdr := ipv6Header{
+		version:  6,
+		len:      uint16(msglen),
+		nextHdr:  IPProtocolICMPv6,
+		hopLimit: ndpHopLimit,
+		src:      src,
+		dst:      dst,
+	}
+	writeIPv6Header(&hdr, b[ethernetHeaderLen:])
+	payload := b[ethernetHeaderLen+40:]
+	writeNDPMessage(msg, payload)
+	sum := checksum.Finish(checksum.Add(checksum.IPv6PseudoHeaderSum(src, dst, msglen, uint8(IPProtocolICMPv6)), payload))
+	payload[2], payload[3] = byte(sum>>8), byte(sum)
+	return frame{b: b, dst: mac, et: EtherTypeIPv6}
+}
+
+// send writes frames to d.iface. It must not be called while d.mu is held.
+func (d *ndp) send(frames []frame) { writeFrames(d.iface, frames) }
+
+// ipv6AllNodes is the link-local all-nodes multicast address, ff02::1.
+var ipv6AllNodes = IPv6{0xff, 0x02, 15: 1}
+
+// solicitedNodeAddr returns the solicited-node multicast address for addr
+// (RFC 4291 section 2.7.1).
+func solicitedNodeAddr(addr IPv6) IPv6 {
+	snaddr := IPv6{0xff, 0x02, 11: 1, 12: 0xff}
+	copy(snaddr[13:], addr[13:])
+	return snaddr
+}
+
+// ipv6MulticastMAC returns the MAC to which frames addressed to the multicast
+// IPv6 address addr are sent (RFC 2464 section 7).
+func ipv6MulticastMAC(addr IPv6) MAC {
+	return MAC{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]}
+}
+
+const (
+	// ICMPv6 message types
+	ndpNeighborSolicitation = 135
+	ndpNeighborAdvert       = 136
+
+	ndpFlagRouter    = 0x80
+	ndpFlagSolicited = 0x40
+	ndpFlagOverride  = 0x20
+
+	ndpOptionSourceLinkAddr = 1
+	ndpOptionTargetLinkAddr = 2
+
+	// length of a Neighbor Solicitation or Advertisement without options
+	ndpMessageLen = 24
+)
+
+// ndpMessage is a Neighbor Solicitation or Neighbor Advertisement (see
+// sections 4.3 and 4.4 of RFC 4861). The checksum is not represented, and
+// is left zero by writeNDPMessage.
+type ndpMessage struct {
+	typ    uint8
+	flags  uint8 // only used in advertisements
+	target IPv6
+	// the source link-layer address option for solicitations,
+	// or the target link-layer address option for advertisements
+	lladdr    MAC
+	lladdrSet bool
+}
+
+func (msg *ndpMessage) EncodedLen() int {
+	if msg.lladdrSet {
+		return ndpMessageLen + 8
+	}
+	return ndpMessageLen
+}
+
+func parseNDPMessage(b []byte) (msg ndpMessage, err error) {
+	if len(b) < ndpMessageLen {
+		return msg, errors.Errorf("invalid NDP message length: %v", len(b))
+	}
+	msg.typ = parse.GetByte(&b)
+	if code := parse.GetByte(&b); code != 0 {
+		return msg, errors.Errorf("invalid NDP message code: %v", code)
+	}
+	parse.GetUint16(&b) // checksum
+	msg.flags = parse.GetByte(&b) & (ndpFlagRouter | ndpFlagSolicited | ndpFlagOverride)
+	parse.GetBytes(&b, 3) // reserved
+	copy(msg.target[:], parse.GetBytes(&b, 16))
+
+	want := ndpOptionSourceLinkAddr
+	if msg.typ == ndpNeighborAdvert {
+		want = ndpOptionTargetLinkAddr
+	}
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return msg, errors.New("truncated NDP option")
+		}
+		typ, optlen := int(b[0]), int(b[1])*8
+		if optlen == 0 || optlen > len(b) {
+			return msg, errors.Errorf("invalid NDP option length: %v", optlen)
+		}
+		if typ == want && optlen == 8 {
+			copy(msg.lladdr[:], b[2:8])
+			msg.lladdrSet = true
+		}
+		b = b[optlen:]
+	}
+	return msg, nil
+}
+
+// assumes that b is at least msg.EncodedLen() bytes long
+func writeNDPMessage(msg *ndpMessage, b []byte) {
+	parse.PutByte(&b, msg.typ)
+	parse.PutByte(&b, 0) // code
+	parse.PutUint16(&b, 0)
+	parse.PutByte(&b, msg.flags)
+	copy(parse.GetBytes(&b, 3), []byte{0, 0, 0})
+	copy(parse.GetBytes(&b, 16), msg.target[:])
+	if msg.lladdrSet {
+		opt := ndpOptionSourceLinkAddr
+		if msg.typ == ndpNeighborAdvert {
+			opt = ndpOptionTargetLinkAddr
+		}
+		parse.PutByte(&b, uint8(opt))
+		parse.PutByte(&b, 1)
+		copy(parse.GetBytes(&b, 6), msg.lladdr[:])
+	}
+}
@@ -0,0 +1,80 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/joshlf/net/internal/checksum"
+)
+
+func TestNDPResolve(t *testing.T) {
+	var iface frameRecorder
+	ourMAC, theirMAC := MAC{2, 0, 0, 0, 0, 1}, MAC{2, 0, 0, 0, 0, 2}
+	ourIP, _ := ParseIPv6("fe80::1")
+	theirIP, _ := ParseIPv6("fe80::2:3:4")
+	d := newNDP(&iface, ourMAC, []IPv6DeviceAddr{{Addr: ourIP}})
+	defer d.Stop()
+	// used only to construct packets; its daemon is never started
+	them := &ndp{hw: theirMAC}
+
+	pkt := make([]byte, ethernetHeaderLen+40)
+	n, err := d.WriteIPv6(pkt, theirIP)
+	if n != len(pkt) || err != nil {
+		t.Fatalf("unexpected result from WriteIPv6: (%v, %v)", n, err)
+	}
+	frames := iface.take()
+	snaddr := solicitedNodeAddr(theirIP)
+	if len(frames) != 1 || frames[0].dst != ipv6MulticastMAC(snaddr) || frames[0].et != EtherTypeIPv6 {
+		t.Fatalf("expected single multicast solicitation; got %v", frames)
+	}
+	if frames[0].dst != (MAC{0x33, 0x33, 0xff, 0x03, 0x00, 0x04}) {
+		t.Fatalf("unexpected solicited-node multicast MAC: %v", frames[0].dst)
+	}
+	sol := frames[0].b[ethernetHeaderLen:]
+	var hdr ipv6Header
+	readIPv6Header(&hdr, sol)
+	if hdr.dst != snaddr || hdr.src != ourIP || hdr.hopLimit != ndpHopLimit {
+		t.Fatalf("unexpected solicitation IPv6 header: %+v", hdr)
+	}
+	sum := checksum.IPv6PseudoHeaderSum(hdr.src, hdr.dst, int(hdr.len), uint8(IPProtocolICMPv6))
+	if checksum.Finish(checksum.Add(sum, sol[40:])) != 0 {
+		t.Fatalf("invalid solicitation checksum")
+	}
+	msg, err := parseNDPMessage(sol[40:])
+	if err != nil || msg.typ != ndpNeighborSolicitation || msg.target != theirIP || msg.lladdr != ourMAC {
+		t.Fatalf("unexpected solicitation: (%+v, %v)", msg, err)
+	}
+
+	// answer the solicitation; the queued packet should be flushed
+	adv := ndpMessage{
+		typ:       ndpNeighborAdvert,
+		flags:     ndpFlagSolicited | ndpFlagOverride,
+		target:    theirIP,
+		lladdr:    theirMAC,
+		lladdrSet: true,
+	}
+	f := them.makeFrame(&adv, theirIP, ourIP, ourMAC)
+	if err := d.HandlePacket(theirMAC, ourMAC, f.b[ethernetHeaderLen:]); err != nil {
+		t.Fatalf("unexpected error handling advertisement: %v", err)
+	}
+	frames = iface.take()
+	if len(frames) != 1 || frames[0].dst != theirMAC || frames[0].et != EtherTypeIPv6 {
+		t.Fatalf("expected queued IPv6 packet to be flushed; got %v", frames)
+	}
+	if mac, err := d.LookupIPv6(theirIP); mac != theirMAC || err != nil {
+		t.Fatalf("unexpected result from LookupIPv6: (%v, %v)", mac, err)
+	}
+
+	// a solicitation for our address should be answered
+	sol2 := ndpMessage{typ: ndpNeighborSolicitation, target: ourIP, lladdr: theirMAC, lladdrSet: true}
+	f = them.makeFrame(&sol2, theirIP, solicitedNodeAddr(ourIP), ipv6MulticastMAC(solicitedNodeAddr(ourIP)))
+	d.HandlePacket(theirMAC, f.dst, f.b[ethernetHeaderLen:])
+	frames = iface.take()
+	if len(frames) != 1 || frames[0].dst != theirMAC {
+		t.Fatalf("expected single unicast advertisement; got %v", frames)
+	}
+	msg, err = parseNDPMessage(frames[0].b[ethernetHeaderLen+40:])
+	if err != nil || msg.typ != ndpNeighborAdvert || msg.target != ourIP || msg.lladdr != ourMAC ||
+		msg.flags != ndpFlagSolicited|ndpFlagOverride {
+		t.Fatalf("unexpected advertisement: (%+v, %v)", msg, err)
+	}
+}
@@ -16,3 +16,9 @@ func IsNoRoute(err error) bool {
 func IsTimeout(err error) bool {
 	return errors.IsTimeout(err)
 }
+
+// IsHostUnreachable returns true if err indicates that a host could not be
+// reached on the local link, for example because address resolution failed.
+func IsHostUnreachable(err error) bool {
+	return errors.IsHostUnreachable(err)
+}
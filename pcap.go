@@ -0,0 +1,404 @@
+package net
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// A CaptureFormat is a file format for captured packets.
+type CaptureFormat int
+
+const (
+	// FormatPcap is the classic libpcap format, with nanosecond timestamps.
+	// It cannot record the direction of packets.
+	FormatPcap CaptureFormat = iota
+	// FormatPcapNG is the pcapng format. The direction of each packet is
+	// recorded in its Enhanced Packet Block's epb_flags option.
+	FormatPcapNG
+)
+
+// link types (see http://www.tcpdump.org/linktypes.html)
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+)
+
+const (
+	// the maximum number of bytes captured per packet
+	pcapSnapLen = 1 << 16
+
+	pcapMagicNanos      = 0xa1b23c4d
+	pcapVersionMajor    = 2
+	pcapVersionMinor    = 4
+	pcapFileHeaderLen   = 24
+	pcapRecordHeaderLen = 16
+
+	pcapngSHB            = 0x0A0D0D0A // Section Header Block
+	pcapngIDB            = 0x00000001 // Interface Description Block
+	pcapngEPB            = 0x00000006 // Enhanced Packet Block
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngOptIfTSResol   = 9 // if_tsresol
+	pcapngOptEPBFlags    = 2 // epb_flags
+	pcapngTSResolNanos   = 9 // 10^-9 seconds
+)
+
+// pcapWriter writes packets to a pcap or pcapng file. It performs
+// no synchronization of its own.
+type pcapWriter struct {
+	w      io.Writer
+	format CaptureFormat
+}
+
+// newPcapWriter creates a new pcapWriter, writing the file header (for pcap)
+// or the Section Header and Interface Description Blocks (for pcapng) to w.
+func newPcapWriter(w io.Writer, format CaptureFormat, linkType uint16) (*pcapWriter, error) {
+	var b []byte
+	le := binary.LittleEndian
+	switch format {
+	case FormatPcap:
+		b = make([]byte, pcapFileHeaderLen)
+		le.PutUint32(b[0:], pcapMagicNanos)
+		le.PutUint16(b[4:], pcapVersionMajor)
+		le.PutUint16(b[6:], pcapVersionMinor)
+		// bytes 8 through 15 are the time zone offset
+		// and timestamp accuracy, which are always 0
+		le.PutUint32(b[16:], pcapSnapLen)
+		le.PutUint32(b[20:], uint32(linkType))
+	case FormatPcapNG:
+		const shbLen, idbLen = 28, 32
+		b = make([]byte, shbLen+idbLen)
+		shb, idb := b[:shbLen], b[shbLen:]
+		le.PutUint32(shb[0:], pcapngSHB)
+		le.PutUint32(shb[4:], shbLen)
+		le.PutUint32(shb[8:], pcapngByteOrderMagic)
+		le.PutUint16(shb[12:], 1) // major version
+		le.PutUint16(shb[14:], 0) // minor version
+		le.PutUint64(shb[16:], ^uint64(0))
+		le.PutUint32(shb[24:], shbLen)
+
+		le.PutUint32(idb[0:], pcapngIDB)
+		le.PutUint32(idb[4:], idbLen)
+		le.PutUint16(idb[8:], linkType)
+		le.PutUint32(idb[12:], pcapSnapLen)
+		le.PutUint16(idb[16:], pcapngOptIfTSResol)
+		le.PutUint16(idb[18:], 1)
+		idb[20] = pcapngTSResolNanos
+		// bytes 24 through 27 are the end of options
+		le.PutUint32(idb[28:], idbLen)
+	default:
+		return nil, errors.Errorf("create capture: unknown format: %v", format)
+	}
+	_, err := w.Write(b)
+	if err != nil {
+		return nil, errors.Annotate(err, "write capture header")
+	}
+	return &pcapWriter{w: w, format: format}, nil
+}
+
+// WritePacket writes the packet b, which was captured at time t travelling
+// in the direction dir.
+func (p *pcapWriter) WritePacket(t time.Time, dir Direction, b []byte) error {
+	orig := len(b)
+	if len(b) > pcapSnapLen {
+		b = b[:pcapSnapLen]
+	}
+	le := binary.LittleEndian
+	var buf []byte
+	switch p.format {
+	case FormatPcap:
+		buf = make([]byte, pcapRecordHeaderLen+len(b))
+		le.PutUint32(buf[0:], uint32(t.Unix()))
+		le.PutUint32(buf[4:], uint32(t.Nanosecond()))
+		le.PutUint32(buf[8:], uint32(len(b)))
+		le.PutUint32(buf[12:], uint32(orig))
+		copy(buf[16:], b)
+	case FormatPcapNG:
+		padded := (len(b) + 3) &^ 3
+		// block header, interface ID, timestamp, lengths,
+		// data, epb_flags, end of options, block trailer
+		blockLen := 8 + 4 + 8 + 8 + padded + 8 + 4 + 4
+		buf = make([]byte, blockLen)
+		ts := uint64(t.UnixNano())
+		le.PutUint32(buf[0:], pcapngEPB)
+		le.PutUint32(buf[4:], uint32(blockLen))
+		// bytes 8 through 11 are the interface ID, which is always 0
+		le.PutUint32(buf[12:], uint32(ts>>32))
+		le.PutUint32(buf[16:], uint32(ts))
+		le.PutUint32(buf[20:], uint32(len(b)))
+		le.PutUint32(buf[24:], uint32(orig))
+		copy(buf[28:], b)
+		opts := buf[28+padded:]
+		le.PutUint16(opts[0:], pcapngOptEPBFlags)
+		le.PutUint16(opts[2:], 4)
+		le.PutUint32(opts[4:], uint32(dir))
+		// bytes 8 through 11 are the end of options
+		le.PutUint32(opts[12:], uint32(blockLen))
+	}
+	_, err := p.w.Write(buf)
+	return errors.Annotate(err, "write captured packet")
+}
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapngSPB       = 0x00000003 // Simple Packet Block
+
+	// additional raw IP link types, which some
+	// tools use in place of linkTypeRaw
+	linkTypeIPv4 = 228
+	linkTypeIPv6 = 229
+)
+
+// readCapture reads all of the packets in the pcap or pcapng file r, which
+// must have the Ethernet link type or one of the raw IP link types. Packets
+// in pcap files, and packets in pcapng files without an epb_flags option,
+// have a Direction of 0. Packets in pcapng Simple Packet Blocks have a zero
+// Time.
+func readCapture(r io.Reader) (packets []CapturedPacket, err error) {
+	// we use parse.GetBytes to consume the file; it
+	// panics with an appropriate error if the file is
+	// truncated, and we return that error
+	defer func() {
+		e := recover()
+		if e != nil {
+			err = errors.Annotate(e.(error), "read capture")
+		}
+	}()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Annotate(err, "read capture")
+	}
+	if len(b) < 4 {
+		return nil, errors.New("read capture: file too short")
+	}
+	if binary.LittleEndian.Uint32(b) == pcapngSHB {
+		return readPcapNG(b)
+	}
+	return readPcap(b)
+}
+
+// ethernetLinkType returns whether linkType is the Ethernet
+// link type, or returns an error if it is not supported.
+func ethernetLinkType(linkType uint16) (bool, error) {
+	switch linkType {
+	case linkTypeEthernet:
+		return true, nil
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return false, nil
+	}
+	return false, errors.Errorf("read capture: unsupported link type: %v", linkType)
+}
+
+func readPcap(b []byte) ([]CapturedPacket, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var nanos bool
+	switch magic := binary.LittleEndian.Uint32(b); {
+	case magic == pcapMagicMicros || magic == pcapMagicNanos:
+		nanos = magic == pcapMagicNanos
+	default:
+		order = binary.BigEndian
+		magic = order.Uint32(b)
+		if magic != pcapMagicMicros && magic != pcapMagicNanos {
+			return nil, errors.New("read capture: not a pcap or pcapng file")
+		}
+		nanos = magic == pcapMagicNanos
+	}
+	hdr := parse.GetBytes(&b, pcapFileHeaderLen)
+	// the upper 16 bits may contain FCS information
+	ethernet, err := ethernetLinkType(uint16(order.Uint32(hdr[20:])))
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []CapturedPacket
+	for len(b) > 0 {
+		rec := parse.GetBytes(&b, pcapRecordHeaderLen)
+		sec, frac := int64(order.Uint32(rec[0:])), int64(order.Uint32(rec[4:]))
+		if !nanos {
+			frac *= 1000
+		}
+		data := parse.GetBytes(&b, int(order.Uint32(rec[8:])))
+		packets = append(packets, CapturedPacket{
+			Time:     time.Unix(sec, frac),
+			Ethernet: ethernet,
+			Data:     data,
+		})
+	}
+	return packets, nil
+}
+
+func readPcapNG(b []byte) ([]CapturedPacket, error) {
+	type iface struct {
+		linkType uint16
+		// timestamp units per second
+		tsPerSec uint64
+	}
+	var order binary.ByteOrder
+	var ifaces []iface
+	var packets []CapturedPacket
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, errors.New("read capture: file truncated")
+		}
+		if binary.LittleEndian.Uint32(b) == pcapngSHB {
+			// each section may have a different byte order,
+			// and has its own set of interfaces
+			switch binary.LittleEndian.Uint32(b[8:]) {
+			case pcapngByteOrderMagic:
+				order = binary.LittleEndian
+			case 0x4D3C2B1A:
+				order = binary.BigEndian
+			default:
+				return nil, errors.New("read capture: invalid byte-order magic")
+			}
+			ifaces = nil
+		}
+		typ, l := order.Uint32(b), int(order.Uint32(b[4:]))
+		if l < 12 || l%4 != 0 {
+			return nil, errors.Errorf("read capture: invalid block length: %v", l)
+		}
+		if l > len(b) {
+			return nil, errors.New("read capture: file truncated")
+		}
+		block := parse.GetBytes(&b, l)
+		body := block[8 : l-4]
+
+		switch typ {
+		case pcapngIDB:
+			if len(body) < 8 {
+				return nil, errors.New("read capture: interface description block too short")
+			}
+			hdr := parse.GetBytes(&body, 8)
+			ifc := iface{linkType: order.Uint16(hdr), tsPerSec: 1000000}
+			for {
+				code, val, err := readPcapNGOption(&body, order)
+				if err != nil {
+					return nil, err
+				}
+				if code == 0 {
+					break
+				}
+				if code == pcapngOptIfTSResol && len(val) == 1 {
+					if ifc.tsPerSec, err = pcapngTSPerSec(val[0]); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if len(ifaces) > 0 && ifaces[0].linkType != ifc.linkType {
+				return nil, errors.New("read capture: multiple link types")
+			}
+			ifaces = append(ifaces, ifc)
+		case pcapngEPB, pcapngSPB:
+			var p CapturedPacket
+			id, caplen := 0, 0
+			if typ == pcapngEPB {
+				if len(body) < 20 {
+					return nil, errors.New("read capture: enhanced packet block too short")
+				}
+				hdr := parse.GetBytes(&body, 20)
+				id = int(order.Uint32(hdr))
+				caplen = int(order.Uint32(hdr[12:]))
+				if caplen > len(body) {
+					return nil, errors.Errorf("read capture: captured length exceeds block: %v", caplen)
+				}
+				if id < len(ifaces) {
+					ts := uint64(order.Uint32(hdr[4:]))<<32 | uint64(order.Uint32(hdr[8:]))
+					p.Time = pcapngTime(ts, ifaces[id].tsPerSec)
+				}
+			} else {
+				if len(body) < 4 {
+					return nil, errors.New("read capture: simple packet block too short")
+				}
+				caplen = int(order.Uint32(parse.GetBytes(&body, 4)))
+				if caplen > len(body) {
+					// the captured length is the smaller of
+					// the original length and the snap length
+					caplen = len(body)
+				}
+			}
+			if id >= len(ifaces) {
+				return nil, errors.Errorf("read capture: packet for unknown interface: %v", id)
+			}
+			// since block lengths are multiples of 4, the
+			// padding fits if the packet data does
+			p.Data = parse.GetBytes(&body, caplen)
+			parse.GetBytes(&body, (4-caplen%4)%4)
+			for {
+				code, val, err := readPcapNGOption(&body, order)
+				if err != nil {
+					return nil, err
+				}
+				if code == 0 {
+					break
+				}
+				if code == pcapngOptEPBFlags && len(val) == 4 {
+					p.Direction = Direction(order.Uint32(val) & 3)
+				}
+			}
+			var err error
+			p.Ethernet, err = ethernetLinkType(ifaces[id].linkType)
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, p)
+		}
+		// other blocks are ignored
+	}
+	return packets, nil
+}
+
+// pcapngTSPerSec returns the number of timestamp units per second for the
+// if_tsresol option value resol, which is a negative power of 10 or, if its
+// high bit is set, of 2. It returns an error if the number of units per second
+// doesn't fit in a uint64.
+func pcapngTSPerSec(resol uint8) (uint64, error) {
+	exp := resol & 0x7F
+	if resol&0x80 != 0 {
+		if exp > 63 {
+			return 0, errors.Errorf("read capture: unsupported timestamp resolution: 2^-%v", exp)
+		}
+		return 1 << exp, nil
+	}
+	// 10^19 is the largest power of 10 which fits in a uint64
+	if exp > 19 {
+		return 0, errors.Errorf("read capture: unsupported timestamp resolution: 10^-%v", exp)
+	}
+	perSec := uint64(1)
+	for i := uint8(0); i < exp; i++ {
+		perSec *= 10
+	}
+	return perSec, nil
+}
+
+// pcapngTime converts the timestamp ts, in units of which there are perSec
+// per second, to a time. perSec must not be 0.
+func pcapngTime(ts, perSec uint64) time.Time {
+	// (ts%perSec)*1e9 may overflow 64 bits for fine resolutions, but
+	// the quotient always fits since ts%perSec < perSec
+	hi, lo := bits.Mul64(ts%perSec, 1e9)
+	nsec, _ := bits.Div64(hi, lo, perSec)
+	return time.Unix(int64(ts/perSec), int64(nsec))
+}
+
+// readPcapNGOption consumes the next option from b, returning its
+// code and value. It returns a code of 0 (opt_endofopt) if there
+// are no more options, and an error if the option is truncated.
+func readPcapNGOption(b *[]byte, order binary.ByteOrder) (code uint16, val []byte, err error) {
+	if len(*b) < 4 {
+		return 0, nil, nil
+	}
+	hdr := parse.GetBytes(b, 4)
+	code, l := order.Uint16(hdr), int(order.Uint16(hdr[2:]))
+	if l+(4-l%4)%4 > len(*b) {
+		return 0, nil, errors.Errorf("read capture: option %v truncated", code)
+	}
+	val = parse.GetBytes(b, l)
+	parse.GetBytes(b, (4-l%4)%4)
+	return code, val, nil
+}
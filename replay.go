@@ -0,0 +1,568 @@
+package net
+
+import (
+	"io"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// ReplayConfig configures a ReplayDevice or ReplayInterface.
+type ReplayConfig struct {
+	// Speedup is the factor by which the delays between packets, as given
+	// by their timestamps, are divided; a Speedup of 2 replays the capture
+	// twice as quickly as it was captured. A Speedup of 0 is treated as 1.
+	Speedup float64
+	// If NoDelay is true, packets are injected as quickly as
+	// possible, and their timestamps are ignored.
+	NoDelay bool
+	// Filter selects which packets from the capture are injected. If
+	// Filter is nil, all packets except those which were captured
+	// travelling outbound are injected.
+	Filter CaptureFilter
+}
+
+// replayer implements the logic common to ReplayDevice and ReplayInterface.
+type replayer struct {
+	packets []CapturedPacket // the packets to inject
+	config  ReplayConfig
+	inject  func(p *CapturedPacket)
+	sent    []CapturedPacket
+	up      bool
+	done    chan struct{} // closed when the daemon returns
+
+	sync syncer
+}
+
+func newReplayer(r io.Reader, ethernet bool, config ReplayConfig) (*replayer, error) {
+	packets, err := readCapture(r)
+	if err != nil {
+		return nil, err
+	}
+	if config.Speedup == 0 {
+		config.Speedup = 1
+	}
+	if config.Speedup < 0 {
+		return nil, errors.Errorf("invalid speedup: %v", config.Speedup)
+	}
+	rp := &replayer{config: config, done: make(chan struct{})}
+	for _, p := range packets {
+		if p.Ethernet != ethernet {
+			return nil, errors.New("capture has wrong link type")
+		}
+		if config.Filter != nil && !config.Filter(&p) ||
+			config.Filter == nil && p.Direction == DirectionOutbound {
+			continue
+		}
+		rp.packets = append(rp.packets, p)
+	}
+	return rp, nil
+}
+
+func (rp *replayer) bringUp() error {
+	return rp.sync.BringUp(func() error {
+		rp.sync.Lock()
+		select {
+		case <-rp.done:
+			// a previous replay has finished
+			rp.done = make(chan struct{})
+		default:
+		}
+		rp.up = true
+		rp.sync.Unlock()
+		return nil
+	}, rp.daemon)
+}
+
+func (rp *replayer) bringDown() error {
+	return rp.sync.BringDown(func() error {
+		rp.sync.Lock()
+		rp.up = false
+		rp.sync.Unlock()
+		return nil
+	})
+}
+
+func (rp *replayer) isUp() bool {
+	return rp.up
+}
+
+func (rp *replayer) daemon() {
+	// NOTE(joshlf): It's safe to access rp.done without synchronization
+	// because it is only modified before the daemon is spawned.
+	defer close(rp.done)
+	stop := rp.sync.StopChan()
+	start := time.Now()
+	for i := range rp.packets {
+		p := &rp.packets[i]
+		var delay time.Duration
+		if !rp.config.NoDelay {
+			offset := time.Duration(float64(p.Time.Sub(rp.packets[0].Time)) / rp.config.Speedup)
+			delay = offset - time.Since(start)
+		}
+		if delay > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+		} else {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+		rp.inject(p)
+	}
+}
+
+// record records the outbound packet b, which is not retained.
+func (rp *replayer) record(b []byte, ethernet bool) {
+	p := CapturedPacket{
+		Time:      time.Now(),
+		Direction: DirectionOutbound,
+		Ethernet:  ethernet,
+		Data:      append([]byte(nil), b...),
+	}
+	rp.sync.Lock()
+	rp.sent = append(rp.sent, p)
+	rp.sync.Unlock()
+}
+
+// Sent returns the packets which have been written, in order.
+func (rp *replayer) Sent() []CapturedPacket {
+	rp.sync.RLock()
+	sent := append([]CapturedPacket(nil), rp.sent...)
+	rp.sync.RUnlock()
+	return sent
+}
+
+// Done returns a channel which is closed once all packets have been
+// injected, or once injection is stopped by bringing the device down.
+// Bringing the device up again causes Done to return a new channel.
+func (rp *replayer) Done() <-chan struct{} {
+	rp.sync.RLock()
+	done := rp.done
+	rp.sync.RUnlock()
+	return done
+}
+
+// A ReplayDevice is a Device which injects IP packets read from a pcap or
+// pcapng file, and records the packets written to it. It is intended for
+// testing the stack against captured traffic.
+//
+// Each time a ReplayDevice is brought up, it injects the packets from the
+// beginning of the capture, passing them to the registered IPv4 or IPv6
+// callback, with delays determined by the packets' timestamps and the
+// ReplayDevice's configuration. Packets written to the device are not sent
+// anywhere; they are recorded, and can be retrieved using Sent.
+//
+// The zero ReplayDevice is not a valid ReplayDevice. ReplayDevices are safe
+// for concurrent access.
+type ReplayDevice struct {
+	addrs4               ipv4Addrs
+	addrs6               ipv6Addrs
+	callback4, callback6 func([]byte) // unset if nil
+	*replayer
+}
+
+var _ IPv4Device = &ReplayDevice{} // make sure *ReplayDevice implements IPv4Device
+var _ IPv6Device = &ReplayDevice{} // make sure *ReplayDevice implements IPv6Device
+
+// NewReplayDevice creates a new ReplayDevice which injects packets read from
+// r, which must contain a pcap or pcapng capture with a raw IP link type. The
+// entire capture is read before NewReplayDevice returns. The returned device
+// is down, and has no associated IPv4 or IPv6 addresses.
+func NewReplayDevice(r io.Reader, config ReplayConfig) (*ReplayDevice, error) {
+	rp, err := newReplayer(r, false, config)
+	if err != nil {
+		return nil, errors.Annotate(err, "create replay device")
+	}
+	dev := &ReplayDevice{replayer: rp}
+	rp.inject = dev.inject
+	return dev, nil
+}
+
+func (dev *ReplayDevice) inject(p *CapturedPacket) {
+	if len(p.Data) == 0 {
+		return
+	}
+	dev.sync.RLock()
+	callback := dev.callback4
+	if p.Data[0]>>4 == 6 {
+		callback = dev.callback6
+	}
+	dev.sync.RUnlock()
+	if callback != nil {
+		// the stack may modify packets in place (for example, when
+		// forwarding them), so don't let it modify the capture
+		callback(append([]byte(nil), p.Data...))
+	}
+}
+
+// BringUp brings dev up, and starts injecting packets from the
+// beginning of the capture. If dev is already up, BringUp is a no-op.
+func (dev *ReplayDevice) BringUp() error {
+	return errors.Annotate(dev.bringUp(), "bring device up")
+}
+
+// BringDown brings dev down, and stops injecting packets. If dev is already
+// down, BringDown is a no-op.
+func (dev *ReplayDevice) BringDown() error {
+	return errors.Annotate(dev.bringDown(), "bring device down")
+}
+
+// IsUp returns true if dev is up.
+func (dev *ReplayDevice) IsUp() bool {
+	dev.sync.RLock()
+	up := dev.isUp()
+	dev.sync.RUnlock()
+	return up
+}
+
+// MTU returns 0, since ReplayDevices have no MTU.
+func (dev *ReplayDevice) MTU() int {
+	return 0
+}
+
+// IPv4 returns dev's primary IPv4 address and network mask if it has any
+// addresses.
+func (dev *ReplayDevice) IPv4() (addr, netmask IPv4, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addrs4.primary()
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv4 replaces dev's IPv4 addresses with the given address and network
+// mask, returning any error encountered. SetIPv4 can only be called when dev
+// is down.
+func (dev *ReplayDevice) SetIPv4(addr, netmask IPv4) error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		dev.addrs4.set(addr, netmask)
+		return nil
+	})
+}
+
+// UnsetIPv4 removes all of dev's IPv4 addresses, returning any error
+// encountered. UnsetIPv4 can only be called when dev is down.
+func (dev *ReplayDevice) UnsetIPv4() error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		dev.addrs4.unset()
+		return nil
+	})
+}
+
+// IPv4Addrs returns all of dev's IPv4 addresses, starting with the primary
+// address.
+func (dev *ReplayDevice) IPv4Addrs() []IPv4DeviceAddr {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	return dev.addrs4.list()
+}
+
+// AddIPv4 implements IPv4Device's AddIPv4.
+func (dev *ReplayDevice) AddIPv4(addr, netmask IPv4) error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		return dev.addrs4.add(addr, netmask)
+	})
+}
+
+// RemoveIPv4 implements IPv4Device's RemoveIPv4.
+func (dev *ReplayDevice) RemoveIPv4(addr IPv4) error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		return dev.addrs4.remove(addr)
+	})
+}
+
+// RegisterIPv4AddrCallback implements IPv4Device's RegisterIPv4AddrCallback.
+func (dev *ReplayDevice) RegisterIPv4AddrCallback(f func()) {
+	dev.sync.Lock()
+	dev.addrs4.callback = f
+	dev.sync.Unlock()
+}
+
+// JoinIPv4Group implements IPv4Device's JoinIPv4Group. Every injected
+// packet is delivered, so it is a no-op.
+func (dev *ReplayDevice) JoinIPv4Group(addr IPv4) error {
+	return errors.Annotate(checkIPv4Group(addr), "join IPv4 group")
+}
+
+// LeaveIPv4Group implements IPv4Device's LeaveIPv4Group.
+func (dev *ReplayDevice) LeaveIPv4Group(addr IPv4) error {
+	return errors.Annotate(checkIPv4Group(addr), "leave IPv4 group")
+}
+
+// IPv6 returns dev's primary IPv6 address and network mask if it has any
+// addresses.
+func (dev *ReplayDevice) IPv6() (addr, netmask IPv6, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addrs6.primary()
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv6 replaces dev's IPv6 addresses with the given address and network
+// mask, returning any error encountered. SetIPv6 can only be called when dev
+// is down.
+func (dev *ReplayDevice) SetIPv6(addr, netmask IPv6) error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		dev.addrs6.set(addr, netmask)
+		return nil
+	})
+}
+
+// UnsetIPv6 removes all of dev's IPv6 addresses, returning any error
+// encountered. UnsetIPv6 can only be called when dev is down.
+func (dev *ReplayDevice) UnsetIPv6() error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		dev.addrs6.unset()
+		return nil
+	})
+}
+
+// IPv6Addrs returns all of dev's IPv6 addresses, starting with the primary
+// address.
+func (dev *ReplayDevice) IPv6Addrs() []IPv6DeviceAddr {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	return dev.addrs6.list()
+}
+
+// AddIPv6 implements IPv6Device's AddIPv6.
+func (dev *ReplayDevice) AddIPv6(addr, netmask IPv6) error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		return dev.addrs6.add(addr, netmask)
+	})
+}
+
+// RemoveIPv6 implements IPv6Device's RemoveIPv6.
+func (dev *ReplayDevice) RemoveIPv6(addr IPv6) error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		return dev.addrs6.remove(addr)
+	})
+}
+
+// RegisterIPv6AddrCallback implements IPv6Device's RegisterIPv6AddrCallback.
+func (dev *ReplayDevice) RegisterIPv6AddrCallback(f func()) {
+	dev.sync.Lock()
+	dev.addrs6.callback = f
+	dev.sync.Unlock()
+}
+
+// JoinIPv6Group implements IPv6Device's JoinIPv6Group. Like
+// JoinIPv4Group, it is a no-op.
+func (dev *ReplayDevice) JoinIPv6Group(addr IPv6) error {
+	return errors.Annotate(checkIPv6Group(addr), "join IPv6 group")
+}
+
+// LeaveIPv6Group implements IPv6Device's LeaveIPv6Group.
+func (dev *ReplayDevice) LeaveIPv6Group(addr IPv6) error {
+	return errors.Annotate(checkIPv6Group(addr), "leave IPv6 group")
+}
+
+// RegisterIPv4Callback registers f to be called when IPv4 packets are injected.
+func (dev *ReplayDevice) RegisterIPv4Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback4 = f
+	dev.sync.Unlock()
+}
+
+// RegisterIPv6Callback registers f to be called when IPv6 packets are injected.
+func (dev *ReplayDevice) RegisterIPv6Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback6 = f
+	dev.sync.Unlock()
+}
+
+// WriteToIPv4 records the IPv4 packet b. dst is ignored.
+func (dev *ReplayDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.write(b)
+}
+
+// WriteToIPv6 records the IPv6 packet b. dst is ignored.
+func (dev *ReplayDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.write(b)
+}
+
+func (dev *ReplayDevice) write(b []byte) (n int, err error) {
+	if !dev.IsUp() {
+		return 0, errors.New("write to down device")
+	}
+	dev.record(b, false)
+	return len(b), nil
+}
+
+// A ReplayInterface is an EthernetInterface which injects Ethernet frames
+// read from a pcap or pcapng file, and records the frames written to it. It
+// is intended for testing the stack against captured traffic.
+//
+// Each time a ReplayInterface is brought up, it injects the frames from the
+// beginning of the capture, passing those which pass its MAC filter (see
+// EthernetInterface's RegisterCallback) to the registered callback, with
+// delays determined by the frames' timestamps and the ReplayInterface's
+// configuration. Frames written to the interface are not sent anywhere; they
+// are recorded, and can be retrieved using Sent.
+//
+// The zero ReplayInterface is not a valid ReplayInterface. ReplayInterfaces
+// are safe for concurrent access.
+type ReplayInterface struct {
+	mtu      int                                        // 0 if unset
+	callback func(b []byte, src, dst MAC, et EtherType) // unset if nil
+	macFilter
+	*replayer
+}
+
+var _ EthernetInterface = &ReplayInterface{} // make sure *ReplayInterface implements EthernetInterface
+
+// NewReplayInterface creates a new ReplayInterface which injects frames read
+// from r, which must contain a pcap or pcapng capture with the Ethernet link
+// type. The entire capture is read before NewReplayInterface returns. The
+// returned interface is down, and has no MAC or MTU set.
+func NewReplayInterface(r io.Reader, config ReplayConfig) (*ReplayInterface, error) {
+	rp, err := newReplayer(r, true, config)
+	if err != nil {
+		return nil, errors.Annotate(err, "create replay interface")
+	}
+	iface := &ReplayInterface{replayer: rp}
+	rp.inject = iface.inject
+	return iface, nil
+}
+
+func (iface *ReplayInterface) inject(p *CapturedPacket) {
+	eh, err := parseEthernetHeader(p.Data)
+	if err != nil {
+		// TODO(joshlf): Log it
+		return
+	}
+	iface.sync.RLock()
+	accept := iface.accepts(eh.dst)
+	callback := iface.callback
+	iface.sync.RUnlock()
+	if accept && callback != nil {
+		// see ReplayDevice.inject
+		callback(append([]byte(nil), p.Data[ethernetHeaderLen:]...), eh.src, eh.dst, eh.OuterEtherType())
+	}
+}
+
+// BringUp implements EthernetInterface's BringUp. Each time iface is
+// brought up, it starts injecting frames from the beginning of the capture.
+func (iface *ReplayInterface) BringUp() error {
+	return errors.Annotate(iface.bringUp(), "bring interface up")
+}
+
+// BringDown implements EthernetInterface's BringDown.
+func (iface *ReplayInterface) BringDown() error {
+	return errors.Annotate(iface.bringDown(), "bring interface down")
+}
+
+// IsUp implements EthernetInterface's IsUp.
+func (iface *ReplayInterface) IsUp() bool {
+	iface.sync.RLock()
+	up := iface.isUp()
+	iface.sync.RUnlock()
+	return up
+}
+
+// MAC implements EthernetInterface's MAC.
+func (iface *ReplayInterface) MAC() (ok bool, mac MAC) {
+	iface.sync.RLock()
+	ok, mac = iface.macSet, iface.mac
+	iface.sync.RUnlock()
+	return ok, mac
+}
+
+// SetMAC implements EthernetInterface's SetMAC.
+func (iface *ReplayInterface) SetMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MAC on up interface")
+	}
+	return iface.setMAC(mac)
+}
+
+// MTU implements EthernetInterface's MTU.
+func (iface *ReplayInterface) MTU() int {
+	iface.sync.RLock()
+	mtu := iface.mtu
+	iface.sync.RUnlock()
+	return mtu
+}
+
+// SetMTU implements EthernetInterface's SetMTU.
+func (iface *ReplayInterface) SetMTU(mtu uint64) error {
+	if mtu == 0 {
+		return errors.New("set interface MTU: zero MTU")
+	}
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MTU on up interface")
+	}
+	iface.mtu = int(mtu)
+	return nil
+}
+
+// RegisterCallback implements EthernetInterface's RegisterCallback.
+func (iface *ReplayInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.sync.Lock()
+	iface.callback = f
+	iface.sync.Unlock()
+}
+
+// AddMulticastMAC implements EthernetInterface's AddMulticastMAC.
+func (iface *ReplayInterface) AddMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	return iface.addMulticastMAC(mac)
+}
+
+// RemoveMulticastMAC implements EthernetInterface's RemoveMulticastMAC.
+func (iface *ReplayInterface) RemoveMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	iface.removeMulticastMAC(mac)
+	iface.sync.Unlock()
+	return nil
+}
+
+// WriteFrame implements EthernetInterface's WriteFrame.
+func (iface *ReplayInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	iface.sync.RLock()
+	src, ok := iface.mac, iface.macSet
+	iface.sync.RUnlock()
+	if !ok {
+		return 0, errors.New("write frame: interface has no MAC")
+	}
+	return iface.WriteFrameSrc(b, src, dst, et)
+}
+
+// WriteFrameSrc implements EthernetInterface's WriteFrameSrc. The frame is
+// recorded, and can be retrieved using Sent.
+func (iface *ReplayInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	if len(b) < ethernetHeaderLen {
+		return 0, errors.New("write frame: buffer too short for Ethernet header")
+	}
+	if !iface.IsUp() {
+		return 0, errors.New("write to down interface")
+	}
+	if mtu := iface.MTU(); mtu != 0 && len(b)-frameHeaderLen(et) > mtu {
+		return 0, errors.MTUf(mtu, "write frame: payload exceeds MTU")
+	}
+	writeEthernetHeader(ethernetHeader{src: src, dst: dst, et: et}, b)
+	iface.record(b, true)
+	return len(b), nil
+}
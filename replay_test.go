@@ -0,0 +1,315 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestReplayDevice(t *testing.T) {
+	for _, format := range []CaptureFormat{FormatPcap, FormatPcapNG} {
+		var buf bytes.Buffer
+		w, err := newPcapWriter(&buf, format, linkTypeRaw)
+		if err != nil {
+			t.Fatalf("unexpected error creating writer: %v", err)
+		}
+		var pkts [][]byte
+		start := time.Unix(1000, 999)
+		for i := 0; i < 3; i++ {
+			pkt := make([]byte, 21)
+			writeIPv4Header(&ipv4Header{version: 4, IHL: 5, len: 21, dst: IPv4{10, 0, 0, 1}}, pkt)
+			pkt[20] = byte(i)
+			pkts = append(pkts, pkt)
+			// the second packet is one that we sent
+			dir := DirectionInbound
+			if i == 1 {
+				dir = DirectionOutbound
+			}
+			w.WritePacket(start.Add(time.Duration(i)*100*time.Millisecond), dir, pkt)
+		}
+
+		read, err := readCapture(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("unexpected error reading capture: %v", err)
+		}
+		if len(read) != 3 {
+			t.Fatalf("got %v packets; want 3", len(read))
+		}
+		for i, p := range read {
+			if !p.Time.Equal(start.Add(time.Duration(i) * 100 * time.Millisecond)) {
+				t.Errorf("got time %v for packet %v", p.Time, i)
+			}
+			if !bytes.Equal(p.Data, pkts[i]) {
+				t.Errorf("got data %v for packet %v; want %v", p.Data, i, pkts[i])
+			}
+		}
+
+		// since the pcap format doesn't record
+		// direction, all packets are injected
+		dev, err := NewReplayDevice(bytes.NewReader(buf.Bytes()), ReplayConfig{Speedup: 10})
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		var got [][]byte
+		dev.RegisterIPv4Callback(func(b []byte) {
+			got = append(got, b)
+			dev.WriteToIPv4(b[20:], IPv4{})
+		})
+		begin := time.Now()
+		dev.BringUp()
+		<-dev.Done()
+		if d := time.Since(begin); d < 20*time.Millisecond {
+			t.Errorf("replay took %v; expected at least 20ms", d)
+		}
+		if format == FormatPcapNG && (len(got) != 2 || !bytes.Equal(got[0], pkts[0]) || !bytes.Equal(got[1], pkts[2])) {
+			t.Errorf("got packets %v; want %v", got, [][]byte{pkts[0], pkts[2]})
+		}
+		if format == FormatPcap && len(got) != 3 {
+			t.Errorf("got %v packets; want 3", len(got))
+		}
+		sent := dev.Sent()
+		if len(sent) != len(got) || sent[0].Direction != DirectionOutbound || !bytes.Equal(sent[0].Data, []byte{0}) {
+			t.Errorf("got sent packets %v", sent)
+		}
+		dev.BringDown()
+	}
+}
+
+func TestReplayInterface(t *testing.T) {
+	ourMAC, theirMAC, otherMAC := MAC{2, 0, 0, 0, 0, 1}, MAC{2, 0, 0, 0, 0, 2}, MAC{2, 0, 0, 0, 0, 3}
+	ourIP, theirIP := IPv4{10, 0, 0, 1}, IPv4{10, 0, 0, 2}
+	frame := func(src, dst MAC, et EtherType, payload []byte) []byte {
+		b := append(make([]byte, ethernetHeaderLen), payload...)
+		writeEthernetHeader(ethernetHeader{src: src, dst: dst, et: et}, b)
+		return b
+	}
+	req := make([]byte, arpHeaderLen)
+	writeARPHeader(&arpHeader{HTYPE: arpHTYPEEthernet, PTYPE: uint16(EtherTypeIPv4), HLEN: 6, PLEN: 4,
+		OPER: arpOperRequest, SHA: theirMAC, SPA: theirIP, TPA: ourIP}, req)
+	pkt := make([]byte, 21)
+	writeIPv4Header(&ipv4Header{version: 4, IHL: 5, len: 21, TTL: 64, proto: IPProtocolUDP, src: theirIP, dst: ourIP}, pkt)
+	setIPv4Checksum(pkt)
+
+	// an ARP request for our address, a packet to another host, which is
+	// filtered out, a packet to us, and a packet which was sent, which
+	// isn't injected
+	start := time.Unix(1000, 0)
+	capture := func(gap time.Duration) []byte {
+		var buf bytes.Buffer
+		w, err := newPcapWriter(&buf, FormatPcapNG, linkTypeEthernet)
+		if err != nil {
+			t.Fatalf("unexpected error creating writer: %v", err)
+		}
+		w.WritePacket(start, DirectionInbound, frame(theirMAC, BroadcastMAC, EtherTypeARP, req))
+		w.WritePacket(start.Add(gap), DirectionInbound, frame(theirMAC, otherMAC, EtherTypeIPv4, pkt))
+		w.WritePacket(start.Add(2*gap), DirectionInbound, frame(theirMAC, ourMAC, EtherTypeIPv4, pkt))
+		w.WritePacket(start.Add(3*gap), DirectionOutbound, frame(ourMAC, theirMAC, EtherTypeIPv4, pkt))
+		return buf.Bytes()
+	}
+
+	// captures must have the right link type
+	if _, err := NewReplayDevice(bytes.NewReader(capture(0)), ReplayConfig{}); err == nil {
+		t.Errorf("expected error creating replay device from Ethernet capture")
+	}
+	var raw bytes.Buffer
+	w, err := newPcapWriter(&raw, FormatPcap, linkTypeRaw)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	w.WritePacket(start, DirectionInbound, pkt)
+	if _, err := NewReplayInterface(bytes.NewReader(raw.Bytes()), ReplayConfig{}); err == nil {
+		t.Errorf("expected error creating replay interface from raw IP capture")
+	}
+
+	for _, c := range []struct {
+		gap    time.Duration
+		config ReplayConfig
+		min    time.Duration // the minimum duration of a replay
+	}{
+		// the outbound packet is dropped when the capture is read, so the
+		// last packet is injected after two gaps
+		{10 * time.Millisecond, ReplayConfig{Speedup: 0.5}, 40 * time.Millisecond},
+		{10 * time.Millisecond, ReplayConfig{Speedup: 2}, 10 * time.Millisecond},
+		{time.Hour, ReplayConfig{NoDelay: true}, 0},
+	} {
+		iface, err := NewReplayInterface(bytes.NewReader(capture(c.gap)), c.config)
+		if err != nil {
+			t.Fatalf("unexpected error creating interface: %v", err)
+		}
+		dev, err := NewEthernetDevice(iface, ourMAC)
+		if err != nil {
+			t.Fatalf("unexpected error creating device: %v", err)
+		}
+		dev.SetIPv4(ourIP, IPv4{255, 255, 255, 0})
+		var got [][]byte
+		dev.RegisterIPv4Callback(func(b []byte) { got = append(got, b) })
+
+		// each time the interface is brought up, the replay restarts
+		for i := 1; i <= 2; i++ {
+			begin := time.Now()
+			if err := dev.BringUp(); err != nil {
+				t.Fatalf("unexpected error bringing device up: %v", err)
+			}
+			select {
+			case <-iface.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for replay with %+v", c.config)
+			}
+			if d := time.Since(begin); d < c.min || c.config.NoDelay && d > time.Second {
+				t.Errorf("replay with %+v took %v; expected at least %v", c.config, d, c.min)
+			}
+			if err := dev.BringDown(); err != nil {
+				t.Fatalf("unexpected error bringing device down: %v", err)
+			}
+			if len(got) != i {
+				t.Fatalf("got %v packets after %v replays with %+v; want %v", len(got), i, c.config, i)
+			}
+			if !bytes.Equal(got[i-1], pkt) {
+				t.Errorf("got packet %v; want %v", got[i-1], pkt)
+			}
+		}
+
+		// the device answered the ARP request in each replay
+		sent := iface.Sent()
+		if len(sent) != 2 {
+			t.Fatalf("got %v sent frames with %+v; want 2 ARP replies", len(sent), c.config)
+		}
+		for _, p := range sent {
+			eh, err := parseEthernetHeader(p.Data)
+			if err != nil {
+				t.Fatalf("unexpected error parsing sent frame: %v", err)
+			}
+			reply, err := parseARPHeader(p.Data[ethernetHeaderLen:])
+			if err != nil || p.Direction != DirectionOutbound || !p.Ethernet ||
+				eh.src != ourMAC || eh.dst != theirMAC || eh.et != EtherTypeARP {
+				t.Fatalf("got sent frame %+v; want ARP reply from %v to %v", p, ourMAC, theirMAC)
+			}
+			if reply.OPER != arpOperReply || reply.SHA != ourMAC || reply.SPA != ourIP || reply.TPA != theirIP {
+				t.Errorf("got ARP reply %+v", reply)
+			}
+		}
+	}
+}
+
+func TestReplayForwarding(t *testing.T) {
+	// the host forwards injected packets back out of the device, which
+	// modifies them in place; each replay must inject the same packets
+	var buf bytes.Buffer
+	w, err := newPcapWriter(&buf, FormatPcap, linkTypeRaw)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	pkt := make([]byte, 21)
+	writeIPv4Header(&ipv4Header{version: 4, IHL: 5, len: 21, TTL: 64, proto: IPProtocolUDP,
+		src: IPv4{10, 0, 0, 2}, dst: IPv4{10, 0, 1, 5}}, pkt)
+	setIPv4Checksum(pkt)
+	w.WritePacket(time.Unix(1000, 0), DirectionInbound, pkt)
+
+	dev, err := NewReplayDevice(bytes.NewReader(buf.Bytes()), ReplayConfig{NoDelay: true})
+	if err != nil {
+		t.Fatalf("unexpected error creating device: %v", err)
+	}
+	dev.SetIPv4(IPv4{10, 0, 0, 1}, IPv4{255, 255, 255, 0})
+	host := NewIPv4Host()
+	host.SetForwarding(true)
+	host.AddIPv4Device(dev)
+	host.AddIPv4DeviceRoute(IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: IPv4{255, 255, 255, 0}}, dev)
+	host.AddIPv4Route(IPv4Subnet{Addr: IPv4{10, 0, 1, 0}, Netmask: IPv4{255, 255, 255, 0}}, IPv4{10, 0, 0, 3})
+
+	const replays = 3
+	for i := 0; i < replays; i++ {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		<-dev.Done()
+		if err := dev.BringDown(); err != nil {
+			t.Fatalf("unexpected error bringing device down: %v", err)
+		}
+	}
+	sent := dev.Sent()
+	if len(sent) != replays {
+		t.Fatalf("got %v forwarded packets; want %v", len(sent), replays)
+	}
+	for i, p := range sent {
+		var hdr ipv4Header
+		readIPv4Header(&hdr, p.Data)
+		if hdr.TTL != 63 || !bytes.Equal(p.Data, sent[0].Data) {
+			t.Errorf("got packet %v with TTL %v from replay %v; want TTL 63, identical to the first", p.Data, hdr.TTL, i)
+		}
+	}
+}
+
+func TestReadPcapNG(t *testing.T) {
+	le := binary.LittleEndian
+	// capture returns a pcapng file with an interface whose if_tsresol
+	// option is resol and the blocks blocks
+	capture := func(resol byte, blocks ...[]byte) []byte {
+		var buf bytes.Buffer
+		if _, err := newPcapWriter(&buf, FormatPcapNG, linkTypeRaw); err != nil {
+			t.Fatalf("unexpected error creating writer: %v", err)
+		}
+		b := buf.Bytes()
+		b[28+20] = resol
+		for _, block := range blocks {
+			b = append(b, block...)
+		}
+		return b
+	}
+	block := func(typ uint32, body []byte) []byte {
+		b := make([]byte, 8+len(body)+4)
+		le.PutUint32(b, typ)
+		le.PutUint32(b[4:], uint32(len(b)))
+		copy(b[8:], body)
+		le.PutUint32(b[len(b)-4:], uint32(len(b)))
+		return b
+	}
+	epb := func(ts uint64) []byte {
+		body := make([]byte, 24)
+		le.PutUint32(body[4:], uint32(ts>>32))
+		le.PutUint32(body[8:], uint32(ts))
+		le.PutUint32(body[12:], 1)
+		le.PutUint32(body[16:], 1)
+		return block(pcapngEPB, body)
+	}
+
+	for _, c := range []struct {
+		resol byte
+		ts    uint64
+		want  time.Time
+	}{
+		{6, 1500*1e6 + 7, time.Unix(1500, 7000)},
+		{12, 1500*1e12 + 123456789012, time.Unix(1500, 123456789)},
+		{19, 1e19 - 1, time.Unix(0, 999999999)},
+		{0x80 | 40, 3<<40 + 1<<39, time.Unix(3, 5e8)},
+		{0x80 | 63, 1<<63 + 1<<62, time.Unix(1, 5e8)},
+	} {
+		pkts, err := readCapture(bytes.NewReader(capture(c.resol, epb(c.ts))))
+		if err != nil {
+			t.Errorf("unexpected error reading capture with resolution %#x: %v", c.resol, err)
+			continue
+		}
+		if len(pkts) != 1 || !pkts[0].Time.Equal(c.want) {
+			t.Errorf("got packets %v with resolution %#x; want 1 at %v", pkts, c.resol, c.want)
+		}
+	}
+
+	truncOpt := make([]byte, 28)
+	le.PutUint32(truncOpt[12:], 4)
+	le.PutUint32(truncOpt[16:], 4)
+	le.PutUint16(truncOpt[24:], pcapngOptEPBFlags)
+	le.PutUint16(truncOpt[26:], 4)
+	for name, b := range map[string][]byte{
+		"resolution 2^-64":  capture(0x80|64, epb(1)),
+		"resolution 10^-20": capture(20, epb(1)),
+		"short EPB":         capture(pcapngTSResolNanos, block(pcapngEPB, make([]byte, 16))),
+		"EPB data too long": capture(pcapngTSResolNanos, block(pcapngEPB, append(make([]byte, 12), 8, 0, 0, 0, 8, 0, 0, 0))),
+		"short IDB":         append(capture(pcapngTSResolNanos), block(pcapngIDB, make([]byte, 4))...),
+		"truncated option":  capture(pcapngTSResolNanos, block(pcapngEPB, truncOpt)),
+		"truncated block":   capture(pcapngTSResolNanos, epb(1)[:24]),
+	} {
+		if _, err := readCapture(bytes.NewReader(b)); err == nil {
+			t.Errorf("%v: expected error", name)
+		}
+	}
+}
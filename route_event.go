@@ -0,0 +1,183 @@
+package net
+
+import "sync"
+
+// A RouteEventType is the kind of change described by a route event.
+type RouteEventType uint8
+
+const (
+	RouteAdded RouteEventType = iota
+	RouteDeleted
+	// RouteChanged means that a route was replaced by one with the same
+	// identity (for device routes, the same subnet; for other routes, the
+	// same subnet, source, and next hop) but other attributes, such as its
+	// metric or device.
+	RouteChanged
+)
+
+func (t RouteEventType) String() string {
+	switch t {
+	case RouteAdded:
+		return "added"
+	case RouteDeleted:
+		return "deleted"
+	case RouteChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// An IPv4RouteEvent describes a change to a routing table. Exactly one of
+// Route and DeviceRoute is non-nil, unless the event only reports that events
+// were lost (see Lost). For RouteDeleted events, it is the route which was
+// deleted, and otherwise, it is the new route. Route's Selected
+// field is never set, since a change to one route can change which others
+// are selected; use IPv4Routes to find out which routes are selected.
+type IPv4RouteEvent struct {
+	Type        RouteEventType
+	Route       *IPv4Route
+	DeviceRoute *IPv4DeviceRoute
+
+	// Lost is set if events before this one were dropped because the
+	// channel was full, in which case the table should be read again. When
+	// only one slot in the channel remains, an event with Lost set and no
+	// route is sent in place of the next event, so that events which are
+	// dropped after it are always reported.
+	Lost bool
+}
+
+// An IPv6RouteEvent is like an IPv4RouteEvent, but for IPv6.
+type IPv6RouteEvent struct {
+	Type        RouteEventType
+	Route       *IPv6Route
+	DeviceRoute *IPv6DeviceRoute
+	Lost        bool
+}
+
+// withDefaults returns route with its default distance filled
+// in, and with Selected cleared, as it is stored in tables.
+func (route IPv4Route) withDefaults() IPv4Route {
+	if route.Distance == 0 {
+		route.Distance = route.Source.Distance()
+	}
+	route.Selected = false
+	return route
+}
+
+func (route IPv6Route) withDefaults() IPv6Route {
+	if route.Distance == 0 {
+		route.Distance = route.Source.Distance()
+	}
+	route.Selected = false
+	return route
+}
+
+// diffIPv4Routes returns the events which describe the change
+// from old to new, which are the routes for a single subnet.
+func diffIPv4Routes(old, new []IPv4Route) []IPv4RouteEvent {
+	find := func(routes []IPv4Route, route IPv4Route) (IPv4Route, bool) {
+		for _, r := range routes {
+			if r.Source == route.Source && r.Nexthop == route.Nexthop {
+				return r, true
+			}
+		}
+		return IPv4Route{}, false
+	}
+	var events []IPv4RouteEvent
+	for _, r := range old {
+		if _, ok := find(new, r); !ok {
+			// copy r so that watchers can't modify the table
+			r := r
+			events = append(events, IPv4RouteEvent{Type: RouteDeleted, Route: &r})
+		}
+	}
+	for _, r := range new {
+		r := r
+		switch o, ok := find(old, r); {
+		case !ok:
+			events = append(events, IPv4RouteEvent{Type: RouteAdded, Route: &r})
+		case o != r:
+			events = append(events, IPv4RouteEvent{Type: RouteChanged, Route: &r})
+		}
+	}
+	return events
+}
+
+func diffIPv6Routes(old, new []IPv6Route) []IPv6RouteEvent {
+	find := func(routes []IPv6Route, route IPv6Route) (IPv6Route, bool) {
+		for _, r := range routes {
+			if r.Source == route.Source && r.Nexthop == route.Nexthop {
+				return r, true
+			}
+		}
+		return IPv6Route{}, false
+	}
+	var events []IPv6RouteEvent
+	for _, r := range old {
+		if _, ok := find(new, r); !ok {
+			r := r
+			events = append(events, IPv6RouteEvent{Type: RouteDeleted, Route: &r})
+		}
+	}
+	for _, r := range new {
+		r := r
+		switch o, ok := find(old, r); {
+		case !ok:
+			events = append(events, IPv6RouteEvent{Type: RouteAdded, Route: &r})
+		case o != r:
+			events = append(events, IPv6RouteEvent{Type: RouteChanged, Route: &r})
+		}
+	}
+	return events
+}
+
+// an ipv4RouteWatcher is a channel passed to WatchIPv4Routes. The same
+// watcher is registered with each of a host's routing tables.
+type ipv4RouteWatcher struct {
+	c    chan<- IPv4RouteEvent
+	lost bool // whether events have been dropped since the last send
+
+	mu sync.Mutex
+}
+
+// send sends e on w.c without blocking. The last slot in w.c is reserved for
+// an event which only reports that events were lost: since nothing is sent
+// once w.c is full, an event which is dropped is always followed in w.c by
+// such an event, or by one which is sent later with Lost set. Channels with a
+// capacity of less than 2 have no slot to reserve.
+func (w *ipv4RouteWatcher) send(e IPv4RouteEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cap(w.c) >= 2 && len(w.c) >= cap(w.c)-1 {
+		e, w.lost = IPv4RouteEvent{}, true
+	}
+	e.Lost = w.lost
+	select {
+	case w.c <- e:
+		w.lost = false
+	default:
+		w.lost = true
+	}
+}
+
+type ipv6RouteWatcher struct {
+	c    chan<- IPv6RouteEvent
+	lost bool
+
+	mu sync.Mutex
+}
+
+func (w *ipv6RouteWatcher) send(e IPv6RouteEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cap(w.c) >= 2 && len(w.c) >= cap(w.c)-1 {
+		e, w.lost = IPv6RouteEvent{}, true
+	}
+	e.Lost = w.lost
+	select {
+	case w.c <- e:
+		w.lost = false
+	default:
+		w.lost = true
+	}
+}
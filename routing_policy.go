@@ -0,0 +1,435 @@
+package net
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// An IPv4Rule selects a routing table for the packets which match it, like
+// the rules configured with Linux's "ip rule". When routing a packet, the
+// rules are tried in order of priority; the first rule which matches the
+// packet and whose table has a route to the packet's destination determines
+// its route. If there is no such rule, the main table is used.
+type IPv4Rule struct {
+	// Priority orders rules; rules with lower priorities are tried first,
+	// and rules with equal priorities in the order in which they were
+	// added.
+	Priority uint32
+
+	// The following fields select packets. The zero value of each
+	// matches all packets.
+
+	// Source matches packets whose source addresses are in the subnet.
+	// Locally originated packets only have source addresses for this
+	// purpose if they are written with WriteToIPv4From.
+	Source IPv4Subnet
+	// InDevice matches packets received from the device, and
+	// never matches locally originated packets.
+	InDevice IPv4Device
+	// DSCP matches packets with the Differentiated Services Code Point.
+	DSCP uint8
+	// Proto matches packets with the protocol.
+	Proto IPProtocol
+	// Mark and MarkMask match packets whose marks (see SetIPv4Marker),
+	// masked with MarkMask, equal Mark. If Mark is nonzero and MarkMask is
+	// zero, the whole mark is compared.
+	Mark, MarkMask uint32
+
+	// Table is the name of the table to use for matching
+	// packets. The empty string is the main table.
+	Table string
+}
+
+// An IPv6Rule is like an IPv4Rule, but for IPv6. Proto matches the
+// upper-layer protocol, after any extension headers, and DSCP matches
+// the upper six bits of the traffic class.
+type IPv6Rule struct {
+	Priority       uint32
+	Source         IPv6Subnet
+	InDevice       IPv6Device
+	DSCP           uint8
+	Proto          IPProtocol
+	Mark, MarkMask uint32
+	Table          string
+}
+
+// an ipv4Flow holds the fields of a packet which rules match, and its
+// flow hash (see ipv4FlowHash)
+type ipv4Flow struct {
+	src    IPv4
+	hasSrc bool       // false for locally originated packets with no source address yet
+	in     IPv4Device // nil for locally originated packets
+	dscp   uint8
+	proto  IPProtocol
+	mark   uint32
+	hash   uint32
+}
+
+func (r *IPv4Rule) matches(f *ipv4Flow) bool {
+	mask := r.MarkMask
+	if mask == 0 && r.Mark != 0 {
+		mask = ^uint32(0)
+	}
+	switch {
+	case r.Source.Netmask != (IPv4{}) && (!f.hasSrc || !r.Source.Has(f.src)):
+		return false
+	case r.InDevice != nil && r.InDevice != f.in:
+		return false
+	case r.DSCP != 0 && r.DSCP != f.dscp:
+		return false
+	case r.Proto != 0 && r.Proto != f.proto:
+		return false
+	}
+	return f.mark&mask == r.Mark
+}
+
+type ipv6Flow struct {
+	src    IPv6
+	hasSrc bool
+	in     IPv6Device
+	dscp   uint8
+	proto  IPProtocol
+	mark   uint32
+	hash   uint32
+}
+
+func (r *IPv6Rule) matches(f *ipv6Flow) bool {
+	mask := r.MarkMask
+	if mask == 0 && r.Mark != 0 {
+		mask = ^uint32(0)
+	}
+	switch {
+	case r.Source.Netmask != (IPv6{}) && (!f.hasSrc || !r.Source.Has(f.src)):
+		return false
+	case r.InDevice != nil && r.InDevice != f.in:
+		return false
+	case r.DSCP != 0 && r.DSCP != f.dscp:
+		return false
+	case r.Proto != 0 && r.Proto != f.proto:
+		return false
+	}
+	return f.mark&mask == r.Mark
+}
+
+// ipv4RoutingPolicy holds a host's routing tables and the rules which
+// select among them. Like the tables themselves, it never blocks readers.
+//
+// NOTE(joshlf): Tables are created when routes are first added to them, and
+// are never removed, even if they become empty, so that watchers and rules
+// never refer to tables which have been replaced.
+type ipv4RoutingPolicy struct {
+	main ipv4RoutingTable
+	// the current *ipv4PolicyState, which must not be modified
+	state    atomic.Value
+	mu       sync.Mutex                 // held by writers
+	watchers map[*ipv4RouteWatcher]bool // guarded by mu
+}
+
+type ipv4PolicyState struct {
+	rules  []IPv4Rule                   // in the order in which they are tried
+	tables map[string]*ipv4RoutingTable // excluding the main table
+}
+
+func (p *ipv4RoutingPolicy) load() ipv4PolicyState {
+	s, _ := p.state.Load().(*ipv4PolicyState)
+	if s == nil {
+		return ipv4PolicyState{}
+	}
+	return *s
+}
+
+// table returns the table with the given name, or nil if there is none.
+func (p *ipv4RoutingPolicy) table(name string) *ipv4RoutingTable {
+	if name == "" {
+		return &p.main
+	}
+	return p.load().tables[name]
+}
+
+// tableForUpdate is like table, but creates the table if it doesn't exist.
+func (p *ipv4RoutingPolicy) tableForUpdate(name string) *ipv4RoutingTable {
+	if rt := p.table(name); rt != nil {
+		return rt
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.load()
+	if rt := s.tables[name]; rt != nil {
+		// created since we checked
+		return rt
+	}
+	rt := &ipv4RoutingTable{name: name, main: &p.main}
+	for w := range p.watchers {
+		rt.watch(w)
+	}
+	tables := map[string]*ipv4RoutingTable{name: rt}
+	for name, rt := range s.tables {
+		tables[name] = rt
+	}
+	p.state.Store(&ipv4PolicyState{rules: s.rules, tables: tables})
+	return rt
+}
+
+// Lookup returns the next hop for packets to addr in the flow f, and the
+// device through which it is reached.
+func (p *ipv4RoutingPolicy) Lookup(addr IPv4, f *ipv4Flow) (nexthop IPv4, dev IPv4Device, ok bool) {
+	s := p.load()
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.matches(f) {
+			continue
+		}
+		rt := &p.main
+		if r.Table != "" {
+			rt = s.tables[r.Table]
+		}
+		if rt == nil {
+			continue
+		}
+		if nexthop, dev, ok = rt.Lookup(addr, f.hash); ok {
+			return nexthop, dev, true
+		}
+	}
+	return p.main.Lookup(addr, f.hash)
+}
+
+func (p *ipv4RoutingPolicy) AddRule(rule IPv4Rule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.load()
+	i := sort.Search(len(s.rules), func(i int) bool { return s.rules[i].Priority > rule.Priority })
+	rules := make([]IPv4Rule, 0, len(s.rules)+1)
+	rules = append(append(append(rules, s.rules[:i]...), rule), s.rules[i:]...)
+	p.state.Store(&ipv4PolicyState{rules: rules, tables: s.tables})
+}
+
+// DeleteRule deletes the first rule which is equal to
+// rule, returning false if there is no such rule.
+func (p *ipv4RoutingPolicy) DeleteRule(rule IPv4Rule) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.load()
+	for i, r := range s.rules {
+		if r == rule {
+			rules := append(append([]IPv4Rule(nil), s.rules[:i]...), s.rules[i+1:]...)
+			p.state.Store(&ipv4PolicyState{rules: rules, tables: s.tables})
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ipv4RoutingPolicy) Rules() []IPv4Rule {
+	return append([]IPv4Rule(nil), p.load().rules...)
+}
+
+// tables returns all of the tables, starting
+// with the main table and then sorted by name.
+func (p *ipv4RoutingPolicy) tables() []*ipv4RoutingTable {
+	s := p.load()
+	var names []string
+	for name := range s.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tables := []*ipv4RoutingTable{&p.main}
+	for _, name := range names {
+		tables = append(tables, s.tables[name])
+	}
+	return tables
+}
+
+// Routes returns the routes in all of the tables, sorted by
+// table (see tables) and then as by ipv4RoutingTable.Routes.
+func (p *ipv4RoutingPolicy) Routes() []IPv4Route {
+	var routes []IPv4Route
+	for _, rt := range p.tables() {
+		routes = append(routes, rt.Routes()...)
+	}
+	return routes
+}
+
+func (p *ipv4RoutingPolicy) DeviceRoutes() []IPv4DeviceRoute {
+	var routes []IPv4DeviceRoute
+	for _, rt := range p.tables() {
+		routes = append(routes, rt.DeviceRoutes()...)
+	}
+	return routes
+}
+
+// Watch arranges for events describing subsequent changes to any of the
+// tables to be sent on c until stop is called. Sends on c never block; if c
+// is full, events are dropped, and the next event which is sent has Lost set
+// (see ipv4RouteWatcher.send).
+func (p *ipv4RoutingPolicy) Watch(c chan<- IPv4RouteEvent) (stop func()) {
+	w := &ipv4RouteWatcher{c: c}
+	p.mu.Lock()
+	if p.watchers == nil {
+		p.watchers = make(map[*ipv4RouteWatcher]bool)
+	}
+	p.watchers[w] = true
+	for _, rt := range p.tables() {
+		rt.watch(w)
+	}
+	p.mu.Unlock()
+	return func() {
+		p.mu.Lock()
+		delete(p.watchers, w)
+		for _, rt := range p.tables() {
+			rt.unwatch(w)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// ipv6RoutingPolicy is like ipv4RoutingPolicy, but for IPv6.
+type ipv6RoutingPolicy struct {
+	main     ipv6RoutingTable
+	state    atomic.Value
+	mu       sync.Mutex                 // held by writers
+	watchers map[*ipv6RouteWatcher]bool // guarded by mu
+}
+
+type ipv6PolicyState struct {
+	rules  []IPv6Rule                   // in the order in which they are tried
+	tables map[string]*ipv6RoutingTable // excluding the main table
+}
+
+func (p *ipv6RoutingPolicy) load() ipv6PolicyState {
+	s, _ := p.state.Load().(*ipv6PolicyState)
+	if s == nil {
+		return ipv6PolicyState{}
+	}
+	return *s
+}
+
+func (p *ipv6RoutingPolicy) table(name string) *ipv6RoutingTable {
+	if name == "" {
+		return &p.main
+	}
+	return p.load().tables[name]
+}
+
+func (p *ipv6RoutingPolicy) tableForUpdate(name string) *ipv6RoutingTable {
+	if rt := p.table(name); rt != nil {
+		return rt
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.load()
+	if rt := s.tables[name]; rt != nil {
+		// created since we checked
+		return rt
+	}
+	rt := &ipv6RoutingTable{name: name, main: &p.main}
+	for w := range p.watchers {
+		rt.watch(w)
+	}
+	tables := map[string]*ipv6RoutingTable{name: rt}
+	for name, rt := range s.tables {
+		tables[name] = rt
+	}
+	p.state.Store(&ipv6PolicyState{rules: s.rules, tables: tables})
+	return rt
+}
+
+func (p *ipv6RoutingPolicy) Lookup(addr IPv6, f *ipv6Flow) (nexthop IPv6, dev IPv6Device, ok bool) {
+	s := p.load()
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.matches(f) {
+			continue
+		}
+		rt := &p.main
+		if r.Table != "" {
+			rt = s.tables[r.Table]
+		}
+		if rt == nil {
+			continue
+		}
+		if nexthop, dev, ok = rt.Lookup(addr, f.hash); ok {
+			return nexthop, dev, true
+		}
+	}
+	return p.main.Lookup(addr, f.hash)
+}
+
+func (p *ipv6RoutingPolicy) AddRule(rule IPv6Rule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.load()
+	i := sort.Search(len(s.rules), func(i int) bool { return s.rules[i].Priority > rule.Priority })
+	rules := make([]IPv6Rule, 0, len(s.rules)+1)
+	rules = append(append(append(rules, s.rules[:i]...), rule), s.rules[i:]...)
+	p.state.Store(&ipv6PolicyState{rules: rules, tables: s.tables})
+}
+
+func (p *ipv6RoutingPolicy) DeleteRule(rule IPv6Rule) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.load()
+	for i, r := range s.rules {
+		if r == rule {
+			rules := append(append([]IPv6Rule(nil), s.rules[:i]...), s.rules[i+1:]...)
+			p.state.Store(&ipv6PolicyState{rules: rules, tables: s.tables})
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ipv6RoutingPolicy) Rules() []IPv6Rule {
+	return append([]IPv6Rule(nil), p.load().rules...)
+}
+
+func (p *ipv6RoutingPolicy) tables() []*ipv6RoutingTable {
+	s := p.load()
+	var names []string
+	for name := range s.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tables := []*ipv6RoutingTable{&p.main}
+	for _, name := range names {
+		tables = append(tables, s.tables[name])
+	}
+	return tables
+}
+
+func (p *ipv6RoutingPolicy) Routes() []IPv6Route {
+	var routes []IPv6Route
+	for _, rt := range p.tables() {
+		routes = append(routes, rt.Routes()...)
+	}
+	return routes
+}
+
+func (p *ipv6RoutingPolicy) DeviceRoutes() []IPv6DeviceRoute {
+	var routes []IPv6DeviceRoute
+	for _, rt := range p.tables() {
+		routes = append(routes, rt.DeviceRoutes()...)
+	}
+	return routes
+}
+
+func (p *ipv6RoutingPolicy) Watch(c chan<- IPv6RouteEvent) (stop func()) {
+	w := &ipv6RouteWatcher{c: c}
+	p.mu.Lock()
+	if p.watchers == nil {
+		p.watchers = make(map[*ipv6RouteWatcher]bool)
+	}
+	p.watchers[w] = true
+	for _, rt := range p.tables() {
+		rt.watch(w)
+	}
+	p.mu.Unlock()
+	return func() {
+		p.mu.Lock()
+		delete(p.watchers, w)
+		for _, rt := range p.tables() {
+			rt.unwatch(w)
+		}
+		p.mu.Unlock()
+	}
+}
@@ -1,242 +1,604 @@
 package net
 
-import "sync"
-
-// TODO(joshlf): Eventually specialize separate IPv4 and IPv6 versions
-// for performance (get rid of interface and type assertion overhead)
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A RouteSource identifies what added a route, such as a routing protocol.
+type RouteSource uint8
+
+const (
+	RouteSourceStatic RouteSource = iota
+	RouteSourceRIP
+	RouteSourceOSPF
+	RouteSourceBGP
+)
+
+// Distance returns the default administrative distance of routes from s.
+// The defaults are those used by most routers.
+func (s RouteSource) Distance() uint8 {
+	switch s {
+	case RouteSourceStatic:
+		return 1
+	case RouteSourceRIP:
+		return 120
+	case RouteSourceOSPF:
+		return 110
+	case RouteSourceBGP:
+		return 20
+	}
+	return 255
+}
 
-// TODO(joshlf): What about subnet refinement? We assume each IP is only in
-// a single subnet, but we also allow multiple subnets that are "unequal"
-// because one is a subset of the other.
+func (s RouteSource) String() string {
+	switch s {
+	case RouteSourceStatic:
+		return "static"
+	case RouteSourceRIP:
+		return "rip"
+	case RouteSourceOSPF:
+		return "ospf"
+	case RouteSourceBGP:
+		return "bgp"
+	}
+	return "unknown"
+}
 
+// An IPv4Route is a route to an IPv4 subnet. A subnet may have any number of
+// routes, which are identified by their sources and next hops. Of the routes
+// whose next hops are directly reachable, those with the lowest distance and,
+// among those, the lowest metric are used; if there are several, packets are
+// spread among them by hashing the fields which identify their flows (see
+// ipv4FlowHash and ipv6FlowHash), so that the packets of a flow all take the
+// same path.
 type IPv4Route struct {
 	Subnet  IPv4Subnet
 	Nexthop IPv4
+	Source  RouteSource
+	// Distance is the route's administrative distance. Routes with lower
+	// distances are preferred regardless of metric. If it is 0 when the
+	// route is added, Source.Distance() is used.
+	Distance uint8
+	// Metric is the route's cost; among routes with the same distance,
+	// those with lower metrics are preferred.
+	Metric uint32
+	// Selected is set in routes returned by IPv4Routes if the route is
+	// currently used to forward packets. It is ignored when adding routes.
+	Selected bool
+	// Table is the name of the routing table which holds the route (see
+	// IPv4Rule). The empty string is the main table.
+	Table string
 }
 
 type IPv4DeviceRoute struct {
 	Subnet IPv4Subnet
 	Device IPv4Device
+	Table  string
 }
 
+// An IPv6Route is like an IPv4Route, but for IPv6.
 type IPv6Route struct {
-	Subnet  IPv6Subnet
-	Nexthop IPv6
+	Subnet   IPv6Subnet
+	Nexthop  IPv6
+	Source   RouteSource
+	Distance uint8
+	Metric   uint32
+	Selected bool
+	Table    string
 }
 
 type IPv6DeviceRoute struct {
 	Subnet IPv6Subnet
 	Device IPv6Device
+	Table  string
 }
 
-type ipv4RoutingTable struct {
-	rt routingTable
+// NOTE(joshlf): The routing tables perform longest-prefix matching over
+// routes and device routes together. If a route and a device route have the
+// same subnet, the device route is preferred. Routes none of whose next hops
+// are reachable are skipped, so that shorter prefixes (such as the default
+// route) still cover their addresses. Netmasks are assumed to be contiguous;
+// any bits after the first zero bit in a netmask are ignored.
+
+// ipv4RouteLess returns true if a is preferred to b. Routes of equal cost
+// are ordered by next hop so that the choice among them is deterministic.
+func ipv4RouteLess(a, b *IPv4Route) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	if a.Metric != b.Metric {
+		return a.Metric < b.Metric
+	}
+	return bytes.Compare(a.Nexthop[:], b.Nexthop[:]) < 0
 }
 
-func (rt *ipv4RoutingTable) AddRoute(subnet IPv4Subnet, nexthop IPv4) {
-	rt.rt.AddRoute(subnet, nexthop)
+// withIPv4Route returns a sorted copy of routes with route in place of any
+// route with the same source and next hop. If add is false, that route is
+// only removed. routes itself may be shared with other versions of the trie,
+// so it is never modified.
+func withIPv4Route(routes []IPv4Route, route IPv4Route, add bool) []IPv4Route {
+	var out []IPv4Route
+	for _, r := range routes {
+		if r.Source != route.Source || r.Nexthop != route.Nexthop {
+			out = append(out, r)
+		}
+	}
+	if add {
+		i := sort.Search(len(out), func(i int) bool { return ipv4RouteLess(&route, &out[i]) })
+		out = append(out, IPv4Route{})
+		copy(out[i+1:], out[i:])
+		out[i] = route
+	}
+	return out
 }
 
-func (rt *ipv4RoutingTable) DeleteRoute(subnet IPv4Subnet) {
-	rt.rt.DeleteRoute(subnet)
+// an ipv4Path is a route, and the device through which its next hop is reached
+type ipv4Path struct {
+	route *IPv4Route
+	dev   IPv4Device
 }
 
-func (rt *ipv4RoutingTable) AddDeviceRoute(subnet IPv4Subnet, dev IPv4Device) {
-	rt.rt.AddDeviceRoute(subnet, dev)
+// selected appends to paths those of n's routes which are currently used to
+// forward packets. If n has a device route, none of them are. Next hops which
+// aren't covered by t's device routes are looked up in main.
+func (t ipv4Trie) selected(n *ipv4TrieNode, main ipv4Trie, paths []ipv4Path) []ipv4Path {
+	if n.devRoute != nil {
+		return paths
+	}
+	var best *IPv4Route
+	for i := range n.routes {
+		r := &n.routes[i]
+		if best != nil && (r.Distance != best.Distance || r.Metric != best.Metric) {
+			break
+		}
+		// the next hop must be directly reachable
+		nh := t.lookup(r.Nexthop, true)
+		if nh == nil {
+			nh = main.lookup(r.Nexthop, true)
+		}
+		if nh != nil {
+			best = r
+			paths = append(paths, ipv4Path{route: r, dev: nh.devRoute.Device})
+		}
+	}
+	return paths
 }
 
-func (rt *ipv4RoutingTable) DeleteDeviceRoute(subnet IPv4Subnet) {
-	rt.rt.DeleteDeviceRoute(subnet)
+// ipv4RoutingTable is a routing table whose lookups never block. Writers
+// build new versions of the trie and publish them atomically, and readers
+// use whichever version was most recently published.
+type ipv4RoutingTable struct {
+	// the current *ipv4TrieNode root, which must not be modified
+	root     atomic.Value
+	mu       sync.Mutex                 // held by writers
+	watchers map[*ipv4RouteWatcher]bool // guarded by mu
+	name     string                     // the value of the Table field of the table's routes
+	// for tables other than the main table, the main table,
+	// through which next hops may also be reached
+	main *ipv4RoutingTable
 }
 
-func (rt *ipv4RoutingTable) Lookup(addr IPv4) (nexthop IPv4, dev IPv4Device, ok bool) {
-	n, d := rt.rt.Lookup(addr)
-	if n == nil {
-		return IPv4{}, nil, false
-	}
-	return n.(IPv4), d.(IPv4Device), true
+func (rt *ipv4RoutingTable) load() ipv4Trie {
+	root, _ := rt.root.Load().(*ipv4TrieNode)
+	return ipv4Trie{root: root}
 }
 
-func (rt *ipv4RoutingTable) Routes() []IPv4Route {
-	var routes []IPv4Route
-	for _, route := range rt.rt.Routes() {
-		routes = append(routes, IPv4Route{
-			Subnet:  route.subnet.(IPv4Subnet),
-			Nexthop: route.nexthop.(IPv4),
-		})
+// loadMain returns the main table's current trie, given
+// that the current version of rt's own trie is trie.
+func (rt *ipv4RoutingTable) loadMain(trie ipv4Trie) ipv4Trie {
+	if rt.main == nil {
+		return trie
 	}
-	return routes
+	return rt.main.load()
 }
 
-func (rt *ipv4RoutingTable) DeviceRoutes() []IPv4DeviceRoute {
-	var routes []IPv4DeviceRoute
-	for _, route := range rt.rt.DeviceRoutes() {
-		routes = append(routes, IPv4DeviceRoute{
-			Subnet: route.subnet.(IPv4Subnet),
-			Device: route.device.(IPv4Device),
-		})
+// update publishes a new version of the trie in which f has been applied
+// to the node for subnet, sends the events which f returns to the table's
+// watchers, and returns them.
+func (rt *ipv4RoutingTable) update(subnet IPv4Subnet, f func(n *ipv4TrieNode) []IPv4RouteEvent) []IPv4RouteEvent {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var events []IPv4RouteEvent
+	rt.root.Store(rt.load().update(subnet, func(n *ipv4TrieNode) { events = f(n) }).root)
+	for w := range rt.watchers {
+		for _, e := range events {
+			w.send(e)
+		}
 	}
-	return routes
+	return events
 }
 
-type ipv6RoutingTable struct {
-	rt routingTable
+// updateRoutes replaces the routes for subnet with f(routes).
+func (rt *ipv4RoutingTable) updateRoutes(subnet IPv4Subnet, f func(routes []IPv4Route) []IPv4Route) []IPv4RouteEvent {
+	return rt.update(subnet, func(n *ipv4TrieNode) []IPv4RouteEvent {
+		old := n.routes
+		n.routes = f(old)
+		return diffIPv4Routes(old, n.routes)
+	})
 }
 
-func (rt *ipv6RoutingTable) AddRoute(subnet IPv6Subnet, nexthop IPv6) {
-	rt.rt.AddRoute(subnet, nexthop)
+// AddRoute adds route, replacing any route for the same
+// subnet with the same source and next hop.
+func (rt *ipv4RoutingTable) AddRoute(route IPv4Route) {
+	route = route.withDefaults()
+	route.Table = rt.name
+	rt.updateRoutes(route.Subnet, func(routes []IPv4Route) []IPv4Route { return withIPv4Route(routes, route, true) })
 }
 
-func (rt *ipv6RoutingTable) DeleteRoute(subnet IPv6Subnet) {
-	rt.rt.DeleteRoute(subnet)
+// DeleteRoute deletes the route for route.Subnet with route.Source and
+// route.Nexthop, returning false if there is no such route.
+func (rt *ipv4RoutingTable) DeleteRoute(route IPv4Route) bool {
+	events := rt.updateRoutes(route.Subnet, func(routes []IPv4Route) []IPv4Route { return withIPv4Route(routes, route, false) })
+	return len(events) > 0
 }
 
-func (rt *ipv6RoutingTable) AddDeviceRoute(subnet IPv6Subnet, dev IPv6Device) {
-	rt.rt.AddDeviceRoute(subnet, dev)
+// ReplaceRoutes atomically replaces all of the routes for
+// subnet from source with routes, whose Subnet and Source
+// fields are ignored.
+func (rt *ipv4RoutingTable) ReplaceRoutes(subnet IPv4Subnet, source RouteSource, routes []IPv4Route) {
+	rt.updateRoutes(subnet, func(old []IPv4Route) []IPv4Route {
+		var out []IPv4Route
+		for _, r := range old {
+			if r.Source != source {
+				out = append(out, r)
+			}
+		}
+		for _, r := range routes {
+			r.Subnet, r.Source, r.Table = subnet, source, rt.name
+			out = withIPv4Route(out, r.withDefaults(), true)
+		}
+		return out
+	})
 }
 
-func (rt *ipv6RoutingTable) DeleteDeviceRoute(subnet IPv6Subnet) {
-	rt.rt.DeleteDeviceRoute(subnet)
+func (rt *ipv4RoutingTable) AddDeviceRoute(subnet IPv4Subnet, dev IPv4Device) {
+	route := &IPv4DeviceRoute{Subnet: subnet, Device: dev, Table: rt.name}
+	rt.update(subnet, func(n *ipv4TrieNode) []IPv4RouteEvent {
+		typ := RouteAdded
+		if n.devRoute != nil {
+			if n.devRoute.Device == dev {
+				return nil
+			}
+			typ = RouteChanged
+		}
+		n.devRoute = route
+		e := *route
+		return []IPv4RouteEvent{{Type: typ, DeviceRoute: &e}}
+	})
+}
+
+// DeleteDeviceRoute deletes the device route for subnet,
+// returning false if there is no such route.
+func (rt *ipv4RoutingTable) DeleteDeviceRoute(subnet IPv4Subnet) bool {
+	events := rt.update(subnet, func(n *ipv4TrieNode) []IPv4RouteEvent {
+		if n.devRoute == nil {
+			return nil
+		}
+		e := *n.devRoute
+		n.devRoute = nil
+		return []IPv4RouteEvent{{Type: RouteDeleted, DeviceRoute: &e}}
+	})
+	return len(events) > 0
 }
 
-func (rt *ipv6RoutingTable) Lookup(addr IPv6) (nexthop IPv6, dev IPv6Device, ok bool) {
-	n, d := rt.rt.Lookup(addr)
-	if n == nil {
-		return IPv6{}, nil, false
+// watch arranges for w to be sent events
+// describing subsequent changes to the table.
+func (rt *ipv4RoutingTable) watch(w *ipv4RouteWatcher) {
+	rt.mu.Lock()
+	if rt.watchers == nil {
+		rt.watchers = make(map[*ipv4RouteWatcher]bool)
 	}
-	return n.(IPv6), d.(IPv6Device), true
+	rt.watchers[w] = true
+	rt.mu.Unlock()
 }
 
-func (rt *ipv6RoutingTable) Routes() []IPv6Route {
-	var routes []IPv6Route
-	for _, route := range rt.rt.Routes() {
-		routes = append(routes, IPv6Route{
-			Subnet:  route.subnet.(IPv6Subnet),
-			Nexthop: route.nexthop.(IPv6),
-		})
+func (rt *ipv4RoutingTable) unwatch(w *ipv4RouteWatcher) {
+	rt.mu.Lock()
+	delete(rt.watchers, w)
+	rt.mu.Unlock()
+}
+
+// Lookup returns the next hop for addr, and the device through which it is
+// reached. If there are several equal-cost paths, hash chooses among them.
+// If none of the next hops of the routes for the longest matching prefix is
+// reachable, the routes for the next longest matching prefix are used, and
+// so on.
+func (rt *ipv4RoutingTable) Lookup(addr IPv4, hash uint32) (nexthop IPv4, dev IPv4Device, ok bool) {
+	trie := rt.load()
+	var nodes [33]*ipv4TrieNode
+	matches := trie.lookupAll(addr, false, nodes[:0])
+	var buf [8]ipv4Path
+	for i := len(matches) - 1; i >= 0; i-- {
+		n := matches[i]
+		if n.devRoute != nil {
+			return addr, n.devRoute.Device, true
+		}
+		paths := trie.selected(n, rt.loadMain(trie), buf[:0])
+		if len(paths) > 0 {
+			p := paths[hash%uint32(len(paths))]
+			return p.route.Nexthop, p.dev, true
+		}
 	}
+	return IPv4{}, nil, false
+}
+
+// Routes returns the routes in the table, sorted by subnet
+// and then from the most to the least preferred.
+func (rt *ipv4RoutingTable) Routes() []IPv4Route {
+	var routes []IPv4Route
+	trie := rt.load()
+	main := rt.loadMain(trie)
+	trie.walk(func(n *ipv4TrieNode) {
+		start := len(routes)
+		routes = append(routes, n.routes...)
+		for _, p := range trie.selected(n, main, nil) {
+			// p.route points into n.routes
+			for i := range n.routes {
+				if p.route == &n.routes[i] {
+					routes[start+i].Selected = true
+				}
+			}
+		}
+	})
 	return routes
 }
 
-func (rt *ipv6RoutingTable) DeviceRoutes() []IPv6DeviceRoute {
-	var routes []IPv6DeviceRoute
-	for _, route := range rt.rt.DeviceRoutes() {
-		routes = append(routes, IPv6DeviceRoute{
-			Subnet: route.subnet.(IPv6Subnet),
-			Device: route.device.(IPv6Device),
-		})
-	}
+// DeviceRoutes returns the device routes in the table, sorted by subnet.
+func (rt *ipv4RoutingTable) DeviceRoutes() []IPv4DeviceRoute {
+	var routes []IPv4DeviceRoute
+	rt.load().walk(func(n *ipv4TrieNode) {
+		if n.devRoute != nil {
+			routes = append(routes, *n.devRoute)
+		}
+	})
 	return routes
 }
 
-// routingTable is generic so that it can work with either IPv4 or IPv6,
-// but any given instance should only be used with one of the two versions,
-// and the implementation assumes this is happening.
-type routingTable struct {
-	routes       []routingTableIPRoute
-	deviceRoutes []routingTableDeviceRoute
-	mu           sync.RWMutex
+// ipv6RouteLess is like ipv4RouteLess, but for IPv6.
+func ipv6RouteLess(a, b *IPv6Route) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	if a.Metric != b.Metric {
+		return a.Metric < b.Metric
+	}
+	return bytes.Compare(a.Nexthop[:], b.Nexthop[:]) < 0
 }
 
-type routingTableIPRoute struct {
-	subnet  IPSubnet
-	nexthop IP
+// withIPv6Route is like withIPv4Route, but for IPv6.
+func withIPv6Route(routes []IPv6Route, route IPv6Route, add bool) []IPv6Route {
+	var out []IPv6Route
+	for _, r := range routes {
+		if r.Source != route.Source || r.Nexthop != route.Nexthop {
+			out = append(out, r)
+		}
+	}
+	if add {
+		i := sort.Search(len(out), func(i int) bool { return ipv6RouteLess(&route, &out[i]) })
+		out = append(out, IPv6Route{})
+		copy(out[i+1:], out[i:])
+		out[i] = route
+	}
+	return out
 }
 
-type routingTableDeviceRoute struct {
-	subnet IPSubnet
-	device Device
+// an ipv6Path is a route, and the device through which its next hop is reached
+type ipv6Path struct {
+	route *IPv6Route
+	dev   IPv6Device
 }
 
-func (r *routingTable) AddRoute(subnet IPSubnet, nexthop IP) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.routes {
-		if SubnetEqual(rr.subnet, subnet) {
-			r.routes[i].nexthop = nexthop
-			return
+// selected is like ipv4Trie.selected, but for IPv6.
+func (t ipv6Trie) selected(n *ipv6TrieNode, main ipv6Trie, paths []ipv6Path) []ipv6Path {
+	if n.devRoute != nil {
+		return paths
+	}
+	var best *IPv6Route
+	for i := range n.routes {
+		r := &n.routes[i]
+		if best != nil && (r.Distance != best.Distance || r.Metric != best.Metric) {
+			break
+		}
+		// the next hop must be directly reachable
+		nh := t.lookup(r.Nexthop, true)
+		if nh == nil {
+			nh = main.lookup(r.Nexthop, true)
+		}
+		if nh != nil {
+			best = r
+			paths = append(paths, ipv6Path{route: r, dev: nh.devRoute.Device})
 		}
 	}
-	r.routes = append(r.routes, routingTableIPRoute{subnet: subnet, nexthop: nexthop})
+	return paths
 }
 
-func (r *routingTable) DeleteRoute(subnet IPSubnet) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.routes {
-		if SubnetEqual(rr.subnet, subnet) {
-			copy(r.routes[i:], r.routes[i+1:])
-			r.routes = r.routes[:len(r.routes)-1]
-			return
-		}
+// ipv6RoutingTable is like ipv4RoutingTable, but for IPv6.
+type ipv6RoutingTable struct {
+	// the current *ipv6TrieNode root, which must not be modified
+	root     atomic.Value
+	mu       sync.Mutex                 // held by writers
+	watchers map[*ipv6RouteWatcher]bool // guarded by mu
+	name     string                     // the value of the Table field of the table's routes
+	// for tables other than the main table, the main table,
+	// through which next hops may also be reached
+	main *ipv6RoutingTable
+}
+
+func (rt *ipv6RoutingTable) load() ipv6Trie {
+	root, _ := rt.root.Load().(*ipv6TrieNode)
+	return ipv6Trie{root: root}
+}
+
+// loadMain returns the main table's current trie, given
+// that the current version of rt's own trie is trie.
+func (rt *ipv6RoutingTable) loadMain(trie ipv6Trie) ipv6Trie {
+	if rt.main == nil {
+		return trie
 	}
+	return rt.main.load()
 }
 
-func (r *routingTable) AddDeviceRoute(subnet IPSubnet, dev Device) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.deviceRoutes {
-		if SubnetEqual(rr.subnet, subnet) {
-			r.deviceRoutes[i].device = dev
-			return
+// update publishes a new version of the trie in which f has been applied
+// to the node for subnet, sends the events which f returns to the table's
+// watchers, and returns them.
+func (rt *ipv6RoutingTable) update(subnet IPv6Subnet, f func(n *ipv6TrieNode) []IPv6RouteEvent) []IPv6RouteEvent {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var events []IPv6RouteEvent
+	rt.root.Store(rt.load().update(subnet, func(n *ipv6TrieNode) { events = f(n) }).root)
+	for w := range rt.watchers {
+		for _, e := range events {
+			w.send(e)
 		}
 	}
-	r.deviceRoutes = append(r.deviceRoutes, routingTableDeviceRoute{
-		subnet: subnet,
-		device: dev,
+	return events
+}
+
+// updateRoutes replaces the routes for subnet with f(routes).
+func (rt *ipv6RoutingTable) updateRoutes(subnet IPv6Subnet, f func(routes []IPv6Route) []IPv6Route) []IPv6RouteEvent {
+	return rt.update(subnet, func(n *ipv6TrieNode) []IPv6RouteEvent {
+		old := n.routes
+		n.routes = f(old)
+		return diffIPv6Routes(old, n.routes)
 	})
 }
 
-func (r *routingTable) DeleteDeviceRoute(subnet IPSubnet) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.deviceRoutes {
-		if SubnetEqual(rr.subnet, subnet) {
-			copy(r.deviceRoutes[i:], r.deviceRoutes[i+1:])
-			r.deviceRoutes = r.deviceRoutes[:len(r.deviceRoutes)-1]
-			return
+// AddRoute adds route, replacing any route for the same
+// subnet with the same source and next hop.
+func (rt *ipv6RoutingTable) AddRoute(route IPv6Route) {
+	route = route.withDefaults()
+	route.Table = rt.name
+	rt.updateRoutes(route.Subnet, func(routes []IPv6Route) []IPv6Route { return withIPv6Route(routes, route, true) })
+}
+
+// DeleteRoute deletes the route for route.Subnet with route.Source and
+// route.Nexthop, returning false if there is no such route.
+func (rt *ipv6RoutingTable) DeleteRoute(route IPv6Route) bool {
+	events := rt.updateRoutes(route.Subnet, func(routes []IPv6Route) []IPv6Route { return withIPv6Route(routes, route, false) })
+	return len(events) > 0
+}
+
+// ReplaceRoutes atomically replaces all of the routes for
+// subnet from source with routes, whose Subnet and Source
+// fields are ignored.
+func (rt *ipv6RoutingTable) ReplaceRoutes(subnet IPv6Subnet, source RouteSource, routes []IPv6Route) {
+	rt.updateRoutes(subnet, func(old []IPv6Route) []IPv6Route {
+		var out []IPv6Route
+		for _, r := range old {
+			if r.Source != source {
+				out = append(out, r)
+			}
 		}
-	}
+		for _, r := range routes {
+			r.Subnet, r.Source, r.Table = subnet, source, rt.name
+			out = withIPv6Route(out, r.withDefaults(), true)
+		}
+		return out
+	})
 }
 
-func (r *routingTable) Lookup(addr IP) (nexthop IP, dev Device) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	dev = r.lookupDeviceRoute(addr)
-	if dev != nil {
-		return addr, dev
-	}
-	for _, rr := range r.routes {
-		if SubnetHas(rr.subnet, addr) {
-			dev = r.lookupDeviceRoute(rr.nexthop)
-			if dev == nil {
-				return nil, nil
+func (rt *ipv6RoutingTable) AddDeviceRoute(subnet IPv6Subnet, dev IPv6Device) {
+	route := &IPv6DeviceRoute{Subnet: subnet, Device: dev, Table: rt.name}
+	rt.update(subnet, func(n *ipv6TrieNode) []IPv6RouteEvent {
+		typ := RouteAdded
+		if n.devRoute != nil {
+			if n.devRoute.Device == dev {
+				return nil
 			}
-			return rr.nexthop, dev
+			typ = RouteChanged
 		}
+		n.devRoute = route
+		e := *route
+		return []IPv6RouteEvent{{Type: typ, DeviceRoute: &e}}
+	})
+}
+
+// DeleteDeviceRoute deletes the device route for subnet,
+// returning false if there is no such route.
+func (rt *ipv6RoutingTable) DeleteDeviceRoute(subnet IPv6Subnet) bool {
+	events := rt.update(subnet, func(n *ipv6TrieNode) []IPv6RouteEvent {
+		if n.devRoute == nil {
+			return nil
+		}
+		e := *n.devRoute
+		n.devRoute = nil
+		return []IPv6RouteEvent{{Type: RouteDeleted, DeviceRoute: &e}}
+	})
+	return len(events) > 0
+}
+
+// watch arranges for w to be sent events
+// describing subsequent changes to the table.
+func (rt *ipv6RoutingTable) watch(w *ipv6RouteWatcher) {
+	rt.mu.Lock()
+	if rt.watchers == nil {
+		rt.watchers = make(map[*ipv6RouteWatcher]bool)
 	}
-	return nil, nil
+	rt.watchers[w] = true
+	rt.mu.Unlock()
+}
+
+func (rt *ipv6RoutingTable) unwatch(w *ipv6RouteWatcher) {
+	rt.mu.Lock()
+	delete(rt.watchers, w)
+	rt.mu.Unlock()
 }
 
-func (r *routingTable) lookupDeviceRoute(addr IP) Device {
-	for _, r := range r.deviceRoutes {
-		if SubnetHas(r.subnet, addr) {
-			return r.device
+// Lookup returns the next hop for addr, and the device through which it is
+// reached. If there are several equal-cost paths, hash chooses among them.
+// If none of the next hops of the routes for the longest matching prefix is
+// reachable, the routes for the next longest matching prefix are used, and
+// so on.
+func (rt *ipv6RoutingTable) Lookup(addr IPv6, hash uint32) (nexthop IPv6, dev IPv6Device, ok bool) {
+	trie := rt.load()
+	var nodes [129]*ipv6TrieNode
+	matches := trie.lookupAll(addr, false, nodes[:0])
+	var buf [8]ipv6Path
+	for i := len(matches) - 1; i >= 0; i-- {
+		n := matches[i]
+		if n.devRoute != nil {
+			return addr, n.devRoute.Device, true
+		}
+		paths := trie.selected(n, rt.loadMain(trie), buf[:0])
+		if len(paths) > 0 {
+			p := paths[hash%uint32(len(paths))]
+			return p.route.Nexthop, p.dev, true
 		}
 	}
-	return nil
+	return IPv6{}, nil, false
 }
 
-func (r *routingTable) Routes() []routingTableIPRoute {
-	r.mu.RLock()
-	routes := append([]routingTableIPRoute(nil), r.routes...)
-	r.mu.RUnlock()
+// Routes returns the routes in the table, sorted by subnet
+// and then from the most to the least preferred.
+func (rt *ipv6RoutingTable) Routes() []IPv6Route {
+	var routes []IPv6Route
+	trie := rt.load()
+	main := rt.loadMain(trie)
+	trie.walk(func(n *ipv6TrieNode) {
+		start := len(routes)
+		routes = append(routes, n.routes...)
+		for _, p := range trie.selected(n, main, nil) {
+			// p.route points into n.routes
+			for i := range n.routes {
+				if p.route == &n.routes[i] {
+					routes[start+i].Selected = true
+				}
+			}
+		}
+	})
 	return routes
 }
 
-func (r *routingTable) DeviceRoutes() []routingTableDeviceRoute {
-	r.mu.RLock()
-	routes := append([]routingTableDeviceRoute(nil), r.deviceRoutes...)
-	r.mu.RUnlock()
+// DeviceRoutes returns the device routes in the table, sorted by subnet.
+func (rt *ipv6RoutingTable) DeviceRoutes() []IPv6DeviceRoute {
+	var routes []IPv6DeviceRoute
+	rt.load().walk(func(n *ipv6TrieNode) {
+		if n.devRoute != nil {
+			routes = append(routes, *n.devRoute)
+		}
+	})
 	return routes
 }
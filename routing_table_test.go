@@ -0,0 +1,614 @@
+package net
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIPv4RoutingTable(t *testing.T) {
+	var rt ipv4RoutingTable
+	dev := &EthernetDevice{}
+	mask := func(l int) IPv4 {
+		var m IPv4
+		for i := 0; i < l; i++ {
+			m[i/8] |= 0x80 >> uint(i%8)
+		}
+		return m
+	}
+	rt.AddDeviceRoute(IPv4Subnet{Addr: IPv4{192, 168, 0, 0}, Netmask: mask(24)}, dev)
+	rt.AddRoute(IPv4Route{Subnet: IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: mask(8)}, Nexthop: IPv4{192, 168, 0, 1}})
+	rt.AddRoute(IPv4Route{Subnet: IPv4Subnet{Addr: IPv4{10, 1, 0, 0}, Netmask: mask(16)}, Nexthop: IPv4{192, 168, 0, 2}})
+	rt.AddRoute(IPv4Route{Subnet: IPv4Subnet{Addr: IPv4{172, 16, 0, 0}, Netmask: mask(12)}, Nexthop: IPv4{192, 168, 1, 1}})
+
+	for _, c := range []struct {
+		addr, nexthop IPv4
+		ok            bool
+	}{
+		{IPv4{10, 1, 2, 3}, IPv4{192, 168, 0, 2}, true},
+		{IPv4{10, 2, 0, 1}, IPv4{192, 168, 0, 1}, true},
+		{IPv4{192, 168, 0, 5}, IPv4{192, 168, 0, 5}, true},
+		// the next hop isn't directly reachable
+		{IPv4{172, 16, 0, 1}, IPv4{}, false},
+		{IPv4{8, 8, 8, 8}, IPv4{}, false},
+	} {
+		nexthop, _, ok := rt.Lookup(c.addr, 0)
+		if nexthop != c.nexthop || ok != c.ok {
+			t.Errorf("Lookup(%v): got %v, %v; want %v, %v", c.addr, nexthop, ok, c.nexthop, c.ok)
+		}
+	}
+
+	rt.DeleteRoute(IPv4Route{Subnet: IPv4Subnet{Addr: IPv4{10, 1, 0, 0}, Netmask: mask(16)}, Nexthop: IPv4{192, 168, 0, 2}})
+	if nexthop, _, _ := rt.Lookup(IPv4{10, 1, 2, 3}, 0); nexthop != (IPv4{192, 168, 0, 1}) {
+		t.Errorf("after deleting route, got next hop %v; want 192.168.0.1", nexthop)
+	}
+	if routes := rt.Routes(); len(routes) != 2 || routes[0].Subnet.Addr != (IPv4{10, 0, 0, 0}) {
+		t.Errorf("unexpected routes: %v", routes)
+	}
+
+	// compare against a linear search with random device routes
+	rt = ipv4RoutingTable{}
+	r := rand.New(rand.NewSource(1))
+	var subnets []IPv4Subnet
+	devs := make(map[IPv4Subnet]IPv4Device)
+	for i := 0; i < 1000; i++ {
+		// only use a few first bytes so that prefixes overlap
+		sub := IPv4Subnet{Addr: IPv4{byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))}, Netmask: mask(r.Intn(33))}
+		key, _ := ipv4Prefix(sub)
+		sub.Addr = IPv4{byte(key >> 24), byte(key >> 16), byte(key >> 8), byte(key)}
+		if _, ok := devs[sub]; ok {
+			continue
+		}
+		dev := &EthernetDevice{}
+		rt.AddDeviceRoute(sub, dev)
+		subnets = append(subnets, sub)
+		devs[sub] = dev
+	}
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			addr := IPv4{byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))}
+			var want IPv4Device
+			best := -1
+			for _, sub := range subnets {
+				if _, l := ipv4Prefix(sub); sub.Has(addr) && int(l) > best {
+					want, best = devs[sub], int(l)
+				}
+			}
+			if _, dev, _ := rt.Lookup(addr, 0); dev != want {
+				t.Fatalf("Lookup(%v): got device %p; want %p", addr, dev, want)
+			}
+		}
+	}
+	check()
+	for _, sub := range subnets[:len(subnets)/2] {
+		rt.DeleteDeviceRoute(sub)
+	}
+	subnets = subnets[len(subnets)/2:]
+	check()
+	if routes := rt.DeviceRoutes(); len(routes) != len(subnets) {
+		t.Errorf("got %v device routes; want %v", len(routes), len(subnets))
+	}
+	for _, sub := range subnets {
+		rt.DeleteDeviceRoute(sub)
+	}
+	if rt.load().root != nil {
+		t.Errorf("trie not empty after deleting all routes")
+	}
+}
+
+func TestIPv6RoutingTable(t *testing.T) {
+	var rt ipv6RoutingTable
+	mask := func(l int) IPv6 {
+		var m IPv6
+		for i := 0; i < l; i++ {
+			m[i/8] |= 0x80 >> uint(i%8)
+		}
+		return m
+	}
+	r := rand.New(rand.NewSource(1))
+	randAddr := func() IPv6 {
+		// only vary a few bits of each half so that prefixes overlap
+		return IPv6{0: 0xfd, 1: byte(r.Intn(4)), 7: byte(r.Intn(256)), 8: byte(r.Intn(4)), 15: byte(r.Intn(256))}
+	}
+	var subnets []IPv6Subnet
+	devs := make(map[IPv6Subnet]IPv6Device)
+	for i := 0; i < 1000; i++ {
+		sub := IPv6Subnet{Addr: randAddr(), Netmask: mask(r.Intn(129))}
+		key, _ := ipv6Prefix(sub)
+		for i := range sub.Addr {
+			sub.Addr[i] &= sub.Netmask[i]
+		}
+		if _, ok := devs[sub]; ok || ipv6KeyOf(sub.Addr) != key {
+			continue
+		}
+		dev := &EthernetDevice{}
+		rt.AddDeviceRoute(sub, dev)
+		subnets = append(subnets, sub)
+		devs[sub] = dev
+	}
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			addr := randAddr()
+			var want IPv6Device
+			best := -1
+			for _, sub := range subnets {
+				if _, l := ipv6Prefix(sub); sub.Has(addr) && int(l) > best {
+					want, best = devs[sub], int(l)
+				}
+			}
+			if _, dev, _ := rt.Lookup(addr, 0); dev != want {
+				t.Fatalf("Lookup(%v): got device %p; want %p", addr, dev, want)
+			}
+		}
+	}
+	check()
+	for _, sub := range subnets[:len(subnets)/2] {
+		rt.DeleteDeviceRoute(sub)
+	}
+	subnets = subnets[len(subnets)/2:]
+	check()
+	for _, sub := range subnets {
+		rt.DeleteDeviceRoute(sub)
+	}
+	if rt.load().root != nil {
+		t.Errorf("trie not empty after deleting all routes")
+	}
+}
+
+func TestRouteSelection(t *testing.T) {
+	var rt ipv4RoutingTable
+	lan := IPv4Subnet{Addr: IPv4{192, 168, 0, 0}, Netmask: IPv4{255, 255, 255, 0}}
+	rt.AddDeviceRoute(lan, &EthernetDevice{})
+	sub := IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: IPv4{255, 0, 0, 0}}
+	route := func(nexthop byte, source RouteSource, metric uint32) IPv4Route {
+		return IPv4Route{Subnet: sub, Nexthop: IPv4{192, 168, 0, nexthop}, Source: source, Metric: metric}
+	}
+	// RIP's distance is higher than OSPF's, so its lower metric doesn't matter
+	rt.AddRoute(route(1, RouteSourceRIP, 1))
+	rt.AddRoute(route(2, RouteSourceOSPF, 20))
+	rt.AddRoute(route(3, RouteSourceOSPF, 10))
+	// the next hop isn't directly reachable
+	unreachable := IPv4Route{Subnet: sub, Nexthop: IPv4{172, 16, 0, 1}, Source: RouteSourceStatic}
+	rt.AddRoute(unreachable)
+	expect := func(want ...byte) {
+		seen := make(map[IPv4]int)
+		for hash := uint32(0); hash < 1000; hash++ {
+			nexthop, _, ok := rt.Lookup(IPv4{10, 1, 2, 3}, hash)
+			if !ok {
+				t.Fatalf("no route found")
+			}
+			if again, _, _ := rt.Lookup(IPv4{10, 1, 2, 3}, hash); again != nexthop {
+				t.Fatalf("got next hops %v and %v for hash %v", nexthop, again, hash)
+			}
+			seen[nexthop]++
+		}
+		if len(seen) != len(want) {
+			t.Fatalf("got next hops %v; want 192.168.0.%v", seen, want)
+		}
+		for _, nexthop := range want {
+			// the paths should be used roughly equally
+			if n := seen[IPv4{192, 168, 0, nexthop}]; n < 1000/len(want)/2 {
+				t.Errorf("got next hops %v; want 192.168.0.%v equally", seen, want)
+			}
+		}
+	}
+	expect(3)
+
+	// replaces the existing route, whose metric was 20
+	rt.AddRoute(route(2, RouteSourceOSPF, 10))
+	expect(2, 3)
+	rt.AddRoute(route(4, RouteSourceOSPF, 10))
+	expect(2, 3, 4)
+
+	routes := rt.Routes()
+	if len(routes) != 5 {
+		t.Fatalf("got %v routes; want 5", len(routes))
+	}
+	for _, r := range routes {
+		if selected := r.Source == RouteSourceOSPF && r.Metric == 10; r.Selected != selected {
+			t.Errorf("route %v: got Selected = %v; want %v", r, r.Selected, selected)
+		}
+		if r.Distance != r.Source.Distance() {
+			t.Errorf("route %v: got distance %v; want %v", r, r.Distance, r.Source.Distance())
+		}
+	}
+
+	rt.AddRoute(route(5, RouteSourceStatic, 100))
+	expect(5)
+	rt.DeleteRoute(route(5, RouteSourceStatic, 0))
+	rt.DeleteRoute(route(2, RouteSourceOSPF, 0))
+	rt.DeleteRoute(route(3, RouteSourceOSPF, 0))
+	rt.DeleteRoute(route(4, RouteSourceOSPF, 0))
+	expect(1)
+	rt.AddDeviceRoute(sub, &EthernetDevice{})
+	for _, r := range rt.Routes() {
+		if r.Selected {
+			t.Errorf("route %v selected despite device route", r)
+		}
+	}
+}
+
+func TestUnreachableRouteFallback(t *testing.T) {
+	// a route whose next hop isn't directly reachable doesn't hide the
+	// routes for shorter prefixes which cover its subnet
+	var rt ipv4RoutingTable
+	dev := &EthernetDevice{}
+	rt.AddDeviceRoute(IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: IPv4{255, 0, 0, 0}}, dev)
+	rt.AddRoute(IPv4Route{Nexthop: IPv4{10, 0, 0, 1}})
+	rt.AddRoute(IPv4Route{Subnet: IPv4Subnet{Addr: IPv4{192, 168, 1, 0}, Netmask: IPv4{255, 255, 255, 0}},
+		Nexthop: IPv4{172, 16, 0, 1}})
+	for _, addr := range []IPv4{{8, 8, 8, 8}, {192, 168, 1, 5}} {
+		if nexthop, d, ok := rt.Lookup(addr, 0); !ok || nexthop != (IPv4{10, 0, 0, 1}) || d != dev {
+			t.Errorf("Lookup(%v) = %v, %v, %v; want default route via 10.0.0.1", addr, nexthop, d, ok)
+		}
+	}
+	// once the next hop is reachable, the more specific route is used
+	rt.AddDeviceRoute(IPv4Subnet{Addr: IPv4{172, 16, 0, 0}, Netmask: IPv4{255, 255, 0, 0}}, dev)
+	if nexthop, _, ok := rt.Lookup(IPv4{192, 168, 1, 5}, 0); !ok || nexthop != (IPv4{172, 16, 0, 1}) {
+		t.Errorf("Lookup(192.168.1.5) = %v, %v; want 172.16.0.1", nexthop, ok)
+	}
+
+	var rt6 ipv6RoutingTable
+	rt6.AddDeviceRoute(IPv6Subnet{Addr: IPv6{0xfd}, Netmask: IPv6{0xff}}, dev)
+	rt6.AddRoute(IPv6Route{Nexthop: IPv6{0xfd, 15: 1}})
+	rt6.AddRoute(IPv6Route{Subnet: IPv6Subnet{Addr: IPv6{0x20, 0x01, 0x0d, 0xb8}, Netmask: IPv6{0xff, 0xff, 0xff, 0xff}},
+		Nexthop: IPv6{0xfe, 0xc0, 15: 1}})
+	if nexthop, _, ok := rt6.Lookup(IPv6{0x20, 0x01, 0x0d, 0xb8, 15: 5}, 0); !ok || nexthop != (IPv6{0xfd, 15: 1}) {
+		t.Errorf("Lookup(2001:db8::5) = %v, %v; want default route via fd00::1", nexthop, ok)
+	}
+}
+
+func TestRouteEvents(t *testing.T) {
+	var p ipv4RoutingPolicy
+	rt := &p.main
+	c := make(chan IPv4RouteEvent, 4)
+	stop := p.Watch(c)
+	sub := IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: IPv4{255, 0, 0, 0}}
+	route := func(nexthop byte, metric uint32) IPv4Route {
+		return IPv4Route{Subnet: sub, Nexthop: IPv4{192, 168, 0, nexthop}, Source: RouteSourceOSPF, Metric: metric}
+	}
+	expect := func(name string, want ...IPv4RouteEvent) {
+		for _, w := range want {
+			select {
+			case e := <-c:
+				if e.Type != w.Type || e.Lost != w.Lost || (e.Route == nil) != (w.Route == nil) ||
+					(e.Route != nil && *e.Route != w.Route.withDefaults()) || (e.DeviceRoute != nil && *e.DeviceRoute != *w.DeviceRoute) {
+					t.Errorf("%v: got event %+v; want %+v", name, e, w)
+				}
+			default:
+				t.Errorf("%v: missing event %+v", name, w)
+			}
+		}
+		select {
+		case e := <-c:
+			t.Errorf("%v: unexpected event %+v", name, e)
+		default:
+		}
+	}
+	event := func(typ RouteEventType, r IPv4Route) IPv4RouteEvent {
+		return IPv4RouteEvent{Type: typ, Route: &r}
+	}
+
+	rt.AddRoute(route(1, 10))
+	expect("add", event(RouteAdded, route(1, 10)))
+	rt.AddRoute(route(1, 10))
+	expect("add existing")
+	rt.AddRoute(route(1, 20))
+	expect("change", event(RouteChanged, route(1, 20)))
+	rt.ReplaceRoutes(sub, RouteSourceOSPF, []IPv4Route{route(1, 20), route(2, 20)})
+	expect("replace", event(RouteAdded, route(2, 20)))
+	rt.ReplaceRoutes(sub, RouteSourceOSPF, []IPv4Route{route(3, 20)})
+	expect("replace all", event(RouteDeleted, route(1, 20)), event(RouteDeleted, route(2, 20)), event(RouteAdded, route(3, 20)))
+	if !rt.DeleteRoute(route(3, 0)) {
+		t.Errorf("could not delete route")
+	}
+	expect("delete", event(RouteDeleted, route(3, 20)))
+	if rt.DeleteRoute(route(3, 0)) {
+		t.Errorf("deleted nonexistent route")
+	}
+	expect("delete nonexistent")
+
+	dev := &EthernetDevice{}
+	rt.AddDeviceRoute(sub, dev)
+	expect("add device route", IPv4RouteEvent{Type: RouteAdded, DeviceRoute: &IPv4DeviceRoute{Subnet: sub, Device: dev}})
+	rt.DeleteDeviceRoute(sub)
+	expect("delete device route", IPv4RouteEvent{Type: RouteDeleted, DeviceRoute: &IPv4DeviceRoute{Subnet: sub, Device: dev}})
+
+	// events are dropped when the channel is full, and the last slot
+	// reports it even if no more events are sent
+	for i := 0; i < cap(c)+2; i++ {
+		rt.AddRoute(route(byte(i), 0))
+	}
+	for i := 0; i < cap(c)-1; i++ {
+		if e := <-c; e.Lost || e.Route == nil {
+			t.Errorf("got event %v before the channel filled; want a route", e)
+		}
+	}
+	if e := <-c; e != (IPv4RouteEvent{Lost: true}) {
+		t.Errorf("got last event %v before overflow; want only Lost set", e)
+	}
+	rt.DeleteRoute(route(0, 0))
+	lost := event(RouteDeleted, route(0, 0))
+	lost.Lost = true
+	expect("after overflow", lost)
+
+	stop()
+	rt.DeleteRoute(route(1, 0))
+	expect("after stop")
+}
+
+func TestRoutingPolicy(t *testing.T) {
+	var p ipv4RoutingPolicy
+	dev0, dev1 := &EthernetDevice{}, &EthernetDevice{}
+	mask := IPv4{255, 255, 255, 0}
+	p.main.AddDeviceRoute(IPv4Subnet{Addr: IPv4{192, 168, 0, 0}, Netmask: mask}, dev0)
+	p.main.AddDeviceRoute(IPv4Subnet{Addr: IPv4{192, 168, 1, 0}, Netmask: mask}, dev1)
+	p.main.AddRoute(IPv4Route{Nexthop: IPv4{192, 168, 0, 1}})
+	// the next hops of other tables' routes are resolved
+	// using the main table's device routes
+	p.tableForUpdate("isp2").AddRoute(IPv4Route{Nexthop: IPv4{192, 168, 1, 1}})
+	p.tableForUpdate("lan").AddRoute(IPv4Route{Subnet: IPv4Subnet{Addr: IPv4{172, 16, 0, 0}, Netmask: IPv4{255, 255}}, Nexthop: IPv4{192, 168, 1, 2}})
+	p.AddRule(IPv4Rule{Priority: 100, Source: IPv4Subnet{Addr: IPv4{10, 0, 1, 0}, Netmask: mask}, Table: "isp2"})
+	p.AddRule(IPv4Rule{Priority: 50, Mark: 1, MarkMask: 1, Table: "isp2"})
+	p.AddRule(IPv4Rule{Priority: 50, InDevice: dev0, Proto: IPProtocolUDP, Table: "lan"})
+	p.AddRule(IPv4Rule{Priority: 10, Table: "nonexistent"})
+
+	for i, r := range p.Rules() {
+		if want := []uint32{10, 50, 50, 100}[i]; r.Priority != want {
+			t.Errorf("rule %v has priority %v; want %v", i, r.Priority, want)
+		}
+	}
+	for _, r := range p.Routes() {
+		if r.Nexthop == (IPv4{192, 168, 1, 1}) && r.Table != "isp2" {
+			t.Errorf("got route %v in table %q; want isp2", r, r.Table)
+		}
+	}
+
+	for _, c := range []struct {
+		name    string
+		dst     IPv4
+		flow    ipv4Flow
+		nexthop IPv4
+		dev     IPv4Device
+	}{
+		{"no rule", IPv4{8, 8, 8, 8}, ipv4Flow{src: IPv4{10, 0, 0, 5}, hasSrc: true}, IPv4{192, 168, 0, 1}, dev0},
+		{"source", IPv4{8, 8, 8, 8}, ipv4Flow{src: IPv4{10, 0, 1, 5}, hasSrc: true}, IPv4{192, 168, 1, 1}, dev1},
+		{"no source", IPv4{8, 8, 8, 8}, ipv4Flow{}, IPv4{192, 168, 0, 1}, dev0},
+		{"mark", IPv4{8, 8, 8, 8}, ipv4Flow{mark: 3}, IPv4{192, 168, 1, 1}, dev1},
+		{"masked mark", IPv4{8, 8, 8, 8}, ipv4Flow{mark: 2}, IPv4{192, 168, 0, 1}, dev0},
+		{"device and protocol", IPv4{172, 16, 3, 4}, ipv4Flow{in: dev0, proto: IPProtocolUDP}, IPv4{192, 168, 1, 2}, dev1},
+		{"wrong protocol", IPv4{172, 16, 3, 4}, ipv4Flow{in: dev0, proto: IPProtocolTCP}, IPv4{192, 168, 0, 1}, dev0},
+		// the lan table has no route, so the main table is used
+		{"no route in table", IPv4{8, 8, 8, 8}, ipv4Flow{in: dev0, proto: IPProtocolUDP}, IPv4{192, 168, 0, 1}, dev0},
+	} {
+		nexthop, dev, ok := p.Lookup(c.dst, &c.flow)
+		if !ok || nexthop != c.nexthop || dev != c.dev {
+			t.Errorf("%v: got %v, %p, %v; want %v, %p, true", c.name, nexthop, dev, ok, c.nexthop, c.dev)
+		}
+	}
+
+	if !p.DeleteRule(IPv4Rule{Priority: 50, Mark: 1, MarkMask: 1, Table: "isp2"}) {
+		t.Errorf("could not delete rule")
+	}
+	if nexthop, _, _ := p.Lookup(IPv4{8, 8, 8, 8}, &ipv4Flow{mark: 3}); nexthop != (IPv4{192, 168, 0, 1}) {
+		t.Errorf("got next hop %v after deleting rule; want 192.168.0.1", nexthop)
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	hdr := ipv4Header{proto: IPProtocolUDP, src: IPv4{10, 0, 0, 1}, dst: IPv4{10, 0, 0, 2}}
+	ports := func(src, dst uint16) []byte {
+		return []byte{byte(src >> 8), byte(src), byte(dst >> 8), byte(dst)}
+	}
+	if ipv4FlowHash(&hdr, ports(1000, 53)) == ipv4FlowHash(&hdr, ports(1001, 53)) {
+		t.Errorf("flows with different ports have the same hash")
+	}
+	// the ports of non-first fragments are not available
+	frag := hdr
+	frag.fragOff = 100
+	if ipv4FlowHash(&frag, ports(1000, 53)) != ipv4FlowHash(&frag, ports(1001, 53)) {
+		t.Errorf("fragments with different data have different hashes")
+	}
+
+	b, hdr6 := makeTestIPv6Packet(IPProtocolUDP, ports(1000, 53))
+	c, _ := makeTestIPv6Packet(IPProtocolUDP, ports(1001, 53))
+	if ipv6FlowHash(&hdr6, b) == ipv6FlowHash(&hdr6, c) {
+		t.Errorf("flows with different ports have the same hash")
+	}
+	// the flow label is used instead of the ports if it is set
+	hdr6.flowLabel = 12345
+	if ipv6FlowHash(&hdr6, b) != ipv6FlowHash(&hdr6, c) {
+		t.Errorf("packets with the same flow label have different hashes")
+	}
+}
+
+// the number of prefixes in the tables used by benchmarks, which is
+// somewhat larger than a full Internet routing table
+const benchmarkRoutes = 1 << 20
+
+// the tries and addresses used by benchmarks, which are only built once
+// since building them takes much longer than any single benchmark run
+var (
+	benchmarkIPv4Once  sync.Once
+	benchmarkIPv4Trie  ipv4Trie
+	benchmarkIPv4Addrs []IPv4
+	benchmarkIPv6Once  sync.Once
+	benchmarkIPv6Trie  ipv6Trie
+	benchmarkIPv6Addrs []IPv6
+)
+
+// newBenchmarkIPv4Table returns a table with benchmarkRoutes routes whose
+// lengths are distributed roughly as in Internet routing tables, and a
+// number of addresses to look up.
+func newBenchmarkIPv4Table() (*ipv4RoutingTable, []IPv4) {
+	benchmarkIPv4Once.Do(func() {
+		benchmarkIPv4Trie, benchmarkIPv4Addrs = buildBenchmarkIPv4Table()
+	})
+	// tries are never modified, so tables can share them
+	rt := new(ipv4RoutingTable)
+	rt.root.Store(benchmarkIPv4Trie.root)
+	return rt, benchmarkIPv4Addrs
+}
+
+func buildBenchmarkIPv4Table() (ipv4Trie, []IPv4) {
+	rt := new(ipv4RoutingTable)
+	r := rand.New(rand.NewSource(1))
+	nexthop := IPv4{192, 168, 0, 1}
+	rt.AddDeviceRoute(IPv4Subnet{Addr: IPv4{192, 168, 0, 0}, Netmask: IPv4{255, 255, 255, 0}}, &EthernetDevice{})
+	for i := 0; i < benchmarkRoutes; i++ {
+		l := 24
+		if r.Intn(2) == 0 {
+			l = 8 + r.Intn(16)
+		}
+		var sub IPv4Subnet
+		r.Read(sub.Addr[:])
+		for j := 0; j < l; j++ {
+			sub.Netmask[j/8] |= 0x80 >> uint(j%8)
+		}
+		rt.AddRoute(IPv4Route{Subnet: sub, Nexthop: nexthop})
+	}
+	addrs := make([]IPv4, 1<<16)
+	for i := range addrs {
+		r.Read(addrs[i][:])
+	}
+	return rt.load(), addrs
+}
+
+func newBenchmarkIPv6Table() (*ipv6RoutingTable, []IPv6) {
+	benchmarkIPv6Once.Do(func() {
+		benchmarkIPv6Trie, benchmarkIPv6Addrs = buildBenchmarkIPv6Table()
+	})
+	rt := new(ipv6RoutingTable)
+	rt.root.Store(benchmarkIPv6Trie.root)
+	return rt, benchmarkIPv6Addrs
+}
+
+func buildBenchmarkIPv6Table() (ipv6Trie, []IPv6) {
+	rt := new(ipv6RoutingTable)
+	r := rand.New(rand.NewSource(1))
+	nexthop := IPv6{0: 0xfe, 1: 0x80, 15: 1}
+	rt.AddDeviceRoute(IPv6Subnet{Addr: IPv6{0: 0xfe, 1: 0x80}, Netmask: IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}, &EthernetDevice{})
+	for i := 0; i < benchmarkRoutes; i++ {
+		l := 48
+		if r.Intn(2) == 0 {
+			l = 16 + r.Intn(48)
+		}
+		sub := IPv6Subnet{Addr: IPv6{0: 0x20}}
+		r.Read(sub.Addr[1:8])
+		for j := 0; j < l; j++ {
+			sub.Netmask[j/8] |= 0x80 >> uint(j%8)
+		}
+		rt.AddRoute(IPv6Route{Subnet: sub, Nexthop: nexthop})
+	}
+	addrs := make([]IPv6, 1<<16)
+	for i := range addrs {
+		addrs[i][0] = 0x20
+		r.Read(addrs[i][1:])
+	}
+	return rt.load(), addrs
+}
+
+func BenchmarkIPv4RoutingTableLookup(b *testing.B) {
+	rt, addrs := newBenchmarkIPv4Table()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.Lookup(addrs[i%len(addrs)], uint32(i))
+	}
+}
+
+func BenchmarkIPv4RoutingTableAddRoute(b *testing.B) {
+	rt, addrs := newBenchmarkIPv4Table()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.AddRoute(IPv4Route{Subnet: IPv4Subnet{Addr: addrs[i%len(addrs)], Netmask: IPv4{255, 255, 255, 0}}, Nexthop: IPv4{192, 168, 0, 2}})
+	}
+}
+
+func BenchmarkIPv6RoutingTableLookup(b *testing.B) {
+	rt, addrs := newBenchmarkIPv6Table()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.Lookup(addrs[i%len(addrs)], uint32(i))
+	}
+}
+
+func BenchmarkIPv6RoutingTableAddRoute(b *testing.B) {
+	rt, addrs := newBenchmarkIPv6Table()
+	mask := IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.AddRoute(IPv6Route{Subnet: IPv6Subnet{Addr: addrs[i%len(addrs)], Netmask: mask}, Nexthop: IPv6{0: 0xfe, 1: 0x80, 15: 2}})
+	}
+}
+
+// benchmarkDevice is an IPv4Device which discards packets written to it.
+// Only the methods used when forwarding are implemented.
+type benchmarkDevice struct {
+	IPv4Device
+	addr IPv4
+}
+
+func (dev *benchmarkDevice) IPv4Addrs() []IPv4DeviceAddr {
+	return []IPv4DeviceAddr{{Addr: dev.addr, Netmask: IPv4{255, 255, 255, 0}}}
+}
+func (dev *benchmarkDevice) MTU() int                                    { return 0 }
+func (dev *benchmarkDevice) RegisterIPv4Callback(f func([]byte))         {}
+func (dev *benchmarkDevice) RegisterIPv4AddrCallback(f func())           {}
+func (dev *benchmarkDevice) WriteToIPv4(b []byte, dst IPv4) (int, error) { return len(b), nil }
+
+// benchmarkIPv4Forward benchmarks forwarding packets on all cores through a
+// host with a full routing table. If churn is true, routes are continuously
+// added and deleted while packets are being forwarded.
+func benchmarkIPv4Forward(b *testing.B, churn bool) {
+	rt, addrs := newBenchmarkIPv4Table()
+	host := NewIPv4Host().(*ipv4ConfigurationHost)
+	host.SetForwarding(true)
+	dev := &benchmarkDevice{addr: IPv4{192, 168, 0, 254}}
+	host.AddIPv4Device(dev)
+	host.routes.main.root.Store(rt.load().root)
+	host.AddIPv4DeviceRoute(IPv4Subnet{Addr: IPv4{192, 168, 0, 0}, Netmask: IPv4{255, 255, 255, 0}}, dev)
+
+	if churn {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			r := rand.New(rand.NewSource(2))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sub := IPv4Subnet{Netmask: IPv4{255, 255, 255, 0}}
+				r.Read(sub.Addr[:])
+				host.AddIPv4Route(sub, IPv4{192, 168, 0, 2})
+				host.routes.main.DeleteRoute(IPv4Route{Subnet: sub, Nexthop: IPv4{192, 168, 0, 2}})
+			}
+		}()
+	}
+
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// each goroutine forwards its own packets, since
+		// forwarding modifies them
+		pkts := make([][]byte, 256)
+		start := int(atomic.AddUint32(&next, 1)) * len(pkts)
+		for i := range pkts {
+			hdr := ipv4Header{version: 4, IHL: 5, len: 64, TTL: 64, proto: IPProtocolUDP,
+				src: IPv4{192, 168, 0, 1}, dst: addrs[(start+i)%len(addrs)]}
+			pkts[i] = make([]byte, int(hdr.len))
+			writeIPv4Header(&hdr, pkts[i])
+			setIPv4Checksum(pkts[i])
+		}
+		for i := 0; pb.Next(); i++ {
+			pkt := pkts[i%len(pkts)]
+			setTTL(pkt, 64)
+			host.callback(dev, pkt)
+		}
+	})
+}
+
+func BenchmarkIPv4Forward(b *testing.B)          { benchmarkIPv4Forward(b, false) }
+func BenchmarkIPv4ForwardWithChurn(b *testing.B) { benchmarkIPv4Forward(b, true) }
@@ -0,0 +1,656 @@
+package net
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// defined in linux/if_tun.h, but not in package syscall on all architectures
+const iffMultiQueue = 0x0100
+
+// default MTU of TUN/TAP devices if none is configured
+const defaultTUNMTU = 1500
+
+// TUNConfig configures a TUNDevice or TAPInterface.
+//
+// The kernel interface is created in the network namespace of the calling
+// process, so a process which has been placed into its own network namespace
+// (for example, using "ip netns exec") will create it there. Creating
+// interfaces requires the CAP_NET_ADMIN capability in that namespace.
+type TUNConfig struct {
+	// Name is the name of the kernel interface. If it is empty, the kernel
+	// chooses a name; it may also contain a "%d" format verb (for example,
+	// "tun%d"), which the kernel will replace with the lowest available
+	// number.
+	Name string
+	// MTU is the MTU of both the device and the kernel interface.
+	// If it is 0, an MTU of 1500 is used.
+	MTU int
+	// Queues is the number of queues (file descriptors) to open for the
+	// interface. If it is greater than 1, the interface is created in
+	// multi-queue mode, and a separate read daemon is spawned for each
+	// queue. If it is 0, a single queue is used.
+	Queues int
+}
+
+// tunDevice implements logic common to TUNDevice and TAPInterface. The kernel
+// interface only exists while the device is up; it is created when the device
+// is brought up, and destroyed when it is brought down.
+type tunDevice struct {
+	config   TUNConfig
+	flags    uint16         // syscall.IFF_TUN or syscall.IFF_TAP
+	name     string         // the kernel's name for the interface; set once up
+	files    []*os.File     // one per queue; nil if down
+	next     uint32         // next queue to write to; accessed atomically
+	callback func(b []byte) // unset if nil
+
+	sync syncer
+}
+
+// newTUNDevice initializes dev, which must be the zero value, since it
+// contains locks which can't be copied.
+func newTUNDevice(dev *tunDevice, config TUNConfig, flags uint16) error {
+	if len(config.Name) >= syscall.IFNAMSIZ {
+		return errors.Errorf("interface name too long: %v", config.Name)
+	}
+	if config.MTU < 0 || config.Queues < 0 {
+		return errors.New("negative MTU or queue count")
+	}
+	if config.MTU == 0 {
+		config.MTU = defaultTUNMTU
+	}
+	if config.Queues == 0 {
+		config.Queues = 1
+	}
+	dev.config, dev.flags, dev.name = config, flags, config.Name
+	return nil
+}
+
+// Name returns the name of the kernel interface. If the kernel chose the
+// name, it is only available once the device has been brought up.
+func (dev *tunDevice) Name() string {
+	dev.sync.RLock()
+	name := dev.name
+	dev.sync.RUnlock()
+	return name
+}
+
+// bringUp creates the kernel interface with a file descriptor for each
+// queue, sets its MTU, and brings it up. bufsize is the size of the buffer
+// each read daemon allocates to read packets.
+func (dev *tunDevice) bringUp(bufsize int) error {
+	daemons := make([]func(), dev.config.Queues)
+	for i := range daemons {
+		i := i
+		daemons[i] = func() { dev.readDaemon(i, bufsize) }
+	}
+	return dev.sync.BringUp(func() error {
+		dev.sync.Lock()
+		defer dev.sync.Unlock()
+		// NOTE(joshlf): Don't need to check whether the device is up already;
+		// dev.sync.BringUp guarantees that we'll only be called if the device
+		// is down.
+
+		flags := dev.flags | syscall.IFF_NO_PI
+		if dev.config.Queues > 1 {
+			flags |= iffMultiQueue
+		}
+		name := dev.config.Name
+		var files []*os.File
+		for i := 0; i < dev.config.Queues; i++ {
+			f, n, err := openTUN(name, flags)
+			if err != nil {
+				closeFiles(files)
+				return errors.Annotate(err, "bring device up")
+			}
+			// all subsequent queues must attach to the same interface
+			name = n
+			files = append(files, f)
+		}
+		err := configureLink(name, dev.config.MTU)
+		if err != nil {
+			closeFiles(files)
+			return errors.Annotate(err, "bring device up")
+		}
+		dev.files, dev.name = files, name
+		return nil
+	}, daemons...)
+}
+
+func (dev *tunDevice) BringDown() error {
+	return dev.sync.BringDown(func() error {
+		dev.sync.Lock()
+		defer dev.sync.Unlock()
+		err := closeFiles(dev.files)
+		dev.files = nil
+		return errors.Annotate(err, "bring device down")
+	})
+}
+
+func (dev *tunDevice) IsUp() bool {
+	dev.sync.RLock()
+	up := dev.isUp()
+	dev.sync.RUnlock()
+	return up
+}
+
+func (dev *tunDevice) isUp() bool {
+	return dev.files != nil
+}
+
+// write writes b to one of dev's queues. mtu is the maximum length of b.
+func (dev *tunDevice) write(b []byte, mtu int) (n int, err error) {
+	if len(b) > mtu {
+		return 0, errors.MTUf(mtu, "write to device: payload exceeds MTU")
+	}
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	if !dev.isUp() {
+		return 0, errors.New("write to down device")
+	}
+
+	q := atomic.AddUint32(&dev.next, 1) % uint32(len(dev.files))
+	n, err = dev.files[q].Write(b)
+	return n, errors.Annotate(err, "write to device")
+}
+
+func (dev *tunDevice) readDaemon(queue, bufsize int) {
+	// NOTE(joshlf): It's safe to access dev.files without synchronization
+	// because it is only modified before the daemons are spawned and after
+	// they have all returned.
+	f := dev.files[queue]
+	b := make([]byte, bufsize)
+	for {
+		select {
+		case <-dev.sync.StopChan():
+			return
+		default:
+		}
+
+		err := f.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		if err != nil {
+			// TODO(joshlf): Log it
+			continue
+		}
+		n, err := f.Read(b)
+		if err != nil {
+			if !errors.IsTimeout(err) {
+				// TODO(joshlf): Log it
+			}
+			continue
+		}
+		// NOTE(joshlf): Don't hold the lock while calling the callback,
+		// since it may write to the device
+		dev.sync.RLock()
+		callback := dev.callback
+		dev.sync.RUnlock()
+		if callback != nil {
+			callback(b[:n])
+		}
+	}
+}
+
+// TUNDevice is a Device backed by a Linux TUN interface. Packets written to
+// the device are received by the kernel on the TUN interface, and packets
+// which the kernel routes out of the TUN interface are received by the device.
+// A TUNDevice is capable of sending and receiving both IPv4 and IPv6 packets.
+// Note that the addresses of the TUNDevice itself are independent of any
+// addresses the kernel interface has been configured with; typically, they
+// are different addresses in the same subnet.
+//
+// The zero TUNDevice is not a valid TUNDevice. TUNDevices are safe for
+// concurrent access.
+type TUNDevice struct {
+	addrs4               ipv4Addrs
+	addrs6               ipv6Addrs
+	callback4, callback6 func([]byte) // unset if nil
+	tunDevice
+}
+
+var _ Device = &TUNDevice{}     // make sure *TUNDevice implements Device
+var _ IPv4Device = &TUNDevice{} // make sure *TUNDevice implements IPv4Device
+var _ IPv6Device = &TUNDevice{} // make sure *TUNDevice implements IPv6Device
+
+// NewTUNDevice creates a new TUNDevice, which is down by default. The kernel
+// interface is not created until the device is brought up.
+func NewTUNDevice(config TUNConfig) (*TUNDevice, error) {
+	dev := &TUNDevice{}
+	if err := newTUNDevice(&dev.tunDevice, config, syscall.IFF_TUN); err != nil {
+		return nil, errors.Annotate(err, "new TUNDevice")
+	}
+	dev.tunDevice.callback = dev.demux
+	return dev, nil
+}
+
+// BringUp brings dev up, creating the kernel interface and bringing it up as
+// well. If dev is already up, BringUp is a no-op.
+func (dev *TUNDevice) BringUp() error { return dev.bringUp(dev.config.MTU) }
+
+// MTU returns dev's MTU.
+func (dev *TUNDevice) MTU() int { return dev.config.MTU }
+
+func (dev *TUNDevice) demux(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	dev.sync.RLock()
+	callback4, callback6 := dev.callback4, dev.callback6
+	dev.sync.RUnlock()
+	switch b[0] >> 4 {
+	case 4:
+		if callback4 != nil {
+			callback4(b)
+		}
+	case 6:
+		if callback6 != nil {
+			callback6(b)
+		}
+	}
+}
+
+// IPv4 returns dev's primary IPv4 address and network mask if it has any
+// addresses.
+func (dev *TUNDevice) IPv4() (addr, netmask IPv4, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addrs4.primary()
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv4 replaces dev's IPv4 addresses with the given address and network
+// mask, returning any error encountered. SetIPv4 can only be called when dev
+// is down.
+func (dev *TUNDevice) SetIPv4(addr, netmask IPv4) error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		dev.addrs4.set(addr, netmask)
+		return nil
+	})
+}
+
+// UnsetIPv4 removes all of dev's IPv4 addresses, returning any error
+// encountered. UnsetIPv4 can only be called when dev is down.
+func (dev *TUNDevice) UnsetIPv4() error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		dev.addrs4.unset()
+		return nil
+	})
+}
+
+// IPv4Addrs returns all of dev's IPv4 addresses, starting with the primary
+// address.
+func (dev *TUNDevice) IPv4Addrs() []IPv4DeviceAddr {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	return dev.addrs4.list()
+}
+
+// AddIPv4 implements IPv4Device's AddIPv4.
+func (dev *TUNDevice) AddIPv4(addr, netmask IPv4) error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		return dev.addrs4.add(addr, netmask)
+	})
+}
+
+// RemoveIPv4 implements IPv4Device's RemoveIPv4.
+func (dev *TUNDevice) RemoveIPv4(addr IPv4) error {
+	return dev.addrs4.change(&dev.sync, func() error {
+		return dev.addrs4.remove(addr)
+	})
+}
+
+// RegisterIPv4AddrCallback implements IPv4Device's RegisterIPv4AddrCallback.
+func (dev *TUNDevice) RegisterIPv4AddrCallback(f func()) {
+	dev.sync.Lock()
+	dev.addrs4.callback = f
+	dev.sync.Unlock()
+}
+
+// JoinIPv4Group implements IPv4Device's JoinIPv4Group. The kernel delivers
+// every packet routed to a TUN interface, so it is a no-op.
+func (dev *TUNDevice) JoinIPv4Group(addr IPv4) error {
+	return errors.Annotate(checkIPv4Group(addr), "join IPv4 group")
+}
+
+// LeaveIPv4Group implements IPv4Device's LeaveIPv4Group.
+func (dev *TUNDevice) LeaveIPv4Group(addr IPv4) error {
+	return errors.Annotate(checkIPv4Group(addr), "leave IPv4 group")
+}
+
+// IPv6 returns dev's primary IPv6 address and network mask if it has any
+// addresses.
+func (dev *TUNDevice) IPv6() (addr, netmask IPv6, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addrs6.primary()
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv6 replaces dev's IPv6 addresses with the given address and network
+// mask, returning any error encountered. SetIPv6 can only be called when dev
+// is down.
+func (dev *TUNDevice) SetIPv6(addr, netmask IPv6) error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		dev.addrs6.set(addr, netmask)
+		return nil
+	})
+}
+
+// UnsetIPv6 removes all of dev's IPv6 addresses, returning any error
+// encountered. UnsetIPv6 can only be called when dev is down.
+func (dev *TUNDevice) UnsetIPv6() error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		dev.addrs6.unset()
+		return nil
+	})
+}
+
+// IPv6Addrs returns all of dev's IPv6 addresses, starting with the primary
+// address.
+func (dev *TUNDevice) IPv6Addrs() []IPv6DeviceAddr {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	return dev.addrs6.list()
+}
+
+// AddIPv6 implements IPv6Device's AddIPv6.
+func (dev *TUNDevice) AddIPv6(addr, netmask IPv6) error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		return dev.addrs6.add(addr, netmask)
+	})
+}
+
+// RemoveIPv6 implements IPv6Device's RemoveIPv6.
+func (dev *TUNDevice) RemoveIPv6(addr IPv6) error {
+	return dev.addrs6.change(&dev.sync, func() error {
+		return dev.addrs6.remove(addr)
+	})
+}
+
+// RegisterIPv6AddrCallback implements IPv6Device's RegisterIPv6AddrCallback.
+func (dev *TUNDevice) RegisterIPv6AddrCallback(f func()) {
+	dev.sync.Lock()
+	dev.addrs6.callback = f
+	dev.sync.Unlock()
+}
+
+// JoinIPv6Group implements IPv6Device's JoinIPv6Group. Like
+// JoinIPv4Group, it is a no-op.
+func (dev *TUNDevice) JoinIPv6Group(addr IPv6) error {
+	return errors.Annotate(checkIPv6Group(addr), "join IPv6 group")
+}
+
+// LeaveIPv6Group implements IPv6Device's LeaveIPv6Group.
+func (dev *TUNDevice) LeaveIPv6Group(addr IPv6) error {
+	return errors.Annotate(checkIPv6Group(addr), "leave IPv6 group")
+}
+
+// RegisterIPv4Callback registers f to be called when IPv4 packets are received.
+func (dev *TUNDevice) RegisterIPv4Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback4 = f
+	dev.sync.Unlock()
+}
+
+// RegisterIPv6Callback registers f to be called when IPv6 packets are received.
+func (dev *TUNDevice) RegisterIPv6Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback6 = f
+	dev.sync.Unlock()
+}
+
+// WriteToIPv4 writes the IPv4 packet b to the kernel. Since a TUN interface is
+// point-to-point, dst is ignored.
+func (dev *TUNDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.write(b, dev.config.MTU)
+}
+
+// WriteToIPv6 writes the IPv6 packet b to the kernel. Since a TUN interface is
+// point-to-point, dst is ignored.
+func (dev *TUNDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.write(b, dev.config.MTU)
+}
+
+// TAPInterface is an EthernetInterface backed by a Linux TAP interface. It
+// behaves as if it were connected by a cable to the kernel's TAP interface:
+// frames written to it are received by the kernel, and frames sent by the
+// kernel are received by it. The MAC of the TAPInterface is independent of
+// the MAC of the kernel interface.
+//
+// The zero TAPInterface is not a valid TAPInterface. TAPInterfaces are safe
+// for concurrent access.
+type TAPInterface struct {
+	callback func(b []byte, src, dst MAC, et EtherType) // unset if nil
+	macFilter
+	tunDevice
+}
+
+var _ EthernetInterface = &TAPInterface{} // make sure *TAPInterface implements EthernetInterface
+
+// NewTAPInterface creates a new TAPInterface, which is down by default. The
+// kernel interface is not created until the interface is brought up.
+func NewTAPInterface(config TUNConfig) (*TAPInterface, error) {
+	iface := &TAPInterface{}
+	if err := newTUNDevice(&iface.tunDevice, config, syscall.IFF_TAP); err != nil {
+		return nil, errors.Annotate(err, "new TAPInterface")
+	}
+	iface.tunDevice.callback = iface.demux
+	return iface, nil
+}
+
+// BringUp brings iface up, creating the kernel interface and bringing it up
+// as well. If iface is already up, BringUp is a no-op.
+func (iface *TAPInterface) BringUp() error {
+	iface.sync.RLock()
+	mtu := iface.config.MTU
+	iface.sync.RUnlock()
+	return iface.bringUp(mtu + ethernetHeaderLen8021)
+}
+
+func (iface *TAPInterface) demux(b []byte) {
+	eh, err := parseEthernetHeader(b)
+	if err != nil {
+		// TODO(joshlf): Log it
+		return
+	}
+	iface.sync.RLock()
+	accept := iface.accepts(eh.dst)
+	callback := iface.callback
+	iface.sync.RUnlock()
+	if accept && callback != nil {
+		callback(b[ethernetHeaderLen:], eh.src, eh.dst, eh.OuterEtherType())
+	}
+}
+
+// MAC returns iface's MAC address, if any.
+func (iface *TAPInterface) MAC() (ok bool, mac MAC) {
+	iface.sync.RLock()
+	ok, mac = iface.macSet, iface.mac
+	iface.sync.RUnlock()
+	return ok, mac
+}
+
+// SetMAC sets iface's MAC address. It is an error to call SetMAC with a
+// multicast MAC, or while iface is up.
+func (iface *TAPInterface) SetMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MAC on up interface")
+	}
+	return iface.setMAC(mac)
+}
+
+// MTU returns iface's MTU.
+func (iface *TAPInterface) MTU() int {
+	iface.sync.RLock()
+	mtu := iface.config.MTU
+	iface.sync.RUnlock()
+	return mtu
+}
+
+// SetMTU sets the MTU of iface and of the kernel interface. It is an error
+// to set an MTU of 0 or to call SetMTU while iface is up.
+func (iface *TAPInterface) SetMTU(mtu uint64) error {
+	if mtu == 0 || mtu > 1<<16 {
+		return errors.Errorf("set interface MTU: invalid MTU: %v", mtu)
+	}
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MTU on up interface")
+	}
+	iface.config.MTU = int(mtu)
+	return nil
+}
+
+// RegisterCallback implements EthernetInterface's RegisterCallback.
+func (iface *TAPInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.sync.Lock()
+	iface.callback = f
+	iface.sync.Unlock()
+}
+
+// AddMulticastMAC implements EthernetInterface's AddMulticastMAC.
+func (iface *TAPInterface) AddMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	return iface.addMulticastMAC(mac)
+}
+
+// RemoveMulticastMAC implements EthernetInterface's RemoveMulticastMAC.
+func (iface *TAPInterface) RemoveMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	iface.removeMulticastMAC(mac)
+	iface.sync.Unlock()
+	return nil
+}
+
+// WriteFrame implements EthernetInterface's WriteFrame.
+func (iface *TAPInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	iface.sync.RLock()
+	src, ok := iface.mac, iface.macSet
+	iface.sync.RUnlock()
+	if !ok {
+		return 0, errors.New("write frame: interface has no MAC")
+	}
+	return iface.WriteFrameSrc(b, src, dst, et)
+}
+
+// WriteFrameSrc implements EthernetInterface's WriteFrameSrc.
+func (iface *TAPInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	if len(b) < ethernetHeaderLen {
+		return 0, errors.New("write frame: buffer too short for Ethernet header")
+	}
+	writeEthernetHeader(ethernetHeader{src: src, dst: dst, et: et}, b)
+	return iface.write(b, iface.MTU()+frameHeaderLen(et))
+}
+
+// Linux's struct ifreq, with the union specialized to a short
+// (for flags) or an int (for the MTU)
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+type ifreqMTU struct {
+	name [syscall.IFNAMSIZ]byte
+	mtu  int32
+	_    [20]byte
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openTUN opens a queue of the TUN/TAP interface with the given name and
+// flags, creating the interface if it doesn't exist, and returns the file
+// along with the kernel's name for the interface.
+func openTUN(name string, flags uint16) (*os.File, string, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", errors.Annotate(os.NewSyscallError("open /dev/net/tun", err), "open TUN/TAP interface")
+	}
+	var ifr ifreqFlags
+	copy(ifr.name[:], name)
+	ifr.flags = flags
+	err = ioctl(fd, syscall.TUNSETIFF, unsafe.Pointer(&ifr))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, "", errors.Annotate(os.NewSyscallError("ioctl TUNSETIFF", err), "open TUN/TAP interface")
+	}
+	// in non-blocking mode, the runtime's poller manages the file,
+	// which allows us to set read deadlines
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, "", errors.Annotate(err, "open TUN/TAP interface")
+	}
+	for i, c := range ifr.name {
+		if c == 0 {
+			name = string(ifr.name[:i])
+			break
+		}
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), name, nil
+}
+
+// configureLink sets the MTU of the named kernel interface,
+// and brings it up.
+func configureLink(name string, mtu int) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return errors.Annotate(os.NewSyscallError("socket", err), "configure link")
+	}
+	defer syscall.Close(fd)
+
+	var ifrm ifreqMTU
+	copy(ifrm.name[:], name)
+	ifrm.mtu = int32(mtu)
+	err = ioctl(fd, syscall.SIOCSIFMTU, unsafe.Pointer(&ifrm))
+	if err != nil {
+		return errors.Annotate(os.NewSyscallError("ioctl SIOCSIFMTU", err), "configure link")
+	}
+
+	var ifrf ifreqFlags
+	copy(ifrf.name[:], name)
+	err = ioctl(fd, syscall.SIOCGIFFLAGS, unsafe.Pointer(&ifrf))
+	if err != nil {
+		return errors.Annotate(os.NewSyscallError("ioctl SIOCGIFFLAGS", err), "configure link")
+	}
+	ifrf.flags |= syscall.IFF_UP
+	err = ioctl(fd, syscall.SIOCSIFFLAGS, unsafe.Pointer(&ifrf))
+	return errors.Annotate(os.NewSyscallError("ioctl SIOCSIFFLAGS", err), "configure link")
+}
+
+// closeFiles closes all of files, returning the first error encountered
+func closeFiles(files []*os.File) error {
+	var err error
+	for _, f := range files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package net
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// skipIfNoTUN skips the test unless TUN/TAP interfaces can be created, which
+// requires /dev/net/tun and the CAP_NET_ADMIN capability.
+func skipIfNoTUN(t *testing.T) {
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("/dev/net/tun not available:", err)
+	}
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip("could not read capabilities:", err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		if err != nil {
+			t.Skip("could not parse capabilities:", err)
+		}
+		const capNetAdmin = 12
+		if caps&(1<<capNetAdmin) == 0 {
+			t.Skip("CAP_NET_ADMIN not available")
+		}
+		return
+	}
+	t.Skip("could not find capabilities")
+}
+
+// readSysNet reads the given attribute of the named kernel interface.
+func readSysNet(name, attr string) (string, error) {
+	b, err := ioutil.ReadFile("/sys/class/net/" + name + "/" + attr)
+	return strings.TrimSpace(string(b)), err
+}
+
+func TestTUNConfig(t *testing.T) {
+	if _, err := NewTUNDevice(TUNConfig{Name: strings.Repeat("a", 16)}); err == nil {
+		t.Errorf("expected error for name which is too long")
+	}
+	if _, err := NewTUNDevice(TUNConfig{MTU: -1}); err == nil {
+		t.Errorf("expected error for negative MTU")
+	}
+	if _, err := NewTAPInterface(TUNConfig{Queues: -1}); err == nil {
+		t.Errorf("expected error for negative queue count")
+	}
+	dev, err := NewTUNDevice(TUNConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error creating device: %v", err)
+	}
+	if dev.MTU() != defaultTUNMTU || dev.config.Queues != 1 || dev.IsUp() {
+		t.Errorf("got MTU %v, %v queues, up %v; want %v, 1, false", dev.MTU(), dev.config.Queues, dev.IsUp(), defaultTUNMTU)
+	}
+}
+
+func TestTUNDevice(t *testing.T) {
+	skipIfNoTUN(t)
+	dev, err := NewTUNDevice(TUNConfig{Name: "nettest%d", MTU: 1400, Queues: 2})
+	if err != nil {
+		t.Fatalf("unexpected error creating device: %v", err)
+	}
+	// bring the device up twice to make sure that
+	// the kernel interface is recreated
+	for i := 0; i < 2; i++ {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing device up: %v", err)
+		}
+		name := dev.Name()
+		if !strings.HasPrefix(name, "nettest") || strings.Contains(name, "%") {
+			t.Errorf("got name %q; want the kernel's expansion of \"nettest%%d\"", name)
+		}
+		if mtu, err := readSysNet(name, "mtu"); err != nil || mtu != "1400" || dev.MTU() != 1400 {
+			t.Errorf("got kernel MTU %v (error: %v), device MTU %v; want 1400", mtu, err, dev.MTU())
+		}
+		flags, err := readSysNet(name, "tun_flags")
+		if err != nil {
+			t.Errorf("unexpected error reading flags: %v", err)
+		} else if f, _ := strconv.ParseUint(flags, 0, 32); f&iffMultiQueue == 0 {
+			t.Errorf("got flags %v; want multi-queue flag to be set", flags)
+		}
+		if len(dev.files) != 2 {
+			t.Errorf("got %v queues; want 2", len(dev.files))
+		}
+		if !dev.IsUp() {
+			t.Errorf("device is not up")
+		}
+
+		if err := dev.BringDown(); err != nil {
+			t.Fatalf("unexpected error bringing device down: %v", err)
+		}
+		if dev.IsUp() {
+			t.Errorf("device is still up")
+		}
+		if _, err := os.Stat("/sys/class/net/" + name); !os.IsNotExist(err) {
+			t.Errorf("kernel interface %v still exists after bringing device down", name)
+		}
+	}
+}
+
+func TestTAPInterface(t *testing.T) {
+	skipIfNoTUN(t)
+	iface, err := NewTAPInterface(TUNConfig{Name: "nettap%d"})
+	if err != nil {
+		t.Fatalf("unexpected error creating interface: %v", err)
+	}
+	if err := iface.BringUp(); err != nil {
+		t.Fatalf("unexpected error bringing interface up: %v", err)
+	}
+	defer iface.BringDown()
+	name := iface.Name()
+	if mtu, err := readSysNet(name, "mtu"); err != nil || mtu != strconv.Itoa(defaultTUNMTU) {
+		t.Errorf("got kernel MTU %v (error: %v); want %v", mtu, err, defaultTUNMTU)
+	}
+	flags, err := readSysNet(name, "tun_flags")
+	if err != nil {
+		t.Errorf("unexpected error reading flags: %v", err)
+	} else if f, _ := strconv.ParseUint(flags, 0, 32); f&iffMultiQueue != 0 {
+		t.Errorf("got flags %v; want single-queue interface", flags)
+	}
+}
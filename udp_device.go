@@ -79,8 +79,14 @@ func (dev *udpDevice) registerCallback(f func(b []byte)) {
 }
 
 func (dev *udpDevice) write(b []byte) (n int, err error) {
+	return dev.writeTo(b, dev.raddr)
+}
+
+// writeTo is like write, but writes to the given remote address
+// rather than to dev.raddr.
+func (dev *udpDevice) writeTo(b []byte, raddr *net.UDPAddr) (n int, err error) {
 	if len(b) > dev.mtu {
-		return 0, errors.MTUf(dev.mtu, "write to device: IPv4 payload exceeds MTU")
+		return 0, errors.MTUf(dev.mtu, "write to device: payload exceeds MTU")
 	}
 	dev.sync.RLock()
 	defer dev.sync.RUnlock()
@@ -88,11 +94,14 @@ func (dev *udpDevice) write(b []byte) (n int, err error) {
 		return 0, errors.New("write to down device")
 	}
 
-	n, err = dev.conn.WriteToUDP(b, dev.raddr)
+	n, err = dev.conn.WriteToUDP(b, raddr)
 	return n, errors.Annotate(err, "write to device")
 }
 
 func (dev *udpDevice) readDaemon() {
+	// NOTE(joshlf): It's safe to access dev.conn without synchronization
+	// because it is only modified before the daemon is spawned and after
+	// it has returned.
 	b := make([]byte, dev.mtu)
 	for {
 		select {
@@ -101,11 +110,9 @@ func (dev *udpDevice) readDaemon() {
 		default:
 		}
 
-		dev.sync.RLock()
 		err := dev.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		if err != nil {
 			// TODO(joshlf): Log it
-			dev.sync.RUnlock()
 			continue
 		}
 		n, _, err := dev.conn.ReadFrom(b)
@@ -118,13 +125,16 @@ func (dev *udpDevice) readDaemon() {
 			if !errors.IsTimeout(err) {
 				// TODO(joshlf): Log it
 			}
-			dev.sync.RUnlock()
 			continue
 		}
-		if dev.callback != nil {
-			dev.callback(b[:n])
-		}
+		// NOTE(joshlf): Don't hold the lock while calling the callback,
+		// since it may write to the device
+		dev.sync.RLock()
+		callback := dev.callback
 		dev.sync.RUnlock()
+		if callback != nil {
+			callback(b[:n])
+		}
 	}
 }
 
@@ -136,8 +146,7 @@ func (dev *udpDevice) readDaemon() {
 // The zero UDPIPv4Device is not a valid UDPIPv4Device. UDPIPv4Devices are safe
 // for concurrent access.
 type UDPIPv4Device struct {
-	addr, netmask IPv4
-	addrSet       bool
+	addrs ipv4Addrs
 	udpDevice
 }
 
@@ -156,36 +165,78 @@ func NewUDPIPv4Device(laddr, raddr *net.UDPAddr, mtu int) (dev *UDPIPv4Device, e
 	return &UDPIPv4Device{udpDevice: udpDevice{laddr: laddr, raddr: raddr, mtu: mtu}}, nil
 }
 
-// IPv4 returns dev's IPv4 address and network mask if they have been set.
+// IPv4 returns dev's primary IPv4 address and network mask if it has any
+// addresses.
 func (dev *UDPIPv4Device) IPv4() (addr, netmask IPv4, ok bool) {
 	dev.sync.RLock()
-	addr, netmask, ok = dev.addr, dev.netmask, dev.addrSet
+	addr, netmask, ok = dev.addrs.primary()
 	dev.sync.RUnlock()
 	return addr, netmask, ok
 }
 
-// SetIPv4 sets dev's IPv4 address and network mask, returning any error
-// encountered. SetIPv4 can only be  called when dev is down.
+// SetIPv4 replaces dev's IPv4 addresses with the given address and network
+// mask, returning any error encountered. SetIPv4 can only be called when dev
+// is down.
 func (dev *UDPIPv4Device) SetIPv4(addr, netmask IPv4) error {
-	dev.sync.Lock()
-	defer dev.sync.Unlock()
-	if dev.isUp() {
-		return errors.New("set device IP address on up device")
-	}
-	dev.addr, dev.netmask, dev.addrSet = addr, netmask, true
-	return nil
+	return dev.addrs.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		dev.addrs.set(addr, netmask)
+		return nil
+	})
 }
 
-// UnsetIPv4 unsets dev's IPv4 address and network mask, returning any error
+// UnsetIPv4 removes all of dev's IPv4 addresses, returning any error
 // encountered. UnsetIPv4 can only be called when dev is down.
 func (dev *UDPIPv4Device) UnsetIPv4() error {
+	return dev.addrs.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		dev.addrs.unset()
+		return nil
+	})
+}
+
+// IPv4Addrs returns all of dev's IPv4 addresses, starting with the primary
+// address.
+func (dev *UDPIPv4Device) IPv4Addrs() []IPv4DeviceAddr {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	return dev.addrs.list()
+}
+
+// AddIPv4 implements IPv4Device's AddIPv4.
+func (dev *UDPIPv4Device) AddIPv4(addr, netmask IPv4) error {
+	return dev.addrs.change(&dev.sync, func() error {
+		return dev.addrs.add(addr, netmask)
+	})
+}
+
+// RemoveIPv4 implements IPv4Device's RemoveIPv4.
+func (dev *UDPIPv4Device) RemoveIPv4(addr IPv4) error {
+	return dev.addrs.change(&dev.sync, func() error {
+		return dev.addrs.remove(addr)
+	})
+}
+
+// RegisterIPv4AddrCallback implements IPv4Device's RegisterIPv4AddrCallback.
+func (dev *UDPIPv4Device) RegisterIPv4AddrCallback(f func()) {
 	dev.sync.Lock()
-	defer dev.sync.Unlock()
-	if dev.isUp() {
-		return errors.New("unset device IP address on up device")
-	}
-	dev.addr, dev.netmask, dev.addrSet = IPv4{}, IPv4{}, true
-	return nil
+	dev.addrs.callback = f
+	dev.sync.Unlock()
+}
+
+// JoinIPv4Group implements IPv4Device's JoinIPv4Group. Every packet sent
+// to dev's UDP address is received, so it is a no-op.
+func (dev *UDPIPv4Device) JoinIPv4Group(addr IPv4) error {
+	return errors.Annotate(checkIPv4Group(addr), "join IPv4 group")
+}
+
+// LeaveIPv4Group implements IPv4Device's LeaveIPv4Group.
+func (dev *UDPIPv4Device) LeaveIPv4Group(addr IPv4) error {
+	return errors.Annotate(checkIPv4Group(addr), "leave IPv4 group")
 }
 
 // RegisterIPv4Callback registers f to be called when IPv4 packets are received.
@@ -207,8 +258,7 @@ func (dev *UDPIPv4Device) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
 // The zero UDPIPv6Device is not a valid UDPIPv6Device. UDPIPv6Devices are safe
 // for concurrent access.
 type UDPIPv6Device struct {
-	addr, netmask IPv6
-	addrSet       bool
+	addrs ipv6Addrs
 	udpDevice
 }
 
@@ -227,36 +277,78 @@ func NewUDPIPv6Device(laddr, raddr *net.UDPAddr, mtu int) (dev *UDPIPv6Device, e
 	return &UDPIPv6Device{udpDevice: udpDevice{laddr: laddr, raddr: raddr, mtu: mtu}}, nil
 }
 
-// IPv6 returns dev's IPv6 address and network mask if they have been set.
+// IPv6 returns dev's primary IPv6 address and network mask if it has any
+// addresses.
 func (dev *UDPIPv6Device) IPv6() (addr, netmask IPv6, ok bool) {
 	dev.sync.RLock()
-	addr, netmask, ok = dev.addr, dev.netmask, dev.addrSet
+	addr, netmask, ok = dev.addrs.primary()
 	dev.sync.RUnlock()
 	return addr, netmask, ok
 }
 
-// SetIPv6 sets dev's IPv6 address and network mask, returning any error
-// encountered. SetIPv6 can only be  called when dev is down.
+// SetIPv6 replaces dev's IPv6 addresses with the given address and network
+// mask, returning any error encountered. SetIPv6 can only be called when dev
+// is down.
 func (dev *UDPIPv6Device) SetIPv6(addr, netmask IPv6) error {
-	dev.sync.Lock()
-	defer dev.sync.Unlock()
-	if dev.isUp() {
-		return errors.New("set device IP address on up device")
-	}
-	dev.addr, dev.netmask, dev.addrSet = addr, netmask, true
-	return nil
+	return dev.addrs.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("set device IP address on up device")
+		}
+		dev.addrs.set(addr, netmask)
+		return nil
+	})
 }
 
-// UnsetIPv6 unsets dev's IPv6 address and network mask, returning any error
+// UnsetIPv6 removes all of dev's IPv6 addresses, returning any error
 // encountered. UnsetIPv6 can only be called when dev is down.
 func (dev *UDPIPv6Device) UnsetIPv6() error {
+	return dev.addrs.change(&dev.sync, func() error {
+		if dev.isUp() {
+			return errors.New("unset device IP address on up device")
+		}
+		dev.addrs.unset()
+		return nil
+	})
+}
+
+// IPv6Addrs returns all of dev's IPv6 addresses, starting with the primary
+// address.
+func (dev *UDPIPv6Device) IPv6Addrs() []IPv6DeviceAddr {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	return dev.addrs.list()
+}
+
+// AddIPv6 implements IPv6Device's AddIPv6.
+func (dev *UDPIPv6Device) AddIPv6(addr, netmask IPv6) error {
+	return dev.addrs.change(&dev.sync, func() error {
+		return dev.addrs.add(addr, netmask)
+	})
+}
+
+// RemoveIPv6 implements IPv6Device's RemoveIPv6.
+func (dev *UDPIPv6Device) RemoveIPv6(addr IPv6) error {
+	return dev.addrs.change(&dev.sync, func() error {
+		return dev.addrs.remove(addr)
+	})
+}
+
+// RegisterIPv6AddrCallback implements IPv6Device's RegisterIPv6AddrCallback.
+func (dev *UDPIPv6Device) RegisterIPv6AddrCallback(f func()) {
 	dev.sync.Lock()
-	defer dev.sync.Unlock()
-	if dev.isUp() {
-		return errors.New("unset device IP address on up device")
-	}
-	dev.addr, dev.netmask, dev.addrSet = IPv6{}, IPv6{}, true
-	return nil
+	dev.addrs.callback = f
+	dev.sync.Unlock()
+}
+
+// JoinIPv6Group implements IPv6Device's JoinIPv6Group. Every packet sent
+// to dev's UDP address is received, so it is a no-op.
+func (dev *UDPIPv6Device) JoinIPv6Group(addr IPv6) error {
+	return errors.Annotate(checkIPv6Group(addr), "join IPv6 group")
+}
+
+// LeaveIPv6Group implements IPv6Device's LeaveIPv6Group.
+func (dev *UDPIPv6Device) LeaveIPv6Group(addr IPv6) error {
+	return errors.Annotate(checkIPv6Group(addr), "leave IPv6 group")
 }
 
 // RegisterIPv6Callback registers f to be called when IPv6 packets are received.
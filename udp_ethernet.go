@@ -0,0 +1,163 @@
+package net
+
+import (
+	"net"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// UDPEthernetInterface is an EthernetInterface created by sending Ethernet
+// frames over UDP. Each frame, including its Ethernet header (and IEEE 802.1Q
+// tag, if any), is carried in a single UDP datagram. Frames are sent to every
+// peer, as if all of the interfaces were connected to a hub, so a set of
+// UDPEthernetInterfaces which all list each other as peers form a single
+// Ethernet segment.
+//
+// The zero UDPEthernetInterface is not a valid UDPEthernetInterface.
+// UDPEthernetInterfaces are safe for concurrent access.
+type UDPEthernetInterface struct {
+	peers    []*net.UDPAddr
+	callback func(b []byte, src, dst MAC, et EtherType) // unset if nil
+	macFilter
+	udpDevice
+}
+
+var _ EthernetInterface = &UDPEthernetInterface{} // make sure *UDPEthernetInterface implements EthernetInterface
+
+// NewUDPEthernetInterface creates a new UDPEthernetInterface, which is down by
+// default, and which sends frames to each of peers. It is the caller's
+// responsibility to ensure that all interfaces on the segment are configured
+// with the same MTU, which must be non-zero. Keep in mind that a single buffer
+// large enough for an MTU-sized frame will be allocated in order to read
+// incoming frames, so an overly-large MTU will result in significant memory
+// waste.
+func NewUDPEthernetInterface(laddr *net.UDPAddr, peers []*net.UDPAddr, mtu int) (*UDPEthernetInterface, error) {
+	if mtu == 0 {
+		return nil, errors.New("new UDPEthernetInterface: zero MTU")
+	}
+	iface := &UDPEthernetInterface{
+		peers:     append([]*net.UDPAddr(nil), peers...),
+		udpDevice: udpDevice{laddr: laddr, mtu: mtu + ethernetHeaderLen8021},
+	}
+	iface.udpDevice.callback = iface.demux
+	return iface, nil
+}
+
+// UDPAddrs returns the local UDP address and the UDP addresses of the peers
+// used by iface.
+func (iface *UDPEthernetInterface) UDPAddrs() (laddr *net.UDPAddr, peers []*net.UDPAddr) {
+	iface.sync.RLock()
+	laddr, peers = iface.laddr, append([]*net.UDPAddr(nil), iface.peers...)
+	iface.sync.RUnlock()
+	return laddr, peers
+}
+
+func (iface *UDPEthernetInterface) demux(b []byte) {
+	eh, err := parseEthernetHeader(b)
+	if err != nil {
+		// TODO(joshlf): Log it
+		return
+	}
+	iface.sync.RLock()
+	accept := iface.accepts(eh.dst)
+	callback := iface.callback
+	iface.sync.RUnlock()
+	if accept && callback != nil {
+		callback(b[ethernetHeaderLen:], eh.src, eh.dst, eh.OuterEtherType())
+	}
+}
+
+// MAC returns iface's MAC address, if any.
+func (iface *UDPEthernetInterface) MAC() (ok bool, mac MAC) {
+	iface.sync.RLock()
+	ok, mac = iface.macSet, iface.mac
+	iface.sync.RUnlock()
+	return ok, mac
+}
+
+// SetMAC sets iface's MAC address. It is an error to call SetMAC with a
+// multicast MAC, or while iface is up.
+func (iface *UDPEthernetInterface) SetMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MAC on up interface")
+	}
+	return iface.setMAC(mac)
+}
+
+// MTU returns iface's MTU.
+func (iface *UDPEthernetInterface) MTU() int {
+	iface.sync.RLock()
+	mtu := iface.mtu - ethernetHeaderLen8021
+	iface.sync.RUnlock()
+	return mtu
+}
+
+// SetMTU sets iface's MTU. It is an error to set an MTU of 0 or to call SetMTU
+// while iface is up.
+func (iface *UDPEthernetInterface) SetMTU(mtu uint64) error {
+	if mtu == 0 || mtu > 1<<16 {
+		return errors.Errorf("set interface MTU: invalid MTU: %v", mtu)
+	}
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MTU on up interface")
+	}
+	iface.mtu = int(mtu) + ethernetHeaderLen8021
+	return nil
+}
+
+// RegisterCallback implements EthernetInterface's RegisterCallback.
+func (iface *UDPEthernetInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.sync.Lock()
+	iface.callback = f
+	iface.sync.Unlock()
+}
+
+// AddMulticastMAC implements EthernetInterface's AddMulticastMAC.
+func (iface *UDPEthernetInterface) AddMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	return iface.addMulticastMAC(mac)
+}
+
+// RemoveMulticastMAC implements EthernetInterface's RemoveMulticastMAC.
+func (iface *UDPEthernetInterface) RemoveMulticastMAC(mac MAC) error {
+	iface.sync.Lock()
+	iface.removeMulticastMAC(mac)
+	iface.sync.Unlock()
+	return nil
+}
+
+// WriteFrame implements EthernetInterface's WriteFrame.
+func (iface *UDPEthernetInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	iface.sync.RLock()
+	src, ok := iface.mac, iface.macSet
+	iface.sync.RUnlock()
+	if !ok {
+		return 0, errors.New("write frame: interface has no MAC")
+	}
+	return iface.WriteFrameSrc(b, src, dst, et)
+}
+
+// WriteFrameSrc implements EthernetInterface's WriteFrameSrc.
+func (iface *UDPEthernetInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	if len(b) < ethernetHeaderLen {
+		return 0, errors.New("write frame: buffer too short for Ethernet header")
+	}
+	if mtu := iface.MTU(); len(b)-frameHeaderLen(et) > mtu {
+		return 0, errors.MTUf(mtu, "write frame: payload exceeds MTU")
+	}
+	writeEthernetHeader(ethernetHeader{src: src, dst: dst, et: et}, b)
+	// NOTE(joshlf): iface.peers is never modified, so it's
+	// safe to access without synchronization
+	for _, peer := range iface.peers {
+		_, err = iface.writeTo(b, peer)
+		if err != nil {
+			return 0, errors.Annotate(err, "write frame")
+		}
+	}
+	return len(b), nil
+}
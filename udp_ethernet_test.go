@@ -0,0 +1,146 @@
+package net
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+func TestUDPEthernetInterface(t *testing.T) {
+	// find two free local ports
+	var addrs [2]*net.UDPAddr
+	for i := range addrs {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		addrs[i] = conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+	}
+
+	const mtu = 1500
+	type frame struct {
+		b        []byte
+		src, dst MAC
+		et       EtherType
+	}
+	macs := [2]MAC{{2, 0, 0, 0, 0, 1}, {2, 0, 0, 0, 0, 2}}
+	var ifaces [2]*UDPEthernetInterface
+	var chans [2]chan frame
+	for i := range ifaces {
+		iface, err := NewUDPEthernetInterface(addrs[i], []*net.UDPAddr{addrs[1-i]}, mtu)
+		if err != nil {
+			t.Fatalf("unexpected error creating interface: %v", err)
+		}
+		if err := iface.SetMAC(macs[i]); err != nil {
+			t.Fatalf("unexpected error setting MAC: %v", err)
+		}
+		c := make(chan frame, 16)
+		iface.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) {
+			c <- frame{append([]byte(nil), b...), src, dst, et}
+		})
+		ifaces[i], chans[i] = iface, c
+	}
+	a, b := ifaces[0], ifaces[1]
+
+	if _, err := NewUDPEthernetInterface(addrs[0], nil, 0); err == nil {
+		t.Errorf("expected error creating interface with zero MTU")
+	}
+	if a.IsUp() {
+		t.Errorf("new interface is up")
+	}
+	if _, err := a.WriteFrame(make([]byte, ethernetHeaderLen+4), macs[1], EtherTypeIPv4); err == nil {
+		t.Errorf("expected error writing frame on down interface")
+	}
+	for _, iface := range ifaces {
+		if err := iface.BringUp(); err != nil {
+			t.Fatalf("unexpected error bringing interface up: %v", err)
+		}
+		defer iface.BringDown()
+	}
+	if !a.IsUp() {
+		t.Errorf("interface is down after bringing it up")
+	}
+	if err := a.SetMAC(macs[0]); err == nil {
+		t.Errorf("expected error setting MAC on up interface")
+	}
+	if err := a.SetMTU(mtu); err == nil {
+		t.Errorf("expected error setting MTU on up interface")
+	}
+
+	write := func(payload []byte, dst MAC, et EtherType) {
+		buf := append(make([]byte, ethernetHeaderLen), payload...)
+		if _, err := a.WriteFrame(buf, dst, et); err != nil {
+			t.Fatalf("unexpected error writing frame: %v", err)
+		}
+	}
+	expect := func(payload []byte, dst MAC, et EtherType, ok bool) {
+		select {
+		case f := <-chans[1]:
+			switch {
+			case !ok:
+				t.Errorf("unexpected frame to %v", f.dst)
+			case !bytes.Equal(f.b, payload) || f.src != macs[0] || f.dst != dst || f.et != et:
+				t.Errorf("got frame %v from %v to %v with EtherType %v; want %v from %v to %v with EtherType %v",
+					f.b, f.src, f.dst, f.et, payload, macs[0], dst, et)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if ok {
+				t.Errorf("timed out waiting for frame to %v", dst)
+			}
+		}
+	}
+
+	// frames are delivered to the peer if they're sent to its MAC, the
+	// broadcast MAC, or a multicast MAC which it has added
+	payload := []byte{1, 2, 3, 4}
+	mcast := MAC{0x01, 0, 0x5e, 0, 0, 1}
+	for _, c := range []struct {
+		dst MAC
+		ok  bool
+	}{
+		{macs[1], true},
+		{MAC{2, 0, 0, 0, 0, 3}, false},
+		{BroadcastMAC, true},
+		{mcast, false},
+	} {
+		write(payload, c.dst, EtherTypeIPv4)
+		expect(payload, c.dst, EtherTypeIPv4, c.ok)
+	}
+	if err := b.AddMulticastMAC(mcast); err != nil {
+		t.Fatalf("unexpected error adding multicast MAC: %v", err)
+	}
+	write(payload, mcast, EtherTypeIPv4)
+	expect(payload, mcast, EtherTypeIPv4, true)
+	b.RemoveMulticastMAC(mcast)
+	write(payload, mcast, EtherTypeIPv4)
+	expect(payload, mcast, EtherTypeIPv4, false)
+
+	// tagged frames are delivered with their tags, which don't count
+	// towards the MTU
+	tagged := append([]byte{0, 10, 0x08, 0x00}, make([]byte, mtu)...)
+	write(tagged, macs[1], EtherTypeVLAN)
+	expect(tagged, macs[1], EtherTypeVLAN, true)
+	_, err := a.WriteFrame(make([]byte, ethernetHeaderLen+mtu+1), macs[1], EtherTypeIPv4)
+	if !errors.IsMTU(err) {
+		t.Errorf("got error %v writing frame larger than MTU; want MTU error", err)
+	}
+
+	// frames aren't delivered while the peer is down
+	if err := b.BringDown(); err != nil {
+		t.Fatalf("unexpected error bringing interface down: %v", err)
+	}
+	if b.IsUp() {
+		t.Errorf("interface is up after bringing it down")
+	}
+	write(payload, macs[1], EtherTypeIPv4)
+	expect(payload, macs[1], EtherTypeIPv4, false)
+	if err := b.BringUp(); err != nil {
+		t.Fatalf("unexpected error bringing interface up: %v", err)
+	}
+	write(payload, macs[1], EtherTypeIPv4)
+	expect(payload, macs[1], EtherTypeIPv4, true)
+}
@@ -0,0 +1,338 @@
+package net
+
+import (
+	"sync"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// length in bytes of the portion of an IEEE 802.1Q tag
+// which follows the EtherTypeVLAN TPID - the TCI and the
+// encapsulated EtherType
+const vlanTagLen = 4
+
+// A VLANTrunk multiplexes IEEE 802.1Q VLANs over a single EthernetInterface,
+// the trunk's parent. It hands out one VLANInterface per VLAN; each is a full
+// EthernetInterface, and so can be used to create an EthernetDevice with its
+// own addresses (see NewEthernetDevice).
+//
+// Incoming frames are demultiplexed by VLAN identifier (VID), and delivered
+// to the VLANInterface with that VID, subject to its own MAC filter. Untagged
+// frames, and frames for VLANs with no VLANInterface, are dropped. Frames
+// written to a VLANInterface are tagged with its VID and priority code point
+// (PCP).
+//
+// The parent's MAC is never set, so that it receives all frames; each
+// VLANInterface filters by its own MAC. The parent is up so long as any of
+// the trunk's VLANInterfaces are up.
+//
+// VLANTrunks are safe for concurrent access.
+type VLANTrunk struct {
+	iface  EthernetInterface
+	vlans  map[uint16]*VLANInterface
+	numUp  int // number of VLANInterfaces which are up
+	upLock sync.Mutex
+
+	mu sync.RWMutex
+}
+
+// NewVLANTrunk creates a new VLANTrunk using iface as its parent. iface is
+// assumed to be down, and must not have a MAC set. After a successful call to
+// NewVLANTrunk, the returned VLANTrunk is considered to own iface;
+// modifications to iface by the caller may result in undefined behavior.
+func NewVLANTrunk(iface EthernetInterface) (*VLANTrunk, error) {
+	if ok, _ := iface.MAC(); ok {
+		return nil, errors.New("create new VLAN trunk: interface has MAC set")
+	}
+	t := &VLANTrunk{
+		iface: iface,
+		vlans: make(map[uint16]*VLANInterface),
+	}
+	iface.RegisterCallback(t.callback)
+	return t, nil
+}
+
+// NewInterface creates a new VLANInterface for the VLAN with the given VID,
+// tagging outgoing frames with the given PCP. It is an error to call
+// NewInterface with a VID outside of the range [1, 4094], with a PCP greater
+// than 7, or with a VID for which t already has a VLANInterface. The returned
+// interface is down, and has no MAC or MTU set.
+func (t *VLANTrunk) NewInterface(vid uint16, pcp uint8) (*VLANInterface, error) {
+	if vid == 0 || vid >= 0xFFF {
+		return nil, errors.Errorf("create new VLAN interface: invalid VID: %v", vid)
+	}
+	if pcp > 7 {
+		return nil, errors.Errorf("create new VLAN interface: invalid PCP: %v", pcp)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.vlans[vid]; ok {
+		return nil, errors.Errorf("create new VLAN interface: VID already in use: %v", vid)
+	}
+	iface := &VLANInterface{trunk: t, vid: vid, pcp: pcp}
+	t.vlans[vid] = iface
+	return iface, nil
+}
+
+func (t *VLANTrunk) callback(b []byte, src, dst MAC, et EtherType) {
+	if et != EtherTypeVLAN || len(b) < vlanTagLen {
+		// TODO(joshlf): Log it
+		return
+	}
+	tci := parse.GetUint16(&b)
+	et = EtherType(parse.GetUint16(&b))
+	t.mu.RLock()
+	iface := t.vlans[tci&0xFFF]
+	t.mu.RUnlock()
+	if iface != nil {
+		iface.deliver(b, src, dst, et)
+	}
+}
+
+// bringUp brings the parent up if it is not already.
+func (t *VLANTrunk) bringUp() error {
+	t.upLock.Lock()
+	defer t.upLock.Unlock()
+	if t.numUp == 0 {
+		err := t.iface.BringUp()
+		if err != nil {
+			return err
+		}
+	}
+	t.numUp++
+	return nil
+}
+
+// bringDown brings the parent down if no VLANInterfaces remain up.
+func (t *VLANTrunk) bringDown() error {
+	t.upLock.Lock()
+	defer t.upLock.Unlock()
+	if t.numUp == 1 {
+		err := t.iface.BringDown()
+		if err != nil {
+			return err
+		}
+	}
+	t.numUp--
+	return nil
+}
+
+// A VLANInterface is an EthernetInterface for a single VLAN on a VLANTrunk.
+// See VLANTrunk for details.
+//
+// The zero VLANInterface is not a valid VLANInterface. VLANInterfaces are
+// safe for concurrent access.
+type VLANInterface struct {
+	trunk    *VLANTrunk
+	vid      uint16
+	pcp      uint8
+	up       bool
+	mtu      int                                        // 0 if unset
+	callback func(b []byte, src, dst MAC, et EtherType) // unset if nil
+	macFilter
+
+	upLock sync.Mutex // held while bringing iface up or down
+	mu     sync.RWMutex
+}
+
+var _ EthernetInterface = &VLANInterface{} // make sure *VLANInterface implements EthernetInterface
+
+// VID returns iface's VLAN identifier.
+func (iface *VLANInterface) VID() uint16 {
+	return iface.vid
+}
+
+// PCP returns the priority code point with which
+// iface tags outgoing frames.
+func (iface *VLANInterface) PCP() uint8 {
+	iface.mu.RLock()
+	pcp := iface.pcp
+	iface.mu.RUnlock()
+	return pcp
+}
+
+// SetPCP sets the priority code point with which iface tags outgoing frames.
+// It is an error to set a PCP greater than 7. SetPCP may be called while
+// iface is up.
+func (iface *VLANInterface) SetPCP(pcp uint8) error {
+	if pcp > 7 {
+		return errors.Errorf("set VLAN interface PCP: invalid PCP: %v", pcp)
+	}
+	iface.mu.Lock()
+	iface.pcp = pcp
+	iface.mu.Unlock()
+	return nil
+}
+
+// BringUp implements EthernetInterface's BringUp. If the trunk's parent
+// is down, it is brought up as well.
+func (iface *VLANInterface) BringUp() error {
+	iface.upLock.Lock()
+	defer iface.upLock.Unlock()
+	if iface.IsUp() {
+		return nil
+	}
+	err := iface.trunk.bringUp()
+	if err != nil {
+		return errors.Annotate(err, "bring VLAN interface up")
+	}
+	iface.mu.Lock()
+	iface.up = true
+	iface.mu.Unlock()
+	return nil
+}
+
+// BringDown implements EthernetInterface's BringDown. If no other
+// interfaces on the trunk are up, the trunk's parent is brought
+// down as well.
+func (iface *VLANInterface) BringDown() error {
+	iface.upLock.Lock()
+	defer iface.upLock.Unlock()
+	// NOTE(joshlf): Don't hold iface.mu while bringing the parent
+	// down, since that waits for any in-progress deliveries to iface,
+	// which acquire iface.mu
+	iface.mu.Lock()
+	up := iface.up
+	iface.up = false
+	iface.mu.Unlock()
+	if !up {
+		return nil
+	}
+	err := iface.trunk.bringDown()
+	if err != nil {
+		iface.mu.Lock()
+		iface.up = true
+		iface.mu.Unlock()
+		return errors.Annotate(err, "bring VLAN interface down")
+	}
+	return nil
+}
+
+// IsUp implements EthernetInterface's IsUp.
+func (iface *VLANInterface) IsUp() bool {
+	iface.mu.RLock()
+	up := iface.up
+	iface.mu.RUnlock()
+	return up
+}
+
+// MAC implements EthernetInterface's MAC.
+func (iface *VLANInterface) MAC() (ok bool, mac MAC) {
+	iface.mu.RLock()
+	ok, mac = iface.macSet, iface.mac
+	iface.mu.RUnlock()
+	return ok, mac
+}
+
+// SetMAC implements EthernetInterface's SetMAC.
+func (iface *VLANInterface) SetMAC(mac MAC) error {
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+	if iface.up {
+		return errors.New("set MAC on up interface")
+	}
+	return iface.setMAC(mac)
+}
+
+// MTU implements EthernetInterface's MTU. If no MTU has been set
+// on iface, the MTU of the trunk's parent is returned.
+func (iface *VLANInterface) MTU() int {
+	iface.mu.RLock()
+	mtu := iface.mtu
+	iface.mu.RUnlock()
+	if mtu == 0 {
+		return iface.trunk.iface.MTU()
+	}
+	return mtu
+}
+
+// SetMTU implements EthernetInterface's SetMTU. Frames which are within
+// iface's MTU may still be rejected if they exceed the MTU of the trunk's
+// parent.
+func (iface *VLANInterface) SetMTU(mtu uint64) error {
+	if mtu == 0 {
+		return errors.New("set interface MTU: zero MTU")
+	}
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+	if iface.up {
+		return errors.New("set MTU on up interface")
+	}
+	iface.mtu = int(mtu)
+	return nil
+}
+
+// RegisterCallback implements EthernetInterface's RegisterCallback.
+func (iface *VLANInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.mu.Lock()
+	iface.callback = f
+	iface.mu.Unlock()
+}
+
+// AddMulticastMAC implements EthernetInterface's AddMulticastMAC.
+func (iface *VLANInterface) AddMulticastMAC(mac MAC) error {
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+	return iface.addMulticastMAC(mac)
+}
+
+// RemoveMulticastMAC implements EthernetInterface's RemoveMulticastMAC.
+func (iface *VLANInterface) RemoveMulticastMAC(mac MAC) error {
+	iface.mu.Lock()
+	iface.removeMulticastMAC(mac)
+	iface.mu.Unlock()
+	return nil
+}
+
+// WriteFrame implements EthernetInterface's WriteFrame.
+func (iface *VLANInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	iface.mu.RLock()
+	src, ok := iface.mac, iface.macSet
+	iface.mu.RUnlock()
+	if !ok {
+		return 0, errors.New("write frame: interface has no MAC")
+	}
+	return iface.WriteFrameSrc(b, src, dst, et)
+}
+
+// WriteFrameSrc implements EthernetInterface's WriteFrameSrc.
+func (iface *VLANInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	if len(b) < ethernetHeaderLen {
+		return 0, errors.New("write frame: buffer too short for Ethernet header")
+	}
+	iface.mu.RLock()
+	up, pcp, mtu := iface.up, iface.pcp, iface.mtu
+	iface.mu.RUnlock()
+	if !up {
+		return 0, errors.New("write to down interface")
+	}
+	if mtu != 0 && len(b)-ethernetHeaderLen > mtu {
+		return 0, errors.MTUf(mtu, "write frame: payload exceeds MTU")
+	}
+
+	// b only has room for an untagged header, so make
+	// a new frame with room for the tag
+	buf := make([]byte, len(b)+vlanTagLen)
+	copy(buf[ethernetHeaderLen8021:], b[ethernetHeaderLen:])
+	tag := buf[ethernetHeaderLen:]
+	parse.PutUint16(&tag, uint16(pcp)<<13|iface.vid)
+	parse.PutUint16(&tag, uint16(et))
+	n, err = iface.trunk.iface.WriteFrameSrc(buf, src, dst, EtherTypeVLAN)
+	if n < vlanTagLen {
+		n = 0
+	} else {
+		n -= vlanTagLen
+	}
+	return n, errors.Annotate(err, "write frame")
+}
+
+func (iface *VLANInterface) deliver(b []byte, src, dst MAC, et EtherType) {
+	iface.mu.RLock()
+	accept := iface.up && iface.accepts(dst) && (iface.mtu == 0 || len(b) <= iface.mtu)
+	callback := iface.callback
+	iface.mu.RUnlock()
+	if accept && callback != nil {
+		callback(b, src, dst, et)
+	}
+}
@@ -0,0 +1,92 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestVLANTrunk(t *testing.T) {
+	// two trunks on the same segment, each with a device on
+	// VLANs 10 and 20; all devices share an IPv4 subnet, so
+	// traffic must be kept apart by the VLAN tags alone
+	var seg EthernetSegment
+	vids := []uint16{10, 20}
+	devs := make(map[uint16][]*EthernetDevice)
+	chans := make(map[uint16][]chan []byte)
+	for i := 0; i < 2; i++ {
+		trunk, err := NewVLANTrunk(seg.NewInterface())
+		if err != nil {
+			t.Fatalf("unexpected error creating trunk: %v", err)
+		}
+		for _, vid := range vids {
+			iface, err := trunk.NewInterface(vid, 3)
+			if err != nil {
+				t.Fatalf("unexpected error creating VLAN interface: %v", err)
+			}
+			dev, err := NewEthernetDevice(iface, MAC{2, 0, 0, 0, byte(vid), byte(i + 1)})
+			if err != nil {
+				t.Fatalf("unexpected error creating device: %v", err)
+			}
+			dev.SetIPv4(IPv4{10, 0, 0, byte(i + 1)}, IPv4{255, 0, 0, 0})
+			c := make(chan []byte, 4)
+			dev.RegisterIPv4Callback(func(b []byte) { c <- b })
+			if err := dev.BringUp(); err != nil {
+				t.Fatalf("unexpected error bringing device up: %v", err)
+			}
+			defer dev.BringDown()
+			devs[vid], chans[vid] = append(devs[vid], dev), append(chans[vid], c)
+		}
+		if _, err := trunk.NewInterface(vids[0], 0); err == nil {
+			t.Errorf("expected error creating VLAN interface with duplicate VID")
+		}
+	}
+
+	// a promiscuous listener on the segment to inspect tags
+	sniffer := seg.NewInterface()
+	tags := make(chan []byte, 16)
+	sniffer.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) {
+		if et == EtherTypeVLAN {
+			tags <- append([]byte(nil), b[:vlanTagLen]...)
+		}
+	})
+	sniffer.BringUp()
+	defer sniffer.BringDown()
+
+	for _, vid := range vids {
+		pkt := []byte{byte(vid)}
+		if _, err := devs[vid][0].WriteToIPv4(pkt, IPv4{10, 0, 0, 2}); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+		select {
+		case got := <-chans[vid][1]:
+			if !bytes.Equal(got, pkt) {
+				t.Errorf("got packet %v on VLAN %v; want %v", got, vid, pkt)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for packet on VLAN %v", vid)
+		}
+	}
+	for _, vid := range vids {
+		select {
+		case got := <-chans[vid][1]:
+			t.Errorf("unexpected extra packet %v on VLAN %v", got, vid)
+		default:
+		}
+	}
+
+	// ARP request, ARP reply, and IPv4 packet on each VLAN
+	for _, vid := range vids {
+		for i := 0; i < 3; i++ {
+			select {
+			case tag := <-tags:
+				eh := ethernetHeader{ieee8021Q: uint32(tag[0])<<8 | uint32(tag[1])}
+				if eh.VID() != vid || eh.PCP() != 3 {
+					t.Errorf("got VID %v and PCP %v; want %v and 3", eh.VID(), eh.PCP(), vid)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for tagged frame")
+			}
+		}
+	}
+}